@@ -64,6 +64,8 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -77,6 +79,9 @@ type tunnel struct {
 	writeQ chan []byte
 	readQ  chan []byte
 
+	devLock   sync.RWMutex // guards dev, which is swapped by ReplaceTunDevice
+	replacing uint32       // 1 while the device is being replaced
+
 	idleR       *C.uv_prepare_t
 	read        *C.uv_async_t
 	loop        *C.uv_loop_t
@@ -175,7 +180,8 @@ func netifSetup(h C.netif_handle, l *C.uv_loop_t, packetCb C.packet_cb, ctx unsa
 }
 
 func (t *tunnel) runReadLoop() {
-	mtu, err := t.dev.MTU()
+	dev := t.device()
+	mtu, err := dev.MTU()
 	if err != nil {
 		log.Panicf("An unexpected and unrecoverable error has occurred while %s: %v", "getting the MTU", err)
 	}
@@ -183,9 +189,9 @@ func (t *tunnel) runReadLoop() {
 	defer log.Debug("tun read loop is done")
 	mtuBuf := make([]byte, mtu)
 	for {
-		nr, err := t.dev.Read(mtuBuf, 0)
+		nr, err := dev.Read(mtuBuf, 0)
 		if err != nil {
-			if err == io.EOF || err == os.ErrClosed {
+			if err == io.EOF || err == os.ErrClosed || atomic.LoadUint32(&t.replacing) == 1 {
 				//that's fine...
 				return
 			}
@@ -230,13 +236,20 @@ func (t *tunnel) runWriteLoop() {
 				return
 			}
 
-			n, err := t.dev.Write(p, 0)
+			n, err := t.device().Write(p, 0)
 			if err != nil {
+				if atomic.LoadUint32(&t.replacing) == 1 {
+					// the device is being replaced, the packet is lost
+					continue
+				}
 				if err == io.EOF || err == os.ErrClosed {
 					//that's fine...
 					return
 				}
-				log.Panicf("An unexpected and unrecoverable error has occurred while %s: %v", "writing to tun device", err)
+				if warn, suppressed := tunWrites.failed(time.Now(), err); warn {
+					log.Warnf("could not write %d bytes to the tun device: %v. %d more writes failed since the last warning", len(p), err, suppressed)
+				}
+				continue
 			}
 
 			if n < len(p) {
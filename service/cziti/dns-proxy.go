@@ -21,25 +21,50 @@ import (
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/openziti/desktop-edge-win/service/windns"
+	"github.com/sirupsen/logrus"
 	"io"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
 )
 
 var domains []string // get any connection-specific local domains
+var dnsTtl uint32 = constants.DefaultDnsTtl
+var interceptedDnsTypes atomic.Value         // map[uint16]bool of the record types answered for intercepted hostnames
+var staticHostOverrides atomic.Value         // map[string]net.IP of fully qualified hostnames answered with a fixed ip
+var dnsQueryLogging uint32                   // 1 when every query is logged with how it was answered
+var dnsOwnerLookup atomic.Value              // func(hostname string) string naming the identities and services of a hostname
+var dnsFailureRcode int32 = dns.RcodeSuccess // rcode answered for intercepted hostnames which are not resolved, -1 proxies them
+
+func init() {
+	interceptedDnsTypes.Store(map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true})
+	staticHostOverrides.Store(map[string]net.IP{})
+}
+
 const (
 	MaxDnsRequests   = 64
 	DnsMsgBufferSize = 1024
 )
 
+// the ways to answer a query for an intercepted hostname which the responder does not resolve
+const (
+	DnsFailureEmpty    = "empty" // a successful response without records. the default
+	DnsFailureForward  = "forward"
+	DnsFailureNxdomain = "nxdomain"
+	DnsFailureServfail = "servfail"
+)
+
 var reqch = make(chan dnsreq, MaxDnsRequests)
 var proxiedRequests = make(chan *proxiedReq, MaxDnsRequests)
 var respChan = make(chan []byte, MaxDnsRequests)
 
 func processDNSquery(packet []byte, p *net.UDPAddr, s *net.UDPConn, ipVer int) {
+	start := time.Now()
 	q := &dns.Msg{}
 	if err := q.Unpack(packet); err != nil {
 		log.Errorf("unexpected error in processDNSquery. [len(packet):%d] [ipVer:%v] [error: %v]", len(packet), ipVer, err)
@@ -61,11 +86,27 @@ func processDNSquery(packet []byte, p *net.UDPAddr, s *net.UDPConn, ipVer int) {
 		return
 	}
 
+	if !dnsLimiter.allow(p.IP.String(), start) {
+		msg.Rcode = dns.RcodeServerFailure
+		if repB, err := msg.Pack(); err == nil {
+			_, _, _ = s.WriteMsgUDP(repB, nil, p)
+		}
+		return
+	}
+
 	var ip net.IP
 	dnsName := strings.TrimSpace(query.Name)
-	ip = DNSMgr.Resolve(dnsName)
+	logQuery := atomic.LoadUint32(&dnsQueryLogging) == 1 && log.IsLevelEnabled(logrus.InfoLevel)
+	match := dnsMatch{hostname: dnsName} // only logged, describes how the query was matched
+	proxyType := false
+	// static overrides always win over the names known from services
+	ip = staticHostOverrides.Load().(map[string]net.IP)[strings.ToLower(dnsName)]
+	match.static = ip != nil
+	if ip == nil {
+		ip = DNSMgr.Resolve(dnsName)
+	}
 
-	// never proxy hostnames that we know about regardless of type
+	// never proxy hostnames that we know about unless the record type is not intercepted
 	if ip == nil {
 		// no direct hit. need to now check to see if the dns query used a connection-specific local domain
 		for _, d := range domains {
@@ -74,28 +115,34 @@ func processDNSquery(packet []byte, p *net.UDPAddr, s *net.UDPConn, ipVer int) {
 				dnsNameTrimmed := strings.TrimRight(dnsName, domain)
 				// dns request has domain appended - removing and resolving
 				ip = DNSMgr.Resolve(dnsNameTrimmed)
+				match.hostname = dnsNameTrimmed
+				match.localDomain = domain
 				break
 			}
 		}
 	}
 
-	// never proxy hostnames that we know about regardless of type
+	if ip != nil && !interceptedDnsTypes.Load().(map[uint16]bool)[query.Qtype] {
+		log.Tracef("%s query for intercepted hostname %s is not an intercepted type", dns.Type(query.Qtype), query.Name)
+		proxyType = true
+		ip = nil
+	}
+
 	if ip != nil {
 		log.Debugf("resolved %s as %v", query.Name, ip)
 
-		if query.Qtype == dns.TypeA && len(ip.To4()) == net.IPv4len {
-			answer := &dns.A{
-				Hdr: dns.RR_Header{Name: query.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-				A:   ip,
-			}
+		if answer := interceptedAnswer(query, ip); answer != nil {
 			msg.Authoritative = true
 			msg.Rcode = dns.RcodeSuccess
 			msg.Answer = append(msg.Answer, answer)
-		} else if query.Qtype == dns.TypeAAAA {
-			log.Trace("AAAA request received for a known domain. A successful DNS response will be generated with no answer")
+		} else {
+			log.Tracef("%s request received for a known domain. A successful DNS response will be generated with no answer", dns.Type(query.Qtype))
 			msg.Rcode = dns.RcodeSuccess
 		}
 
+		if logQuery {
+			log.Infof("dns query %s %s from %v: %s. answered %v with %d records", dns.Type(query.Qtype), query.Name, p, match.describe(proxyType), ip, len(msg.Answer))
+		}
 		repB, err := msg.Pack()
 		if err == nil {
 			_, _, err = s.WriteMsgUDP(repB, nil, p)
@@ -103,12 +150,163 @@ func processDNSquery(packet []byte, p *net.UDPAddr, s *net.UDPConn, ipVer int) {
 		if err != nil {
 			log.Error("unexpected dns error", err)
 		}
+		recordDnsLatency(time.Since(start))
+	} else if lazyHostnameQueried(dnsName) {
+		if logQuery {
+			log.Infof("dns query %s %s from %v: hostname of a lazy identity. connecting it, answered SERVFAIL", dns.Type(query.Qtype), query.Name, p)
+		}
+		// the identity is being connected. fail this query so the client asks again instead of going upstream
+		msg.Rcode = dns.RcodeServerFailure
+		if repB, err := msg.Pack(); err == nil {
+			_, _, _ = s.WriteMsgUDP(repB, nil, p)
+		}
+	} else if rcode := atomic.LoadInt32(&dnsFailureRcode); proxyType && rcode >= 0 {
+		if logQuery {
+			log.Infof("dns query %s %s from %v: %s. answered %s", dns.Type(query.Qtype), query.Name, p, match.describe(proxyType), dns.RcodeToString[int(rcode)])
+		}
+		msg.Rcode = int(rcode)
+		if repB, err := msg.Pack(); err == nil {
+			_, _, _ = s.WriteMsgUDP(repB, nil, p)
+		}
 	} else {
 		// log.Debug("proxying ", dns.Type(query.Qtype), query.Name, q.Id, " for ", p)
+		if logQuery {
+			matched := "not intercepted"
+			if proxyType {
+				matched = match.describe(proxyType)
+			}
+			log.Infof("dns query %s %s from %v: %s. proxied upstream", dns.Type(query.Qtype), query.Name, p, matched)
+		}
 		proxyDNS(q, p, s, ipVer)
 	}
 }
 
+// dnsMatch is how a query was matched. it is only described when the query is logged
+type dnsMatch struct {
+	static      bool
+	hostname    string
+	localDomain string
+}
+
+func (m dnsMatch) describe(typeNotIntercepted bool) string {
+	var b strings.Builder
+	if m.static {
+		b.WriteString("static host override")
+	} else {
+		b.WriteString("intercepted hostname")
+		if m.localDomain != "" {
+			b.WriteString(" " + m.hostname + " with local domain " + m.localDomain)
+		}
+		if owners := dnsOwnersOf(m.hostname); owners != "" {
+			b.WriteString(" by " + owners)
+		}
+	}
+	if typeNotIntercepted {
+		b.WriteString(" but the type is not intercepted")
+	}
+	return b.String()
+}
+
+// SetDnsOwnerLookup sets how the query log names the identities and services intercepting a hostname
+func SetDnsOwnerLookup(lookup func(hostname string) string) {
+	dnsOwnerLookup.Store(lookup)
+}
+
+func dnsOwnersOf(hostname string) string {
+	if lookup, ok := dnsOwnerLookup.Load().(func(hostname string) string); ok && lookup != nil {
+		return lookup(hostname)
+	}
+	return ""
+}
+
+// SetDnsQueryLogging turns the logging of every query answered or proxied by the dns responder on or off
+func SetDnsQueryLogging(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&dnsQueryLogging, v)
+}
+
+// interceptedAnswer returns the answer to the query of an intercepted hostname resolved as ip, using the configured
+// ttl. nil is returned when the query is not for the address family of ip
+func interceptedAnswer(query dns.Question, ip net.IP) dns.RR {
+	hdr := dns.RR_Header{Name: query.Name, Rrtype: query.Qtype, Class: dns.ClassINET, Ttl: atomic.LoadUint32(&dnsTtl)}
+	if query.Qtype == dns.TypeA && len(ip.To4()) == net.IPv4len {
+		return &dns.A{Hdr: hdr, A: ip}
+	}
+	if query.Qtype == dns.TypeAAAA && ip.To4() == nil {
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}
+	}
+	return nil
+}
+
+// SetDnsTtl sets the ttl used for the answers to intercepted hostnames
+func SetDnsTtl(seconds int) {
+	atomic.StoreUint32(&dnsTtl, uint32(seconds))
+}
+
+// SetDnsFailureMode sets how a query for an intercepted hostname which is not answered, e.g. a record type which is
+// not intercepted, is handled: empty answers it successfully without records, forward proxies it upstream, nxdomain
+// and servfail answer it with that rcode
+func SetDnsFailureMode(mode string) error {
+	rcode, err := dnsFailureModeRcode(mode)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&dnsFailureRcode, rcode)
+	return nil
+}
+
+// dnsFailureModeRcode returns the rcode answered with the dns failure mode, -1 when the query is proxied
+func dnsFailureModeRcode(mode string) (int32, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case DnsFailureEmpty:
+		return dns.RcodeSuccess, nil
+	case DnsFailureForward:
+		return -1, nil
+	case DnsFailureNxdomain:
+		return dns.RcodeNameError, nil
+	case DnsFailureServfail:
+		return dns.RcodeServerFailure, nil
+	}
+	return 0, fmt.Errorf("unknown dns failure mode %s. must be one of %s, %s, %s or %s", mode, DnsFailureEmpty, DnsFailureForward, DnsFailureNxdomain, DnsFailureServfail)
+}
+
+// SetInterceptedDnsTypes sets the record types answered for intercepted hostnames, e.g. A, AAAA. queries of any
+// other type are handled according to the dns failure mode
+func SetInterceptedDnsTypes(types []string) error {
+	intercepted := make(map[uint16]bool)
+	for _, t := range types {
+		qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(t))]
+		if !ok {
+			return fmt.Errorf("unknown dns record type: %s", t)
+		}
+		intercepted[qtype] = true
+	}
+	interceptedDnsTypes.Store(intercepted)
+	return nil
+}
+
+// SetStaticHostOverrides sets the hostnames which are always answered with the given ip instead of the normal
+// resolution. keys must be hostnames and values ip addresses
+func SetStaticHostOverrides(overrides map[string]string) error {
+	parsed := make(map[string]net.IP)
+	for host, addr := range overrides {
+		name := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+		if _, ok := dns.IsDomainName(name); !ok || name == "" || net.ParseIP(name) != nil {
+			return fmt.Errorf("invalid hostname for static override: %s", host)
+		}
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return fmt.Errorf("invalid ip for static override of %s: %s", host, addr)
+		}
+		parsed[dns.Fqdn(name)] = ip
+	}
+	staticHostOverrides.Store(parsed)
+	return nil
+}
+
 type dnsreq struct {
 	q    []byte
 	s    *net.UDPConn
@@ -116,11 +314,14 @@ type dnsreq struct {
 	ifId int
 }
 
+// RunDNSserver answers dns queries on each of the given addresses. the first address is required, failing to listen
+// on any of the others is logged and does not affect the rest
 func RunDNSserver(dnsBind []net.IP, ready chan bool) {
 	go runDNSproxy(dnsBind)
 
-	for _, bindAddr := range dnsBind {
-		go runListener(&bindAddr, 53, reqch)
+	for i := range dnsBind {
+		bindAddr := dnsBind[i]
+		go runListener(&bindAddr, 53, reqch, i == 0)
 	}
 
 	windns.RemoveAllNrptRules()
@@ -132,7 +333,7 @@ func RunDNSserver(dnsBind []net.IP, ready chan bool) {
 	}
 }
 
-func runListener(ip *net.IP, port int, reqch chan dnsreq) {
+func runListener(ip *net.IP, port int, reqch chan dnsreq, required bool) {
 	laddr := &net.UDPAddr{
 		IP:   *ip,
 		Port: port,
@@ -168,6 +369,13 @@ func runListener(ip *net.IP, port int, reqch chan dnsreq) {
 		}
 		time.Sleep(500 * time.Millisecond)
 	}
+	if err != nil {
+		if required {
+			log.Panicf("An unexpected and unrecoverable error has occurred while %s: %v", "udp listening on network", err)
+		}
+		log.Errorf("could not listen for dns at %v, no queries will be answered on this address: %v", laddr, err)
+		return
+	}
 
 	log.Infof("DNS listening at: %v", laddr)
 
@@ -0,0 +1,299 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDnsMatchDescribe(t *testing.T) {
+	defer SetDnsOwnerLookup(nil)
+	SetDnsOwnerLookup(func(hostname string) string {
+		if hostname == "web.ziti." {
+			return "service web of identity alice"
+		}
+		return ""
+	})
+	tests := []struct {
+		name               string
+		match              dnsMatch
+		typeNotIntercepted bool
+		want               string
+	}{
+		{"static", dnsMatch{static: true, hostname: "web.ziti."}, false, "static host override"},
+		{"intercepted", dnsMatch{hostname: "web.ziti."}, false, "intercepted hostname by service web of identity alice"},
+		{"no owner", dnsMatch{hostname: "db.ziti."}, false, "intercepted hostname"},
+		{"local domain", dnsMatch{hostname: "web.ziti.", localDomain: "corp.local."}, false,
+			"intercepted hostname web.ziti. with local domain corp.local. by service web of identity alice"},
+		{"type not intercepted", dnsMatch{hostname: "db.ziti."}, true, "intercepted hostname but the type is not intercepted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.match.describe(tt.typeNotIntercepted); got != tt.want {
+				t.Errorf("describe() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDnsFailureModeRcode(t *testing.T) {
+	defer func() { _ = SetDnsFailureMode(DnsFailureEmpty) }()
+	tests := []struct {
+		mode    string
+		want    int32
+		wantErr bool
+	}{
+		{DnsFailureEmpty, dns.RcodeSuccess, false},
+		{DnsFailureForward, -1, false},
+		{" NXDomain ", dns.RcodeNameError, false},
+		{DnsFailureServfail, dns.RcodeServerFailure, false},
+		{"", 0, true},
+		{"refused", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			atomic.StoreInt32(&dnsFailureRcode, 99)
+			err := SetDnsFailureMode(tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetDnsFailureMode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := atomic.LoadInt32(&dnsFailureRcode)
+			if tt.wantErr && got != 99 {
+				t.Errorf("an invalid mode changed the rcode to %d", got)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("rcode = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeDnsManager resolves the hostnames it holds
+type fakeDnsManager map[string]net.IP
+
+func (f fakeDnsManager) Resolve(dnsName string) net.IP {
+	return f[dnsName]
+}
+
+func (f fakeDnsManager) ApplyDNS(string, string) {}
+
+// useFakeDnsManager makes the responder resolve web.ziti. to 100.64.0.5
+func useFakeDnsManager(t *testing.T) {
+	saved := DNSMgr
+	t.Cleanup(func() { DNSMgr = saved })
+	DNSMgr = fakeDnsManager{"web.ziti.": net.ParseIP("100.64.0.5")}
+}
+
+// queryResponder sends a query through processDNSquery. it returns the response the responder wrote back, or the
+// request handed to the upstream proxy when the query was forwarded
+func queryResponder(t *testing.T, name string, qtype uint16) (*dns.Msg, *proxiedReq) {
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	q := &dns.Msg{}
+	q.SetQuestion(name, qtype)
+	packet, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	processDNSquery(packet, client.LocalAddr().(*net.UDPAddr), responder, 4)
+	select {
+	case req := <-proxiedRequests:
+		return nil, req
+	default:
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, DnsMsgBufferSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("no response from the responder: %v", err)
+	}
+	resp := &dns.Msg{}
+	if err = resp.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return resp, nil
+}
+
+func TestInterceptedDnsTypes(t *testing.T) {
+	useFakeDnsManager(t)
+	defer func() {
+		_ = SetInterceptedDnsTypes([]string{"A", "AAAA"})
+		_ = SetDnsFailureMode(DnsFailureEmpty)
+	}()
+	// the service forwards the types which are not intercepted once the types are configured
+	if err := SetInterceptedDnsTypes([]string{"A", "AAAA", "TXT"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetDnsFailureMode(DnsFailureForward); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		qname       string
+		qtype       uint16
+		wantForward bool
+	}{
+		{"A is intercepted", "web.ziti.", dns.TypeA, false},
+		{"TXT is intercepted", "web.ziti.", dns.TypeTXT, false},
+		{"MX is forwarded", "web.ziti.", dns.TypeMX, true},
+		{"other hostnames are forwarded", "example.com.", dns.TypeA, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, proxied := queryResponder(t, tt.qname, tt.qtype)
+			if tt.wantForward {
+				if proxied == nil || proxied.req.Question[0].Qtype != tt.qtype {
+					t.Errorf("the query was answered with %v, want it forwarded upstream", resp)
+				}
+				return
+			}
+			if resp == nil || resp.Rcode != dns.RcodeSuccess {
+				t.Fatalf("the query was forwarded or answered with %v, want it intercepted", resp)
+			}
+			if tt.qtype == dns.TypeA && (len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.ParseIP("100.64.0.5"))) {
+				t.Errorf("answers %v, want 100.64.0.5", resp.Answer)
+			}
+		})
+	}
+}
+
+func TestDnsFailureModeResponse(t *testing.T) {
+	useFakeDnsManager(t)
+	defer func() { _ = SetDnsFailureMode(DnsFailureEmpty) }()
+	tests := []struct {
+		mode        string
+		wantRcode   int
+		wantForward bool
+	}{
+		{DnsFailureEmpty, dns.RcodeSuccess, false},
+		{DnsFailureNxdomain, dns.RcodeNameError, false},
+		{DnsFailureServfail, dns.RcodeServerFailure, false},
+		{DnsFailureForward, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			if err := SetDnsFailureMode(tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			// MX is not one of the intercepted types, so the responder does not answer it for the intercepted name
+			resp, proxied := queryResponder(t, "web.ziti.", dns.TypeMX)
+			if tt.wantForward {
+				if proxied == nil {
+					t.Errorf("the query was answered with %v, want it forwarded upstream", resp)
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatal("the query was forwarded upstream, want it answered")
+			}
+			if resp.Rcode != tt.wantRcode || len(resp.Answer) != 0 {
+				t.Errorf("answered %s with %d records, want %s without records",
+					dns.RcodeToString[resp.Rcode], len(resp.Answer), dns.RcodeToString[tt.wantRcode])
+			}
+		})
+	}
+}
+
+func TestInterceptedAnswer(t *testing.T) {
+	defer SetDnsTtl(constants.DefaultDnsTtl)
+	tests := []struct {
+		name     string
+		ttl      int
+		qtype    uint16
+		ip       string
+		wantType uint16 // 0 when there is no answer
+	}{
+		{"a record", 30, dns.TypeA, "100.64.0.5", dns.TypeA},
+		{"aaaa record", 3600, dns.TypeAAAA, "fd00::5", dns.TypeAAAA},
+		{"aaaa query of an ipv4 hostname", 30, dns.TypeAAAA, "100.64.0.5", 0},
+		{"a query of an ipv6 hostname", 30, dns.TypeA, "fd00::5", 0},
+		{"txt query", 30, dns.TypeTXT, "100.64.0.5", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetDnsTtl(tt.ttl)
+			answer := interceptedAnswer(dns.Question{Name: "web.ziti.", Qtype: tt.qtype, Qclass: dns.ClassINET}, net.ParseIP(tt.ip))
+			if tt.wantType == 0 {
+				if answer != nil {
+					t.Errorf("interceptedAnswer() = %v, want no answer", answer)
+				}
+				return
+			}
+			if answer == nil {
+				t.Fatal("interceptedAnswer() returned no answer")
+			}
+			if hdr := answer.Header(); hdr.Rrtype != tt.wantType || hdr.Ttl != uint32(tt.ttl) || hdr.Name != "web.ziti." {
+				t.Errorf("interceptedAnswer() = %v, want a %s record with ttl %d", answer, dns.Type(tt.wantType), tt.ttl)
+			}
+		})
+	}
+}
+
+func TestSetStaticHostOverrides(t *testing.T) {
+	defer staticHostOverrides.Store(map[string]net.IP{})
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		wantErr   bool
+		want      map[string]string
+	}{
+		{"none", map[string]string{}, false, map[string]string{}},
+		{"hostnames are fully qualified in lowercase", map[string]string{" Web.Example.COM ": "10.0.0.5", "db.example.com.": "fd00::5"}, false,
+			map[string]string{"web.example.com.": "10.0.0.5", "db.example.com.": "fd00::5"}},
+		{"invalid ip", map[string]string{"web.example.com": "10.0.0"}, true, map[string]string{"web.example.com.": "10.0.0.1"}},
+		{"ip as the hostname", map[string]string{"10.0.0.5": "10.0.0.5"}, true, map[string]string{"web.example.com.": "10.0.0.1"}},
+		{"empty hostname", map[string]string{" ": "10.0.0.5"}, true, map[string]string{"web.example.com.": "10.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// an invalid override must leave the overrides in place
+			if err := SetStaticHostOverrides(map[string]string{"web.example.com": "10.0.0.1"}); err != nil {
+				t.Fatal(err)
+			}
+			err := SetStaticHostOverrides(tt.overrides)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetStaticHostOverrides() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			got := staticHostOverrides.Load().(map[string]net.IP)
+			if len(got) != len(tt.want) {
+				t.Errorf("overrides = %v, want %v", got, tt.want)
+			}
+			for host, ip := range tt.want {
+				if !got[host].Equal(net.ParseIP(ip)) {
+					t.Errorf("override of %s = %v, want %s", host, got[host], ip)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"sync"
+	"time"
+)
+
+// the number of sources tracked before the buckets of idle sources are dropped
+const dnsRateLimitMaxSources = 1024
+
+// dnsRateLimiter answers if a query from a source is within the limit, using a token bucket per source address.
+// a zero rate disables the limiting
+type dnsRateLimiter struct {
+	sync.Mutex
+	rate    float64 // tokens added to a bucket every second
+	burst   float64 // tokens a bucket holds, the queries a source can send at once
+	buckets map[string]*dnsBucket
+}
+
+type dnsBucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool // set once limiting engaged for the source, cleared when a query is allowed again
+	refused int
+}
+
+var dnsLimiter = &dnsRateLimiter{buckets: make(map[string]*dnsBucket)}
+
+// SetDnsRateLimit limits the queries each source can send to the dns responder to perSecond, allowing bursts of up to
+// burst queries. queries over the limit are answered with SERVFAIL. a rate of 0 disables the limiting
+func SetDnsRateLimit(perSecond int, burst int) {
+	if burst < perSecond {
+		burst = perSecond
+	}
+	dnsLimiter.Lock()
+	defer dnsLimiter.Unlock()
+	dnsLimiter.rate = float64(perSecond)
+	dnsLimiter.burst = float64(burst)
+	dnsLimiter.buckets = make(map[string]*dnsBucket)
+}
+
+func (l *dnsRateLimiter) allow(source string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+
+	b, found := l.buckets[source]
+	if !found {
+		if len(l.buckets) >= dnsRateLimitMaxSources {
+			l.dropIdle(now)
+		}
+		b = &dnsBucket{tokens: l.burst, last: now}
+		l.buckets[source] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		if !b.limited {
+			log.Warnf("dns queries from %s are over the limit of %v per second. the queries are answered with SERVFAIL", source, l.rate)
+			b.limited = true
+		}
+		b.refused++
+		return false
+	}
+	if b.limited {
+		log.Infof("dns queries from %s are no longer limited. %d queries were refused", source, b.refused)
+		b.limited = false
+		b.refused = 0
+	}
+	b.tokens--
+	return true
+}
+
+// dropIdle removes the buckets which have refilled completely, they are the same as a new bucket
+func (l *dnsRateLimiter) dropIdle(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for source, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, source)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDnsRateLimiterFlood(t *testing.T) {
+	tests := []struct {
+		name      string
+		perSecond float64
+		burst     float64
+		queries   int
+		wantAllow int
+	}{
+		{"disabled", 0, 0, 1000, 1000},
+		{"flood is cut at the burst", 10, 20, 1000, 20},
+		{"under the burst", 10, 20, 15, 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &dnsRateLimiter{rate: tt.perSecond, burst: tt.burst, buckets: make(map[string]*dnsBucket)}
+			now := time.Now()
+			allowed := 0
+			for i := 0; i < tt.queries; i++ {
+				if l.allow("10.0.0.1", now) {
+					allowed++
+				}
+			}
+			if allowed != tt.wantAllow {
+				t.Errorf("allowed %d of %d queries, want %d", allowed, tt.queries, tt.wantAllow)
+			}
+			if !l.allow("10.0.0.2", now) {
+				t.Error("another source was limited by the flood")
+			}
+		})
+	}
+}
+
+func TestDnsRateLimiterRefill(t *testing.T) {
+	l := &dnsRateLimiter{rate: 10, burst: 20, buckets: make(map[string]*dnsBucket)}
+	now := time.Now()
+	for l.allow("10.0.0.1", now) {
+	}
+	b := l.buckets["10.0.0.1"]
+	if !b.limited || b.refused != 1 {
+		t.Fatalf("limited %t refused %d, want the source limited with one refused query", b.limited, b.refused)
+	}
+
+	now = now.Add(time.Second)
+	allowed := 0
+	for l.allow("10.0.0.1", now) {
+		allowed++
+	}
+	if allowed != 10 {
+		t.Errorf("allowed %d queries a second after the flood, want 10", allowed)
+	}
+
+	// a long idle source gets a full bucket back, not more
+	now = now.Add(time.Hour)
+	allowed = 0
+	for l.allow("10.0.0.1", now) {
+		allowed++
+	}
+	if allowed != 20 {
+		t.Errorf("allowed %d queries after an hour, want the burst of 20", allowed)
+	}
+}
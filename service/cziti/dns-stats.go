@@ -0,0 +1,92 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// upper bounds, in microseconds, of the buckets of the dns responder latency histogram. the last bucket is unbounded
+var dnsLatencyBounds = []int64{50, 100, 250, 500, 1000, 2500, 5000, 10000, 25000, 50000, 100000, 250000, 1000000}
+
+var dnsLatencyBuckets = make([]int64, len(dnsLatencyBounds)+1)
+var dnsQueryCount int64
+var dnsLatencyTotal int64 // microseconds
+var dnsLatencyMax int64   // microseconds, reported as the p99 when it falls in the unbounded bucket
+
+func recordDnsLatency(d time.Duration) {
+	us := d.Microseconds()
+	i := 0
+	for i < len(dnsLatencyBounds) && us > dnsLatencyBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&dnsLatencyBuckets[i], 1)
+	atomic.AddInt64(&dnsLatencyTotal, us)
+	atomic.AddInt64(&dnsQueryCount, 1)
+	for max := atomic.LoadInt64(&dnsLatencyMax); us > max; max = atomic.LoadInt64(&dnsLatencyMax) {
+		if atomic.CompareAndSwapInt64(&dnsLatencyMax, max, us) {
+			break
+		}
+	}
+}
+
+// DnsResponderStats returns the count, average and p99 latency of the queries answered by the ziti dns responder since
+// the service started or the stats were last reset. the p99 is the upper bound of the histogram bucket it falls in,
+// or the slowest query seen when that is the unbounded bucket
+func DnsResponderStats() dto.DnsResponderStats {
+	stats := dto.DnsResponderStats{Count: atomic.LoadInt64(&dnsQueryCount)}
+	if stats.Count == 0 {
+		return stats
+	}
+	stats.AverageMs = float64(atomic.LoadInt64(&dnsLatencyTotal)) / float64(stats.Count) / 1000
+
+	buckets := make([]int64, len(dnsLatencyBuckets))
+	for i := range dnsLatencyBuckets {
+		buckets[i] = atomic.LoadInt64(&dnsLatencyBuckets[i])
+	}
+	stats.P99Ms = float64(latencyP99(buckets, stats.Count, atomic.LoadInt64(&dnsLatencyMax))) / 1000
+	return stats
+}
+
+// latencyP99 returns the p99, in microseconds, of the histogram of count queries with dnsLatencyBounds
+func latencyP99(buckets []int64, count int64, max int64) int64 {
+	target := (count*99 + 99) / 100
+	var seen int64
+	for i := range buckets {
+		seen += buckets[i]
+		if seen >= target {
+			if i < len(dnsLatencyBounds) {
+				return dnsLatencyBounds[i]
+			}
+			return max
+		}
+	}
+	return max
+}
+
+func ResetDnsResponderStats() {
+	for i := range dnsLatencyBuckets {
+		atomic.StoreInt64(&dnsLatencyBuckets[i], 0)
+	}
+	atomic.StoreInt64(&dnsLatencyTotal, 0)
+	atomic.StoreInt64(&dnsLatencyMax, 0)
+	atomic.StoreInt64(&dnsQueryCount, 0)
+}
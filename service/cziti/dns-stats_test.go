@@ -0,0 +1,51 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import "testing"
+
+func TestLatencyP99(t *testing.T) {
+	bucketsWith := func(counts map[int]int64) []int64 {
+		b := make([]int64, len(dnsLatencyBounds)+1)
+		for i, c := range counts {
+			b[i] = c
+		}
+		return b
+	}
+	overflow := len(dnsLatencyBounds)
+	tests := []struct {
+		name    string
+		buckets []int64
+		count   int64
+		max     int64
+		want    int64
+	}{
+		{"all in the first bucket", bucketsWith(map[int]int64{0: 100}), 100, 40, 50},
+		{"slow tail below 1%", bucketsWith(map[int]int64{0: 99, 5: 1}), 100, 2000, 50},
+		{"slow tail at 2%", bucketsWith(map[int]int64{0: 98, 5: 2}), 100, 2000, 2500},
+		{"overflow bucket reports the max", bucketsWith(map[int]int64{0: 90, overflow: 10}), 100, 3500000, 3500000},
+		{"single slow query", bucketsWith(map[int]int64{overflow: 1}), 1, 1200000, 1200000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := latencyP99(tt.buckets, tt.count, tt.max); got != tt.want {
+				t.Errorf("latencyP99() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+type lazyRegistry struct {
+	hostnames map[string]string // hostname to the fingerprint of the identity not connected yet
+	onQuery   func(fingerprint string)
+}
+
+var lazyHostnames atomic.Value // *lazyRegistry
+
+func init() {
+	lazyHostnames.Store(&lazyRegistry{hostnames: map[string]string{}})
+}
+
+// SetLazyHostnames replaces the hostnames of the identities which are only connected once one of their hostnames is
+// queried. wildcard hostnames (*.example.com) match every name in the domain. onQuery is called, on its own
+// goroutine, with the fingerprint of the identity owning a queried hostname
+func SetLazyHostnames(hostnames map[string]string, onQuery func(fingerprint string)) {
+	normalized := make(map[string]string, len(hostnames))
+	for h, fingerprint := range hostnames {
+		normalized[strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")] = fingerprint
+	}
+	lazyHostnames.Store(&lazyRegistry{hostnames: normalized, onQuery: onQuery})
+}
+
+// lazyHostnameQueried reports if the name belongs to an identity which is not connected yet and starts connecting it
+func lazyHostnameQueried(dnsName string) bool {
+	registry := lazyHostnames.Load().(*lazyRegistry)
+	hostnames := registry.hostnames
+	if len(hostnames) == 0 {
+		return false
+	}
+	name := strings.TrimSuffix(strings.ToLower(dnsName), ".")
+	fingerprint, found := hostnames[name]
+	for !found {
+		dot := strings.Index(name, ".")
+		if dot < 0 {
+			break
+		}
+		name = name[dot+1:]
+		fingerprint, found = hostnames["*."+name]
+	}
+	if !found {
+		return false
+	}
+	if registry.onQuery != nil {
+		go registry.onQuery(fingerprint)
+	}
+	return true
+}
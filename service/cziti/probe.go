@@ -0,0 +1,177 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+/*
+#cgo windows LDFLAGS: -l libziti.imp -luv -lws2_32 -lpsapi
+
+#include <stdlib.h>
+#include <ziti/ziti.h>
+#include "sdk.h"
+
+*/
+import "C"
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+type probeResult struct {
+	status int
+	err    error
+}
+
+// probe is one ProbeService call. conn and abandoned are only used on the uv loop
+type probe struct {
+	czctx     C.ziti_context
+	service   string
+	results   chan probeResult
+	conn      C.ziti_connection
+	abandoned bool
+}
+
+var probeCounter uint64
+var probes sync.Map                             //probe key -> *probe
+var probeConns = map[C.ziti_connection]*probe{} //connections being dialed. only used on the uv loop
+
+// FindServiceByName returns the service with the given name or nil if the identity has no such service
+func (zid *ZIdentity) FindServiceByName(name string) *ZService {
+	var found *ZService
+	zid.Services.Range(func(key interface{}, value interface{}) bool {
+		svc := value.(*ZService)
+		if svc.Name == name {
+			found = svc
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// ProbeService dials the named service through the identity's ziti context and closes the connection as soon as
+// the dial completes. the dial runs on the uv loop, a probe which times out has its connection closed there too.
+// returns how long the dial took
+func ProbeService(zid *ZIdentity, serviceName string, timeout time.Duration) (time.Duration, error) {
+	if zid == nil || unsafe.Pointer(zid.czctx) == C.NULL {
+		return 0, fmt.Errorf("identity is not loaded")
+	}
+	if zid.FindServiceByName(serviceName) == nil {
+		return 0, fmt.Errorf("service %s was not found for identity %s", serviceName, zid.Fingerprint)
+	}
+
+	key := fmt.Sprintf("%s:%d", zid.Fingerprint, atomic.AddUint64(&probeCounter, 1))
+	p := &probe{czctx: zid.czctx, service: serviceName, results: make(chan probeResult, 1)}
+	probes.Store(key, p)
+
+	start := time.Now()
+	onProbeLoop(key, C.uv_async_cb(C.ziti_probe_start))
+	select {
+	case r := <-p.results:
+		probes.Delete(key)
+		return time.Since(start), r.err
+	case <-time.After(timeout):
+		onProbeLoop(key, C.uv_async_cb(C.ziti_probe_abandon))
+		return 0, fmt.Errorf("probing service %s timed out after %v", serviceName, timeout)
+	}
+}
+
+// onProbeLoop runs cb on the uv loop with the key of the probe
+func onProbeLoop(key string, cb C.uv_async_cb) {
+	async := (*C.uv_async_t)(C.malloc(C.sizeof_uv_async_t))
+	async.data = unsafe.Pointer(C.CString(key))
+	C.uv_async_init(_impl.libuvCtx.l, async, cb)
+	C.uv_async_send(async)
+}
+
+// probeOfAsync returns the probe the async was sent for and releases the async
+func probeOfAsync(async *C.uv_async_t) (string, *probe) {
+	cKey := (*C.char)(async.data)
+	key := C.GoString(cKey)
+	C.free(unsafe.Pointer(cKey))
+	C.uv_close((*C.uv_handle_t)(unsafe.Pointer(async)), C.uv_close_cb(C.free_async))
+	if p, ok := probes.Load(key); ok {
+		return key, p.(*probe)
+	}
+	return key, nil
+}
+
+//export ziti_probe_start
+func ziti_probe_start(async *C.uv_async_t) {
+	key, p := probeOfAsync(async)
+	if p == nil || p.abandoned {
+		return
+	}
+	cSvc := C.CString(p.service)
+	defer C.free(unsafe.Pointer(cSvc))
+
+	var conn C.ziti_connection
+	if rc := C.ziti_conn_init(p.czctx, &conn, nil); rc != C.ZITI_OK {
+		p.results <- probeResult{status: int(rc), err: fmt.Errorf("could not create connection: %s", C.GoString(C.ziti_errorstr(rc)))}
+		return
+	}
+	if rc := C.ziti_dial(conn, cSvc, C.ziti_conn_cb(C.ziti_probe_conn_cb_go), C.ziti_data_cb(C.ziti_probe_data_cb_go)); rc != C.ZITI_OK {
+		C.ziti_close(conn, nil)
+		p.results <- probeResult{status: int(rc), err: fmt.Errorf("could not dial service %s: %s", p.service, C.GoString(C.ziti_errorstr(rc)))}
+		return
+	}
+	log.Debugf("service probe %s started", key)
+	p.conn = conn
+	probeConns[conn] = p
+}
+
+//export ziti_probe_abandon
+func ziti_probe_abandon(async *C.uv_async_t) {
+	key, p := probeOfAsync(async)
+	probes.Delete(key)
+	if p == nil {
+		return
+	}
+	p.abandoned = true
+	if p.conn != nil && probeConns[p.conn] == p {
+		log.Debugf("service probe %s timed out, closing its connection", key)
+		delete(probeConns, p.conn)
+		C.ziti_close(p.conn, nil)
+	}
+}
+
+//export ziti_probe_conn_cb_go
+func ziti_probe_conn_cb_go(conn C.ziti_connection, status C.int) {
+	p, ok := probeConns[conn]
+	if !ok {
+		//the probe timed out and already closed the connection
+		return
+	}
+	delete(probeConns, conn)
+	C.ziti_close(conn, nil)
+
+	r := probeResult{status: int(status)}
+	if status != C.ZITI_OK {
+		r.err = fmt.Errorf("dial failed: %s", C.GoString(C.ziti_errorstr(status)))
+	}
+	log.Debugf("service probe of %s completed with status %d", p.service, int(status))
+	p.results <- r
+}
+
+//export ziti_probe_data_cb_go
+func ziti_probe_data_cb_go(_ C.ziti_connection, _ *C.uint8_t, length C.ssize_t) C.ssize_t {
+	//the probe never reads, discard anything the far side sends before the close completes
+	return length
+}
@@ -81,6 +81,7 @@ type BulkServiceChange struct {
 	HostnamesToRemove  map[string]bool
 	ServicesToRemove   []*dto.Service
 	ServicesToAdd      []*dto.Service
+	ChangedServices    []string // services whose configuration was changed on the controller
 	MfaMinTimeout      int32
 	MfaMaxTimeout      int32
 	MfaMinTimeoutRem   int32
@@ -220,8 +221,10 @@ func (zid *ZIdentity) setVersionFromId() string {
 	return zid.Version
 }
 
+// setNameFromId reads the name from the identity the controller returned. '<unknown>' is only kept until the
+// controller returns a name, a context which connects again picks up the name it failed to get before
 func (zid *ZIdentity) setNameFromId() string {
-	if len(zid.Name) > 0 {
+	if len(zid.Name) > 0 && zid.Name != "<unknown>" && zid.czid == nil {
 		return zid.Name
 	}
 	zid.Name = "<unknown>"
@@ -597,6 +600,10 @@ func toAddy(hostOrIpOrCidr string) dto.Address {
 		log.Debugf("%s appears to be a proper CIDR", hostOrIpOrCidr)
 		ones, _ := ipnet.Mask.Size()
 		addy.IP = ip.String()
+		if ones == 0 {
+			//without a prefix the address is a single ip, keep the unspecified address so a /0 can be told apart
+			addy.IP = ipnet.IP.String()
+		}
 		addy.Prefix = ones
 	}
 	log.Tracef("parsed address: %v from %s", addy, hostOrIpOrCidr)
@@ -640,6 +647,7 @@ func eventCB(ztx C.ziti_context, event *C.ziti_event_t) {
 		hostnamesToRemove := make(map[string]bool)
 		servicesToRemove := make([]*dto.Service, 0)
 		servicesToAdd := make([]*dto.Service, 0)
+		changedServices := make([]string, 0)
 
 		srvEvent := C.ziti_event_service_event(event)
 
@@ -667,6 +675,7 @@ func eventCB(ztx C.ziti_context, event *C.ziti_event_t) {
 			}
 
 			log.Info("service changed remove the service then add it back immediately", C.GoString(changed.name))
+			changedServices = append(changedServices, C.GoString(changed.name))
 			svcToRemove := serviceCB(ztx, changed, C.ZITI_SERVICE_UNAVAILABLE, zid)
 			if svcToRemove != nil {
 
@@ -725,6 +734,7 @@ func eventCB(ztx C.ziti_context, event *C.ziti_event_t) {
 			HostnamesToRemove:  hostnamesToRemove,
 			ServicesToAdd:      servicesToAdd,
 			ServicesToRemove:   servicesToRemove,
+			ChangedServices:    changedServices,
 			MfaMinTimeout:      zid.MfaMinTimeout,
 			MfaMaxTimeout:      zid.MfaMaxTimeout,
 			MfaMinTimeoutRem:   zid.MfaMinTimeoutRem,
@@ -83,6 +83,13 @@ void ziti_mfa_ar_cb(ziti_context ztx, void *mfa_ctx, int status);
 void ziti_ar_mfa_status_cb_go(ziti_context ztx, void *mfa_ctx, int status, char *fingerprint);
 void ziti_auth_mfa_status_cb_go(ziti_context ztx, int status, char *fingerprint);
 
+//declare service probe callbacks
+void ziti_probe_conn_cb_go(ziti_connection conn, int status);
+ssize_t ziti_probe_data_cb_go(ziti_connection conn, uint8_t *data, ssize_t length);
+void ziti_probe_start(uv_async_t *handle);
+void ziti_probe_abandon(uv_async_t *handle);
+void free_async(uv_handle_t* timer);
+
 ziti_posture_query_set* posture_query_set_get(ziti_posture_query_set_array arr, int idx);
 ziti_posture_query* posture_queries_get(ziti_posture_query_array arr, int idx);
 
@@ -0,0 +1,44 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"testing"
+)
+
+func TestToAddy(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		want dto.Address
+	}{
+		{"hostname", "web.ziti", dto.Address{IsHost: true, HostName: "web.ziti"}},
+		{"single ip", "10.1.2.3", dto.Address{IP: "10.1.2.3"}},
+		{"cidr", "10.1.2.3/16", dto.Address{IP: "10.1.2.3", Prefix: 16}},
+		{"ipv4 /0", "10.1.2.3/0", dto.Address{IP: "0.0.0.0"}},
+		{"ipv6 /0", "fd00::1/0", dto.Address{IP: "::"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := toAddy(tt.addr); got != tt.want {
+				t.Errorf("toAddy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
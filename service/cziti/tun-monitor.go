@@ -0,0 +1,132 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"golang.zx2c4.com/wireguard/tun"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+)
+
+// tunWriteMonitor counts the failed writes to the TUN and calls onFailing once more than threshold writes failed
+// within window. onFailing is not called again until backoff has passed, the backoff doubles every time it is called.
+// a failed write is warned about at most once every warnInterval
+type tunWriteMonitor struct {
+	sync.Mutex
+	threshold    int
+	window       time.Duration
+	failures     []time.Time
+	onFailing    func(failures int, err error)
+	backoff      time.Duration
+	nextAllowed  time.Time
+	warnInterval time.Duration
+	nextWarn     time.Time
+	suppressed   int
+}
+
+var tunWrites = &tunWriteMonitor{
+	threshold:    constants.TunWriteFailureThreshold,
+	window:       constants.TunWriteFailureWindow * time.Second,
+	backoff:      constants.TunRecoverMinBackoff * time.Second,
+	warnInterval: constants.TunWriteWarnInterval * time.Second,
+}
+
+// SetTunWriteFailureHandler sets the function called when writes to the TUN keep failing. it is called on its own
+// goroutine so it can replace the TUN device
+func SetTunWriteFailureHandler(onFailing func(failures int, err error)) {
+	tunWrites.Lock()
+	defer tunWrites.Unlock()
+	tunWrites.onFailing = onFailing
+}
+
+// failed records a failed write. it returns whether the failure should be warned about along with the number of
+// failures which were not warned about since the last warning
+func (m *tunWriteMonitor) failed(now time.Time, err error) (warn bool, suppressed int) {
+	m.Lock()
+	defer m.Unlock()
+	if now.Before(m.nextWarn) {
+		m.suppressed++
+	} else {
+		warn, suppressed = true, m.suppressed
+		m.suppressed = 0
+		m.nextWarn = now.Add(m.warnInterval)
+	}
+	m.recover(now, err)
+	return warn, suppressed
+}
+
+func (m *tunWriteMonitor) recover(now time.Time, err error) {
+	cutoff := now.Add(-m.window)
+	kept := m.failures[:0]
+	for _, f := range m.failures {
+		if f.After(cutoff) {
+			kept = append(kept, f)
+		}
+	}
+	m.failures = append(kept, now)
+	if len(m.failures) < m.threshold || m.onFailing == nil {
+		return
+	}
+	if now.Before(m.nextAllowed) {
+		log.Debugf("writes to the TUN are still failing. not recovering again before %s", m.nextAllowed.Format(time.RFC3339))
+		return
+	}
+	if now.Sub(m.nextAllowed) > constants.TunRecoverMaxBackoff*time.Second {
+		// the last recovery was long ago, start over with the shortest backoff
+		m.backoff = constants.TunRecoverMinBackoff * time.Second
+	}
+	failures := len(m.failures)
+	m.failures = nil
+	m.nextAllowed = now.Add(m.backoff)
+	m.backoff *= 2
+	if m.backoff > constants.TunRecoverMaxBackoff*time.Second {
+		m.backoff = constants.TunRecoverMaxBackoff * time.Second
+	}
+	go m.onFailing(failures, err)
+}
+
+// ReplaceTunDevice swaps the TUN device the tunneler reads and writes with the one returned by recreate. packets
+// written while the device is replaced are dropped. recreate is given the device in use so it can close it first
+func ReplaceTunDevice(recreate func(old tun.Device) (tun.Device, error)) error {
+	if theTun == nil {
+		return fmt.Errorf("the TUN is not hooked up to the tunneler")
+	}
+	atomic.StoreUint32(&theTun.replacing, 1)
+	defer atomic.StoreUint32(&theTun.replacing, 0)
+
+	dev, err := recreate(theTun.device())
+	if err != nil {
+		return err
+	}
+	theTun.devLock.Lock()
+	theTun.dev = dev
+	theTun.devLock.Unlock()
+	go theTun.runReadLoop()
+	log.Info("the TUN device was replaced")
+	return nil
+}
+
+func (t *tunnel) device() tun.Device {
+	t.devLock.RLock()
+	defer t.devLock.RUnlock()
+	return t.dev
+}
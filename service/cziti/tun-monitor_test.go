@@ -0,0 +1,78 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTunWriteMonitorWarnings(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name           string
+		after          []time.Duration
+		wantWarn       []bool
+		wantSuppressed []int
+	}{
+		{"first failure", []time.Duration{0}, []bool{true}, []int{0}},
+		{"failures within the interval", []time.Duration{0, time.Second, 2 * time.Second}, []bool{true, false, false}, []int{0, 0, 0}},
+		{"failures after the interval", []time.Duration{0, time.Second, 2 * time.Second, 10 * time.Second}, []bool{true, false, false, true}, []int{0, 0, 0, 2}},
+		{"failures far apart", []time.Duration{0, time.Minute, 2 * time.Minute}, []bool{true, true, true}, []int{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &tunWriteMonitor{threshold: 1000, window: time.Second, warnInterval: 10 * time.Second}
+			var warns []bool
+			var suppressed []int
+			for _, d := range tt.after {
+				w, s := m.failed(start.Add(d), errors.New("write failed"))
+				warns = append(warns, w)
+				suppressed = append(suppressed, s)
+			}
+			if !reflect.DeepEqual(warns, tt.wantWarn) || !reflect.DeepEqual(suppressed, tt.wantSuppressed) {
+				t.Errorf("failed() warned %v, suppressed %v, want %v, %v", warns, suppressed, tt.wantWarn, tt.wantSuppressed)
+			}
+		})
+	}
+}
+
+func TestTunWriteMonitorRecovers(t *testing.T) {
+	recovered := make(chan int, 1)
+	m := &tunWriteMonitor{
+		threshold:    3,
+		window:       10 * time.Second,
+		backoff:      30 * time.Second,
+		warnInterval: 10 * time.Second,
+		onFailing:    func(failures int, err error) { recovered <- failures },
+	}
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		m.failed(start.Add(time.Duration(i)*time.Second), errors.New("write failed"))
+	}
+	select {
+	case failures := <-recovered:
+		if failures != 3 {
+			t.Errorf("recovered after %d failures, want 3", failures)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the TUN was not recovered after the failures exceeded the threshold")
+	}
+}
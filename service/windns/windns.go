@@ -19,7 +19,9 @@ package windns
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util/logging"
 	"net"
 	"os"
@@ -107,7 +109,7 @@ func FlushDNS() {
 	}
 }
 
-func RemoveAllNrptRules() {
+func RemoveAllNrptRules() error {
 	script := fmt.Sprintf(`Get-DnsClientNrptRule | Where { $_.Comment.StartsWith("Added by %s") } | Remove-DnsClientNrptRule -ErrorAction SilentlyContinue -Force`, exeName)
 	log.Tracef("removing all nrpt rules with: %s", script)
 
@@ -119,6 +121,32 @@ func RemoveAllNrptRules() {
 	if err != nil {
 		log.Errorf("ERROR removing all nrpt rules: %v", err)
 	}
+	return err
+}
+
+// GetNrptRules returns the nrpt rules added by the tunneler
+func GetNrptRules() ([]dto.NrptRule, error) {
+	script := fmt.Sprintf(`ConvertTo-Json -Compress -InputObject @(Get-DnsClientNrptRule | Where { $_.Comment -and $_.Comment.StartsWith("Added by %s") } | Select-Object Namespace, NameServers)`, exeName)
+	log.Tracef("listing nrpt rules with: %s", script)
+
+	cmd := exec.Command("powershell", "-Command", script)
+	cmd.Stderr = os.Stdout
+	output := new(bytes.Buffer)
+	cmd.Stdout = output
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("could not list nrpt rules: %v", err)
+	}
+
+	rules := make([]dto.NrptRule, 0)
+	if len(bytes.TrimSpace(output.Bytes())) == 0 {
+		return rules, nil
+	}
+	if err = json.Unmarshal(output.Bytes(), &rules); err != nil {
+		return nil, fmt.Errorf("could not parse nrpt rules: %v", err)
+	}
+	return rules, nil
 }
 
 var namespaceTemplate = `%s@{n="%s";}`
@@ -291,7 +319,7 @@ func removeSingleNrtpRule(nrptRule string) {
 	}
 }
 
-func CleanUpNetworkAdapterProfile() {
+func CleanUpNetworkAdapterProfile() error {
 	script := fmt.Sprintf(`$key="Microsoft.PowerShell.Core\Registry::HKEY_LOCAL_MACHINE\SOFTWARE\Microsoft\Windows NT\CurrentVersion\NetworkList\Signatures\Unmanaged\*"
 Get-ItemProperty -Path $key | where {$_.FirstNetwork -match "ziti.*"} | Remove-Item
 
@@ -308,5 +336,5 @@ Get-ItemProperty -Path $key | where {$_.ProfileName -match "Ziti.*"} | Remove-It
 	if err != nil {
 		log.Errorf("ERROR Cleaning up the Network Adapter profiles: %v", err)
 	}
-
+	return err
 }
@@ -21,8 +21,22 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
 )
 
+// StrictConfigRecoveryEnv names the environment variable which, when set to true, makes the service refuse to start
+// when both the config file and its backup are unreadable. It cannot live in the config file as that is the file
+// which is corrupt.
+const StrictConfigRecoveryEnv = "ZITI_STRICT_CONFIG_RECOVERY"
+
+// MaxConfigSizeEnv names the environment variable used to override the largest config file, in bytes, that is read
+const MaxConfigSizeEnv = "ZITI_MAX_CONFIG_SIZE"
+
+var identityPath string
+
 func ExecutablePath() string {
 	fi, err := os.Executable()
 	if err != nil {
@@ -38,17 +52,56 @@ func Path() string {
 	path, _ := os.UserConfigDir()
 	return path + string(os.PathSeparator) + "NetFoundry" + string(os.PathSeparator)
 }
+
+// IdentityPath is the folder holding the identity files, the config folder unless another folder was set
+func IdentityPath() string {
+	if identityPath == "" {
+		return Path()
+	}
+	return identityPath
+}
+
+// SetIdentityPath moves the identity files to another folder. an empty path puts them back in the config folder
+func SetIdentityPath(path string) {
+	if path != "" && !strings.HasSuffix(path, string(os.PathSeparator)) {
+		path += string(os.PathSeparator)
+	}
+	identityPath = path
+}
+
+// UninstallExportPath is the folder PrepareUninstall copies the config and the identity files to. it is within the
+// config folder so it gets the same permissions
+func UninstallExportPath() string {
+	return Path() + "uninstall-export" + string(os.PathSeparator)
+}
 func LogFile() string {
 	return filepath.Join(LogsPath(), "ziti-tunneler.log")
 }
 func LogsPath() string {
 	return filepath.Join(ExecutablePath(), "logs", "service")
 }
+
+// PolicyFile is the machine-wide policy deployed by fleet tools, kept apart from the config the user manages
+func PolicyFile() string {
+	programData := os.Getenv("ProgramData")
+	if programData == "" {
+		return Path() + "policy.json"
+	}
+	return filepath.Join(programData, "NetFoundry", "policy.json")
+}
 func BackupFile() string {
 	return File() + ".backup"
 }
-func EnsureConfigFolder() error {
-	return ensureFolder(Path())
+func StrictConfigRecovery() bool {
+	strict, _ := strconv.ParseBool(os.Getenv(StrictConfigRecoveryEnv))
+	return strict
+}
+func MaxConfigSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv(MaxConfigSizeEnv), 10, 64)
+	if err != nil || size <= 0 {
+		return constants.DefaultMaxConfigFileSize
+	}
+	return size
 }
 func EnsureLogsFolder() error {
 	return ensureFolder(LogsPath())
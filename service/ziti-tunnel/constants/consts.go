@@ -31,4 +31,83 @@ const (
 
 	DefaultApiPageSize = 25
 	MinimumApiPageSize = 10
+	MaximumApiPageSize = 500
+
+	ServiceProbeTimeout = 5 // seconds to wait for a service probe dial
+
+	MaxClockSkew = 300 // seconds the local clock may be off the clock of a controller before it is reported
+
+	LatencyHistorySize           = 120 // latency samples kept per identity and service
+	MinimumLatencySampleInterval = 5   // seconds
+	LatencyIdleCheckInterval     = 30  // seconds between checks of the config while latency sampling is disabled
+
+	DefaultDnsTtl = 60 // ttl in seconds of intercepted dns answers
+	MinimumDnsTtl = 1
+	MaximumDnsTtl = 3600
+
+	DefaultControllerDialTimeout = 10 // seconds to wait when dialing the controller
+	MinimumControllerDialTimeout = 1
+	MaximumControllerDialTimeout = 120
+
+	DefaultMaxConfigFileSize = 4 * 1024 * 1024 // bytes
+
+	AdapterDeleteAttempts  = 5
+	AdapterDeleteBackoffMs = 250 // multiplied by the attempt number
+
+	MetricsHistorySize           = 4096 // number of metrics samples retained in memory
+	DefaultMetricsSampleInterval = 5    // seconds
+	MinimumMetricsSampleInterval = 1
+	MetricsBroadcastInterval     = 5  // seconds
+	DefaultBatterySampleInterval = 30 // seconds between metrics broadcasts and samples while on battery
+	PowerStateCheckInterval      = 30 // seconds
+
+	MaxWarnings = 200 // warnings kept in memory until they are cleared, the oldest are dropped first
+
+	DefaultBackupRetentionDays = 30 // days config backups are kept, the newest valid backup is always kept
+
+	DefaultOrphanGraceDays = 7 // days a recovered identity may fail to load before it is flagged for removal
+
+	DefaultEventQueueCapacity = 32
+	MinimumEventQueueCapacity = 8
+	MaximumEventQueueCapacity = 32767
+
+	DefaultLazyIdleTimeout = 30 // minutes without traffic before a lazy identity is disconnected again
+	LazyIdleCheckInterval  = 60 // seconds
+
+	MfaReminderCheckInterval = 30 // seconds between checks for identities which need an mfa reminder
+
+	DefaultConnectTimeout = 60 // seconds an identity may take to connect before its load is abandoned
+	MinimumConnectTimeout = 5
+	ConnectRetryDelay     = 60 // seconds before an identity whose load was abandoned is loaded again
+
+	DefaultReconnectWindow   = 30 // seconds the reconnects of the identities whose load was abandoned are spread over
+	MaximumReconnectWindow   = 600
+	DefaultReconnectJitterMs = 1000
+
+	ConfigChangeDebounce  = 2  // seconds to wait for further config changes of an identity before applying them
+	NetworkChangeDebounce = 3  // seconds to wait for the network to stop changing before checking the dns of the TUN
+	TunInterfaceCacheTtl  = 10 // seconds the live state of the TUN is reported from the cache
+
+	TunWriteFailureThreshold = 20  // failed writes to the TUN within the window before it is considered broken
+	TunWriteFailureWindow    = 10  // seconds
+	TunRecoverMinBackoff     = 30  // seconds before the TUN can be recovered again, doubled every recovery
+	TunRecoverMaxBackoff     = 600 // seconds
+	TunWriteWarnInterval     = 10  // seconds between the warnings about failed writes to the TUN
+
+	TunMetricPreferred = 5   // interface metric of the TUN when it is preferred over the other interfaces
+	TunMetricSplit     = 255 // interface metric of the TUN when only the routes of the services should use it
+
+	RouteDeleteAttempts  = 3   // deletes of a route which lingers before giving up, when the removal is verified
+	RouteDeleteBackoffMs = 100 // multiplied by the attempt number
+
+	ConfigSaveAttempts  = 5
+	ConfigSaveBackoffMs = 100 // multiplied by the attempt number
+
+	ScheduleCheckInterval = 30 // seconds between checks of the schedules of the identities
+
+	ResourceStatsMinInterval = 5 // seconds a sample of the resource stats is reused for
+	ResourceStatsFile        = "resource-stats.json"
+
+	HookTimeout     = 30   // seconds a post-connect or post-disconnect command of an identity may run before it is stopped
+	HookOutputLimit = 4096 // bytes of the output of a hook which are logged
 )
@@ -73,24 +73,48 @@ type HostContext struct {
 }
 
 type Identity struct {
-	Name               string
-	FingerPrint        string
-	Active             bool
-	Config             idcfg.Config
-	ControllerVersion  string
-	Status             string
-	MfaEnabled         bool
-	MfaNeeded          bool
-	Services           []*Service `json:",omitempty"`
-	Metrics            *Metrics   `json:",omitempty"`
-	Tags               []string   `json:",omitempty"`
-	MfaMinTimeout      int32
-	MfaMaxTimeout      int32
-	MfaMinTimeoutRem   int32
-	MfaMaxTimeoutRem   int32
-	MfaLastUpdatedTime time.Time
-	ServiceUpdatedTime time.Time
-	Notified           bool
+	Name                  string
+	FingerPrint           string
+	Active                bool
+	Config                idcfg.Config
+	ControllerVersion     string
+	Status                string
+	MfaEnabled            bool
+	MfaNeeded             bool
+	Services              []*Service `json:",omitempty"`
+	Metrics               *Metrics   `json:",omitempty"`
+	Tags                  []string   `json:",omitempty"`
+	MfaMinTimeout         int32
+	MfaMaxTimeout         int32
+	MfaMinTimeoutRem      int32
+	MfaMaxTimeoutRem      int32
+	MfaLastUpdatedTime    time.Time
+	ServiceUpdatedTime    time.Time
+	Notified              bool
+	LastError             string `json:",omitempty"`
+	ReadOnly              bool   `json:",omitempty"`
+	LoadPriority          int
+	ConnectTimeout        int       `json:",omitempty"` // seconds to wait for the identity to connect, the default when 0
+	ApiPageSize           int       `json:",omitempty"` // overrides the ApiPageSize of the config for this identity when set
+	Recovered             bool      `json:",omitempty"` // re-added by the orphan scan and never loaded since
+	RecoveredAt           time.Time `json:",omitempty"`
+	PendingRemoval        bool      `json:",omitempty"`
+	UnresolvedName        bool      `json:",omitempty"` // the controller did not return a name for the identity
+	Lazy                  bool      `json:",omitempty"` // only connected once one of its hostnames is queried
+	LazyHostnames         []string  `json:",omitempty"` // hostnames of the services seen the last time it was connected
+	LazyState             string    `json:",omitempty"` // idle or active
+	PostConnectCommand    []string  `json:",omitempty"` // reported from the IdentityHooks of the policy, never saved
+	PostDisconnectCommand []string  `json:",omitempty"` // reported from the IdentityHooks of the policy, never saved
+	Schedule              *Schedule `json:",omitempty"` // the identity is only active within the window of the schedule
+	NextTransition        time.Time `json:",omitempty"` // when the schedule next activates or deactivates the identity
+}
+
+// Schedule is a window of local time. the window starts on each of the days, every day when there are none, and
+// runs past midnight when End is before Start
+type Schedule struct {
+	Days  []string `json:",omitempty"` // Monday or Mon
+	Start string   // 08:00
+	End   string   // 17:30
 }
 type Metrics struct {
 	Up   int64
@@ -118,7 +142,7 @@ func (id *Identity) Path() string {
 	if id.FingerPrint == "" {
 		log.Fatalf("fingerprint is invalid for id %s", id.Name)
 	}
-	return config.Path() + id.FingerPrint + ".json"
+	return config.IdentityPath() + id.FingerPrint + ".json"
 }
 
 type TunnelStatus struct {
@@ -130,10 +154,84 @@ type TunnelStatus struct {
 	ServiceVersion        ServiceVersion
 	TunIpv4               string
 	TunIpv4Mask           int
+	StrictTunIpv4Mask     bool   `json:",omitempty"`
+	TunIpConflict         string `json:",omitempty"` // keep, fail or next, when the TUN address is used by another adapter. keep when not set
+	TunAutoRecover        bool   `json:",omitempty"` // recreate the TUN when writes to it keep failing
+	TunCidrRoute          string `json:",omitempty"` // add or skip the route for the TUN cidr, add when not set
+	ServiceCidrRoute      string `json:",omitempty"` // add or skip the route of a service cidr containing the TUN address, add when not set
+	ExistingTunPolicy     string `json:",omitempty"` // recreate or reuse a TUN left by a previous run, recreate when not set
+	SplitTunnel           *bool  `json:",omitempty"` // only traffic for ziti services prefers the TUN, true when not set
+	VerifyRouteRemoval    bool   `json:",omitempty"` // check a removed route is gone and delete it again when it is not
+	OrphanGraceDays       int    `json:",omitempty"`
+	AutoForgetOrphans     bool   `json:",omitempty"`
+	AutoRecoverOrphans    *bool  `json:",omitempty"` // add orphaned identity files back to the config, true when not set
+	DisableNetbios        bool   `json:",omitempty"` // turn netbios off on the TUN interface
 	Status                string
 	AddDns                bool
 	NotificationFrequency int
 	ApiPageSize           int
+	ImportDir             string
+	IdentityDir           string `json:",omitempty"` // folder of the identity files, the config folder when not set
+	StrictIdentityDir     bool   `json:",omitempty"` // refuse an identity folder readable by everyone or the users
+	DnsTtlSeconds         int
+	DnsQueryLogging       bool   `json:",omitempty"`
+	DnsRateLimit          int    `json:",omitempty"` // queries per second from one source, 0 disables the limit
+	DnsRateLimitBurst     int    `json:",omitempty"`
+	DnsFailureMode        string `json:",omitempty"` // empty, forward, nxdomain or servfail for intercepted names which are not answered. unset forwards the types left out of a configured InterceptedDnsTypes
+	MetricsSampleInterval int
+	BatterySampleInterval int `json:",omitempty"` // seconds between metrics broadcasts and samples on battery
+	LatencySampleInterval int `json:",omitempty"` // seconds between latency samples of LatencyMonitors, 0 disables them
+	ReconnectWindow       int `json:",omitempty"` // seconds the reconnects of abandoned identities are spread over
+	ReconnectJitterMs     int `json:",omitempty"`
+	ControllerDialTimeout int
+	BackupRetentionDays   int
+	LogMaxSizeMb          int               `json:",omitempty"` // rotate the log file once it is larger, 0 only rotates it daily
+	LogMaxFiles           int               `json:",omitempty"` // log files kept, the rotation count of the log destination when 0
+	MaxIdentities         int               `json:",omitempty"` // 0 is no limit
+	AllowedControllers    []string          `json:",omitempty"`
+	InterceptedDnsTypes   []string          `json:",omitempty"`
+	Syslog                *SyslogConfig     `json:",omitempty"`
+	LogDestination        *LogDestination   `json:",omitempty"`
+	StaticHostOverrides   map[string]string `json:",omitempty"`
+	LatencyMonitors       []LatencyMonitor  `json:",omitempty"`
+	LoopbackMappings      []LoopbackMapping `json:",omitempty"` // loopback ports forwarded to the intercept of a service
+	DnsSearchDomains      []string          `json:",omitempty"`
+	DnsListenAddresses    []string          `json:",omitempty"` // answered on in addition to the TUN ip, e.g. 127.0.0.53
+	WinsServers           []string          `json:",omitempty"` // set on the TUN interface for netbios name resolution
+	EventQueueCapacity    int
+	LazyIdleTimeout       int                `json:",omitempty"` // minutes without traffic before a lazy identity is disconnected
+	MfaReminderLeadTime   int                `json:",omitempty"` // minutes before the mfa timeout to start reminding, 0 disables the reminders
+	EventQueueLen         int                `json:",omitempty"`
+	EventQueueCap         int                `json:",omitempty"`
+	DnsResponderStats     *DnsResponderStats `json:",omitempty"`
+	TunMarker             *TunMarker         `json:",omitempty"`
+	TunInterface          *TunInterface      `json:",omitempty"`
+	ServiceCidrConflicts  []TunCidrConflict  `json:",omitempty"`
+	DnsDecision           *DnsDecision       `json:",omitempty"`
+	PowerMode             string             `json:",omitempty"` // ac or battery
+	Degraded              bool               `json:",omitempty"`
+	DegradedReason        string             `json:",omitempty"`
+}
+
+// LoopbackMapping forwards connections to 127.0.0.1:Port to the intercepted address of Service
+type LoopbackMapping struct {
+	Port        int
+	Service     string
+	ServicePort int    `json:",omitempty"` // the intercepted port connected to, Port when not set
+	Fingerprint string `json:",omitempty"` // the identity of the service, the first identity providing it when not set
+}
+
+type SyslogConfig struct {
+	Protocol string // udp or tcp
+	Address  string // host:port of the collector
+	Facility int
+}
+
+// LogDestination moves the log file from its default location in the logs folder next to the executable
+type LogDestination struct {
+	Path          string // within the logs folder, a relative path is relative to the logs folder
+	RotationHours int    `json:",omitempty"` // hours between two rotations, 24 when unset
+	RotationCount int    `json:",omitempty"` // rotated files kept, 7 when unset
 }
 
 type ServiceVersion struct {
@@ -147,6 +245,230 @@ type ZitiTunnelStatus struct {
 	Metrics *Metrics      `json:",omitempty"`
 }
 
+type ServiceProbe struct {
+	Fingerprint string
+	ServiceName string
+	Reachable   bool
+	LatencyMs   int64
+	Error       string `json:",omitempty"`
+}
+
+// LatencyMonitor is a service of an identity whose latency is sampled every LatencySampleInterval
+type LatencyMonitor struct {
+	Fingerprint string
+	Service     string
+}
+
+type LatencySample struct {
+	Time      time.Time
+	LatencyMs int64
+	Error     string `json:",omitempty"`
+}
+
+// ClockSkew compares the local clock with the clock of the controller of an identity. a positive skew is a local
+// clock ahead of the controller
+type ClockSkew struct {
+	Fingerprint    string
+	Controller     string
+	LocalTime      time.Time
+	ControllerTime time.Time
+	SkewSeconds    float64
+	Unverified     bool   `json:",omitempty"` // the time was read without verifying the certificate of the controller
+	Warning        string `json:",omitempty"`
+}
+
+type RepairResult struct {
+	Step     string
+	Target   string
+	Ok       bool
+	Repaired bool
+	Error    string `json:",omitempty"`
+}
+
+type DnsResponderStats struct {
+	Count     int64
+	AverageMs float64
+	P99Ms     float64
+}
+
+type IdentityFileCheck struct {
+	File        string
+	Fingerprint string
+	Valid       bool
+	Error       string `json:",omitempty"`
+}
+
+type CleanupResult struct {
+	Step   string
+	Target string `json:",omitempty"`
+	Ok     bool
+	Error  string `json:",omitempty"`
+}
+
+type Interception struct {
+	ServiceName string
+	Hostnames   []string
+	Domains     []string
+	Cidrs       []string
+	Protocols   []string
+	Ports       []PortRange
+}
+
+type DnsOwner struct {
+	Fingerprint string
+	Identity    string
+	Service     string
+}
+
+// DnsCoverage is a hostname or wildcard domain intercepted by the tunnel and who claims it
+type DnsCoverage struct {
+	Name     string
+	Wildcard bool
+	Overlap  bool // claimed by more than one identity
+	Owners   []DnsOwner
+}
+
+type NrptRule struct {
+	Namespace   []string
+	NameServers []string
+}
+
+// EnrollmentTest is the result of authenticating an identity file with its controller without loading it
+type EnrollmentTest struct {
+	Path              string
+	Controller        string
+	ControllerVersion string `json:",omitempty"`
+	Name              string `json:",omitempty"` // the name of the identity as returned by the controller
+	Success           bool
+	Error             string `json:",omitempty"`
+}
+
+// IdentityInventory sorts the identities by whether they are persisted in the config and loaded
+type IdentityInventory struct {
+	Loaded       []InventoryEntry // persisted and loaded
+	NotLoaded    []InventoryEntry // persisted but not loaded, see LastError
+	NotPersisted []InventoryEntry // held by the service but not persisted, which should not happen
+}
+
+type InventoryEntry struct {
+	Fingerprint string
+	Name        string
+	Loaded      bool
+	LastError   string `json:",omitempty"`
+}
+
+// IdentityMetadata is what can be shared about an identity without exposing its key
+type IdentityMetadata struct {
+	Fingerprint string
+	Name        string
+	Controller  string
+	Tags        []string `json:",omitempty"`
+	Active      bool
+	MfaEnabled  bool
+	CertExpiry  *time.Time `json:",omitempty"`
+	Error       string     `json:",omitempty"` // why the controller or the certificate expiry could not be read
+}
+
+// OrphanCandidate is an identity file in the identity folder which no identity of the config refers to
+type OrphanCandidate struct {
+	Fingerprint string
+	Path        string
+	Controller  string
+}
+
+// TunCidrConflict is a cidr intercepted by a service which contains the TUN address
+type TunCidrConflict struct {
+	Fingerprint string
+	Service     string
+	Cidr        string
+}
+
+// IdentityIndexRebuild lists the fingerprints of the identities by what happened to them when the index was rebuilt
+type IdentityIndexRebuild struct {
+	Kept     []string // already loaded, left alone
+	Reloaded []string
+	Missing  []string // in the config but the identity file is gone
+	Dropped  []string // in the index but not in the config
+}
+
+// ConfigPolicy overrides or constrains the user config. fields which are not set leave the user config alone
+type ConfigPolicy struct {
+	AllowedControllers    []string                 `json:",omitempty"` // the user config can only narrow this list
+	NotificationFrequency *int                     `json:",omitempty"` // replaces the configured value
+	MaxIdentities         *int                     `json:",omitempty"` // the configured value can only be lowered
+	LockedSettings        []string                 `json:",omitempty"` // ipc commands refused while the policy is in place, e.g. SetWins
+	IdentityHooks         map[string]IdentityHooks `json:",omitempty"` // by fingerprint. hooks run as SYSTEM so only the policy sets them
+}
+
+// IdentityHooks are the commands run when an identity connects or disconnects, see ConfigPolicy
+type IdentityHooks struct {
+	PostConnectCommand    []string `json:",omitempty"` // program and arguments run each time the identity is loaded
+	PostDisconnectCommand []string `json:",omitempty"` // program and arguments run when the identity is disconnected
+}
+
+// DnsDecision is why dns was or was not applied to the TUN interface when it was created
+type DnsDecision struct {
+	ApplyDns        bool   // AddDns from the config
+	NrptEffective   bool   // result of the nrpt policy test
+	Action          string // applied-interface-dns or relied-on-nrpt
+	InterfaceMetric int    // chosen from the action and SplitTunnel
+}
+
+// NetworkPlan is what the service applies to the system with the current config, see PlanNetworkChanges
+type NetworkPlan struct {
+	TunIpv4          string
+	TunIpv4Mask      int
+	Routes           []PlannedRoute
+	DnsAction        string   // applied-interface-dns or relied-on-nrpt
+	NrptTested       bool     // false when the nrpt policy test has not run yet and the nrpt rules are assumed to be effective
+	DnsServers       []string // set on the TUN interface
+	DnsSearchDomains []string
+	NrptRules        []string // namespaces sent to NrptNameServer
+	NrptNameServer   string
+	InterfaceMetric  int
+	WinsServers      []string
+	DisableNetbios   bool
+}
+
+type PlannedRoute struct {
+	Destination string
+	NextHop     string
+	Metric      int
+	Service     string `json:",omitempty"` // empty for the route of the TUN cidr
+	Fingerprint string `json:",omitempty"`
+}
+
+// ResourceStats is the resource usage of the service process
+type ResourceStats struct {
+	Time            time.Time
+	WorkingSetBytes uint64
+	HeapBytes       uint64 // allocated on the go heap
+	SysBytes        uint64 // obtained from windows by the go runtime
+	Goroutines      int
+	Handles         uint32
+	TunUpRate       int64 // bytes per second summed over the identities
+	TunDownRate     int64
+}
+
+// Warning is a problem the tunneler worked around or could not fix, kept until the warnings are cleared
+type Warning struct {
+	Category string // config, tun, dns or identity
+	Message  string
+	Time     time.Time
+}
+
+type DnsConfig struct {
+	DnsMode   string
+	Servers   []string
+	NrptRules []NrptRule
+}
+
+type SelfTestResult struct {
+	Check  string
+	Passed bool
+	Detail string
+}
+
 type StatusEvent struct {
 	Op string
 }
@@ -156,6 +478,12 @@ type ActionEvent struct {
 	Action string
 }
 
+// EventFilter is written to the events pipe by a consumer which only wants the events of some identities or ops
+type EventFilter struct {
+	Fingerprints []string
+	Ops          []string
+}
+
 type TunnelStatusEvent struct {
 	StatusEvent
 	Status     TunnelStatus
@@ -174,6 +502,48 @@ type BulkServiceEvent struct {
 	RemovedServices []*Service
 }
 
+// DnsReappliedEvent is sent when the dns of the TUN was reset by windows and set back
+type DnsReappliedEvent struct {
+	ActionEvent
+	Found   []string // the dns servers found on the TUN
+	Applied string
+}
+
+// IdentityLoadProgressEvent is sent while the identities are loaded at startup, every time one of them changes state.
+// Done is set on the last event, once every identity is loaded, failed or deferred
+type IdentityLoadProgressEvent struct {
+	ActionEvent
+	Fingerprint string
+	Name        string
+	State       string // loading, loaded, failed or deferred
+	Error       string `json:",omitempty"`
+	Settled     int    // identities which are no longer loading
+	Loaded      int
+	Total       int
+	Done        bool
+}
+
+// KeyRotationEvent is sent when the key of an identity starts being rotated and when the rotation succeeded or failed.
+// NewFingerprint is set once the identity was rotated to a new certificate
+type KeyRotationEvent struct {
+	ActionEvent
+	Fingerprint    string
+	NewFingerprint string `json:",omitempty"`
+	State          string // started, rotated or failed
+	Error          string `json:",omitempty"`
+}
+
+type TunnelDegradedEvent struct {
+	ActionEvent
+	Reason string
+}
+
+type ConfigChangedEvent struct {
+	ActionEvent
+	Fingerprint     string
+	ChangedServices []string
+}
+
 type IdentityEvent struct {
 	ActionEvent
 	Id Identity
@@ -184,6 +554,96 @@ type LogLevelEvent struct {
 	LogLevel string
 }
 
+// ConfigAdjustment is a config value the service changed when it started, and why
+type ConfigAdjustment struct {
+	Field      string
+	Configured interface{}
+	Effective  interface{}
+	Reason     string
+}
+
+// ConfigDifference is one field which differs between two configs. Field is the path of the field, identities are
+// named by fingerprint: Identities[fingerprint].Name
+type ConfigDifference struct {
+	Field string
+	Kind  string      // added, removed, changed or missing when the file does not exist
+	A     interface{} `json:",omitempty"`
+	B     interface{} `json:",omitempty"`
+}
+
+type EffectiveConfig struct {
+	Configured  TunnelStatus // as read from the config when the service started
+	Effective   TunnelStatus
+	Adjustments []ConfigAdjustment
+}
+
+// TunInterface is the live state of the TUN as windows reports it, as opposed to the configured TunIpv4/TunIpv4Mask
+type TunInterface struct {
+	Luid       uint64
+	Index      uint32
+	Alias      string
+	Addresses  []string // cidrs assigned to the interface
+	Mtu        uint32
+	OperStatus string
+	Error      string `json:",omitempty"` // set when part of the state could not be read
+}
+
+// TunMarker records the TUN the service last created so what it left behind after an unclean shutdown can be found
+// without matching every ziti looking route or rule
+type TunMarker struct {
+	Luid uint64
+	Ip   string // next hop of the routes and name server of the nrpt rules
+}
+
+// ControllerMigrationResult is the outcome of moving one identity to a new controller host. NewAddress is empty
+// when the identity did not match and was skipped
+type ControllerMigrationResult struct {
+	Fingerprint string
+	OldAddress  string
+	NewAddress  string
+	Migrated    bool
+	Error       string
+}
+
+type MfaSatisfaction struct {
+	Fingerprint    string
+	Satisfied      bool
+	RenewInSeconds int64 // 0 when the mfa never needs renewing
+}
+
+// MfaDeadline is the identity whose mfa must be renewed first. Fingerprint is empty when no identity needs renewing
+type MfaDeadline struct {
+	Fingerprint      string `json:",omitempty"`
+	Name             string `json:",omitempty"`
+	RemainingSeconds int64  // 0 when the mfa is already needed
+}
+
+// RouteInfo is a route of the TUN. Destination is a cidr
+type RouteInfo struct {
+	Destination string
+	NextHop     string
+	Metric      uint32
+}
+
+type RouteMetricMismatch struct {
+	Destination    string
+	NextHop        string
+	ExpectedMetric uint32
+	ActualMetric   uint32
+}
+
+type RouteDiff struct {
+	Missing          []RouteInfo
+	Extra            []RouteInfo
+	MetricMismatches []RouteMetricMismatch
+}
+
+type MfaReminderEvent struct {
+	ActionEvent
+	Fingerprint      string
+	RemainingSeconds int32
+}
+
 type MfaEvent struct {
 	ActionEvent
 	Fingerprint     string
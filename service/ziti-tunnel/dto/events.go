@@ -26,6 +26,11 @@ const (
 	NORMAL       = "Normal"
 	CONNECTED    = "connected"
 	DISCONNECTED = "disconnected"
+	CONFLICT     = "conflict"
+
+	CONFIG_CHANGED = "config_changed"
+	LOAD_PROGRESS  = "load_progress"
+	KEY_ROTATION   = "key_rotation"
 
 	SERVICE_OP      = "service"
 	BULK_SERVICE_OP = "bulkservice"
@@ -34,6 +39,7 @@ const (
 	FEEDBACK_OP     = "CaptureLogs"
 	MFA_OP          = "mfa"
 	CONTROLLER_OP	= "controller"
+	TUNNEL_OP       = "tunnel"
 
 	MFAEnrollmentChallengAtion      = "enrollment_challenge"
 	MFAEnrollmentVerificationAction = "enrollment_verification"
@@ -41,6 +47,11 @@ const (
 
 	MFA_AUTH_CHALLENGE_ACTION = "auth_challenge"
 	MFAAuthenticationAction   = "mfa_auth_status"
+	MFA_REMINDER_ACTION       = "reminder"
+
+	DRIVER_MISSING_ACTION    = "driver_missing"
+	TUN_WRITE_FAILING_ACTION = "write_failing"
+	TUN_DNS_REAPPLIED_ACTION = "dns_reapplied"
 )
 
 var SERVICE_ADDED = ActionEvent{
@@ -72,6 +83,22 @@ var IDENTITY_DISCONNECTED = ActionEvent{
 	StatusEvent: StatusEvent{Op: IDENTITY_OP},
 	Action:      DISCONNECTED,
 }
+var IDENTITY_CONFLICT = ActionEvent{
+	StatusEvent: StatusEvent{Op: IDENTITY_OP},
+	Action:      CONFLICT,
+}
+var IDENTITY_CONFIG_CHANGED = ActionEvent{
+	StatusEvent: StatusEvent{Op: IDENTITY_OP},
+	Action:      CONFIG_CHANGED,
+}
+var IDENTITY_LOAD_PROGRESS = ActionEvent{
+	StatusEvent: StatusEvent{Op: IDENTITY_OP},
+	Action:      LOAD_PROGRESS,
+}
+var IDENTITY_KEY_ROTATION = ActionEvent{
+	StatusEvent: StatusEvent{Op: IDENTITY_OP},
+	Action:      KEY_ROTATION,
+}
 var LOGLEVEL_CHANGED = ActionEvent{
 	StatusEvent: StatusEvent{Op: LOGLEVEL_OP},
 	Action:      CHANGED,
@@ -113,6 +140,11 @@ var MFAAuthenticationEvent = ActionEvent{
 	Action:      MFAAuthenticationAction,
 }
 
+var MFAReminderEvent = ActionEvent{
+	StatusEvent: StatusEvent{Op: MFA_OP},
+	Action:      MFA_REMINDER_ACTION,
+}
+
 var CONTROLLER_CONNECTED = ActionEvent{
 	StatusEvent: StatusEvent{Op: CONTROLLER_OP},
 	Action:		 CONNECTED,
@@ -121,3 +153,18 @@ var CONTROLLER_DISCONNECTED = ActionEvent{
 	StatusEvent: StatusEvent{Op: CONTROLLER_OP},
 	Action:		 DISCONNECTED,
 }
+
+var WINTUN_DRIVER_MISSING = ActionEvent{
+	StatusEvent: StatusEvent{Op: TUNNEL_OP},
+	Action:      DRIVER_MISSING_ACTION,
+}
+
+var TUN_WRITE_FAILING = ActionEvent{
+	StatusEvent: StatusEvent{Op: TUNNEL_OP},
+	Action:      TUN_WRITE_FAILING_ACTION,
+}
+
+var TUN_DNS_REAPPLIED = ActionEvent{
+	StatusEvent: StatusEvent{Op: TUNNEL_OP},
+	Action:      TUN_DNS_REAPPLIED_ACTION,
+}
@@ -103,6 +103,21 @@ func main() {
 		err = service.ControlService(svc.Continue, svc.Running)
 	case "version":
 		fmt.Println(version())
+	case "selftest":
+		logging.InitLogger(logrus.WarnLevel)
+		results, passed := service.SelfTest()
+		for _, r := range results {
+			status := "PASS"
+			if !r.Passed {
+				status = "FAIL"
+			}
+			fmt.Printf("%s  %-12s %s\n", status, r.Check, r.Detail)
+		}
+		if !passed {
+			fmt.Println("self test failed")
+			os.Exit(1)
+		}
+		fmt.Println("self test passed")
 	case "list":
 		commandline.Execute()
 	case "identity":
@@ -128,7 +143,7 @@ func usage(errmsg string) {
 		"%s\n\n"+
 			"usage: %s <command>\n"+
 			"       where <command> is one of\n"+
-			"       install, remove, debug, start, stop, pause, continue, list, identity, loglevel, feedback, config or version.\n",
+			"       install, remove, debug, start, stop, pause, continue, list, identity, loglevel, feedback, config, selftest or version.\n",
 		errmsg, os.Args[0])
 	os.Exit(2)
 }
@@ -0,0 +1,109 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CheckClockSkew compares the local clock with the Date header of the controller of the identity. the time the
+// request took is split in half to estimate when the controller stamped the response. a skew larger than
+// MaxClockSkew, or one that puts the certificate of the identity outside of its validity, is reported as a warning
+func (t *RuntimeState) CheckClockSkew(fingerprint string) (dto.ClockSkew, error) {
+	id := t.Find(fingerprint)
+	if id == nil {
+		return dto.ClockSkew{}, fmt.Errorf("%w: %s", ErrIdentityNotFound, fingerprint)
+	}
+	cfg := idcfg.Config{}
+	if err := probeIdentityFile(id.Path(), &cfg); err != nil {
+		return dto.ClockSkew{}, fmt.Errorf("could not read identity file %s: %v", id.Path(), err)
+	}
+	if err := t.controllerAllowed(cfg.ZtAPI); err != nil {
+		return dto.ClockSkew{}, err
+	}
+	sdkId, err := identity.LoadIdentity(cfg.ID)
+	if err != nil {
+		return dto.ClockSkew{}, fmt.Errorf("the certificate or key of the identity cannot be used: %v", err)
+	}
+
+	result := dto.ClockSkew{Fingerprint: fingerprint, Controller: cfg.ZtAPI}
+	client := controllerClient(sdkId)
+	defer client.CloseIdleConnections()
+	controllerTime, local, err := controllerDate(client, strings.TrimRight(cfg.ZtAPI, "/")+"/version")
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) && invalid.Reason == x509.Expired {
+		// the certificate of the controller looks expired or not yet valid, which is what a skewed clock does. the
+		// time is read again without verifying the controller, it is only reported and never trusted
+		log.Warnf("the certificate of controller %s is outside of its validity, reading its time without verifying it: %v", cfg.ZtAPI, err)
+		insecure := &http.Client{Timeout: client.Timeout, Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			DialContext:     controllerDialer().DialContext,
+		}}
+		defer insecure.CloseIdleConnections()
+		result.Unverified = true
+		controllerTime, local, err = controllerDate(insecure, strings.TrimRight(cfg.ZtAPI, "/")+"/version")
+	}
+	if err != nil {
+		return result, fmt.Errorf("could not read the time of the controller: %v", err)
+	}
+
+	result.LocalTime = local.UTC()
+	result.ControllerTime = controllerTime.UTC()
+	skew := local.Sub(controllerTime)
+	result.SkewSeconds = skew.Seconds()
+
+	leaf := sdkId.Cert().Leaf
+	switch {
+	case leaf != nil && controllerTime.Before(leaf.NotBefore):
+		result.Warning = fmt.Sprintf("the certificate of the identity is not valid before %v, the controller time is %v", leaf.NotBefore.UTC(), result.ControllerTime)
+	case leaf != nil && local.Before(leaf.NotBefore):
+		result.Warning = fmt.Sprintf("the certificate of the identity is not valid before %v, the local time is %v", leaf.NotBefore.UTC(), result.LocalTime)
+	case skew > constants.MaxClockSkew*time.Second || skew < -constants.MaxClockSkew*time.Second:
+		result.Warning = fmt.Sprintf("the local clock is %v off the clock of the controller, more than the %d seconds allowed", skew.Round(time.Second), constants.MaxClockSkew)
+	}
+	if result.Warning != "" {
+		log.Warn(recordWarning(WarningIdentity, "clock skew check of identity %s: %s", fingerprint, result.Warning))
+	}
+	return result, nil
+}
+
+// controllerDate returns the Date header of the response from url and the local time halfway through the request
+func controllerDate(client *http.Client, url string) (time.Time, time.Time, error) {
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	_ = resp.Body.Close()
+	local := start.Add(time.Since(start) / 2)
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("the controller did not send a valid Date header: %v", err)
+	}
+	return date, local, nil
+}
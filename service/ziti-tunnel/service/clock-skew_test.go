@@ -0,0 +1,92 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckClockSkew(t *testing.T) {
+	tests := []struct {
+		name        string
+		offset      time.Duration // added to the local time to get the time of the controller
+		wantSkew    float64
+		wantWarning bool
+	}{
+		{"in sync", 0, 0, false},
+		{"within the allowed skew", -2 * time.Minute, 120, false},
+		{"controller ahead", 10 * time.Minute, -600, true},
+		{"before the certificate is valid", -2 * time.Hour, 7200, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempConfigDir(t)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Date", time.Now().Add(tt.offset).UTC().Format(http.TimeFormat))
+			}))
+			defer srv.Close()
+			savedClient, savedWarnings := controllerClient, warnings
+			defer func() { controllerClient, warnings = savedClient, savedWarnings }()
+			controllerClient = func(identity.Identity) *http.Client { return srv.Client() }
+			warnings = &warningCollector{max: 10}
+
+			key, cert, fingerprint := testIdentityPem(t)
+			id := &Id{Identity: dto.Identity{FingerPrint: fingerprint, Name: "skewed"}}
+			data, err := json.Marshal(idcfg.Config{ZtAPI: srv.URL, ID: identity.IdentityConfig{Key: key, Cert: cert}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(id.Path(), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			rt := &RuntimeState{ids: map[string]*Id{fingerprint: id}, state: &dto.TunnelStatus{}}
+
+			got, err := rt.CheckClockSkew(fingerprint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Controller != srv.URL || got.Unverified {
+				t.Errorf("CheckClockSkew() = %+v", got)
+			}
+			// the Date header only has a precision of a second
+			if math.Abs(got.SkewSeconds-tt.wantSkew) > 2 {
+				t.Errorf("SkewSeconds = %f, want about %f", got.SkewSeconds, tt.wantSkew)
+			}
+			if (got.Warning != "") != tt.wantWarning {
+				t.Errorf("Warning = %q, want a warning %t", got.Warning, tt.wantWarning)
+			}
+			if recorded := len(rt.Warnings()); (recorded == 1) != tt.wantWarning {
+				t.Errorf("%d warnings recorded, want a warning %t", recorded, tt.wantWarning)
+			}
+		})
+	}
+
+	if _, err := (&RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{}}).CheckClockSkew("unknown"); !errors.Is(err, ErrIdentityNotFound) {
+		t.Errorf("CheckClockSkew() of an unknown identity error = %v, want %v", err, ErrIdentityNotFound)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// splitCombinedIdentities splits the files of the folder which hold a json array of identity configs into one file
+// per fingerprint and returns the fingerprints written. entries which are not a valid identity are logged and
+// skipped. the combined file is renamed to .split afterwards so it is not split again, unless limitReached refused
+// one of its entries. limitReached is given the number of identities split so far
+func splitCombinedIdentities(folder string, limitReached func(pending int) error) map[string]bool {
+	split := make(map[string]bool)
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		log.Warnf("could not read the identity folder %s: %v", folder, err)
+		return split
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		combined := path.Join(folder, f.Name())
+		entries, err := readCombinedIdentities(combined)
+		if err != nil {
+			log.Warnf("could not read the combined identity file %s: %v", combined, err)
+			continue
+		}
+		if entries == nil {
+			continue //a single identity or another json file, handled as before
+		}
+		log.Infof("splitting %d identities from combined identity file %s", len(entries), combined)
+		refused := false
+		for i, entry := range entries {
+			if err = limitReached(len(split)); err != nil {
+				log.Warn(recordWarning(WarningIdentity, "not splitting entry %d of combined identity file %s: %v", i, combined, err))
+				refused = true
+				continue
+			}
+			fingerprint, err := splitIdentity(folder, entry)
+			if err != nil {
+				log.Warn(recordWarning(WarningIdentity, "skipping entry %d of combined identity file %s: %v", i, combined, err))
+				continue
+			}
+			split[fingerprint] = true
+			log.Infof("identity %s split from combined identity file %s", fingerprint, combined)
+		}
+		if refused {
+			log.Warnf("the combined identity file %s is kept so the refused entries are split once identities are removed", combined)
+			continue
+		}
+		if err = os.Rename(combined, combined+".split"); err != nil {
+			log.Errorf("could not move the combined identity file %s aside: %v", combined, err)
+		}
+	}
+	return split
+}
+
+// readCombinedIdentities returns the entries of the file when it holds a json array. nil is returned for any other
+// json file
+func readCombinedIdentities(filename string) ([]json.RawMessage, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(bytes.TrimPrefix(data, utf8Bom))
+	if len(data) == 0 || data[0] != '[' {
+		return nil, nil
+	}
+	entries := make([]json.RawMessage, 0)
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// splitIdentity writes one entry of a combined identity file to the file of its fingerprint
+func splitIdentity(folder string, entry json.RawMessage) (string, error) {
+	cfg := idcfg.Config{}
+	if err := json.Unmarshal(entry, &cfg); err != nil {
+		return "", fmt.Errorf("not an identity config: %v", err)
+	}
+	if strings.TrimSpace(cfg.ID.Key) == "" {
+		return "", fmt.Errorf("the identity config has no key")
+	}
+	sdkId, err := identity.LoadIdentity(cfg.ID)
+	if err != nil {
+		return "", fmt.Errorf("could not load the identity: %v", err)
+	}
+	fingerprint, err := fingerprintOf(sdkId)
+	if err != nil {
+		return "", err
+	}
+	target := path.Join(folder, fingerprint+".json")
+	if _, err = os.Stat(target); err == nil {
+		return "", fmt.Errorf("identity %s already exists", fingerprint)
+	}
+	if err = writeIdentityFile(target, cfg); err != nil {
+		return "", err
+	}
+	return fingerprint, nil
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadCombinedIdentities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "combined-identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name        string
+		data        string
+		wantEntries int
+		wantNil     bool
+		wantErr     bool
+	}{
+		{"array", `[{"id":{}},{"id":{}}]`, 2, false, false},
+		{"byte order mark and whitespace", "\xEF\xBB\xBF \r\n[{}]", 1, false, false},
+		{"empty array", `[]`, 0, false, false},
+		{"single identity", `{"ztAPI":"https://ctrl:1280"}`, 0, true, false},
+		{"empty file", ``, 0, true, false},
+		{"malformed array", `[{"id":`, 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "combined.json")
+			if err := ioutil.WriteFile(file, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readCombinedIdentities(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readCombinedIdentities() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (entries == nil) != tt.wantNil || len(entries) != tt.wantEntries {
+				t.Errorf("got %d entries (nil %t), want %d (nil %t)", len(entries), entries == nil, tt.wantEntries, tt.wantNil)
+			}
+		})
+	}
+
+	if _, err := readCombinedIdentities(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("readCombinedIdentities() of a missing file returned no error")
+	}
+}
+
+func TestSplitCombinedIdentitiesLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    error
+		wantKept bool
+	}{
+		{"no limit", nil, false},
+		{"limit reached", errors.New("no more than 1 identities can be added"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "split-limit")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			combined := filepath.Join(dir, "combined.json")
+			// entries without a key are skipped, which is enough to see if the file is moved aside
+			if err := ioutil.WriteFile(combined, []byte(`[{"id":{}}]`), 0600); err != nil {
+				t.Fatal(err)
+			}
+			pending := -1
+			split := splitCombinedIdentities(dir, func(n int) error {
+				pending = n
+				return tt.limit
+			})
+			if len(split) != 0 || pending != 0 {
+				t.Errorf("got %d identities split and pending %d, want none and 0", len(split), pending)
+			}
+			_, err = os.Stat(combined)
+			if kept := err == nil; kept != tt.wantKept {
+				t.Errorf("combined file kept = %t, want %t", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestIdentityLimitReachedWith(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		ids      int
+		inConfig int
+		pending  int
+		wantErr  bool
+	}{
+		{"no limit", 0, 5, 5, 5, false},
+		{"below the limit", 3, 1, 1, 1, false},
+		{"loaded identities reach the limit", 2, 2, 0, 0, true},
+		{"identities of the config reach the limit", 2, 0, 2, 0, true},
+		{"pending identities reach the limit", 2, 0, 1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RuntimeState{state: &dto.TunnelStatus{MaxIdentities: tt.max}, ids: make(map[string]*Id)}
+			for i := 0; i < tt.ids; i++ {
+				r.ids[string(rune('a'+i))] = &Id{}
+			}
+			for i := 0; i < tt.inConfig; i++ {
+				r.state.Identities = append(r.state.Identities, &dto.Identity{})
+			}
+			if err := r.identityLimitReachedWith(tt.pending); (err != nil) != tt.wantErr {
+				t.Errorf("identityLimitReachedWith() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScanSplitsCombinedIdentities(t *testing.T) {
+	dir := useTempConfigDir(t)
+	useMemoryStateStore(t)
+	savedWarnings := warnings
+	defer func() { warnings = savedWarnings }()
+	warnings = &warningCollector{max: 10}
+
+	entries := make([]json.RawMessage, 0, 3)
+	fingerprints := make([]string, 0, 2)
+	for i := 0; i < 2; i++ {
+		key, cert, fingerprint := testIdentityPem(t)
+		entry, err := json.Marshal(idcfg.Config{ZtAPI: "https://ctrl:1280", ID: identity.IdentityConfig{Key: key, Cert: cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	entries = append(entries, json.RawMessage(`{"ztAPI":"https://ctrl:1280","id":{"key":"pem:not a key"}}`))
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	combined := filepath.Join(dir, "combined.json")
+	if err = ioutil.WriteFile(combined, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	rt := &RuntimeState{state: &dto.TunnelStatus{}, ids: make(map[string]*Id)}
+
+	rt.scanForOrphanedIdentities(dir)
+
+	for _, fingerprint := range fingerprints {
+		var cfg idcfg.Config
+		if err := probeIdentityFile(filepath.Join(dir, fingerprint+".json"), &cfg); err != nil || cfg.ZtAPI != "https://ctrl:1280" {
+			t.Errorf("%s.json ztAPI = %s (%v), want https://ctrl:1280", fingerprint, cfg.ZtAPI, err)
+		}
+	}
+	loaded := make(map[string]bool)
+	for _, id := range rt.state.Identities {
+		if !id.Active || id.Recovered || id.Status != STATUS_ENROLLED {
+			t.Errorf("split identity %s added as %+v, want active and enrolled", id.FingerPrint, id)
+		}
+		loaded[id.FingerPrint] = true
+	}
+	if len(loaded) != 2 || !loaded[fingerprints[0]] || !loaded[fingerprints[1]] {
+		t.Errorf("identities added = %v, want %v", loaded, fingerprints)
+	}
+
+	if _, err := os.Stat(combined); !os.IsNotExist(err) {
+		t.Errorf("the combined file is still there: %v", err)
+	}
+	split, err := ioutil.ReadFile(combined + ".split")
+	if err != nil || string(split) != string(data) {
+		t.Errorf("combined.json.split = %q (%v), want the combined file", split, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		names := make([]string, 0, len(files))
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("files = %v, want the two identities and combined.json.split", names)
+	}
+	if got := rt.Warnings(); len(got) != 1 || !strings.Contains(got[0].Message, "entry 2") {
+		t.Errorf("warnings = %+v, want one for the invalid entry", got)
+	}
+}
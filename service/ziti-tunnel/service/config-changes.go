@@ -0,0 +1,149 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/windns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var configChanges = &configChangeDebouncer{
+	pending: make(map[string]*pendingConfigChange),
+	delay:   constants.ConfigChangeDebounce * time.Second,
+	apply:   applyConfigChange,
+}
+
+// configChangeDebouncer collects the service config changes pushed by a controller so a burst of changes for an
+// identity is applied and announced once
+type configChangeDebouncer struct {
+	sync.Mutex
+	pending map[string]*pendingConfigChange
+	delay   time.Duration
+	apply   func(fingerprint string, p *pendingConfigChange)
+}
+
+type pendingConfigChange struct {
+	timer      *time.Timer
+	generation int // the timer which is allowed to apply the change, a stopped timer may already be running
+	services   map[string]bool
+	hostnames  map[string]bool
+	routes     map[string]net.IPNet
+	tunIpv4    string
+}
+
+func (d *configChangeDebouncer) signal(sc cziti.BulkServiceChange) {
+	d.Lock()
+	defer d.Unlock()
+	p, found := d.pending[sc.Fingerprint]
+	if !found {
+		p = &pendingConfigChange{services: make(map[string]bool), hostnames: make(map[string]bool), routes: make(map[string]net.IPNet)}
+		d.pending[sc.Fingerprint] = p
+	}
+	for _, name := range sc.ChangedServices {
+		p.services[name] = true
+	}
+	for _, svc := range sc.ServicesToAdd {
+		if !p.services[svc.Name] {
+			continue
+		}
+		for _, addr := range svc.Addresses {
+			if addr.IsHost {
+				p.hostnames[addr.HostName] = true
+			} else if cidr := serviceCidr(addr); cidr != nil {
+				p.routes[cidr.String()] = *cidr
+			}
+		}
+	}
+	// read here, the timer runs on its own goroutine
+	p.tunIpv4 = rts.state.TunIpv4
+
+	if found {
+		p.timer.Stop()
+	}
+	p.generation++
+	fingerprint, generation := sc.Fingerprint, p.generation
+	p.timer = time.AfterFunc(d.delay, func() {
+		d.Lock()
+		if d.pending[fingerprint] != p || p.generation != generation {
+			d.Unlock()
+			return
+		}
+		delete(d.pending, fingerprint)
+		d.Unlock()
+		d.apply(fingerprint, p)
+	})
+}
+
+// applyConfigChange makes sure the hostnames and cidrs of the changed services are still intercepted once the
+// remove/add done for each change is over, adding only the nrpt rules and routes which went missing, and tells the
+// consumers which services changed
+func applyConfigChange(fingerprint string, p *pendingConfigChange) {
+	if len(p.hostnames) > 0 {
+		rules, err := windns.GetNrptRules()
+		if err != nil {
+			log.Warnf("could not list the nrpt rules, adding the rules of the changed services again: %v", err)
+		}
+		windns.AddNrptRules(missingNrptHostnames(p.hostnames, rules), p.tunIpv4)
+	}
+	if nextHop := net.ParseIP(p.tunIpv4); nextHop != nil && rts.tun != nil {
+		for _, cidr := range p.routes {
+			if rts.hasRoute(cidr, nextHop) {
+				continue
+			}
+			if err := rts.AddRoute(cidr, nextHop, 1); err != nil {
+				log.Warnf("could not add the route %s of a changed service: %v", cidr.String(), err)
+			}
+		}
+	}
+
+	services := make([]string, 0, len(p.services))
+	for name := range p.services {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	log.Infof("applied controller config changes for identity %s. changed services: %v", fingerprint, services)
+	rts.BroadcastEvent(dto.ConfigChangedEvent{
+		ActionEvent:     dto.IDENTITY_CONFIG_CHANGED,
+		Fingerprint:     fingerprint,
+		ChangedServices: services,
+	})
+}
+
+// missingNrptHostnames returns the hostnames which have no nrpt rule
+func missingNrptHostnames(hostnames map[string]bool, rules []dto.NrptRule) map[string]bool {
+	existing := make(map[string]bool)
+	for _, r := range rules {
+		for _, ns := range r.Namespace {
+			existing[strings.ToLower(strings.TrimPrefix(ns, "."))] = true
+		}
+	}
+	missing := make(map[string]bool)
+	for h := range hostnames {
+		if !existing[strings.ToLower(strings.TrimPrefix(h, "."))] {
+			missing[h] = true
+		}
+	}
+	return missing
+}
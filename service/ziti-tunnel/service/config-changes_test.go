@@ -0,0 +1,105 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+func TestConfigChangeDebounce(t *testing.T) {
+	saved := rts.state
+	defer func() { rts.state = saved }()
+	rts.state = &dto.TunnelStatus{TunIpv4: "100.64.0.1"}
+
+	var lock sync.Mutex
+	applied := make([]*pendingConfigChange, 0)
+	done := make(chan struct{}, 10)
+	d := &configChangeDebouncer{
+		pending: make(map[string]*pendingConfigChange),
+		delay:   50 * time.Millisecond,
+		apply: func(fingerprint string, p *pendingConfigChange) {
+			lock.Lock()
+			applied = append(applied, p)
+			lock.Unlock()
+			done <- struct{}{}
+		},
+	}
+	change := func(name string, addr dto.Address) cziti.BulkServiceChange {
+		return cziti.BulkServiceChange{
+			Fingerprint:     "fp",
+			ChangedServices: []string{name},
+			ServicesToAdd:   []*dto.Service{{Name: name, Addresses: []dto.Address{addr}}},
+		}
+	}
+	d.signal(change("web", dto.Address{IsHost: true, HostName: "web.ziti"}))
+	d.signal(change("db", dto.Address{IP: "10.1.0.0", Prefix: 16}))
+	d.signal(change("web", dto.Address{IsHost: true, HostName: "web.ziti"}))
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the change was not applied")
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(applied) != 1 {
+		t.Fatalf("applied %d times, want once", len(applied))
+	}
+	p := applied[0]
+	if !reflect.DeepEqual(p.services, map[string]bool{"web": true, "db": true}) {
+		t.Errorf("services %v, want web and db", p.services)
+	}
+	if !reflect.DeepEqual(p.hostnames, map[string]bool{"web.ziti": true}) {
+		t.Errorf("hostnames %v, want web.ziti", p.hostnames)
+	}
+	if _, ok := p.routes["10.1.0.0/16"]; !ok || len(p.routes) != 1 {
+		t.Errorf("routes %v, want 10.1.0.0/16", p.routes)
+	}
+	if p.tunIpv4 != "100.64.0.1" {
+		t.Errorf("the TUN address %s was not taken when signalled", p.tunIpv4)
+	}
+}
+
+func TestMissingNrptHostnames(t *testing.T) {
+	rules := []dto.NrptRule{{Namespace: []string{"web.ziti", ".DB.ziti"}}}
+	tests := []struct {
+		name      string
+		rules     []dto.NrptRule
+		hostnames map[string]bool
+		want      map[string]bool
+	}{
+		{"all have a rule", rules, map[string]bool{"web.ziti": true, "db.ziti": true}, map[string]bool{}},
+		{"one is missing", rules, map[string]bool{"web.ziti": true, "new.ziti": true}, map[string]bool{"new.ziti": true}},
+		{"the rules could not be listed", nil, map[string]bool{"web.ziti": true}, map[string]bool{"web.ziti": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingNrptHostnames(tt.hostnames, tt.rules); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingNrptHostnames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
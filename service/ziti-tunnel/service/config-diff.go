@@ -0,0 +1,119 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"os"
+	"reflect"
+)
+
+// the kinds of ConfigDifference
+const (
+	ConfigDiffAdded   = "added"   // only in the second config
+	ConfigDiffRemoved = "removed" // only in the first config
+	ConfigDiffChanged = "changed"
+	ConfigDiffMissing = "missing" // the file does not exist and is compared as an empty config
+)
+
+// identity fields never compared, the keys of an identity must not end up in a diff
+var diffIgnoredIdentityFields = map[string]bool{"Config": true}
+
+// DiffConfigs compares the config files a and b field by field. the values canonicalStatus drops for the config hash
+// are ignored, identities are matched by fingerprint. a file which does not exist is compared as an empty config
+func DiffConfigs(a string, b string) ([]dto.ConfigDifference, error) {
+	diffs := make([]dto.ConfigDifference, 0)
+	statuses := make([]dto.TunnelStatus, 2)
+	for i, f := range []string{a, b} {
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			diffs = append(diffs, dto.ConfigDifference{Field: f, Kind: ConfigDiffMissing})
+		}
+		s, err := readConfig(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", f, err)
+		}
+		statuses[i] = canonicalStatus(*s)
+	}
+
+	diffs = append(diffs, diffFields("", statuses[0], statuses[1], map[string]bool{"Identities": true})...)
+	return append(diffs, diffIdentities(statuses[0].Identities, statuses[1].Identities)...), nil
+}
+
+// diffIdentities lists the identities only in one of the lists and the fields which differ for the others. both lists
+// are sorted by fingerprint
+func diffIdentities(a []*dto.Identity, b []*dto.Identity) []dto.ConfigDifference {
+	diffs := make([]dto.ConfigDifference, 0)
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].FingerPrint < b[j].FingerPrint):
+			diffs = append(diffs, dto.ConfigDifference{Field: identityField(a[i], ""), Kind: ConfigDiffRemoved, A: a[i].Name})
+			i++
+		case i == len(a) || b[j].FingerPrint < a[i].FingerPrint:
+			diffs = append(diffs, dto.ConfigDifference{Field: identityField(b[j], ""), Kind: ConfigDiffAdded, B: b[j].Name})
+			j++
+		default:
+			diffs = append(diffs, diffFields(identityField(a[i], "."), *a[i], *b[j], diffIgnoredIdentityFields)...)
+			i++
+			j++
+		}
+	}
+	return diffs
+}
+
+func identityField(id *dto.Identity, suffix string) string {
+	return fmt.Sprintf("Identities[%s]%s", id.FingerPrint, suffix)
+}
+
+// diffFields compares the exported fields of two values of the same struct type. fields whose json is the same, or
+// which are both empty, are equal
+func diffFields(prefix string, a interface{}, b interface{}, ignored map[string]bool) []dto.ConfigDifference {
+	diffs := make([]dto.ConfigDifference, 0)
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for f := 0; f < va.NumField(); f++ {
+		field := va.Type().Field(f)
+		if field.PkgPath != "" || ignored[field.Name] {
+			continue
+		}
+		fa, fb := va.Field(f).Interface(), vb.Field(f).Interface()
+		ja, _ := json.Marshal(fa)
+		jb, _ := json.Marshal(fb)
+		if bytes.Equal(ja, jb) || (emptyJson(ja) && emptyJson(jb)) {
+			continue
+		}
+		diff := dto.ConfigDifference{Field: prefix + field.Name, Kind: ConfigDiffChanged, A: fa, B: fb}
+		if emptyJson(ja) {
+			diff.Kind, diff.A = ConfigDiffAdded, nil
+		} else if emptyJson(jb) {
+			diff.Kind, diff.B = ConfigDiffRemoved, nil
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+func emptyJson(b []byte) bool {
+	switch string(b) {
+	case "null", "[]", "{}", `""`:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := write("a.json", `{"TunIpv4":"100.64.0.1","Duration":5,"DnsTtlSeconds":30,"Identities":[
+		{"FingerPrint":"bb","Name":"b","Active":true,"Config":{"ztAPI":"https://a:1280"}},
+		{"FingerPrint":"aa","Name":"a"}]}`)
+	b := write("b.json", `{"TunIpv4":"100.64.0.2","Duration":9,"DnsTtlSeconds":30,"ImportDir":"C:\\import","Identities":[
+		{"FingerPrint":"cc","Name":"c"},
+		{"FingerPrint":"bb","Name":"b","Active":false,"Config":{"ztAPI":"https://b:1280"}}]}`)
+
+	tests := []struct {
+		name string
+		a, b string
+		want map[string]string
+	}{
+		{"same file", a, a, map[string]string{}},
+		{"different files", a, b, map[string]string{
+			"TunIpv4":               ConfigDiffChanged,
+			"ImportDir":             ConfigDiffAdded,
+			"Identities[aa]":        ConfigDiffRemoved,
+			"Identities[bb].Active": ConfigDiffChanged,
+			"Identities[cc]":        ConfigDiffAdded,
+		}},
+		{"missing file", b, filepath.Join(dir, "missing.json"), map[string]string{
+			filepath.Join(dir, "missing.json"): ConfigDiffMissing,
+			"TunIpv4":                          ConfigDiffRemoved,
+			"DnsTtlSeconds":                    ConfigDiffRemoved,
+			"ImportDir":                        ConfigDiffRemoved,
+			"Identities[bb]":                   ConfigDiffRemoved,
+			"Identities[cc]":                   ConfigDiffRemoved,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs, err := DiffConfigs(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string, len(diffs))
+			for _, d := range diffs {
+				got[d.Field] = d.Kind
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffConfigs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"os"
+	"sync"
+)
+
+// ConfigDirError is returned by EnsureConfigDir when the config folder could not be created or secured
+type ConfigDirError struct {
+	Path string
+	Op   string
+	Err  error
+}
+
+func (e *ConfigDirError) Error() string {
+	return fmt.Sprintf("could not %s the config folder %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *ConfigDirError) Unwrap() error {
+	return e.Err
+}
+
+var configDirLock sync.Mutex
+
+// EnsureConfigDir creates the config folder, readable only by SYSTEM and the administrators, when it does not exist.
+// it is checked on every call so a folder which could not be created before, or was removed since, is created now.
+// the lock keeps two callers from creating it at the same time
+func EnsureConfigDir() error {
+	configDirLock.Lock()
+	defer configDirLock.Unlock()
+	return ensureConfigDir(config.Path())
+}
+
+func ensureConfigDir(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return &ConfigDirError{Path: path, Op: "use", Err: fmt.Errorf("it is not a folder")}
+		}
+		// an existing folder is left as it is, VerifyAndRepair reports and fixes its permissions
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return &ConfigDirError{Path: path, Op: "read", Err: err}
+	}
+
+	log.Infof("creating the config folder %s", path)
+	if err = os.MkdirAll(path, 0700); err != nil {
+		return &ConfigDirError{Path: path, Op: "create", Err: err}
+	}
+	if err = applySddl(path, secureFolderSddl); err != nil {
+		return &ConfigDirError{Path: path, Op: "secure", Err: err}
+	}
+	return nil
+}
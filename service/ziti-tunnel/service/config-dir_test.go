@@ -0,0 +1,62 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureConfigDirExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "not-a-folder")
+	if err = ioutil.WriteFile(file, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		wantOp string
+	}{
+		{"existing folder", dir, ""},
+		{"a file", file, "use"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ensureConfigDir(tt.path)
+			if tt.wantOp == "" {
+				if err != nil {
+					t.Errorf("ensureConfigDir(%s) error = %v", tt.path, err)
+				}
+				return
+			}
+			var dirErr *ConfigDirError
+			if !errors.As(err, &dirErr) || dirErr.Op != tt.wantOp {
+				t.Errorf("ensureConfigDir(%s) error = %v, want the %s op to fail", tt.path, err, tt.wantOp)
+			}
+		})
+	}
+}
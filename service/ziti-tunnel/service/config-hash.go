@@ -0,0 +1,96 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"sort"
+	"time"
+)
+
+// ConfigHash returns a SHA-256 of the configuration the tunnel is running with. values which change while the
+// tunnel runs (uptime, metrics, mfa timers, service lists...) are left out and the identities and lists are sorted
+// so two machines configured the same way produce the same hash no matter the order things were added in
+func (t *RuntimeState) ConfigHash() (string, error) {
+	b, err := json.Marshal(canonicalStatus(t.ToStatus(false)))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func canonicalStatus(s dto.TunnelStatus) dto.TunnelStatus {
+	s.Active = false // true while the TUN is up
+	s.Duration = 0
+	s.DnsResponderStats = nil
+	s.EventQueueLen = 0
+	s.EventQueueCap = 0
+	s.TunMarker = nil
+	s.Degraded = false
+	s.DegradedReason = ""
+
+	s.AllowedControllers = sortedCopy(s.AllowedControllers)
+	s.InterceptedDnsTypes = sortedCopy(s.InterceptedDnsTypes)
+	s.DnsSearchDomains = sortedCopy(s.DnsSearchDomains)
+	s.DnsListenAddresses = sortedCopy(s.DnsListenAddresses)
+	// StaticHostOverrides is a map, json.Marshal already writes the keys in sorted order
+
+	ids := make([]*dto.Identity, 0, len(s.Identities))
+	for _, id := range s.Identities {
+		if id == nil {
+			continue
+		}
+		c := *id
+		c.ControllerVersion = ""
+		c.Status = ""
+		c.MfaNeeded = false
+		c.Services = nil
+		c.Metrics = nil
+		c.MfaMinTimeoutRem = 0
+		c.MfaMaxTimeoutRem = 0
+		c.MfaLastUpdatedTime = time.Time{}
+		c.ServiceUpdatedTime = time.Time{}
+		c.Notified = false
+		c.LastError = ""
+		c.UnresolvedName = false
+		c.LazyHostnames = nil
+		c.LazyState = ""
+		c.NextTransition = time.Time{}
+		c.Tags = sortedCopy(c.Tags)
+		ids = append(ids, &c)
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return ids[i].FingerPrint < ids[j].FingerPrint
+	})
+	s.Identities = ids
+	return s
+}
+
+// sortedCopy sorts a copy so the slice held by the state is left as it is
+func sortedCopy(in []string) []string {
+	if len(in) == 0 {
+		return nil
+	}
+	out := append([]string(nil), in...)
+	sort.Strings(out)
+	return out
+}
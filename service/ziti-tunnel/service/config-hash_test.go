@@ -0,0 +1,71 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+func TestCanonicalStatus(t *testing.T) {
+	base := func() dto.TunnelStatus {
+		return dto.TunnelStatus{
+			TunIpv4:            "100.64.0.1",
+			AllowedControllers: []string{"b.example.com", "a.example.com"},
+			Identities: []*dto.Identity{
+				{FingerPrint: "b", Active: true, Tags: []string{"y", "x"}},
+				{FingerPrint: "a", Active: true},
+			},
+		}
+	}
+	tests := []struct {
+		name     string
+		change   func(s *dto.TunnelStatus)
+		wantSame bool
+	}{
+		{"unchanged", func(s *dto.TunnelStatus) {}, true},
+		{"tun up", func(s *dto.TunnelStatus) { s.Active = true; s.Duration = 1000 }, true},
+		{"identity order", func(s *dto.TunnelStatus) { s.Identities[0], s.Identities[1] = s.Identities[1], s.Identities[0] }, true},
+		{"list order", func(s *dto.TunnelStatus) { s.AllowedControllers = []string{"a.example.com", "b.example.com"} }, true},
+		{"identity status", func(s *dto.TunnelStatus) { s.Identities[0].Status = "Enrolled"; s.Identities[0].LastError = "timeout" }, true},
+		{"next transition", func(s *dto.TunnelStatus) { s.Identities[0].NextTransition = time.Now() }, true},
+		{"nil identity", func(s *dto.TunnelStatus) { s.Identities = append(s.Identities, nil) }, true},
+		{"identity disabled", func(s *dto.TunnelStatus) { s.Identities[0].Active = false }, false},
+		{"tun address", func(s *dto.TunnelStatus) { s.TunIpv4 = "100.64.0.2" }, false},
+	}
+	want, err := json.Marshal(canonicalStatus(base()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := base()
+			tt.change(&s)
+			got, err := json.Marshal(canonicalStatus(s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (string(got) == string(want)) != tt.wantSame {
+				t.Errorf("canonicalStatus() same = %v, want %v", !tt.wantSame, tt.wantSame)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// rights which let a trustee change or replace a file: generic all/write, file all/write, write data, append data,
+// write extended attributes, write attributes, delete, write dac and write owner
+var sddlWriteRights = []string{"GA", "GW", "FA", "FW", "DC", "LC", "RP", "CR", "SD", "WD", "WO"}
+
+// the same rights as an access mask: file write data 0x2, append data 0x4, write ea 0x10 and write attributes 0x100
+const sddlWriteMask = windows.GENERIC_ALL | windows.GENERIC_WRITE | windows.DELETE | windows.WRITE_DAC | windows.WRITE_OWNER |
+	0x2 | 0x4 | 0x10 | 0x100
+
+// adminOnly reports if only SYSTEM and the administrators can change the file. it is a variable so the acl check can
+// be replaced
+var adminOnly = func(path string) (bool, error) {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return false, err
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return false, err
+	}
+	if !owner.IsWellKnown(windows.WinLocalSystemSid) && !owner.IsWellKnown(windows.WinBuiltinAdministratorsSid) {
+		log.Debugf("%s is owned by unexpected sid: %s", path, owner.String())
+		return false, nil
+	}
+	if dacl, _, err := sd.DACL(); err != nil || dacl == nil {
+		//a missing dacl grants everyone access
+		return false, nil
+	}
+	return !sddlGrantsWrite(sd.String()), nil
+}
+
+// sddlGrantsWrite reports if an allow entry of the sddl gives everyone, the users or the interactive users a right
+// to change the file
+func sddlGrantsWrite(sddl string) bool {
+	for _, ace := range strings.Split(sddl, "(")[1:] {
+		fields := strings.Split(strings.TrimSuffix(ace, ")"), ";")
+		if len(fields) != 6 || fields[0] != "A" {
+			continue
+		}
+		if !insecureTrustee(fields[5]) {
+			continue
+		}
+		rights := fields[2]
+		if strings.HasPrefix(strings.ToLower(rights), "0x") {
+			mask, err := strconv.ParseUint(rights[2:], 16, 32)
+			if err != nil || mask&sddlWriteMask != 0 {
+				return true
+			}
+			continue
+		}
+		for i := 0; i+2 <= len(rights); i += 2 {
+			for _, r := range sddlWriteRights {
+				if rights[i:i+2] == r {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func insecureTrustee(trustee string) bool {
+	for _, t := range insecureSddlTrustees {
+		if ";;;"+trustee+")" == t {
+			return true
+		}
+	}
+	return false
+}
+
+// readConfigPolicy reads the policy file. nil is returned when there is no policy file. a policy file which can be
+// changed by anyone but SYSTEM and the administrators is refused
+func readConfigPolicy(path string) (*dto.ConfigPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	secured, err := adminOnly(path)
+	if err != nil {
+		return nil, fmt.Errorf("the permissions of the policy file %s could not be verified: %v", path, err)
+	}
+	if !secured {
+		return nil, fmt.Errorf("the policy file %s can be changed by users other than the administrators", path)
+	}
+	policy := &dto.ConfigPolicy{}
+	if err = json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("policy file %s is not valid: %v", path, err)
+	}
+	return policy, nil
+}
+
+// applyConfigPolicy changes the state to what the policy enforces and returns every value it changed
+func applyConfigPolicy(policy *dto.ConfigPolicy, state *dto.TunnelStatus) []dto.ConfigAdjustment {
+	adjustments := make([]dto.ConfigAdjustment, 0)
+	if policy == nil {
+		return adjustments
+	}
+	enforced := func(field string, configured interface{}, effective interface{}, reason string) {
+		adjustments = append(adjustments, dto.ConfigAdjustment{Field: field, Configured: configured, Effective: effective, Reason: "enforced by the policy: " + reason})
+	}
+
+	if len(policy.AllowedControllers) > 0 {
+		allowed := make([]string, 0, len(state.AllowedControllers))
+		for _, entry := range state.AllowedControllers {
+			if allowedByPolicy(entry, policy.AllowedControllers) {
+				allowed = append(allowed, entry)
+			}
+		}
+		if len(allowed) == 0 {
+			allowed = policy.AllowedControllers
+		}
+		if len(allowed) != len(state.AllowedControllers) {
+			enforced("AllowedControllers", state.AllowedControllers, allowed, "only controllers allowed by the policy can be allowed")
+			state.AllowedControllers = allowed
+		}
+	}
+
+	if f := policy.NotificationFrequency; f != nil && (*f < constants.MinimumFrequency || *f > constants.MaximumFrequency) {
+		log.Warnf("ignoring the notification frequency %d of the policy, it must be between %d and %d minutes", *f, constants.MinimumFrequency, constants.MaximumFrequency)
+		policy.NotificationFrequency = nil
+	}
+	if policy.NotificationFrequency != nil && *policy.NotificationFrequency != state.NotificationFrequency {
+		enforced("NotificationFrequency", state.NotificationFrequency, *policy.NotificationFrequency, "the notification frequency is set by the policy")
+		state.NotificationFrequency = *policy.NotificationFrequency
+	}
+
+	if policy.MaxIdentities != nil && *policy.MaxIdentities > 0 {
+		if state.MaxIdentities == 0 || state.MaxIdentities > *policy.MaxIdentities {
+			enforced("MaxIdentities", state.MaxIdentities, *policy.MaxIdentities, fmt.Sprintf("no more than %d identities are allowed", *policy.MaxIdentities))
+			state.MaxIdentities = *policy.MaxIdentities
+		}
+	}
+	return adjustments
+}
+
+// withoutPolicy puts back the configured value of every field the policy changed so the config file keeps what the
+// user configured and the policy can be removed
+func (t *RuntimeState) withoutPolicy(status *dto.TunnelStatus) {
+	if t.configured == nil {
+		return
+	}
+	for _, a := range t.enforced {
+		switch a.Field {
+		case "AllowedControllers":
+			status.AllowedControllers = t.configured.AllowedControllers
+		case "NotificationFrequency":
+			status.NotificationFrequency = t.configured.NotificationFrequency
+		case "MaxIdentities":
+			status.MaxIdentities = t.configured.MaxIdentities
+		}
+	}
+	for _, id := range status.Identities {
+		id.PostConnectCommand = nil
+		id.PostDisconnectCommand = nil
+	}
+}
+
+// lockedByPolicy returns an error when the policy does not allow the ipc command to change the config
+func (t *RuntimeState) lockedByPolicy(function string) error {
+	if t.policy == nil {
+		return nil
+	}
+	for _, locked := range t.policy.LockedSettings {
+		if strings.EqualFold(strings.TrimSpace(locked), function) {
+			return fmt.Errorf("%s is locked by the policy %s", function, config.PolicyFile())
+		}
+	}
+	return nil
+}
+
+// allowedByPolicy reports if the allowlist entry is the same as, or narrower than, one of the policy entries
+func allowedByPolicy(entry string, policy []string) bool {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	for _, p := range policy {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if entry == p || (strings.HasPrefix(p, ".") && strings.HasSuffix(entry, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// identityLimitReached returns an error when another identity would go over MaxIdentities
+func (t *RuntimeState) identityLimitReached() error {
+	return t.identityLimitReachedWith(0)
+}
+
+// identityLimitReachedWith returns an error when another identity would go over MaxIdentities with pending
+// identities added which are not counted yet
+func (t *RuntimeState) identityLimitReachedWith(pending int) error {
+	if t.state.MaxIdentities < 1 {
+		return nil
+	}
+	t.idsLock.RLock()
+	count := len(t.ids)
+	t.idsLock.RUnlock()
+	if n := len(t.state.Identities); n > count {
+		count = n //while the config is loaded only the config lists the identities
+	}
+	if count+pending >= t.state.MaxIdentities {
+		return fmt.Errorf("no more than %d identities can be added", t.state.MaxIdentities)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"testing"
+)
+
+func TestSddlGrantsWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		sddl string
+		want bool
+	}{
+		{"admins only", "O:BAD:P(A;;FA;;;SY)(A;;FA;;;BA)", false},
+		{"users can read", "O:BAD:(A;;FA;;;SY)(A;;FA;;;BA)(A;;FR;;;BU)", false},
+		{"users can write", "O:BAD:(A;;FA;;;SY)(A;;FW;;;BU)", true},
+		{"everyone has full access", "O:BAD:(A;ID;FA;;;WD)", true},
+		{"interactive users can write data", "O:BAD:(A;;0x120089;;;SY)(A;;CCDCLCSWRPWPDTLOCRSDRCWDWO;;;IU)", true},
+		{"authenticated users read with a mask", "O:BAD:(A;;0x1200a9;;;AU)", false},
+		{"authenticated users write with a mask", "O:BAD:(A;;0x1301bf;;;AU)", true},
+		{"users are denied", "O:BAD:(D;;FA;;;BU)(A;;FA;;;BA)", false},
+		{"invalid mask is refused", "O:BAD:(A;;0xzz;;;BU)", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sddlGrantsWrite(tt.sddl); got != tt.want {
+				t.Errorf("sddlGrantsWrite(%q) = %v, want %v", tt.sddl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithoutPolicy(t *testing.T) {
+	configuredFrequency := 10
+	state := &dto.TunnelStatus{NotificationFrequency: configuredFrequency, MaxIdentities: 0, AllowedControllers: []string{"a.example.com", ".other.com"}}
+	configured := *state
+	enforcedFrequency := 20
+	maxIdentities := 3
+	policy := &dto.ConfigPolicy{AllowedControllers: []string{".example.com"}, NotificationFrequency: &enforcedFrequency, MaxIdentities: &maxIdentities}
+
+	rt := &RuntimeState{state: state, configured: &configured}
+	rt.enforced = applyConfigPolicy(policy, state)
+	if len(rt.enforced) != 3 {
+		t.Fatalf("expected 3 adjustments, got %v", rt.enforced)
+	}
+	if state.NotificationFrequency != enforcedFrequency || state.MaxIdentities != maxIdentities || len(state.AllowedControllers) != 1 {
+		t.Fatalf("the policy was not applied: %+v", state)
+	}
+
+	persisted := *state
+	rt.withoutPolicy(&persisted)
+	if persisted.NotificationFrequency != configuredFrequency {
+		t.Errorf("NotificationFrequency = %d, want %d", persisted.NotificationFrequency, configuredFrequency)
+	}
+	if persisted.MaxIdentities != 0 {
+		t.Errorf("MaxIdentities = %d, want 0", persisted.MaxIdentities)
+	}
+	if len(persisted.AllowedControllers) != 2 {
+		t.Errorf("AllowedControllers = %v, want %v", persisted.AllowedControllers, configured.AllowedControllers)
+	}
+}
+
+func TestLockedByPolicy(t *testing.T) {
+	rt := &RuntimeState{}
+	if err := rt.lockedByPolicy("SetWins"); err != nil {
+		t.Errorf("nothing is locked without a policy: %v", err)
+	}
+	rt.policy = &dto.ConfigPolicy{LockedSettings: []string{" setwins ", "SetLogDestination"}}
+	tests := []struct {
+		function string
+		locked   bool
+	}{
+		{"SetWins", true},
+		{"SetLogDestination", true},
+		{"Status", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.function, func(t *testing.T) {
+			if err := rt.lockedByPolicy(tt.function); (err != nil) != tt.locked {
+				t.Errorf("lockedByPolicy(%s) = %v, want locked %v", tt.function, err, tt.locked)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"sync"
+	"time"
+)
+
+// connectDeadlines abandons the load of an identity which has not connected before its deadline and loads it again
+// later. the sdk cannot cancel a context which has not reported yet, so an abandoned context is shut down as soon
+// as it reports
+type connectDeadlines struct {
+	sync.Mutex
+	timers    map[*cziti.ZIdentity]*time.Timer
+	abandoned map[*cziti.ZIdentity]bool
+}
+
+var connectWatch = &connectDeadlines{
+	timers:    make(map[*cziti.ZIdentity]*time.Timer),
+	abandoned: make(map[*cziti.ZIdentity]bool),
+}
+
+func connectTimeout(id *Id) time.Duration {
+	if id.ConnectTimeout > 0 {
+		return time.Duration(id.ConnectTimeout) * time.Second
+	}
+	return constants.DefaultConnectTimeout * time.Second
+}
+
+// start begins the deadline of the load of zid
+func (c *connectDeadlines) start(id *Id, zid *cziti.ZIdentity) {
+	timeout := connectTimeout(id)
+	c.Lock()
+	defer c.Unlock()
+	c.timers[zid] = time.AfterFunc(timeout, func() {
+		c.expired(id, zid, timeout)
+	})
+}
+
+// connected stops the deadline once the context of zid reported. false is returned when the load was abandoned,
+// the context is then shut down
+func (c *connectDeadlines) connected(zid *cziti.ZIdentity) bool {
+	c.Lock()
+	if c.abandoned[zid] {
+		delete(c.abandoned, zid)
+		c.Unlock()
+		log.Infof("an abandoned identity load reported after all. shutting down its context")
+		zid.Shutdown()
+		return false
+	}
+	if timer, ok := c.timers[zid]; ok {
+		timer.Stop()
+		delete(c.timers, zid)
+	}
+	c.Unlock()
+	return true
+}
+
+// expired abandons the load. it runs on a timer while the uv loop reports the status of zid, so the context of the
+// identity is only cleared under idsLock and while holding the lock which decides if the load reported in time
+func (c *connectDeadlines) expired(id *Id, zid *cziti.ZIdentity, timeout time.Duration) {
+	c.Lock()
+	if _, ok := c.timers[zid]; !ok {
+		c.Unlock()
+		return
+	}
+	delete(c.timers, zid)
+	if !rts.replaceCId(id, zid, nil) {
+		c.Unlock()
+		return
+	}
+	c.abandoned[zid] = true
+	c.Unlock()
+
+	log.Warn(recordWarning(WarningIdentity, "identity %s[%s] did not connect within %v. abandoning the load and trying again in %d seconds",
+		id.Name, id.FingerPrint, timeout, constants.ConnectRetryDelay))
+	id.LastError = fmt.Sprintf("connect timeout: the identity did not connect within %v", timeout)
+	startupLoad.done(id, LoadStateFailed, id.LastError)
+	rts.BroadcastEvent(dto.IdentityEvent{
+		ActionEvent: dto.IDENTITY_DISCONNECTED,
+		Id:          id.Identity,
+	})
+
+	reconnects.schedule(id)
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+func TestConnectTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout int
+		want    time.Duration
+	}{
+		{"default", 0, constants.DefaultConnectTimeout * time.Second},
+		{"configured", 5, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := &Id{Identity: dto.Identity{ConnectTimeout: tt.timeout}}
+			if got := connectTimeout(id); got != tt.want {
+				t.Errorf("connectTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceCId(t *testing.T) {
+	first, second := &cziti.ZIdentity{}, &cziti.ZIdentity{}
+	tests := []struct {
+		name    string
+		current *cziti.ZIdentity
+		old     *cziti.ZIdentity
+		want    bool
+		wantCId *cziti.ZIdentity
+	}{
+		{"still the same load", first, first, true, second},
+		{"loaded again since", second, first, false, second},
+		{"already cleared", nil, first, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &RuntimeState{}
+			id := &Id{CId: tt.current}
+			if got := rt.replaceCId(id, tt.old, second); got != tt.want {
+				t.Errorf("replaceCId() = %v, want %v", got, tt.want)
+			}
+			if rt.cId(id) != tt.wantCId {
+				t.Errorf("the context was not left as expected")
+			}
+		})
+	}
+}
+
+func TestConnectedBeforeDeadline(t *testing.T) {
+	c := &connectDeadlines{timers: make(map[*cziti.ZIdentity]*time.Timer), abandoned: make(map[*cziti.ZIdentity]bool)}
+	zid := &cziti.ZIdentity{}
+	id := &Id{CId: zid, Identity: dto.Identity{ConnectTimeout: 60}}
+	c.start(id, zid)
+	if !c.connected(zid) {
+		t.Fatalf("a load which reported before its deadline was treated as abandoned")
+	}
+	if _, ok := c.timers[zid]; ok {
+		t.Errorf("the deadline was not stopped")
+	}
+	// the deadline firing after the report must not abandon the load
+	c.expired(id, zid, time.Minute)
+	if c.abandoned[zid] || id.CId != zid {
+		t.Errorf("the load was abandoned after it reported")
+	}
+}
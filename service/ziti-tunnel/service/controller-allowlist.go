@@ -0,0 +1,62 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// controllerAllowed reports if the controller address is permitted by the AllowedControllers allowlist. entries
+// starting with a '.' match any host with that suffix, any other entry must match the host exactly. an empty
+// allowlist allows every controller
+func (t *RuntimeState) controllerAllowed(ztAPI string) error {
+	if len(t.state.AllowedControllers) == 0 {
+		return nil
+	}
+	address := ztAPI
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("controller address %s could not be parsed and is not allowed", ztAPI)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, entry := range t.state.AllowedControllers {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) {
+				return nil
+			}
+		} else if host == entry {
+			return nil
+		}
+	}
+	return fmt.Errorf("controller %s is not in the list of allowed controllers", host)
+}
+
+// findByPath returns the identity stored in the given identity file
+func (t *RuntimeState) findByPath(configFile string) *Id {
+	return t.Find(strings.TrimSuffix(filepath.Base(configFile), ".json"))
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControllerAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   []string
+		ztAPI     string
+		wantAllow bool
+	}{
+		{"empty allowlist", nil, "https://anything.example.org:1280", true},
+		{"exact host", []string{"ctrl.example.com"}, "https://ctrl.example.com:1280", true},
+		{"exact host without a scheme", []string{"ctrl.example.com"}, "ctrl.example.com:1280", true},
+		{"host differs in case", []string{" CTRL.example.com "}, "https://ctrl.EXAMPLE.com", true},
+		{"host suffix", []string{".example.com"}, "https://east.ctrl.example.com", true},
+		{"suffix does not match the bare domain", []string{".example.com"}, "https://example.com", false},
+		{"exact entry is not a suffix", []string{"example.com"}, "https://evil-example.com", false},
+		{"other host", []string{"ctrl.example.com", ".example.net"}, "https://ctrl.example.org", false},
+		{"blank entries are ignored", []string{""}, "https://ctrl.example.com", false},
+		{"unparsable address", []string{"ctrl.example.com"}, "https://ctrl%zz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RuntimeState{state: &dto.TunnelStatus{AllowedControllers: tt.allowed}}
+			if err := r.controllerAllowed(tt.ztAPI); (err == nil) != tt.wantAllow {
+				t.Errorf("controllerAllowed(%s) = %v, want allowed %t", tt.ztAPI, err, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestUpdateControllerAddressAllowlist(t *testing.T) {
+	const original = "https://ctrl.example.com:1280"
+	tests := []struct {
+		name          string
+		allowed       []string
+		newAddress    string
+		wantZtAPI     string
+		wantLastError bool
+	}{
+		{"allowed change", []string{".example.com"}, "moved.example.com:1280", "https://moved.example.com:1280", false},
+		{"rejected change", []string{".example.com"}, "https://ctrl.example.org", original, true},
+		{"empty allowlist", nil, "https://ctrl.example.org", "https://ctrl.example.org", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "controller-allowlist")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "fp.json")
+			data, _ := json.Marshal(idcfg.Config{ZtAPI: original})
+			if err = ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			savedDial := dialController
+			dialController = func(ctx context.Context, target string) (net.Conn, error) {
+				return nil, errors.New("not dialing in a test")
+			}
+			defer func() { dialController = savedDial }()
+
+			id := &Id{Identity: dto.Identity{FingerPrint: "fp"}}
+			r := &RuntimeState{state: &dto.TunnelStatus{AllowedControllers: tt.allowed}, ids: map[string]*Id{"fp": id}}
+			r.UpdateControllerAddress(path, tt.newAddress)
+
+			data, err = ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got idcfg.Config
+			if err = json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ZtAPI != tt.wantZtAPI {
+				t.Errorf("ZtAPI = %s, want %s", got.ZtAPI, tt.wantZtAPI)
+			}
+			if (id.LastError != "") != tt.wantLastError {
+				t.Errorf("LastError = %q, want it set %t", id.LastError, tt.wantLastError)
+			}
+		})
+	}
+}
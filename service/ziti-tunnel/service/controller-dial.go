@@ -0,0 +1,106 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dialController opens the connection used to check a controller is reachable
+var dialController = func(ctx context.Context, target string) (net.Conn, error) {
+	return controllerDialer().DialContext(ctx, "tcp", target)
+}
+
+// controllerDialTimeout is how long to wait when dialing a controller
+func controllerDialTimeout() time.Duration {
+	if rts.state == nil || rts.state.ControllerDialTimeout < 1 {
+		return constants.DefaultControllerDialTimeout * time.Second
+	}
+	return time.Duration(rts.state.ControllerDialTimeout) * time.Second
+}
+
+// checkControllerReachable verifies a tcp connection to the controller can be opened with the controller dial timeout
+func checkControllerReachable(controller string) error {
+	return checkControllersReachable([]string{controller})[controller]
+}
+
+// checkControllersReachable dials every controller at the same time and returns why each one which could not be
+// reached failed. all the dials share one deadline of the controller dial timeout
+func checkControllersReachable(controllers []string) map[string]error {
+	ctx, cancel := context.WithTimeout(context.Background(), controllerDialTimeout())
+	defer cancel()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	failed := make(map[string]error)
+	for _, controller := range controllers {
+		wg.Add(1)
+		go func(controller string) {
+			defer wg.Done()
+			err := dialReachable(ctx, controller)
+			if err == nil {
+				return
+			}
+			lock.Lock()
+			failed[controller] = err
+			lock.Unlock()
+		}(controller)
+	}
+	wg.Wait()
+	return failed
+}
+
+func dialReachable(ctx context.Context, controller string) error {
+	target, err := controllerHostPort(controller)
+	if err != nil {
+		return err
+	}
+	conn, err := dialController(ctx, target)
+	if err != nil {
+		return fmt.Errorf("could not connect to controller %s: %v", target, err)
+	}
+	_ = conn.Close()
+	return nil
+}
+
+// controllerDialer dials with the controller dial timeout
+func controllerDialer() *net.Dialer {
+	return &net.Dialer{Timeout: controllerDialTimeout()}
+}
+
+// controllerHostPort returns the host:port of the controller url, using 443 when no port is given
+func controllerHostPort(controller string) (string, error) {
+	if !strings.Contains(controller, "://") {
+		controller = "https://" + controller
+	}
+	ctrlUrl, err := url.Parse(controller)
+	if err != nil {
+		return "", fmt.Errorf("invalid controller address %s: %v", controller, err)
+	}
+	if ctrlUrl.Port() == "" {
+		return net.JoinHostPort(ctrlUrl.Hostname(), "443"), nil
+	}
+	return ctrlUrl.Host, nil
+}
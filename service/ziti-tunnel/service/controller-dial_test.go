@@ -0,0 +1,94 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+func TestControllerHostPort(t *testing.T) {
+	tests := []struct {
+		controller string
+		want       string
+		wantErr    bool
+	}{
+		{"https://ctrl.example.com", "ctrl.example.com:443", false},
+		{"https://ctrl.example.com:1280/edge", "ctrl.example.com:1280", false},
+		{"ctrl.example.com:8441", "ctrl.example.com:8441", false},
+		{"ctrl.example.com", "ctrl.example.com:443", false},
+		{"https://[::1]", "[::1]:443", false},
+		{"https://ctrl%zz", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.controller, func(t *testing.T) {
+			got, err := controllerHostPort(tt.controller)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("controllerHostPort() = %s, %v, want %s, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckControllersReachable(t *testing.T) {
+	savedDial, savedState := dialController, rts.state
+	defer func() { dialController, rts.state = savedDial, savedState }()
+	rts.state = &dto.TunnelStatus{ControllerDialTimeout: 1}
+
+	// the unreachable controller only gives up when the shared deadline passes
+	dialController = func(ctx context.Context, target string) (net.Conn, error) {
+		switch target {
+		case "up.example.com:443":
+			client, server := net.Pipe()
+			_ = server.Close()
+			return client, nil
+		case "refused.example.com:443":
+			return nil, errors.New("connection refused")
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	controllers := []string{"https://up.example.com", "https://refused.example.com", "https://slow1.example.com", "https://slow2.example.com", "https://slow3.example.com"}
+	start := time.Now()
+	failed := checkControllersReachable(controllers)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("checking %d controllers took %v, the dials do not share one deadline", len(controllers), elapsed)
+	}
+	tests := []struct {
+		controller string
+		wantErr    bool
+	}{
+		{"https://up.example.com", false},
+		{"https://refused.example.com", true},
+		{"https://slow1.example.com", true},
+		{"https://slow3.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.controller, func(t *testing.T) {
+			if err := failed[tt.controller]; (err != nil) != tt.wantErr {
+				t.Errorf("checkControllersReachable()[%s] = %v, wantErr %v", tt.controller, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"sort"
+	"strings"
+)
+
+// dnsCoverage collects the hostnames and wildcard domains intercepted by the services, with the identities and
+// services claiming them
+func dnsCoverage(services map[string][]*dto.Service, names map[string]string) []dto.DnsCoverage {
+	byName := make(map[string]*dto.DnsCoverage)
+	for fp, svcs := range services {
+		for _, svc := range svcs {
+			if svc == nil {
+				continue
+			}
+			for _, addr := range svc.Addresses {
+				if !addr.IsHost || addr.HostName == "" {
+					continue
+				}
+				hostname := strings.ToLower(strings.TrimSuffix(addr.HostName, "."))
+				c, found := byName[hostname]
+				if !found {
+					c = &dto.DnsCoverage{
+						Name:     hostname,
+						Wildcard: strings.HasPrefix(hostname, "*."),
+						Owners:   make([]dto.DnsOwner, 0),
+					}
+					byName[hostname] = c
+				}
+				c.Owners = append(c.Owners, dto.DnsOwner{Fingerprint: fp, Identity: names[fp], Service: svc.Name})
+			}
+		}
+	}
+
+	coverage := make([]dto.DnsCoverage, 0, len(byName))
+	for _, c := range byName {
+		sort.SliceStable(c.Owners, func(i, j int) bool {
+			if c.Owners[i].Fingerprint != c.Owners[j].Fingerprint {
+				return c.Owners[i].Fingerprint < c.Owners[j].Fingerprint
+			}
+			return c.Owners[i].Service < c.Owners[j].Service
+		})
+		for _, o := range c.Owners {
+			if o.Fingerprint != c.Owners[0].Fingerprint {
+				c.Overlap = true //claimed by more than one identity
+				break
+			}
+		}
+		coverage = append(coverage, *c)
+	}
+	sort.SliceStable(coverage, func(i, j int) bool {
+		return coverage[i].Name < coverage[j].Name
+	})
+	return coverage
+}
+
+// DnsCoverage returns every hostname and wildcard domain intercepted by the loaded identities, sorted by name. a name
+// claimed by more than one identity is flagged as an overlap
+func (t *RuntimeState) DnsCoverage() []dto.DnsCoverage {
+	services := make(map[string][]*dto.Service)
+	names := make(map[string]string)
+	t.idsLock.RLock()
+	for fp, id := range t.ids {
+		if id.CId == nil || !id.CId.Loaded {
+			continue
+		}
+		names[fp] = id.Name
+		id.CId.Services.Range(func(key interface{}, value interface{}) bool {
+			services[fp] = append(services[fp], value.(*cziti.ZService).Service)
+			return true
+		})
+	}
+	t.idsLock.RUnlock()
+	return dnsCoverage(services, names)
+}
+
+// dnsOwners names the services and identities intercepting the hostname for the dns query log
+func (t *RuntimeState) dnsOwners(hostname string) string {
+	return ownersOf(t.DnsCoverage(), hostname)
+}
+
+// ownersOf names the services and identities of the coverage intercepting the hostname, directly or with a wildcard
+// domain. empty when no service intercepts it
+func ownersOf(coverage []dto.DnsCoverage, hostname string) string {
+	name := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+	owners := make([]string, 0)
+	for _, c := range coverage {
+		if c.Name != name && !(c.Wildcard && strings.HasSuffix(name, c.Name[1:])) {
+			continue
+		}
+		for _, o := range c.Owners {
+			identity := o.Identity
+			if identity == "" {
+				identity = o.Fingerprint
+			}
+			owners = append(owners, fmt.Sprintf("service %s of identity %s", o.Service, identity))
+		}
+	}
+	return strings.Join(owners, ", ")
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"testing"
+)
+
+func hostService(name string, hostnames ...string) *dto.Service {
+	svc := &dto.Service{Name: name}
+	for _, h := range hostnames {
+		svc.Addresses = append(svc.Addresses, dto.Address{IsHost: true, HostName: h})
+	}
+	return svc
+}
+
+func TestDnsCoverage(t *testing.T) {
+	names := map[string]string{"fp1": "alice", "fp2": "bob"}
+	tests := []struct {
+		name     string
+		services map[string][]*dto.Service
+		want     []dto.DnsCoverage
+	}{
+		{"nothing intercepted", map[string][]*dto.Service{"fp1": {nil, {Name: "ip", Addresses: []dto.Address{{IP: "10.0.0.1"}}}}}, []dto.DnsCoverage{}},
+		{"one owner", map[string][]*dto.Service{"fp1": {hostService("web", "Web.Ziti.")}}, []dto.DnsCoverage{
+			{Name: "web.ziti", Owners: []dto.DnsOwner{{Fingerprint: "fp1", Identity: "alice", Service: "web"}}},
+		}},
+		{"two services of one identity", map[string][]*dto.Service{"fp1": {hostService("web2", "web.ziti"), hostService("web", "web.ziti")}}, []dto.DnsCoverage{
+			{Name: "web.ziti", Owners: []dto.DnsOwner{{Fingerprint: "fp1", Identity: "alice", Service: "web"}, {Fingerprint: "fp1", Identity: "alice", Service: "web2"}}},
+		}},
+		{"overlap and wildcard", map[string][]*dto.Service{"fp2": {hostService("all", "*.ziti", "web.ziti")}, "fp1": {hostService("web", "web.ziti")}}, []dto.DnsCoverage{
+			{Name: "*.ziti", Wildcard: true, Owners: []dto.DnsOwner{{Fingerprint: "fp2", Identity: "bob", Service: "all"}}},
+			{Name: "web.ziti", Overlap: true, Owners: []dto.DnsOwner{{Fingerprint: "fp1", Identity: "alice", Service: "web"}, {Fingerprint: "fp2", Identity: "bob", Service: "all"}}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dnsCoverage(tt.services, names); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dnsCoverage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOwnersOf(t *testing.T) {
+	coverage := dnsCoverage(map[string][]*dto.Service{
+		"fp1": {hostService("web", "web.ziti")},
+		"fp2": {hostService("all", "*.ziti")},
+	}, map[string]string{"fp1": "alice"})
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{"WEB.ziti.", "service all of identity fp2, service web of identity alice"},
+		{"db.ziti", "service all of identity fp2"},
+		{"ziti", ""},
+		{"web.ziti.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			if got := ownersOf(coverage, tt.hostname); got != tt.want {
+				t.Errorf("ownersOf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsWatcher checks the dns of the TUN once the network stops changing, windows resets the dns of the interfaces
+// when the network profile changes
+type dnsWatcher struct {
+	sync.Mutex
+	callback *winipcfg.InterfaceChangeCallback
+	timer    *time.Timer
+}
+
+var dnsWatch dnsWatcher
+
+func watchNetworkChanges() {
+	cb, err := winipcfg.RegisterInterfaceChangeCallback(func(_ winipcfg.MibNotificationType, _ *winipcfg.MibIPInterfaceRow) {
+		tunInterfaceDetails.invalidate()
+		dnsWatch.changed()
+	})
+	if err != nil {
+		log.Warnf("could not watch for network changes. the dns of the TUN is not checked when the network changes: %v", err)
+		return
+	}
+	dnsWatch.Lock()
+	dnsWatch.callback = cb
+	dnsWatch.Unlock()
+}
+
+func stopWatchingNetworkChanges() {
+	dnsWatch.Lock()
+	defer dnsWatch.Unlock()
+	if dnsWatch.timer != nil {
+		dnsWatch.timer.Stop()
+	}
+	if dnsWatch.callback != nil {
+		_ = dnsWatch.callback.Unregister()
+		dnsWatch.callback = nil
+	}
+}
+
+// changed restarts the wait for the network to settle
+func (w *dnsWatcher) changed() {
+	w.Lock()
+	defer w.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timer = time.AfterFunc(constants.NetworkChangeDebounce*time.Second, rts.reapplyTunDns)
+}
+
+// reapplyTunDns sets the dns of the TUN again when it was applied to the interface and no longer points at the TUN
+func (t *RuntimeState) reapplyTunDns() {
+	if t.tun == nil || dnsMode(t.currentDnsDecision()) == DnsModeNrpt {
+		return
+	}
+	ip := net.ParseIP(t.state.TunIpv4)
+	luid := winipcfg.LUID((*t.tun).(*tun.NativeTun).LUID())
+	servers, err := luid.DNS()
+	if err != nil {
+		log.Warnf("could not check the dns of the TUN after a network change: %v", err)
+		return
+	}
+	found, reset := dnsReset(servers, ip)
+	if !reset {
+		log.Debugf("the dns of the TUN is still %s after a network change", ip)
+		return
+	}
+	log.Warnf("the dns of the TUN changed to %v after a network change. setting it back to %s", found, ip)
+	if err = luid.SetDNS(windows.AF_INET, []net.IP{ip}, t.state.DnsSearchDomains); err != nil {
+		log.Errorf("could not set the dns of the TUN back to %s: %v", ip, err)
+		return
+	}
+	t.BroadcastEvent(dto.DnsReappliedEvent{
+		ActionEvent: dto.TUN_DNS_REAPPLIED,
+		Found:       found,
+		Applied:     ip.String(),
+	})
+}
+
+// dnsReset reports if ip is no longer one of the dns servers of the TUN, along with the servers found
+func dnsReset(servers []net.IP, ip net.IP) ([]string, bool) {
+	found := make([]string, len(servers))
+	for i, s := range servers {
+		if s.Equal(ip) {
+			return nil, false
+		}
+		found[i] = s.String()
+	}
+	return found, true
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDnsReset(t *testing.T) {
+	tunIp := net.ParseIP("100.64.0.1")
+	tests := []struct {
+		name      string
+		servers   []string
+		wantFound []string
+		wantReset bool
+	}{
+		{"still the TUN", []string{"100.64.0.1"}, nil, false},
+		{"TUN among others", []string{"1.1.1.1", "100.64.0.1"}, nil, false},
+		{"reset to dhcp", []string{"192.168.1.1", "8.8.8.8"}, []string{"192.168.1.1", "8.8.8.8"}, true},
+		{"cleared", nil, []string{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := make([]net.IP, len(tt.servers))
+			for i, s := range tt.servers {
+				servers[i] = net.ParseIP(s)
+			}
+			found, reset := dnsReset(servers, tunIp)
+			if reset != tt.wantReset || !reflect.DeepEqual(found, tt.wantFound) {
+				t.Errorf("dnsReset() = %v, %t, want %v, %t", found, reset, tt.wantFound, tt.wantReset)
+			}
+		})
+	}
+}
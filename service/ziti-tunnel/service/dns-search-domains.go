@@ -0,0 +1,130 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+	"strings"
+)
+
+const tcpipInterfacesKey = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters\Interfaces\`
+
+// GetDnsSearchDomains returns the dns suffix search list of the TUN interface
+func (t *RuntimeState) GetDnsSearchDomains() ([]string, error) {
+	if t.tun == nil {
+		return nil, fmt.Errorf("the TUN is not up")
+	}
+	nativeTunDevice := (*t.tun).(*tun.NativeTun)
+	guid, err := winipcfg.LUID(nativeTunDevice.LUID()).GUID()
+	if err != nil {
+		return nil, err
+	}
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, tcpipInterfacesKey+guid.String(), registry.QUERY_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the tcpip settings of the TUN: %v", err)
+	}
+	defer k.Close()
+	list, _, err := k.GetStringValue("SearchList")
+	if err == registry.ErrNotExist {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read the search list of the TUN: %v", err)
+	}
+	domains := make([]string, 0)
+	for _, d := range strings.Split(list, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains, nil
+}
+
+// SetDnsSearchDomains validates and dedupes the domains, applies them as the dns suffix search list of the TUN
+// interface and saves them so they are applied again when the TUN is created
+func (t *RuntimeState) SetDnsSearchDomains(domains []string) ([]string, error) {
+	cleaned, err := normalizeSearchDomains(domains)
+	if err != nil {
+		return nil, err
+	}
+	if t.tun != nil {
+		nativeTunDevice := (*t.tun).(*tun.NativeTun)
+		if err = applyDnsSearchDomains(winipcfg.LUID(nativeTunDevice.LUID()), cleaned); err != nil {
+			return nil, fmt.Errorf("could not set the search domains on the TUN: %v", err)
+		}
+	}
+	log.Infof("setting dns search domains: %v", cleaned)
+	t.state.DnsSearchDomains = cleaned
+	t.SaveState()
+	return cleaned, nil
+}
+
+// applyDnsSearchDomains sets the search list while keeping the dns servers already set on the interface
+func applyDnsSearchDomains(luid winipcfg.LUID, domains []string) error {
+	servers, err := luid.DNS()
+	if err != nil {
+		return err
+	}
+	v4 := make([]net.IP, 0, len(servers))
+	for _, s := range servers {
+		if s.To4() != nil {
+			v4 = append(v4, s)
+		}
+	}
+	return luid.SetDNS(windows.AF_INET, v4, domains)
+}
+
+func normalizeSearchDomains(domains []string) ([]string, error) {
+	seen := make(map[string]bool)
+	cleaned := make([]string, 0, len(domains))
+	for _, d := range domains {
+		name := strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if name == "" {
+			continue
+		}
+		if !validDomainName(name) {
+			return nil, fmt.Errorf("invalid search domain: %s", d)
+		}
+		if !seen[name] {
+			seen[name] = true
+			cleaned = append(cleaned, name)
+		}
+	}
+	return cleaned, nil
+}
+
+func validDomainName(name string) bool {
+	if len(name) > 253 || net.ParseIP(name) != nil {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeSearchDomains(t *testing.T) {
+	tests := []struct {
+		name    string
+		domains []string
+		want    []string
+		wantErr bool
+	}{
+		{"none", nil, []string{}, false},
+		{"cleaned", []string{" Corp.Example.COM. ", "ziti"}, []string{"corp.example.com", "ziti"}, false},
+		{"blanks skipped", []string{"", " ", "."}, []string{}, false},
+		{"duplicates removed in order", []string{"b.example", "a.example", "B.EXAMPLE."}, []string{"b.example", "a.example"}, false},
+		{"underscore allowed", []string{"_srv.example"}, []string{"_srv.example"}, false},
+		{"ip address", []string{"10.0.0.1"}, nil, true},
+		{"empty label", []string{"corp..example"}, nil, true},
+		{"leading hyphen", []string{"-corp.example"}, nil, true},
+		{"label too long", []string{strings.Repeat("a", 64) + ".example"}, nil, true},
+		{"invalid character", []string{"corp example"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeSearchDomains(tt.domains)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeSearchDomains(%v) error = %v, wantErr %t", tt.domains, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeSearchDomains(%v) = %v, want %v", tt.domains, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetDnsSearchDomainsWithoutTun(t *testing.T) {
+	useTempConfigDir(t)
+	rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{DnsSearchDomains: []string{"old.example"}}}
+
+	if _, err := rt.SetDnsSearchDomains([]string{"bad domain"}); err == nil {
+		t.Error("SetDnsSearchDomains() accepted an invalid domain")
+	}
+	if !reflect.DeepEqual(rt.state.DnsSearchDomains, []string{"old.example"}) {
+		t.Errorf("an invalid domain changed the search domains to %v", rt.state.DnsSearchDomains)
+	}
+
+	// the domains are saved to be applied when the TUN is created
+	got, err := rt.SetDnsSearchDomains([]string{"Corp.Example", "corp.example"})
+	if err != nil {
+		t.Fatalf("SetDnsSearchDomains() error = %v", err)
+	}
+	if want := []string{"corp.example"}; !reflect.DeepEqual(got, want) || !reflect.DeepEqual(rt.state.DnsSearchDomains, want) {
+		t.Errorf("SetDnsSearchDomains() = %v with the state at %v, want %v", got, rt.state.DnsSearchDomains, want)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// DryLoadAll parses every identity file in the config folder without connecting any of them. when validate is set the
+// key and certificates are loaded as well and the fingerprint is compared to the file name
+func (t *RuntimeState) DryLoadAll(validate bool) ([]dto.IdentityFileCheck, error) {
+	return dryLoadFolder(config.IdentityPath(), validate)
+}
+
+// dryLoadFolder checks the identity files of folder. json files which are not identities are skipped the same way
+// findOrphanedIdentities skips them
+func dryLoadFolder(folder string, validate bool) ([]dto.IdentityFileCheck, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]dto.IdentityFileCheck, 0)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") || f.Name() == filepath.Base(config.File()) {
+			continue
+		}
+		cfg, ok := identityFileOf(filepath.Join(folder, f.Name()))
+		if !ok {
+			continue
+		}
+		result := dto.IdentityFileCheck{
+			File:        f.Name(),
+			Fingerprint: strings.TrimSuffix(f.Name(), ".json"),
+		}
+		if err = dryLoad(cfg, result.Fingerprint, validate); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Valid = true
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func dryLoad(cfg idcfg.Config, fingerprint string, validate bool) error {
+	if strings.TrimSpace(cfg.ID.Cert) == "" {
+		return fmt.Errorf("the identity has no certificate")
+	}
+	if strings.TrimSpace(cfg.ZtAPI) == "" {
+		return fmt.Errorf("the identity has no controller address")
+	}
+	if !validate {
+		return nil
+	}
+	sdkId, err := loadIdentity(cfg.ID)
+	if err != nil {
+		return fmt.Errorf("the identity could not be loaded: %v", err)
+	}
+	actual, err := fingerprintOf(sdkId)
+	if err != nil {
+		return err
+	}
+	if actual != fingerprint {
+		return fmt.Errorf("the certificate fingerprint %s does not match the file name", actual)
+	}
+	return nil
+}
+
+// loadIdentity loads the key and certificates of cfg. the sdk panics on a key which is not pem encoded, which is
+// reported as an error instead
+func loadIdentity(cfg identity.IdentityConfig) (id identity.Identity, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			id, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	return identity.LoadIdentity(cfg)
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDryLoadFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dry-load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, cert, fingerprint := testIdentityPem(t)
+	identityOf := func(ztAPI, key, cert string) string {
+		data, err := json.Marshal(idcfg.Config{ZtAPI: ztAPI, ID: identity.IdentityConfig{Key: key, Cert: cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	files := map[string]string{
+		"settings.json":       `{"logLevel":"info"}`,
+		"broken.json":         `{"ztAPI":`,
+		"no-key.json":         identityOf("https://ctrl:1280", "", cert),
+		"notes.txt":           identityOf("https://ctrl:1280", key, cert),
+		"no-cert.json":        identityOf("https://ctrl:1280", key, ""),
+		"no-controller.json":  identityOf("", key, cert),
+		"bad-key.json":        identityOf("https://ctrl:1280", "pem:garbage", cert),
+		"wrong-name.json":     identityOf("https://ctrl:1280", key, cert),
+		fingerprint + ".json": identityOf("https://ctrl:1280", key, cert),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		validate bool
+		want     map[string]bool
+	}{
+		{"parse only", false, map[string]bool{
+			"no-cert.json": false, "no-controller.json": false, "bad-key.json": true, "wrong-name.json": true, fingerprint + ".json": true,
+		}},
+		{"validate", true, map[string]bool{
+			"no-cert.json": false, "no-controller.json": false, "bad-key.json": false, "wrong-name.json": false, fingerprint + ".json": true,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := dryLoadFolder(dir, tt.validate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]bool)
+			for _, r := range results {
+				if r.Valid == (r.Error != "") {
+					t.Errorf("%s: valid %t with error %q", r.File, r.Valid, r.Error)
+				}
+				got[r.File] = r.Valid
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dryLoadFolder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+)
+
+// EffectiveConfig returns the config as it was read when the service started next to the config in use, with every
+// value the service changed while starting because it was unset or out of range
+func (t *RuntimeState) EffectiveConfig() dto.EffectiveConfig {
+	ec := dto.EffectiveConfig{
+		Effective:   t.ToStatus(false),
+		Adjustments: t.adjustments,
+	}
+	if t.configured != nil {
+		ec.Configured = *t.configured
+	}
+	if ec.Adjustments == nil {
+		ec.Adjustments = make([]dto.ConfigAdjustment, 0)
+	}
+	return ec
+}
+
+// configAdjustments compares the values LoadConfig applies defaults and limits to
+func configAdjustments(configured *dto.TunnelStatus, effective *dto.TunnelStatus) []dto.ConfigAdjustment {
+	adjustments := make([]dto.ConfigAdjustment, 0)
+	check := func(field string, c interface{}, e interface{}, unset bool, reason string) {
+		if reflect.DeepEqual(c, e) {
+			return
+		}
+		if unset {
+			reason = "not configured, the default is used"
+		}
+		adjustments = append(adjustments, dto.ConfigAdjustment{Field: field, Configured: c, Effective: e, Reason: reason})
+	}
+
+	check("TunIpv4Mask", configured.TunIpv4Mask, effective.TunIpv4Mask, false,
+		fmt.Sprintf("the mask cannot be smaller than /%d", constants.Ipv4MinMask))
+	check("NotificationFrequency", configured.NotificationFrequency, effective.NotificationFrequency, false,
+		fmt.Sprintf("the notification frequency cannot be less than %d minutes", constants.MinimumFrequency))
+	check("DnsTtlSeconds", configured.DnsTtlSeconds, effective.DnsTtlSeconds, configured.DnsTtlSeconds == 0,
+		fmt.Sprintf("the dns ttl must be between %d and %d seconds", constants.MinimumDnsTtl, constants.MaximumDnsTtl))
+	check("DnsRateLimit", configured.DnsRateLimit, effective.DnsRateLimit, false,
+		"a negative rate disables the dns rate limit")
+	check("DnsFailureMode", configured.DnsFailureMode, effective.DnsFailureMode, configured.DnsFailureMode == "",
+		"the dns failure mode must be empty, forward, nxdomain or servfail")
+	check("ControllerDialTimeout", configured.ControllerDialTimeout, effective.ControllerDialTimeout, configured.ControllerDialTimeout == 0,
+		fmt.Sprintf("the controller dial timeout must be between %d and %d seconds", constants.MinimumControllerDialTimeout, constants.MaximumControllerDialTimeout))
+	check("TunCidrRoute", configured.TunCidrRoute, effective.TunCidrRoute, false,
+		fmt.Sprintf("the TUN cidr route must be %s or %s", TunCidrRouteAdd, TunCidrRouteSkip))
+	check("TunIpConflict", configured.TunIpConflict, effective.TunIpConflict, false,
+		fmt.Sprintf("the TUN ip conflict must be %s, %s or %s", TunIpConflictKeep, TunIpConflictFail, TunIpConflictNext))
+	check("InterceptedDnsTypes", configured.InterceptedDnsTypes, effective.InterceptedDnsTypes, len(configured.InterceptedDnsTypes) == 0,
+		"one of the dns types cannot be intercepted")
+	check("StaticHostOverrides", configured.StaticHostOverrides, effective.StaticHostOverrides, false,
+		"the static host overrides are invalid and are ignored")
+	check("LoopbackMappings", configured.LoopbackMappings, effective.LoopbackMappings, false,
+		"the loopback mappings are invalid and are ignored")
+	check("WinsServers", configured.WinsServers, effective.WinsServers, false,
+		"the wins servers are invalid and are ignored")
+	check("LatencySampleInterval", configured.LatencySampleInterval, effective.LatencySampleInterval, false,
+		fmt.Sprintf("the latency sample interval must be 0 or at least %d seconds", constants.MinimumLatencySampleInterval))
+	check("ReconnectWindow", configured.ReconnectWindow, effective.ReconnectWindow, false,
+		fmt.Sprintf("the reconnect window cannot be more than %d seconds", constants.MaximumReconnectWindow))
+	check("EventQueueCapacity", configured.EventQueueCapacity, effective.EventQueueCapacity, configured.EventQueueCapacity == 0,
+		fmt.Sprintf("the event queue capacity must be between %d and %d", constants.MinimumEventQueueCapacity, constants.MaximumEventQueueCapacity))
+	check("MfaReminderLeadTime", configured.MfaReminderLeadTime, effective.MfaReminderLeadTime, false,
+		"a negative lead time disables the mfa reminders")
+	check("MetricsSampleInterval", configured.MetricsSampleInterval, effective.MetricsSampleInterval, configured.MetricsSampleInterval == 0,
+		fmt.Sprintf("the metrics sample interval cannot be less than %d seconds", constants.MinimumMetricsSampleInterval))
+	check("BatterySampleInterval", configured.BatterySampleInterval, effective.BatterySampleInterval, configured.BatterySampleInterval == 0,
+		"the battery sample interval cannot be less than 1 second")
+	return adjustments
+}
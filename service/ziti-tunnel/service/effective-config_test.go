@@ -0,0 +1,71 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"strings"
+	"testing"
+)
+
+func TestConfigAdjustments(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured dto.TunnelStatus
+		effective  dto.TunnelStatus
+		want       string // field:reason prefix of each adjustment
+	}{
+		{"nothing changed", dto.TunnelStatus{DnsTtlSeconds: 30}, dto.TunnelStatus{DnsTtlSeconds: 30}, ""},
+		{"unset uses the default", dto.TunnelStatus{}, dto.TunnelStatus{DnsTtlSeconds: constants.DefaultDnsTtl},
+			"DnsTtlSeconds:not configured"},
+		{"out of range is clamped", dto.TunnelStatus{DnsTtlSeconds: 7200}, dto.TunnelStatus{DnsTtlSeconds: constants.MaximumDnsTtl},
+			"DnsTtlSeconds:the dns ttl must be between"},
+		{"several values", dto.TunnelStatus{TunIpv4Mask: 24, EventQueueCapacity: 1},
+			dto.TunnelStatus{TunIpv4Mask: constants.Ipv4MinMask, EventQueueCapacity: constants.DefaultEventQueueCapacity},
+			"TunIpv4Mask:the mask cannot be smaller,EventQueueCapacity:the event queue capacity must be between"},
+		{"invalid overrides are dropped", dto.TunnelStatus{StaticHostOverrides: map[string]string{"web": "bad"}}, dto.TunnelStatus{},
+			"StaticHostOverrides:the static host overrides are invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := configAdjustments(&tt.configured, &tt.effective)
+			var want []string
+			if tt.want != "" {
+				want = strings.Split(tt.want, ",")
+			}
+			if len(got) != len(want) {
+				t.Fatalf("configAdjustments() = %+v, want %s", got, tt.want)
+			}
+			for i, a := range got {
+				field := strings.SplitN(want[i], ":", 2)
+				if a.Field != field[0] || !strings.HasPrefix(a.Reason, field[1]) {
+					t.Errorf("adjustment %d = %s: %s, want %s", i, a.Field, a.Reason, want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEffectiveConfigBeforeLoad(t *testing.T) {
+	rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{}}
+	ec := rt.EffectiveConfig()
+	if ec.Adjustments == nil || len(ec.Adjustments) != 0 {
+		t.Errorf("Adjustments = %v, want an empty list", ec.Adjustments)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+const (
+	ExistingTunRecreate = "recreate" // delete the adapter left by a previous run and create a new one. the default
+	ExistingTunReuse    = "reuse"    // keep the guid of the adapter left by a previous run so windows sees the same interface
+)
+
+// tunAdapterLayer finds and removes the TUN adapter left behind by a previous run, a variable so that it can be swapped out
+type tunAdapterLayer interface {
+	find(name string) (windows.GUID, bool)
+	remove(name string)
+}
+
+var tunAdapters tunAdapterLayer = wintunAdapters{}
+
+// the function used to create the TUN device with the guid of an existing adapter
+var createTUNWithGUID = tun.CreateTUNWithRequestedGUID
+
+type wintunAdapters struct{}
+
+func (wintunAdapters) find(name string) (windows.GUID, bool) {
+	wt, err := tun.WintunPool.OpenAdapter(name)
+	if err != nil {
+		return windows.GUID{}, false
+	}
+	guid, err := winipcfg.LUID(wt.LUID()).GUID()
+	if err != nil {
+		log.Warnf("found existing interface %s but could not read its guid: %v", name, err)
+		return windows.GUID{}, false
+	}
+	return *guid, true
+}
+
+func (wintunAdapters) remove(name string) {
+	removeTunAdapter(name)
+}
+
+// prepareTun deals with an adapter named name left by a previous run according to ExistingTunPolicy, before the TUN is
+// created. it returns the guid the TUN is to be created with, nil when windows picks a new one. wintun always replaces
+// an adapter with the same name when creating one, reusing keeps the guid and with it the network profile and
+// settings windows associated with the interface, the configuration of the TUN is applied again either way
+func (t *RuntimeState) prepareTun(name string) *windows.GUID {
+	guid, found := tunAdapters.find(name)
+	if !found {
+		return nil
+	}
+	switch t.state.ExistingTunPolicy {
+	case ExistingTunReuse:
+		log.Infof("interface %s already exists, reusing it. ExistingTunPolicy is %s", name, ExistingTunReuse)
+		return &guid
+	case "", ExistingTunRecreate:
+	default:
+		log.Warnf("unknown ExistingTunPolicy %s, interface %s is recreated", t.state.ExistingTunPolicy, name)
+	}
+	log.Infof("interface %s already exists, removing it before creating the TUN", name)
+	tunAdapters.remove(name)
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"testing"
+)
+
+// leftoverTun is the adapter left behind by a previous run when found is set
+type leftoverTun struct {
+	guid    windows.GUID
+	found   bool
+	removed []string
+}
+
+func (l *leftoverTun) find(string) (windows.GUID, bool) { return l.guid, l.found }
+func (l *leftoverTun) remove(name string)               { l.removed = append(l.removed, name) }
+
+func TestPrepareTun(t *testing.T) {
+	guid := windows.GUID{Data1: 0x1234}
+	tests := []struct {
+		name        string
+		policy      string
+		found       bool
+		wantGuid    bool
+		wantRemoved bool
+	}{
+		{"no leftover", ExistingTunReuse, false, false, false},
+		{"recreate by default", "", true, false, true},
+		{"recreate", ExistingTunRecreate, true, false, true},
+		{"reuse", ExistingTunReuse, true, true, false},
+		{"unknown policy recreates", "keep", true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := tunAdapters
+			defer func() { tunAdapters = saved }()
+			leftover := &leftoverTun{guid: guid, found: tt.found}
+			tunAdapters = leftover
+
+			r := &RuntimeState{state: &dto.TunnelStatus{ExistingTunPolicy: tt.policy}}
+			got := r.prepareTun(TunName)
+			if (got != nil) != tt.wantGuid || (got != nil && *got != guid) {
+				t.Errorf("prepareTun() = %v, want the guid of the leftover %t", got, tt.wantGuid)
+			}
+			if (len(leftover.removed) == 1 && leftover.removed[0] == TunName) != tt.wantRemoved {
+				t.Errorf("removed %v, want the leftover removed %t", leftover.removed, tt.wantRemoved)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// ExportInventory writes the public metadata of every identity as json. only the fields of dto.IdentityMetadata are
+// written, the config of the identity, which holds its key, is never copied into it
+func (t *RuntimeState) ExportInventory(w io.Writer) error {
+	t.idsLock.RLock()
+	entries := make([]dto.IdentityMetadata, 0, len(t.state.Identities))
+	for _, sid := range t.state.Identities {
+		if sid == nil {
+			continue
+		}
+		id := t.ids[sid.FingerPrint]
+		if id == nil {
+			id = &Id{Identity: *sid}
+		}
+		entries = append(entries, identityMetadata(id))
+	}
+	t.idsLock.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Fingerprint < entries[j].Fingerprint })
+	out := json.NewEncoder(w)
+	out.SetIndent("", "  ")
+	return out.Encode(entries)
+}
+
+func identityMetadata(id *Id) dto.IdentityMetadata {
+	m := dto.IdentityMetadata{
+		Fingerprint: id.FingerPrint,
+		Name:        id.Name,
+		Tags:        id.Tags,
+		Active:      id.Active,
+		MfaEnabled:  id.MfaEnabled,
+	}
+	cfg := idcfg.Config{}
+	if err := probeIdentityFile(id.Path(), &cfg); err != nil {
+		m.Error = fmt.Sprintf("could not read the identity file: %v", err)
+		return m
+	}
+	m.Controller = cfg.ZtAPI
+	cert, err := identityCertificate(&cfg)
+	if err != nil {
+		m.Error = err.Error()
+		return m
+	}
+	expiry := cert.NotAfter.UTC()
+	m.CertExpiry = &expiry
+	return m
+}
+
+// identityCertificate returns the certificate of the identity from the identity file or the file it references. only
+// the certificate is read, never the key
+func identityCertificate(cfg *idcfg.Config) (*x509.Certificate, error) {
+	var data []byte
+	if strings.HasPrefix(cfg.ID.Cert, "pem:") {
+		data = []byte(strings.TrimPrefix(cfg.ID.Cert, "pem:"))
+	} else {
+		path := strings.TrimPrefix(cfg.ID.Cert, "file://")
+		var err error
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("could not read the certificate of the identity: %v", err)
+		}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("the identity has no pem certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
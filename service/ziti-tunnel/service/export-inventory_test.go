@@ -0,0 +1,84 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestExportInventory(t *testing.T) {
+	useTempConfigDir(t)
+	key, cert, fingerprint := testIdentityPem(t)
+	present := &Id{Identity: dto.Identity{FingerPrint: fingerprint, Name: "present", Tags: []string{"ops"}, Active: true}}
+	data, err := json.Marshal(idcfg.Config{ZtAPI: "https://ctrl:1280", ID: identity.IdentityConfig{Key: key, Cert: cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(present.Path(), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rt := &RuntimeState{
+		ids: map[string]*Id{fingerprint: present},
+		state: &dto.TunnelStatus{Identities: []*dto.Identity{
+			{FingerPrint: fingerprint, Name: "present"},
+			{FingerPrint: "0000missing", Name: "missing"},
+			nil,
+		}},
+	}
+	var out bytes.Buffer
+	if err = rt.ExportInventory(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "PRIVATE KEY") {
+		t.Fatalf("the inventory holds the key of the identity: %s", out.String())
+	}
+	var got []dto.IdentityMetadata
+	if err = json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d entries, want 2: %+v", len(got), got)
+	}
+	missing, found := got[0], got[1]
+	if missing.Fingerprint != "0000missing" || found.Fingerprint != fingerprint {
+		t.Fatalf("entries are not sorted by fingerprint: %s, %s", missing.Fingerprint, found.Fingerprint)
+	}
+	if missing.Error == "" || missing.Controller != "" || missing.CertExpiry != nil {
+		t.Errorf("the identity without a file = %+v, want only an error", missing)
+	}
+	if found.Error != "" {
+		t.Errorf("unexpected error: %s", found.Error)
+	}
+	if found.Controller != "https://ctrl:1280" {
+		t.Errorf("Controller = %s, want https://ctrl:1280", found.Controller)
+	}
+	if found.CertExpiry == nil {
+		t.Error("the certificate expiry was not read")
+	}
+	if found.Name != "present" || !found.Active || len(found.Tags) != 1 {
+		t.Errorf("the loaded identity was not used: %+v", found)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"golang.org/x/sys/windows"
+	"os"
+	"strings"
+)
+
+// worldReadable reports if the folder grants access to everyone or the users. it is a variable so the acl check can be
+// replaced
+var worldReadable = func(path string) (bool, error) {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return false, err
+	}
+	return grantsInsecureTrustee(path, sd), nil
+}
+
+// useIdentityDir points the identity files at the configured IdentityDir. a folder readable by everyone or the users
+// is only used with a warning unless StrictIdentityDir is set, then it is refused and no identity is loaded
+func (t *RuntimeState) useIdentityDir() {
+	t.identityDirErr = nil
+	dir := strings.TrimSpace(t.state.IdentityDir)
+	config.SetIdentityPath(dir)
+	if dir == "" {
+		return
+	}
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.identityDirErr = fmt.Errorf("the identity folder %s is not a folder or cannot be read", dir)
+		log.Error(recordWarning(WarningConfig, "%v. no identity will be loaded", t.identityDirErr))
+		return
+	}
+	open, err := worldReadable(dir)
+	if err != nil {
+		if t.state.StrictIdentityDir {
+			t.identityDirErr = fmt.Errorf("the permissions of the identity folder %s could not be verified: %v", dir, err)
+			log.Error(recordWarning(WarningConfig, "%v. no identity will be loaded", t.identityDirErr))
+		} else {
+			log.Warnf("the permissions of the identity folder %s could not be verified: %v", dir, err)
+		}
+	} else if open {
+		if t.state.StrictIdentityDir {
+			t.identityDirErr = fmt.Errorf("the identity folder %s is readable by everyone or the users", dir)
+			log.Error(recordWarning(WarningConfig, "%v. no identity will be loaded", t.identityDirErr))
+		} else {
+			log.Warnf("the identity folder %s is readable by everyone or the users. the keys of the identities may be exposed", dir)
+		}
+	}
+	if t.identityDirErr == nil {
+		log.Infof("identity files are read from %s", dir)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	HookPostConnect    = "post-connect"
+	HookPostDisconnect = "post-disconnect"
+)
+
+// hookOutput keeps at most constants.HookOutputLimit bytes of the output of a hook
+type hookOutput struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (o *hookOutput) Write(p []byte) (int, error) {
+	room := constants.HookOutputLimit - o.buf.Len()
+	if room < len(p) {
+		o.truncated = true
+		if room > 0 {
+			o.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return o.buf.Write(p)
+}
+
+func (o *hookOutput) String() string {
+	s := strings.TrimSpace(o.buf.String())
+	if o.truncated {
+		s += " ...(truncated)"
+	}
+	return s
+}
+
+// identityHooks returns the hooks the policy sets for the identity. the hooks run as SYSTEM so they are only read from
+// the policy file, which only the administrators can change, and never from the config or over ipc
+func (t *RuntimeState) identityHooks(fingerprint string) dto.IdentityHooks {
+	if t.policy == nil {
+		return dto.IdentityHooks{}
+	}
+	return t.policy.IdentityHooks[fingerprint]
+}
+
+// runIdentityHook runs the command of a hook of an identity in the background. the first entry of the command is the
+// program and the rest are its arguments. no shell is involved so nothing in the arguments is interpreted
+func runIdentityHook(id *Id, hook string) {
+	hooks := rts.identityHooks(id.FingerPrint)
+	command := hooks.PostConnectCommand
+	if hook == HookPostDisconnect {
+		command = hooks.PostDisconnectCommand
+	}
+	if len(command) == 0 || strings.TrimSpace(command[0]) == "" {
+		return
+	}
+	name := id.Name
+	fingerprint := id.FingerPrint
+	argv := append([]string{}, command...)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("the %s hook of identity %s[%s] panicked: %v", hook, name, fingerprint, r)
+			}
+		}()
+		if err := execHook(hook, name, fingerprint, argv); err != nil {
+			log.Warn(recordWarning(WarningIdentity, "the %s hook of identity %s[%s] failed: %v", hook, name, fingerprint, err))
+		}
+	}()
+}
+
+var execHook = func(hook string, name string, fingerprint string, argv []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), constants.HookTimeout*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	out := &hookOutput{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	log.Infof("running the %s hook of identity %s[%s]: %v", hook, name, fingerprint, argv)
+	err := cmd.Run()
+	if output := out.String(); output != "" {
+		log.Infof("output of the %s hook of identity %s[%s]: %s", hook, name, fingerprint, output)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("it did not complete within %d seconds and was stopped", constants.HookTimeout)
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"empty", nil, ""},
+		{"trimmed", []string{"  done\r\n"}, "done"},
+		{"fits", []string{strings.Repeat("a", constants.HookOutputLimit)}, strings.Repeat("a", constants.HookOutputLimit)},
+		{"truncated", []string{strings.Repeat("a", constants.HookOutputLimit-1), "bc", "d"}, strings.Repeat("a", constants.HookOutputLimit-1) + "b ...(truncated)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &hookOutput{}
+			for _, w := range tt.writes {
+				if n, err := out.Write([]byte(w)); err != nil || n != len(w) {
+					t.Fatalf("Write returned %d, %v", n, err)
+				}
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunIdentityHook(t *testing.T) {
+	originalExec := execHook
+	originalPolicy := rts.policy
+	defer func() {
+		execHook = originalExec
+		rts.policy = originalPolicy
+	}()
+	rts.policy = &dto.ConfigPolicy{IdentityHooks: map[string]dto.IdentityHooks{
+		"fp": {PostConnectCommand: []string{"mount.exe", "z:"}, PostDisconnectCommand: []string{"unmount.exe"}},
+	}}
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		hook        string
+		run         func() error
+		want        []string
+	}{
+		{"post-connect runs", "fp", HookPostConnect, func() error { return nil }, []string{"mount.exe", "z:"}},
+		{"post-disconnect runs", "fp", HookPostDisconnect, func() error { return nil }, []string{"unmount.exe"}},
+		{"a failure is contained", "fp", HookPostConnect, func() error { return errors.New("exit status 1") }, []string{"mount.exe", "z:"}},
+		{"a panic is contained", "fp", HookPostConnect, func() error { panic("boom") }, []string{"mount.exe", "z:"}},
+		{"no hook without the policy", "other", HookPostConnect, func() error { return nil }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := make(chan []string, 1)
+			execHook = func(hook string, name string, fingerprint string, argv []string) error {
+				ran <- argv
+				return tt.run()
+			}
+			runIdentityHook(&Id{Identity: dto.Identity{Name: "id", FingerPrint: tt.fingerprint}}, tt.hook)
+			select {
+			case argv := <-ran:
+				if strings.Join(argv, " ") != strings.Join(tt.want, " ") {
+					t.Errorf("ran %v, want %v", argv, tt.want)
+				}
+			case <-time.After(time.Second):
+				if tt.want != nil {
+					t.Errorf("the %s hook did not run", tt.hook)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"sort"
+)
+
+// IdentityInventory compares the identities persisted in the config with the identities the service holds and
+// loaded. identities which are held but not persisted should never exist, they point at a bug
+func (t *RuntimeState) IdentityInventory() dto.IdentityInventory {
+	inventory := dto.IdentityInventory{
+		Loaded:       make([]dto.InventoryEntry, 0),
+		NotLoaded:    make([]dto.InventoryEntry, 0),
+		NotPersisted: make([]dto.InventoryEntry, 0),
+	}
+
+	t.idsLock.RLock()
+	defer t.idsLock.RUnlock()
+	persisted := make(map[string]bool, len(t.state.Identities))
+	for _, sid := range t.state.Identities {
+		if sid == nil || persisted[sid.FingerPrint] {
+			continue
+		}
+		persisted[sid.FingerPrint] = true
+		entry := dto.InventoryEntry{Fingerprint: sid.FingerPrint, Name: sid.Name}
+		if id, found := t.ids[sid.FingerPrint]; found && id.CId != nil && id.CId.Loaded {
+			entry.Name = id.Name
+			entry.Loaded = true
+			inventory.Loaded = append(inventory.Loaded, entry)
+			continue
+		}
+		if id, found := t.ids[sid.FingerPrint]; found {
+			entry.LastError = id.LastError
+		} else {
+			entry.LastError = sid.LastError
+		}
+		inventory.NotLoaded = append(inventory.NotLoaded, entry)
+	}
+	for fp, id := range t.ids {
+		if !persisted[fp] {
+			inventory.NotPersisted = append(inventory.NotPersisted, dto.InventoryEntry{
+				Fingerprint: fp,
+				Name:        id.Name,
+				Loaded:      id.CId != nil && id.CId.Loaded,
+				LastError:   id.LastError,
+			})
+		}
+	}
+	for _, entries := range [][]dto.InventoryEntry{inventory.Loaded, inventory.NotLoaded, inventory.NotPersisted} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Fingerprint < entries[j].Fingerprint })
+	}
+	return inventory
+}
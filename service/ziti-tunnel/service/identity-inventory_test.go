@@ -0,0 +1,55 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"testing"
+)
+
+func TestIdentityInventory(t *testing.T) {
+	rt := &RuntimeState{
+		ids: map[string]*Id{
+			"loaded": {Identity: dto.Identity{FingerPrint: "loaded", Name: "controller name"}, CId: &cziti.ZIdentity{Loaded: true}},
+			"failed": {Identity: dto.Identity{FingerPrint: "failed", Name: "failed", LastError: "could not load"}},
+			"orphan": {Identity: dto.Identity{FingerPrint: "orphan", Name: "orphan"}, CId: &cziti.ZIdentity{Loaded: true}},
+		},
+		state: &dto.TunnelStatus{Identities: []*dto.Identity{
+			{FingerPrint: "loaded", Name: "file name"},
+			{FingerPrint: "failed", Name: "failed"},
+			{FingerPrint: "inactive", Name: "inactive", LastError: "never loaded"},
+			{FingerPrint: "loaded", Name: "duplicate"},
+			nil,
+		}},
+	}
+
+	got := rt.IdentityInventory()
+	want := dto.IdentityInventory{
+		Loaded: []dto.InventoryEntry{{Fingerprint: "loaded", Name: "controller name", Loaded: true}},
+		NotLoaded: []dto.InventoryEntry{
+			{Fingerprint: "failed", Name: "failed", LastError: "could not load"},
+			{Fingerprint: "inactive", Name: "inactive", LastError: "never loaded"},
+		},
+		NotPersisted: []dto.InventoryEntry{{Fingerprint: "orphan", Name: "orphan", Loaded: true}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IdentityInventory() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"strings"
+	"time"
+)
+
+// parseClock returns the minutes since midnight of a local time like 08:30
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a time like 08:30", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// scheduleDay parses a day of a schedule, either the name of the day or its first three letters
+func scheduleDay(day string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(day, d.String()) || strings.EqualFold(day, d.String()[:3]) {
+			return d, nil
+		}
+	}
+	return time.Sunday, fmt.Errorf("%s is not a day of the week", day)
+}
+
+func validateSchedule(s *dto.Schedule) error {
+	if s == nil {
+		return nil
+	}
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(s.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("the start and end of the schedule are both %s", s.Start)
+	}
+	for _, day := range s.Days {
+		if _, err := scheduleDay(day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// onDay reports if the window of the schedule starts on day. a schedule without days applies to every day
+func onDay(s *dto.Schedule, day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if wd, err := scheduleDay(d); err == nil && wd == day {
+			return true
+		}
+	}
+	return false
+}
+
+// inSchedule reports if the local time t is within the window of the schedule. a window whose end is before its
+// start runs past midnight into the next day
+func inSchedule(s *dto.Schedule, t time.Time) bool {
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(s.End)
+	if err != nil {
+		return false
+	}
+	t = t.Local()
+	now := t.Hour()*60 + t.Minute()
+	if start < end {
+		return onDay(s, t.Weekday()) && now >= start && now < end
+	}
+	if now >= start {
+		return onDay(s, t.Weekday())
+	}
+	return now < end && onDay(s, t.AddDate(0, 0, -1).Weekday())
+}
+
+// nextScheduleTransition returns when the identity is next activated or deactivated by the schedule. the zero
+// time is returned when the schedule never changes. the boundaries are built in local time so they move with dst
+func nextScheduleTransition(s *dto.Schedule, now time.Time) time.Time {
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return time.Time{}
+	}
+	end, err := parseClock(s.End)
+	if err != nil {
+		return time.Time{}
+	}
+	now = now.Local()
+	current := inSchedule(s, now)
+	var next time.Time
+	for i := 0; i <= 8; i++ {
+		for _, m := range []int{start, end} {
+			c := time.Date(now.Year(), now.Month(), now.Day()+i, m/60, m%60, 0, 0, time.Local)
+			if !c.After(now) || inSchedule(s, c) == current {
+				continue
+			}
+			if next.IsZero() || c.Before(next) {
+				next = c
+			}
+		}
+	}
+	return next
+}
+
+// identitySchedules activates and deactivates the identities with a schedule when a boundary of their schedule is
+// crossed. in between the identity can be toggled by hand. only used from the handleEvents loop
+type identitySchedules struct {
+	within map[string]bool
+}
+
+var schedules = &identitySchedules{within: make(map[string]bool)}
+
+func (s *identitySchedules) check(now time.Time) {
+	for _, id := range rts.allIds() {
+		if id.Schedule == nil {
+			delete(s.within, id.FingerPrint)
+			id.NextTransition = time.Time{}
+			continue
+		}
+		if active, crossed := s.crossed(id.FingerPrint, id.Schedule, now); crossed && active != id.Active {
+			log.Infof("schedule of identity %s[%s] sets it to active=%t", id.Name, id.FingerPrint, active)
+			setIdentityActive(id, active)
+		}
+		id.NextTransition = nextScheduleTransition(id.Schedule, now)
+	}
+}
+
+// crossed reports if a boundary of the schedule was crossed since the last check, and if the identity should be
+// active now. the first check of an identity only records where it is
+func (s *identitySchedules) crossed(fingerprint string, schedule *dto.Schedule, now time.Time) (bool, bool) {
+	within := inSchedule(schedule, now)
+	last, seen := s.within[fingerprint]
+	s.within[fingerprint] = within
+	return within, seen && last != within
+}
+
+func setSchedule(fingerprint string, schedule *dto.Schedule) (*Id, error) {
+	id := rts.Find(fingerprint)
+	if id == nil {
+		return nil, fmt.Errorf("identity with fingerprint %s not found", fingerprint)
+	}
+	if err := validateSchedule(schedule); err != nil {
+		return nil, err
+	}
+	id.Schedule = schedule
+	id.NextTransition = time.Time{}
+	if schedule != nil {
+		id.NextTransition = nextScheduleTransition(schedule, time.Now())
+	}
+	rts.SaveState()
+	return id, nil
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// monday returns a local time on monday the 7th of june 2021
+func monday(hour, minute int) time.Time {
+	return time.Date(2021, 6, 7, hour, minute, 0, 0, time.Local)
+}
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule *dto.Schedule
+		wantErr  bool
+	}{
+		{"no schedule", nil, false},
+		{"every day", &dto.Schedule{Start: "08:00", End: "17:30"}, false},
+		{"named days", &dto.Schedule{Days: []string{"Monday", "tue"}, Start: "08:00", End: "17:30"}, false},
+		{"bad start", &dto.Schedule{Start: "8am", End: "17:30"}, true},
+		{"bad end", &dto.Schedule{Start: "08:00", End: "25:00"}, true},
+		{"empty window", &dto.Schedule{Start: "08:00", End: "08:00"}, true},
+		{"bad day", &dto.Schedule{Days: []string{"Mo"}, Start: "08:00", End: "17:30"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSchedule(tt.schedule); (err != nil) != tt.wantErr {
+				t.Errorf("validateSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInSchedule(t *testing.T) {
+	office := &dto.Schedule{Days: []string{"Mon"}, Start: "08:00", End: "17:00"}
+	night := &dto.Schedule{Days: []string{"Sun"}, Start: "22:00", End: "06:00"}
+	tests := []struct {
+		name     string
+		schedule *dto.Schedule
+		at       time.Time
+		want     bool
+	}{
+		{"before the window", office, monday(7, 59), false},
+		{"at the start", office, monday(8, 0), true},
+		{"at the end", office, monday(17, 0), false},
+		{"other day", office, monday(10, 0).AddDate(0, 0, 1), false},
+		{"past midnight from the day before", night, monday(5, 59), true},
+		{"after the window past midnight", night, monday(6, 0), false},
+		{"start on a day without the window", night, monday(22, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inSchedule(tt.schedule, tt.at); got != tt.want {
+				t.Errorf("inSchedule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextScheduleTransition(t *testing.T) {
+	office := &dto.Schedule{Days: []string{"Mon"}, Start: "08:00", End: "17:00"}
+	tests := []struct {
+		name     string
+		schedule *dto.Schedule
+		now      time.Time
+		want     time.Time
+	}{
+		{"start later today", office, monday(7, 0), monday(8, 0)},
+		{"end of the current window", office, monday(9, 0), monday(17, 0)},
+		{"start next week", office, monday(18, 0), monday(8, 0).AddDate(0, 0, 7)},
+		{"invalid schedule", &dto.Schedule{Start: "x", End: "17:00"}, monday(7, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextScheduleTransition(tt.schedule, tt.now); !got.Equal(tt.want) {
+				t.Errorf("nextScheduleTransition() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleCrossed(t *testing.T) {
+	office := &dto.Schedule{Start: "08:00", End: "17:00"}
+	s := &identitySchedules{within: make(map[string]bool)}
+	tests := []struct {
+		name        string
+		at          time.Time
+		wantActive  bool
+		wantCrossed bool
+	}{
+		{"first check only records", monday(9, 0), true, false},
+		{"still within", monday(10, 0), true, false},
+		{"end crossed", monday(17, 30), false, true},
+		{"still outside", monday(18, 0), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active, crossed := s.crossed("fp", office, tt.at)
+			if active != tt.wantActive || crossed != tt.wantCrossed {
+				t.Errorf("crossed() = %v, %v, want %v, %v", active, crossed, tt.wantActive, tt.wantCrossed)
+			}
+		})
+	}
+}
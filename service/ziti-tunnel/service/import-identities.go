@@ -0,0 +1,100 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importIdentities moves any identity files staged in importDir into the config folder and adds them to the
+// configuration. identities whose fingerprint is already known, or which would go over MaxIdentities, are skipped and
+// left in place
+func (t *RuntimeState) importIdentities(importDir string) {
+	if strings.TrimSpace(importDir) == "" {
+		return
+	}
+	files, err := ioutil.ReadDir(importDir)
+	if err != nil {
+		log.Warnf("could not read the identity import folder %s: %v", importDir, err)
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		source := filepath.Join(importDir, f.Name())
+		cfg := idcfg.Config{}
+		err = probeIdentityFile(source, &cfg)
+		if err != nil || strings.TrimSpace(cfg.ID.Key) == "" {
+			log.Debugf("file %s in the import folder does not appear to be an identity", source)
+			continue
+		}
+		sdkId, err := identity.LoadIdentity(cfg.ID)
+		if err != nil {
+			log.Warnf("could not load identity in the import folder %s: %v", source, err)
+			continue
+		}
+		fingerprint, err := fingerprintOf(sdkId)
+		if err != nil {
+			log.Warnf("could not load identity in the import folder %s: %v", source, err)
+			continue
+		}
+		if t.knownFingerprint(fingerprint) {
+			log.Infof("identity %s in the import folder is already known with fingerprint %s. skipping import", source, fingerprint)
+			continue
+		}
+		if err = t.identityLimitReached(); err != nil {
+			log.Warn(recordWarning(WarningIdentity, "identity %s in the import folder was not imported: %v", source, err))
+			continue
+		}
+
+		newId := &dto.Identity{
+			Name:        fingerprint,
+			FingerPrint: fingerprint,
+			Active:      true,
+			Config:      cfg,
+			Status:      STATUS_ENROLLED,
+		}
+		if _, err = copy(source, newId.Path()); err != nil {
+			log.Errorf("could not import identity %s to %s: %v", source, newId.Path(), err)
+			_ = os.Remove(newId.Path())
+			continue
+		}
+		t.state.Identities = append(t.state.Identities, newId)
+		t.SaveState()
+		log.Infof("imported identity %s from %s", fingerprint, source)
+		deleteFile(source)
+	}
+}
+
+func (t *RuntimeState) knownFingerprint(fingerprint string) bool {
+	for _, sid := range t.state.Identities {
+		if sid != nil && sid.FingerPrint == fingerprint {
+			return true
+		}
+	}
+	_, err := os.Stat(config.IdentityPath() + fingerprint + ".json")
+	return err == nil
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testIdentityPem returns the pem encoded key and a self signed certificate along with the fingerprint of the certificate
+func testIdentityPem(t *testing.T) (string, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dry-load"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return "pem:" + string(keyPem), "pem:" + string(certPem), fmt.Sprintf("%x", sha1.Sum(der))
+}
+
+// writeTestIdentity writes a new identity to path and returns its fingerprint
+func writeTestIdentity(t *testing.T, path string) string {
+	key, cert, fingerprint := testIdentityPem(t)
+	data, err := json.Marshal(idcfg.Config{ZtAPI: "https://ctrl:1280", ID: identity.IdentityConfig{Key: key, Cert: cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fingerprint
+}
+
+func TestImportIdentities(t *testing.T) {
+	dir := useTempConfigDir(t)
+	importDir, err := ioutil.TempDir("", "import-identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(importDir)
+
+	newFingerprint := writeTestIdentity(t, filepath.Join(importDir, "new.json"))
+	knownFingerprint := writeTestIdentity(t, filepath.Join(importDir, "duplicate.json"))
+	if err = ioutil.WriteFile(filepath.Join(importDir, "notes.json"), []byte(`{"note":"not an identity"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{
+		Identities: []*dto.Identity{{FingerPrint: knownFingerprint, Name: "known"}},
+	}}
+
+	rt.importIdentities(importDir)
+
+	var fingerprints []string
+	for _, sid := range rt.state.Identities {
+		fingerprints = append(fingerprints, sid.FingerPrint)
+	}
+	if len(fingerprints) != 2 || fingerprints[0] != knownFingerprint || fingerprints[1] != newFingerprint {
+		t.Errorf("identities %v, want the known one and %s", fingerprints, newFingerprint)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantExists bool
+	}{
+		{"new identity imported", filepath.Join(dir, newFingerprint+".json"), true},
+		{"new identity removed from the import folder", filepath.Join(importDir, "new.json"), false},
+		{"duplicate left in the import folder", filepath.Join(importDir, "duplicate.json"), true},
+		{"duplicate not imported", filepath.Join(dir, knownFingerprint+".json"), false},
+		{"other json left in the import folder", filepath.Join(importDir, "notes.json"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := os.Stat(tt.path); (err == nil) != tt.wantExists {
+				t.Errorf("%s exists %t, want %t", tt.path, err == nil, tt.wantExists)
+			}
+		})
+	}
+}
+
+func TestImportIdentitiesLimit(t *testing.T) {
+	dir := useTempConfigDir(t)
+	importDir, err := ioutil.TempDir("", "import-identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(importDir)
+	saved := warnings
+	defer func() { warnings = saved }()
+	warnings = &warningCollector{max: 10}
+
+	fingerprint := writeTestIdentity(t, filepath.Join(importDir, "over-the-limit.json"))
+	rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{
+		MaxIdentities: 1,
+		Identities:    []*dto.Identity{{FingerPrint: "existing", Name: "existing"}},
+	}}
+
+	rt.importIdentities(importDir)
+
+	if len(rt.state.Identities) != 1 {
+		t.Errorf("%d identities, want only the existing one", len(rt.state.Identities))
+	}
+	if _, err := os.Stat(filepath.Join(dir, fingerprint+".json")); err == nil {
+		t.Error("the identity over the limit was copied to the identity folder")
+	}
+	if _, err := os.Stat(filepath.Join(importDir, "over-the-limit.json")); err != nil {
+		t.Errorf("the identity over the limit was not left in the import folder: %v", err)
+	}
+	if w := rt.Warnings(); len(w) != 1 || w[0].Category != WarningIdentity {
+		t.Errorf("warnings %v, want one identity warning for the identity over the limit", w)
+	}
+}
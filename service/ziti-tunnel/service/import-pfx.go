@@ -0,0 +1,202 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"golang.org/x/crypto/pkcs12"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImportPfx builds an identity from the certificate and key in a PKCS#12/PFX file, writes it to the identity folder
+// and connects it. nothing is written unless the file can be decrypted and its certificate and key can be used. the
+// file must be owned by a user or be in the import folder, see sourceFileAllowed
+func (t *RuntimeState) ImportPfx(path string, password string, controllerUrl string, name string) (*Id, error) {
+	u, err := url.Parse(strings.TrimSpace(controllerUrl))
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("the controller url must be an https url: %s", controllerUrl)
+	}
+	if err = t.controllerAllowed(u.String()); err != nil {
+		return nil, err
+	}
+	if err = t.identityLimitReached(); err != nil {
+		return nil, err
+	}
+
+	if err = t.sourceFileAllowed(path); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err == pkcs12.ErrIncorrectPassword {
+		return nil, fmt.Errorf("the password for %s is incorrect", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s is not a valid pfx file: %v", path, err)
+	}
+
+	cfg, err := pfxIdentityConfig(blocks)
+	if err != nil {
+		return nil, fmt.Errorf("%s could not be used as an identity: %v", path, err)
+	}
+	cfg.ZtAPI = u.String()
+
+	sdkId, err := identity.LoadIdentity(cfg.ID)
+	if err != nil {
+		return nil, fmt.Errorf("%s could not be used as an identity: %v", path, err)
+	}
+	fingerprint, err := fingerprintOf(sdkId)
+	if err != nil {
+		return nil, fmt.Errorf("%s could not be used as an identity: %v", path, err)
+	}
+	if t.knownFingerprint(fingerprint) {
+		return nil, fmt.Errorf("an identity with fingerprint %s already exists", fingerprint)
+	}
+	if strings.TrimSpace(name) == "" {
+		name = fingerprint
+	}
+
+	newId := &dto.Identity{
+		Name:        name,
+		FingerPrint: fingerprint,
+		Active:      true,
+		Config:      cfg,
+		Status:      STATUS_ENROLLED,
+	}
+	if err = writeIdentityFile(newId.Path(), cfg); err != nil {
+		return nil, err
+	}
+	log.Infof("imported identity %s from %s. identity file written to: %s", fingerprint, path, newId.Path())
+
+	id := &Id{
+		Identity: dto.Identity{
+			FingerPrint: fingerprint,
+			Active:      true,
+		},
+	}
+	t.addIdentity(id, newId)
+	return id, nil
+}
+
+// pfxIdentityConfig maps the blocks of a pfx onto an identity config. the certificate sharing the key's localKeyId is
+// the client certificate, any other certificate is added as a ca
+func pfxIdentityConfig(blocks []*pem.Block) (idcfg.Config, error) {
+	cfg := idcfg.Config{}
+	var key *pem.Block
+	var certs []*pem.Block
+	for _, b := range blocks {
+		switch b.Type {
+		case "PRIVATE KEY":
+			if key != nil {
+				return cfg, fmt.Errorf("more than one private key found")
+			}
+			key = b
+		case "CERTIFICATE":
+			certs = append(certs, b)
+		}
+	}
+	if key == nil {
+		return cfg, fmt.Errorf("no private key found")
+	}
+	if len(certs) == 0 {
+		return cfg, fmt.Errorf("no certificate found")
+	}
+
+	// ToPEM returns PKCS#1 or SEC 1 keys, convert them to PKCS#8
+	var pk interface{}
+	pk, err := x509.ParsePKCS1PrivateKey(key.Bytes)
+	if err != nil {
+		if pk, err = x509.ParseECPrivateKey(key.Bytes); err != nil {
+			return cfg, fmt.Errorf("unsupported private key: %v", err)
+		}
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ID.Key = "pem:" + string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	leaf := 0
+	for i, c := range certs {
+		if keyId, ok := key.Headers["localKeyId"]; ok && c.Headers["localKeyId"] == keyId {
+			leaf = i
+			break
+		}
+	}
+	var ca bytes.Buffer
+	for i, c := range certs {
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Bytes})
+		if i == leaf {
+			cfg.ID.Cert = "pem:" + string(encoded)
+		} else {
+			ca.Write(encoded)
+		}
+	}
+	if ca.Len() > 0 {
+		cfg.ID.CA = "pem:" + ca.String()
+	}
+	return cfg, nil
+}
+
+// writeIdentityFile writes the identity to a temporary file next to path and then renames it over path so a failure
+// never leaves a partial or missing identity file behind
+func writeIdentityFile(path string, cfg idcfg.Config) error {
+	return replaceIdentityFile(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return enc.Encode(&cfg)
+	})
+}
+
+// replaceIdentityFile writes what write produces to a temporary file next to path and renames it over path
+func replaceIdentityFile(path string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "ziti-identity-*")
+	if err != nil {
+		return fmt.Errorf("could not create a temporary file in %s: %v", filepath.Dir(path), err)
+	}
+	if err = write(tmp); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("could not write the identity file %s: %v", path, err)
+	}
+	return nil
+}
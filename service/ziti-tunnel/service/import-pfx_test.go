@@ -0,0 +1,337 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+var (
+	oidPfxData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPfxShroudedKeyBag  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidPfxCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPfxX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidPfxLocalKeyId      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPfxTripleDes       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPfxSha1            = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+const pfxIterations = 2048
+
+type pfxContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pfxSafeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pfxAttribute `asn1:"set"`
+}
+
+type pfxAttribute struct {
+	Id    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type pfxCertBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pfxShroudedKey struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pfxPbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pfxMacData struct {
+	Mac struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}
+	MacSalt    []byte
+	Iterations int
+}
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe pfxContentInfo
+	MacData  pfxMacData
+}
+
+// testPfx returns a pfx protected by password holding a new key and its self signed certificate, along with the
+// fingerprint of the certificate. x/crypto/pkcs12 only decodes, so the pfx is built here: the key is shrouded with
+// pbeWithSHAAnd3-KeyTripleDES-CBC and the contents are signed with an hmac-sha1 as in rfc 7292
+func testPfx(t *testing.T, password string) ([]byte, string) {
+	keyPem, certPem, fingerprint := testIdentityPem(t)
+	keyBlock, _ := pem.Decode([]byte(strings.TrimPrefix(keyPem, "pem:")))
+	certBlock, _ := pem.Decode([]byte(strings.TrimPrefix(certPem, "pem:")))
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bmpPassword := pfxBmpString(password)
+
+	keySalt := pfxRandom(t, 8)
+	params := pfxMarshal(t, pfxPbeParams{Salt: keySalt, Iterations: pfxIterations})
+	shrouded := pfxMarshal(t, pfxShroudedKey{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPfxTripleDes, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: pfxEncrypt(t, pkcs8, keySalt, bmpPassword),
+	})
+	cert := pfxMarshal(t, pfxCertBag{Id: oidPfxX509Certificate, Data: certBlock.Bytes})
+
+	keyId := []byte{1}
+	certBags := pfxMarshal(t, []pfxSafeBag{pfxBag(t, oidPfxCertBag, cert, keyId)})
+	keyBags := pfxMarshal(t, []pfxSafeBag{pfxBag(t, oidPfxShroudedKeyBag, shrouded, keyId)})
+	authSafe := pfxMarshal(t, []pfxContentInfo{pfxDataContent(t, certBags), pfxDataContent(t, keyBags)})
+
+	macSalt := pfxRandom(t, 8)
+	mac := hmac.New(sha1.New, pfxKdf(macSalt, bmpPassword, 3, 20))
+	mac.Write(authSafe)
+	pdu := pfxPdu{Version: 3, AuthSafe: pfxDataContent(t, authSafe)}
+	pdu.MacData.Mac.Algorithm = pkix.AlgorithmIdentifier{Algorithm: oidPfxSha1, Parameters: asn1.NullRawValue}
+	pdu.MacData.Mac.Digest = mac.Sum(nil)
+	pdu.MacData.MacSalt = macSalt
+	pdu.MacData.Iterations = pfxIterations
+	return pfxMarshal(t, pdu), fingerprint
+}
+
+// pfxBag wraps value in a safe bag tagged with keyId
+func pfxBag(t *testing.T, id asn1.ObjectIdentifier, value []byte, keyId []byte) pfxSafeBag {
+	return pfxSafeBag{
+		Id:    id,
+		Value: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+		Attributes: []pfxAttribute{{
+			Id:    oidPfxLocalKeyId,
+			Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: pfxMarshal(t, keyId)},
+		}},
+	}
+}
+
+// pfxDataContent wraps data in a content info of type data
+func pfxDataContent(t *testing.T, data []byte) pfxContentInfo {
+	return pfxContentInfo{
+		ContentType: oidPfxData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: pfxMarshal(t, data)},
+	}
+}
+
+// pfxEncrypt encrypts data with the 3des key and iv derived from salt and password
+func pfxEncrypt(t *testing.T, data []byte, salt []byte, password []byte) []byte {
+	block, err := des.NewTripleDESCipher(pfxKdf(salt, password, 1, 24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := block.BlockSize() - len(data)%block.BlockSize()
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, pfxKdf(salt, password, 2, 8)).CryptBlocks(padded, padded)
+	return padded
+}
+
+// pfxKdf derives size bytes for the purpose id with the sha1 key derivation of rfc 7292 appendix B.2
+func pfxKdf(salt []byte, password []byte, id byte, size int) []byte {
+	const u, v = sha1.Size, 64
+	fill := func(pattern []byte) []byte {
+		if len(pattern) == 0 {
+			return nil
+		}
+		n := v * ((len(pattern) + v - 1) / v)
+		return bytes.Repeat(pattern, (n+len(pattern)-1)/len(pattern))[:n]
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+	var key []byte
+	for len(key) < size {
+		a := sha1.Sum(append(append([]byte{}, d...), i...))
+		for r := 1; r < pfxIterations; r++ {
+			a = sha1.Sum(a[:])
+		}
+		key = append(key, a[:u]...)
+		b := new(big.Int).SetBytes(fill(a[:]))
+		b.Add(b, big.NewInt(1))
+		for j := 0; j < len(i); j += v {
+			sum := new(big.Int).SetBytes(i[j : j+v])
+			out := sum.Add(sum, b).Bytes()
+			if len(out) > v {
+				out = out[len(out)-v:]
+			}
+			for k := 0; k < v; k++ {
+				i[j+k] = 0
+			}
+			for k, c := range out {
+				i[j+v-len(out)+k] = c
+			}
+		}
+	}
+	return key[:size]
+}
+
+// pfxBmpString encodes s as the null terminated utf-16 string pkcs12 derives its keys from
+func pfxBmpString(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return append(b, 0, 0)
+}
+
+func pfxRandom(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func pfxMarshal(t *testing.T, v interface{}) []byte {
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestImportPfx(t *testing.T) {
+	useTempConfigDir(t)
+	useMemoryStateStore(t)
+	savedConnect := connectNewIdentity
+	defer func() { connectNewIdentity = savedConnect }()
+	var connected []string
+	connectNewIdentity = func(id *Id) { connected = append(connected, id.FingerPrint) }
+
+	importDir, err := ioutil.TempDir("", "import-pfx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(importDir)
+	pfx, fingerprint := testPfx(t, "secret")
+	write := func(name string, data []byte) string {
+		path := filepath.Join(importDir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	valid := write("valid.pfx", pfx)
+	malformed := write("malformed.pfx", []byte("not a pfx file"))
+	truncated := write("truncated.pfx", pfx[:len(pfx)/2])
+
+	configFiles := func() []string {
+		infos, err := ioutil.ReadDir(config.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+
+	failures := []struct {
+		name     string
+		path     string
+		password string
+		wantErr  string
+	}{
+		{"wrong password", valid, "not the secret", "password"},
+		{"malformed file", malformed, "secret", "not a valid pfx file"},
+		{"truncated file", truncated, "secret", "not a valid pfx file"},
+		{"missing file", filepath.Join(importDir, "missing.pfx"), "secret", "could not read"},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{ImportDir: importDir}}
+			id, err := rt.ImportPfx(tt.path, tt.password, "https://ctrl:1280", "")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ImportPfx() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if id != nil || len(rt.state.Identities) != 0 {
+				t.Errorf("ImportPfx() added an identity after failing")
+			}
+			if files := configFiles(); len(files) != 0 {
+				t.Errorf("files %v left in the config folder after failing", files)
+			}
+		})
+	}
+
+	t.Run("imported", func(t *testing.T) {
+		rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{ImportDir: importDir}}
+		id, err := rt.ImportPfx(valid, "secret", "https://ctrl:1280", "pfx identity")
+		if err != nil {
+			t.Fatalf("ImportPfx() error = %v", err)
+		}
+		if id.FingerPrint != fingerprint || len(connected) != 1 || connected[0] != fingerprint {
+			t.Errorf("ImportPfx() fingerprint %s connected %v, want %s", id.FingerPrint, connected, fingerprint)
+		}
+		if len(rt.state.Identities) != 1 || rt.state.Identities[0].Name != "pfx identity" {
+			t.Errorf("identities %v, want the pfx identity", rt.state.Identities)
+		}
+		if files := configFiles(); len(files) != 1 || files[0] != fingerprint+".json" {
+			t.Errorf("config folder holds %v, want only %s.json", files, fingerprint)
+		}
+
+		cfg := idcfg.Config{}
+		if err = probeIdentityFile(filepath.Join(config.Path(), fingerprint+".json"), &cfg); err != nil {
+			t.Fatalf("the identity file could not be read: %v", err)
+		}
+		if cfg.ZtAPI != "https://ctrl:1280" {
+			t.Errorf("ZtAPI = %s, want https://ctrl:1280", cfg.ZtAPI)
+		}
+		sdkId, err := identity.LoadIdentity(cfg.ID)
+		if err != nil {
+			t.Fatalf("the imported identity does not load: %v", err)
+		}
+		if loaded, err := fingerprintOf(sdkId); err != nil || loaded != fingerprint {
+			t.Errorf("the imported identity has fingerprint %s (%v), want %s", loaded, err, fingerprint)
+		}
+
+		if _, err = rt.ImportPfx(valid, "secret", "https://ctrl:1280", ""); err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("importing the pfx again error = %v, want it to already exist", err)
+		}
+	})
+}
@@ -20,9 +20,11 @@ package service
 import "C"
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Microsoft/go-winio"
 	"github.com/openziti/desktop-edge-win/service/cziti"
@@ -67,18 +69,43 @@ var notificationFrequency *time.Ticker
 
 func SubMain(ops chan string, changes chan<- svc.Status, winEvents <-chan WindowsEvents) error {
 	log.Info("============================== service begins ==============================")
+	removeLeftoversOfLastTun()
 	windns.RemoveAllNrptRules()
 	// cleanup old ziti tun profiles
 	windns.CleanUpNetworkAdapterProfile()
 	CleanUpZitiTUNAdapters(TunName)
 
+	// the identities are only in rts.ids once initialize loaded them and each save writes the identities of rts.ids.
+	// the saves of the startup, including the identities imported, split, recovered or forgotten, are written once then
+	rts.BeginBatch()
 	rts.LoadConfig()
+	events.resize(rts.state.EventQueueCapacity)
 	l := rts.state.LogLevel
 	parsedLevel, cLogLevel := logging.ParseLevel(l)
 
 	rts.state.LogLevel = parsedLevel.String()
 	logging.InitLogger(parsedLevel)
 	_ = logging.Elog.Info(InformationEvent, SvcName+" starting. log file located at "+config.LogFile())
+	if sl := rts.state.Syslog; sl != nil && strings.TrimSpace(sl.Address) != "" {
+		if err := logging.EnableSyslog(sl.Protocol, sl.Address, sl.Facility); err != nil {
+			log.Errorf("could not enable syslog forwarding: %v", err)
+		} else {
+			log.Infof("forwarding logs to syslog collector at %s://%s", sl.Protocol, sl.Address)
+		}
+	}
+
+	if ld := rts.state.LogDestination; ld != nil && strings.TrimSpace(ld.Path) != "" {
+		if path, err := logDestinationPath(config.LogsPath(), ld.Path); err != nil {
+			log.Warn(recordWarning(WarningConfig, "ignoring the log destination, logging to %s: %v", logging.LogFilePath(), err))
+		} else if err = logging.SetLogDestination(path, ld.RotationHours, ld.RotationCount); err != nil {
+			log.Errorf("could not move the log file, logging to %s: %v", logging.LogFilePath(), err)
+		}
+	}
+	if rts.state.LogMaxSizeMb != 0 || rts.state.LogMaxFiles != 0 {
+		if err := logging.SetLogRotationSize(rts.state.LogMaxSizeMb, rts.state.LogMaxFiles); err != nil {
+			log.Errorf("could not set the log rotation size: %v", err)
+		}
+	}
 
 	if rts.state.ApiPageSize < constants.MinimumApiPageSize {
 		log.Debugf("page size value was smaller than the minimim %d. using default page size: %d", constants.MinimumApiPageSize, constants.DefaultApiPageSize)
@@ -99,11 +126,19 @@ func SubMain(ops chan string, changes chan<- svc.Status, winEvents <-chan Window
 		log.Panicf("unexpected err from initialize: %v", err)
 		return err
 	}
+	rts.EndBatch()
 
 	TunStarted = time.Now()
 
-	for _, id := range rts.ids {
-		connectIdentity(id)
+	if !rts.state.Degraded {
+		watchNetworkChanges()
+		defer stopWatchingNetworkChanges()
+	}
+
+	ids := rts.idsInLoadOrder()
+	startupLoad.begin(ids)
+	for _, id := range ids {
+		lazyIdentities.connectOrDefer(id)
 	}
 
 	go handleEvents(initialized)
@@ -111,6 +146,8 @@ func SubMain(ops chan string, changes chan<- svc.Status, winEvents <-chan Window
 	//listen for services that show up
 	go acceptServices()
 
+	go sampleLatencyPeriodically()
+
 	// listen for windows power events and call mfa auth func
 	go func() {
 		for {
@@ -118,7 +155,7 @@ func SubMain(ops chan string, changes chan<- svc.Status, winEvents <-chan Window
 			case wEvents := <-winEvents:
 				if wEvents.WinPowerEvent == PBT_APMRESUMESUSPEND || wEvents.WinPowerEvent == PBT_APMRESUMEAUTOMATIC {
 					log.Debugf("Received Windows Power Event in tunnel %d", wEvents.WinPowerEvent)
-					for _, id := range rts.ids {
+					for _, id := range rts.allIds() {
 						if id.CId != nil && id.CId.Loaded {
 							cziti.EndpointStateChanged(id.CId, true, false)
 						}
@@ -126,7 +163,7 @@ func SubMain(ops chan string, changes chan<- svc.Status, winEvents <-chan Window
 				}
 				if wEvents.WinSessionEvent == WTS_SESSION_UNLOCK {
 					log.Debugf("Received Windows Session Event (device unlocked) in tunnel %d", wEvents.WinSessionEvent)
-					for _, id := range rts.ids {
+					for _, id := range rts.allIds() {
 						if id.CId != nil && id.CId.Loaded {
 							cziti.EndpointStateChanged(id.CId, false, true)
 						}
@@ -165,7 +202,7 @@ func SubMain(ops chan string, changes chan<- svc.Status, winEvents <-chan Window
 	waitForStopRequest(ops)
 
 	log.Debug("shutting down. start a ZitiDump")
-	for _, id := range rts.ids {
+	for _, id := range rts.allIds() {
 		if id.CId != nil && id.CId.Loaded {
 			cziti.ZitiDumpOnShutdown(id.CId)
 		}
@@ -296,18 +333,10 @@ func (p *Pipes) shutdownConnections() {
 func initialize(cLogLevel int) error {
 	//TODO: this all needs to be cleaned up. it's done it two places and redundant
 	//TODO: fix with mfa?
-	ipv4 := rts.state.TunIpv4
-	ipv4mask := rts.state.TunIpv4Mask
-	if strings.TrimSpace(ipv4) == "" {
-		log.Infof("ip not provided using default: %v", ipv4)
-		ipv4 = constants.Ipv4ip
-		rts.UpdateIpv4(ipv4)
-	}
-	if ipv4mask < constants.Ipv4MaxMask {
-		log.Warnf("provided mask is too large: %d using default: %d", ipv4mask, constants.Ipv4DefaultMask)
-		ipv4mask = constants.Ipv4DefaultMask
-		rts.UpdateIpv4Mask(ipv4mask)
+	if err := checkStrictIpv4Mask(rts.state.TunIpv4Mask); err != nil {
+		return err
 	}
+	ipv4, ipv4mask := rts.clampTunAddress(rts.state.TunIpv4, rts.state.TunIpv4Mask)
 	_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipv4, ipv4mask))
 	if err != nil {
 		return fmt.Errorf("error parsing CIDR block: (%v)", err)
@@ -317,6 +346,10 @@ func initialize(cLogLevel int) error {
 
 	assignedIp, t, err := rts.CreateTun(rts.state.TunIpv4, rts.state.TunIpv4Mask, rts.state.AddDns)
 	if err != nil {
+		if errors.Is(err, ErrWintunMissing) {
+			enterDegradedMode(err)
+			return nil
+		}
 		return err
 	}
 
@@ -325,10 +358,22 @@ func initialize(cLogLevel int) error {
 	if err != nil {
 		log.Panicf("An unrecoverable error has occurred! %v", err)
 	}
+	cziti.SetTunWriteFailureHandler(rts.tunWriteFailing)
 
 	setTunInfo(rts.state)
 
 	rts.state.Active = true
+	loadIdsFromState()
+	dnsReady := make(chan bool)
+	go cziti.RunDNSserver(append([]net.IP{assignedIp}, dnsListenAddresses(assignedIp)...), dnsReady)
+	<-dnsReady
+	log.Debugf("initial state loaded from configuration file")
+	return nil
+}
+
+func loadIdsFromState() {
+	rts.idsLock.Lock()
+	defer rts.idsLock.Unlock()
 	for _, id := range rts.state.Identities {
 		if id != nil {
 			i := &Id{
@@ -340,11 +385,20 @@ func initialize(cLogLevel int) error {
 			log.Warnf("identity was nil?")
 		}
 	}
-	dnsReady := make(chan bool)
-	go cziti.RunDNSserver([]net.IP{assignedIp}, dnsReady)
-	<-dnsReady
-	log.Debugf("initial state loaded from configuration file")
-	return nil
+}
+
+// enterDegradedMode is used when the TUN cannot be created because the wintun driver is missing. the configuration
+// and identities remain available over ipc so the UI can show them and prompt for a repair but nothing is connected
+func enterDegradedMode(cause error) {
+	log.Errorf("the TUN could not be created, the service is running in degraded mode: %v", cause)
+	rts.state.Active = false
+	rts.state.Degraded = true
+	rts.state.DegradedReason = cause.Error()
+	loadIdsFromState()
+	rts.BroadcastEvent(dto.TunnelDegradedEvent{
+		ActionEvent: dto.WINTUN_DRIVER_MISSING,
+		Reason:      rts.state.DegradedReason,
+	})
 }
 
 func setTunInfo(s *dto.TunnelStatus) {
@@ -494,6 +548,12 @@ func serveIpc(conn net.Conn) {
 			continue
 		}
 
+		if lockErr := rts.lockedByPolicy(cmd.Function); lockErr != nil {
+			log.Warn(lockErr)
+			respondWithError(enc, "the setting cannot be changed", ERROR, lockErr)
+			continue
+		}
+
 		switch cmd.Function {
 		case "AddIdentity":
 			addIdMsg, addErr := reader.ReadString('\n')
@@ -563,11 +623,12 @@ func serveIpc(conn net.Conn) {
 			sendIdentityAndNotifyUI(enc, cmd.Payload["Fingerprint"].(string))
 		case "ZitiDump":
 			log.Debug("request to ZitiDump received")
-			for _, id := range rts.ids {
+			for _, id := range rts.allIds() {
 				if id.CId != nil {
 					cziti.ZitiDump(id.CId, fmt.Sprintf(`%s\%s.ziti.txt`, config.LogsPath(), id.Name))
 				}
 			}
+			rts.writeResourceStats()
 			log.Debug("request to ZitiDump complete")
 			respond(enc, dto.Response{Message: "ZitiDump complete", Code: SUCCESS, Error: "", Payload: nil})
 		case "EnableMFA":
@@ -596,6 +657,456 @@ func serveIpc(conn net.Conn) {
 		case "UpdateFrequency":
 			notificationFreq := cmd.Payload["NotificationFrequency"].(float64)
 			updateNotificationFrequency(enc, int(notificationFreq))
+		case "UpdateDnsTtl":
+			ttl, ok := cmd.Payload["DnsTtlSeconds"].(float64)
+			if !ok {
+				respondWithError(enc, "could not set the dns ttl", ERROR, fmt.Errorf("DnsTtlSeconds must be a number"))
+				break
+			}
+			ttlSet := rts.UpdateDnsTtl(int(ttl))
+			respond(enc, dto.Response{Message: "dns ttl is set", Code: SUCCESS, Error: "", Payload: ttlSet})
+		case "SetDnsQueryLogging":
+			enabled, _ := cmd.Payload["DnsQueryLogging"].(bool)
+			rts.UpdateDnsQueryLogging(enabled)
+			respond(enc, dto.Response{Message: "dns query logging is set", Code: SUCCESS, Error: "", Payload: enabled})
+		case "SetDnsFailureMode":
+			mode, _ := cmd.Payload["DnsFailureMode"].(string)
+			if err := rts.UpdateDnsFailureMode(mode); err != nil {
+				respondWithError(enc, "could not set the dns failure mode", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "dns failure mode is set", Code: SUCCESS, Error: "", Payload: rts.state.DnsFailureMode})
+			}
+		case "SetTunIpConflict":
+			mode, _ := cmd.Payload["TunIpConflict"].(string)
+			if err := rts.UpdateTunIpConflict(mode); err != nil {
+				respondWithError(enc, "could not set the tun ip conflict", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "tun ip conflict is set", Code: SUCCESS, Error: "", Payload: rts.state.TunIpConflict})
+			}
+		case "SetVerifyRouteRemoval":
+			enabled, _ := cmd.Payload["VerifyRouteRemoval"].(bool)
+			rts.UpdateVerifyRouteRemoval(enabled)
+			respond(enc, dto.Response{Message: "verify route removal is set", Code: SUCCESS, Error: "", Payload: enabled})
+		case "SetSplitTunnel":
+			enabled, _ := cmd.Payload["SplitTunnel"].(bool)
+			metric := rts.UpdateSplitTunnel(enabled)
+			respond(enc, dto.Response{Message: "split tunnel is set", Code: SUCCESS, Error: "", Payload: metric})
+		case "SetTunAutoRecover":
+			enabled, _ := cmd.Payload["TunAutoRecover"].(bool)
+			rts.UpdateTunAutoRecover(enabled)
+			respond(enc, dto.Response{Message: "tun auto recover is set", Code: SUCCESS, Error: "", Payload: enabled})
+		case "SetDnsRateLimit":
+			perSecond, _ := cmd.Payload["DnsRateLimit"].(float64)
+			burst, _ := cmd.Payload["DnsRateLimitBurst"].(float64)
+			if err := rts.UpdateDnsRateLimit(int(perSecond), int(burst)); err != nil {
+				respondWithError(enc, "could not set the dns rate limit", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "dns rate limit is set", Code: SUCCESS, Error: "", Payload: int(perSecond)})
+			}
+		case "UpdateControllerDialTimeout":
+			timeout, ok := cmd.Payload["ControllerDialTimeout"].(float64)
+			if !ok {
+				respondWithError(enc, "could not set the controller dial timeout", ERROR, fmt.Errorf("ControllerDialTimeout must be a number"))
+				break
+			}
+			timeoutSet := rts.UpdateControllerDialTimeout(int(timeout))
+			respond(enc, dto.Response{Message: "controller dial timeout is set", Code: SUCCESS, Error: "", Payload: timeoutSet})
+		case "VerifyAndRepair":
+			skip := make(map[string]bool)
+			if steps, ok := cmd.Payload["Skip"].([]interface{}); ok {
+				for _, step := range steps {
+					skip[fmt.Sprintf("%v", step)] = true
+				}
+			}
+			results := rts.VerifyAndRepair(skip)
+			respond(enc, dto.Response{Message: "verify and repair complete", Code: SUCCESS, Error: "", Payload: results})
+		case "ExportMetricsCsv":
+			fingerprint, _ := cmd.Payload["Fingerprint"].(string)
+			var buf bytes.Buffer
+			if err := rts.ExportMetricsCsv(&buf, fingerprint); err != nil {
+				respondWithError(enc, "could not export metrics", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "metrics exported", Code: SUCCESS, Error: "", Payload: buf.String()})
+			}
+		case "OrphanCandidates":
+			candidates, err := rts.OrphanCandidates()
+			if err != nil {
+				respondWithError(enc, "could not list the orphaned identities", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "orphaned identities", Code: SUCCESS, Error: "", Payload: candidates})
+			}
+		case "ExportInventory":
+			var buf bytes.Buffer
+			if err := rts.ExportInventory(&buf); err != nil {
+				respondWithError(enc, "could not export the identity inventory", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "identity inventory exported", Code: SUCCESS, Error: "", Payload: buf.String()})
+			}
+		case "ListAdapterCleanup":
+			respond(enc, dto.Response{Message: "adapters removed by the cleanup", Code: SUCCESS, Error: "", Payload: CleanUpZitiTUNAdaptersDryRun(TunName)})
+		case "CurrentDnsConfig":
+			cfg, err := rts.CurrentDnsConfig()
+			if err != nil {
+				respondWithError(enc, "could not read the dns configuration", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "dns configuration", Code: SUCCESS, Error: "", Payload: cfg})
+			}
+		case "SetLazy":
+			fingerprint, ok := cmd.Payload["Fingerprint"].(string)
+			if !ok {
+				respondWithError(enc, "could not set lazy", IDENTITY_NOT_FOUND, fmt.Errorf("the Fingerprint is required"))
+				break
+			}
+			lazy, ok := cmd.Payload["Lazy"].(bool)
+			if !ok {
+				respondWithError(enc, "could not set lazy", ERROR, fmt.Errorf("Lazy must be true or false"))
+				break
+			}
+			setLazy(enc, fingerprint, lazy)
+		case "SetLoadPriority":
+			fingerprint, ok := cmd.Payload["Fingerprint"].(string)
+			if !ok {
+				respondWithError(enc, "could not set the load priority", IDENTITY_NOT_FOUND, fmt.Errorf("the Fingerprint is required"))
+				break
+			}
+			priority, ok := cmd.Payload["LoadPriority"].(float64)
+			if !ok {
+				respondWithError(enc, "could not set the load priority", ERROR, fmt.Errorf("LoadPriority must be a number"))
+				break
+			}
+			setLoadPriority(enc, fingerprint, int(priority))
+		case "SetIdentityApiPageSize":
+			fingerprint, _ := cmd.Payload["Fingerprint"].(string)
+			pageSize, _ := cmd.Payload["ApiPageSize"].(float64)
+			setIdentityApiPageSize(enc, fingerprint, int(pageSize))
+		case "SetSchedule":
+			fingerprint, _ := cmd.Payload["Fingerprint"].(string)
+			var schedule *dto.Schedule
+			if s, ok := cmd.Payload["Schedule"].(map[string]interface{}); ok {
+				schedule = &dto.Schedule{}
+				schedule.Start, _ = s["Start"].(string)
+				schedule.End, _ = s["End"].(string)
+				if days, ok := s["Days"].([]interface{}); ok {
+					for _, d := range days {
+						if day, ok := d.(string); ok {
+							schedule.Days = append(schedule.Days, day)
+						}
+					}
+				}
+			}
+			id, err := setSchedule(fingerprint, schedule)
+			if err != nil {
+				respondWithError(enc, "could not set the schedule of the identity", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "identity schedule is set", Code: SUCCESS, Error: "", Payload: Clean(id)})
+			}
+		case "SetConnectTimeout":
+			fingerprint, _ := cmd.Payload["Fingerprint"].(string)
+			timeout, _ := cmd.Payload["ConnectTimeout"].(float64)
+			setConnectTimeout(enc, fingerprint, int(timeout))
+		case "VerifyBackupIntegrity":
+			if err := rts.VerifyBackupIntegrity(); err != nil {
+				respondWithError(enc, "config backup verification failed", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "config backup verified", Code: SUCCESS, Error: "", Payload: ""})
+			}
+		case "PlanNetworkChanges":
+			plan, err := rts.PlanNetworkChanges()
+			if err != nil {
+				respondWithError(enc, "could not plan the network changes", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "network plan", Code: SUCCESS, Error: "", Payload: plan})
+			}
+		case "ResourceStats":
+			respond(enc, dto.Response{Message: "resource stats", Code: SUCCESS, Error: "", Payload: rts.ResourceStats()})
+		case "DnsCoverage":
+			respond(enc, dto.Response{Message: "dns coverage", Code: SUCCESS, Error: "", Payload: rts.DnsCoverage()})
+		case "ListInterceptions":
+			fingerprint, ok := cmd.Payload["Fingerprint"].(string)
+			if !ok {
+				respondWithError(enc, "could not list interceptions", IDENTITY_NOT_FOUND, fmt.Errorf("the Fingerprint is required"))
+				break
+			}
+			interceptions, err := rts.ListInterceptions(fingerprint)
+			if err != nil {
+				respondWithError(enc, "could not list interceptions", IDENTITY_NOT_FOUND, err)
+			} else {
+				respond(enc, dto.Response{Message: "interceptions", Code: SUCCESS, Error: "", Payload: interceptions})
+			}
+		case "SetLogDestination":
+			d := dto.LogDestination{}
+			d.Path, _ = cmd.Payload["Path"].(string)
+			hours, _ := cmd.Payload["RotationHours"].(float64)
+			count, _ := cmd.Payload["RotationCount"].(float64)
+			d.RotationHours = int(hours)
+			d.RotationCount = int(count)
+			if err := rts.UpdateLogDestination(d); err != nil {
+				respondWithError(enc, "could not move the log file", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "log file moved", Code: SUCCESS, Error: "", Payload: logging.LogFilePath()})
+			}
+		case "SetStaticHostOverrides":
+			overrides := make(map[string]string)
+			if o, ok := cmd.Payload["StaticHostOverrides"].(map[string]interface{}); ok {
+				for host, addr := range o {
+					overrides[host] = fmt.Sprintf("%v", addr)
+				}
+			}
+			if err := rts.UpdateStaticHostOverrides(overrides); err != nil {
+				respondWithError(enc, "could not set the static host overrides", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "static host overrides set", Code: SUCCESS, Error: "", Payload: overrides})
+			}
+		case "SetLoopbackMappings":
+			mappings := make([]dto.LoopbackMapping, 0)
+			if list, ok := cmd.Payload["LoopbackMappings"].([]interface{}); ok {
+				for _, l := range list {
+					if m, ok := l.(map[string]interface{}); ok {
+						mapping := dto.LoopbackMapping{}
+						port, _ := m["Port"].(float64)
+						servicePort, _ := m["ServicePort"].(float64)
+						mapping.Port = int(port)
+						mapping.ServicePort = int(servicePort)
+						mapping.Service, _ = m["Service"].(string)
+						mappings = append(mappings, mapping)
+					}
+				}
+			}
+			if err := rts.UpdateLoopbackMappings(mappings); err != nil {
+				respondWithError(enc, "could not set the loopback mappings", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "loopback mappings set", Code: SUCCESS, Error: "", Payload: mappings})
+			}
+		case "PrepareUninstall":
+			export, _ := cmd.Payload["Export"].(bool)
+			results := rts.PrepareUninstall(export)
+			respond(enc, dto.Response{Message: "prepared for uninstall", Code: SUCCESS, Error: "", Payload: results})
+		case "DnsResponderStats":
+			stats := rts.DnsResponderStats()
+			if reset, _ := cmd.Payload["Reset"].(bool); reset {
+				rts.ResetDnsResponderStats()
+			}
+			respond(enc, dto.Response{Message: "dns responder stats", Code: SUCCESS, Error: "", Payload: stats})
+		case "ImportPfx":
+			path, ok := cmd.Payload["Path"].(string)
+			if !ok || path == "" {
+				respondWithError(enc, "could not import the pfx file", COULD_NOT_ENROLL, fmt.Errorf("the Path of the pfx file is required"))
+				break
+			}
+			controllerUrl, ok := cmd.Payload["ControllerUrl"].(string)
+			if !ok || controllerUrl == "" {
+				respondWithError(enc, "could not import the pfx file", COULD_NOT_ENROLL, fmt.Errorf("the ControllerUrl is required"))
+				break
+			}
+			password, _ := cmd.Payload["Password"].(string)
+			name, _ := cmd.Payload["Name"].(string)
+			id, err := rts.ImportPfx(path, password, controllerUrl, name)
+			if err != nil {
+				respondWithError(enc, "could not import the pfx file", COULD_NOT_ENROLL, err)
+			} else {
+				respond(enc, dto.Response{Message: "success", Code: SUCCESS, Error: "", Payload: Clean(id)})
+			}
+		case "GetDnsSearchDomains":
+			domains, err := rts.GetDnsSearchDomains()
+			if err != nil {
+				respondWithError(enc, "could not get the dns search domains", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "dns search domains", Code: SUCCESS, Error: "", Payload: domains})
+			}
+		case "SetDnsSearchDomains":
+			domains := make([]string, 0)
+			if d, ok := cmd.Payload["DnsSearchDomains"].([]interface{}); ok {
+				for _, domain := range d {
+					domains = append(domains, fmt.Sprintf("%v", domain))
+				}
+			}
+			set, err := rts.SetDnsSearchDomains(domains)
+			if err != nil {
+				respondWithError(enc, "could not set the dns search domains", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "dns search domains set", Code: SUCCESS, Error: "", Payload: set})
+			}
+		case "SetWins":
+			servers := make([]string, 0)
+			if s, ok := cmd.Payload["WinsServers"].([]interface{}); ok {
+				for _, server := range s {
+					servers = append(servers, fmt.Sprintf("%v", server))
+				}
+			}
+			disable, _ := cmd.Payload["DisableNetbios"].(bool)
+			set, err := rts.SetWins(servers, disable)
+			if err != nil {
+				respondWithError(enc, "could not set the wins servers", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "wins servers set", Code: SUCCESS, Error: "", Payload: set})
+			}
+		case "DryLoadAll":
+			validate, _ := cmd.Payload["Validate"].(bool)
+			results, err := rts.DryLoadAll(validate)
+			if err != nil {
+				respondWithError(enc, "could not check the identity files", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "identity files checked", Code: SUCCESS, Error: "", Payload: results})
+			}
+		case "RouteDiff":
+			expected := make([]dto.RouteInfo, 0)
+			if routes, ok := cmd.Payload["Expected"].([]interface{}); ok {
+				for _, r := range routes {
+					if m, ok := r.(map[string]interface{}); ok {
+						route := dto.RouteInfo{}
+						route.Destination, _ = m["Destination"].(string)
+						route.NextHop, _ = m["NextHop"].(string)
+						metric, _ := m["Metric"].(float64)
+						route.Metric = uint32(metric)
+						expected = append(expected, route)
+					}
+				}
+			}
+			diff, err := rts.RouteDiff(expected)
+			if err != nil {
+				respondWithError(enc, "could not compare the routes", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "routes compared", Code: SUCCESS, Error: "", Payload: diff})
+			}
+		case "SetLogRotation":
+			maxSize, _ := cmd.Payload["LogMaxSizeMb"].(float64)
+			maxFiles, _ := cmd.Payload["LogMaxFiles"].(float64)
+			if err := rts.UpdateLogRotation(int(maxSize), int(maxFiles)); err != nil {
+				respondWithError(enc, "could not set the log rotation", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "log rotation set", Code: SUCCESS, Error: "", Payload: logging.LogFilePath()})
+			}
+		case "EffectiveConfig":
+			respond(enc, dto.Response{Message: "effective config", Code: SUCCESS, Error: "", Payload: rts.EffectiveConfig()})
+		case "MfaSatisfied":
+			fingerprint, ok := cmd.Payload["Fingerprint"].(string)
+			if !ok {
+				respondWithError(enc, "could not check the mfa", MFA_FINGERPRINT_NOT_FOUND, fmt.Errorf("the Fingerprint is required"))
+				break
+			}
+			satisfied, renewIn, err := rts.MfaSatisfied(fingerprint)
+			if errors.Is(err, ErrIdentityNotFound) {
+				respondWithError(enc, "could not check the mfa", MFA_FINGERPRINT_NOT_FOUND, err)
+			} else if err != nil {
+				respondWithError(enc, "could not check the mfa", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "mfa checked", Code: SUCCESS, Error: "", Payload: dto.MfaSatisfaction{
+					Fingerprint:    fingerprint,
+					Satisfied:      satisfied,
+					RenewInSeconds: int64(renewIn.Seconds()),
+				}})
+			}
+		case "NextMfaDeadline":
+			respond(enc, dto.Response{Message: "next mfa deadline", Code: SUCCESS, Error: "", Payload: rts.NextMfaDeadline()})
+		case "MigrateController":
+			oldHostSuffix, _ := cmd.Payload["OldHostSuffix"].(string)
+			newHost, _ := cmd.Payload["NewHost"].(string)
+			results, err := rts.MigrateController(oldHostSuffix, newHost)
+			if err != nil {
+				respondWithError(enc, "could not migrate the controller", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "controller migrated", Code: SUCCESS, Error: "", Payload: results})
+			}
+		case "TestEnrollment":
+			path, _ := cmd.Payload["Path"].(string)
+			respond(enc, dto.Response{Message: "enrollment tested", Code: SUCCESS, Error: "", Payload: rts.TestEnrollment(path)})
+		case "RecentLogs":
+			count, _ := cmd.Payload["Count"].(float64)
+			minLevel, _ := cmd.Payload["MinLevel"].(string)
+			respond(enc, dto.Response{Message: "recent logs", Code: SUCCESS, Error: "", Payload: rts.RecentLogs(int(count), minLevel)})
+		case "IdentityInventory":
+			respond(enc, dto.Response{Message: "identity inventory", Code: SUCCESS, Error: "", Payload: rts.IdentityInventory()})
+		case "ReEnroll":
+			fingerprint, _ := cmd.Payload["Fingerprint"].(string)
+			jwt, _ := cmd.Payload["JwtString"].(string)
+			id, err := rts.ReEnroll(fingerprint, jwt)
+			if errors.Is(err, ErrIdentityNotFound) {
+				respondWithError(enc, "could not re-enroll the identity", IDENTITY_NOT_FOUND, err)
+			} else if err != nil {
+				respondWithError(enc, "could not re-enroll the identity", COULD_NOT_ENROLL, err)
+			} else {
+				respond(enc, dto.Response{Message: "identity re-enrolled", Code: SUCCESS, Error: "", Payload: Clean(id)})
+			}
+		case "Warnings":
+			respond(enc, dto.Response{Message: "warnings", Code: SUCCESS, Error: "", Payload: rts.Warnings()})
+		case "ClearWarnings":
+			respond(enc, dto.Response{Message: "warnings cleared", Code: SUCCESS, Error: "", Payload: rts.ClearWarnings()})
+		case "RotateKey":
+			fingerprint, _ := cmd.Payload["Fingerprint"].(string)
+			id, err := rts.RotateKey(fingerprint)
+			if errors.Is(err, ErrIdentityNotFound) {
+				respondWithError(enc, "could not rotate the key of the identity", IDENTITY_NOT_FOUND, err)
+			} else if err != nil {
+				respondWithError(enc, "could not rotate the key of the identity", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "identity key rotated", Code: SUCCESS, Error: "", Payload: Clean(id)})
+			}
+		case "RebuildIdentityIndex":
+			result := rts.RebuildIdentityIndex()
+			respond(enc, dto.Response{Message: "identity index rebuilt", Code: SUCCESS, Error: "", Payload: result})
+		case "PruneBackups":
+			removed, err := rts.PruneBackups()
+			if err != nil {
+				respondWithError(enc, "could not prune the config backups", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "config backups pruned", Code: SUCCESS, Error: "", Payload: removed})
+			}
+		case "DiffConfigs":
+			a, _ := cmd.Payload["A"].(string)
+			b, _ := cmd.Payload["B"].(string)
+			diffs, err := DiffConfigs(a, b)
+			if err != nil {
+				respondWithError(enc, "could not compare the configs", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "configs compared", Code: SUCCESS, Error: "", Payload: diffs})
+			}
+		case "ConfigHash":
+			hash, err := rts.ConfigHash()
+			if err != nil {
+				respondWithError(enc, "could not compute the config hash", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "config hash", Code: SUCCESS, Error: "", Payload: hash})
+			}
+		case "CheckClockSkew":
+			fingerprint, _ := cmd.Payload["Fingerprint"].(string)
+			skew, err := rts.CheckClockSkew(fingerprint)
+			if errors.Is(err, ErrIdentityNotFound) {
+				respondWithError(enc, "could not check the clock skew", IDENTITY_NOT_FOUND, err)
+			} else if err != nil {
+				respondWithError(enc, "could not check the clock skew", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "clock skew checked", Code: SUCCESS, Error: "", Payload: skew})
+			}
+		case "ServiceLatencyHistory":
+			fingerprint, _ := cmd.Payload["Fingerprint"].(string)
+			serviceName, _ := cmd.Payload["ServiceName"].(string)
+			respond(enc, dto.Response{Message: "service latency history", Code: SUCCESS, Error: "", Payload: rts.ServiceLatencyHistory(fingerprint, serviceName)})
+		case "SetLatencyMonitoring":
+			monitors := make([]dto.LatencyMonitor, 0)
+			if list, ok := cmd.Payload["LatencyMonitors"].([]interface{}); ok {
+				for _, l := range list {
+					if m, ok := l.(map[string]interface{}); ok {
+						monitor := dto.LatencyMonitor{}
+						monitor.Fingerprint, _ = m["Fingerprint"].(string)
+						monitor.Service, _ = m["Service"].(string)
+						monitors = append(monitors, monitor)
+					}
+				}
+			}
+			interval, _ := cmd.Payload["LatencySampleInterval"].(float64)
+			if err := rts.UpdateLatencyMonitoring(monitors, int(interval)); err != nil {
+				respondWithError(enc, "could not set the latency monitoring", ERROR, err)
+			} else {
+				respond(enc, dto.Response{Message: "latency monitoring set", Code: SUCCESS, Error: "", Payload: monitors})
+			}
+		case "ProbeService":
+			fingerprint, _ := cmd.Payload["Fingerprint"].(string)
+			serviceName, _ := cmd.Payload["ServiceName"].(string)
+			if fingerprint == "" || serviceName == "" {
+				respondWithError(enc, "could not probe the service", ERROR, fmt.Errorf("the Fingerprint and ServiceName are required"))
+				break
+			}
+			probeService(enc, fingerprint, serviceName)
 		case "Debug":
 			dbg()
 			respond(enc, dto.Response{
@@ -770,6 +1281,7 @@ func serveEvents(conn net.Conn) {
 
 	w := bufio.NewWriter(conn)
 	o := json.NewEncoder(w)
+	go readEventFilters(conn, id)
 
 	log.Info("new event client connected - sending current status")
 	err := o.Encode(dto.TunnelStatusEvent{
@@ -783,6 +1295,12 @@ func serveEvents(conn net.Conn) {
 	} else {
 		log.Info("status sent. listening for new events")
 	}
+	if rts.state.Degraded {
+		_ = o.Encode(dto.TunnelDegradedEvent{
+			ActionEvent: dto.WINTUN_DRIVER_MISSING,
+			Reason:      rts.state.DegradedReason,
+		})
+	}
 
 loop:
 	for {
@@ -808,6 +1326,21 @@ loop:
 	log.Info("a connected event client has disconnected")
 }
 
+// readEventFilters reads the filters a consumer may write to the events pipe. consumers which never write anything
+// keep receiving every event
+func readEventFilters(conn net.Conn, id string) {
+	dec := json.NewDecoder(conn)
+	for {
+		var f dto.EventFilter
+		if err := dec.Decode(&f); err != nil {
+			log.Tracef("no longer reading event filters for id: %s. %v", id, err)
+			return
+		}
+		log.Debugf("event client %s subscribed to fingerprints: %v ops: %v", id, f.Fingerprints, f.Ops)
+		events.filter(id, f)
+	}
+}
+
 func writerFlush(writer bufio.Writer) {
 	writer.Flush()
 }
@@ -846,22 +1379,27 @@ func toggleIdentity(out *json.Encoder, fingerprint string, onOff bool) {
 			Payload: nil,
 		})
 	} else {
-		if onOff {
-			connectIdentity(id)
-		} else {
-			err := disconnectIdentity(id)
-			if err != nil {
-				log.Warnf("could not disconnect identity: %v", err)
-			}
-		}
-		id.Active = onOff
-		rts.SaveState()
+		setIdentityActive(id, onOff)
 		respond(out, dto.Response{Message: "identity toggled", Code: SUCCESS, Error: "", Payload: Clean(id)})
 	}
 
 	log.Debugf("toggle ziti on/off for %s: %t responded to", fingerprint, onOff)
 }
 
+// setIdentityActive connects or disconnects the identity and saves it as active or not
+func setIdentityActive(id *Id, onOff bool) {
+	if onOff {
+		connectIdentity(id)
+	} else {
+		err := disconnectIdentity(id)
+		if err != nil {
+			log.Warnf("could not disconnect identity: %v", err)
+		}
+	}
+	id.Active = onOff
+	rts.SaveState()
+}
+
 func removeTempFile(file os.File) {
 	err := os.Remove(file.Name()) // clean up
 	if err != nil {
@@ -876,6 +1414,11 @@ func removeTempFile(file os.File) {
 func newIdentity(newId dto.AddIdentity, out *json.Encoder) {
 	log.Debugf("new identity for %s: %s", newId.Id.Name, newId.EnrollmentFlags.JwtString)
 
+	if err := rts.identityLimitReached(); err != nil {
+		respondWithError(out, "the identity cannot be added", COULD_NOT_ENROLL, err)
+		return
+	}
+
 	tokenStr := newId.EnrollmentFlags.JwtString
 	log.Debugf("jwt to parse: %s", tokenStr)
 	tkn, _, err := enroll.ParseToken(tokenStr)
@@ -940,6 +1483,11 @@ func newIdentity(newId dto.AddIdentity, out *json.Encoder) {
 	if err != nil {
 		log.Panicf("An unexpected and unrecoverable error has occurred while %s: %v", "enrolling an identity", err)
 	}
+	if rts.Find(newId.Id.FingerPrint) != nil {
+		removeTempFile(*enrolled)
+		respondWithError(out, fmt.Sprintf("an identity with fingerprint %s already exists", newId.Id.FingerPrint), FINGERPRINT_CONFLICT, nil)
+		return
+	}
 	newPath := newId.Id.Path()
 
 	//move the temp file to its final home after enrollment
@@ -956,16 +1504,12 @@ func newIdentity(newId dto.AddIdentity, out *json.Encoder) {
 	id := &Id{
 		Identity: dto.Identity{
 			FingerPrint: newId.Id.FingerPrint,
+			Active:      true, //since it's a new id being added - presume that it's active
 		},
 	}
 
-	rts.ids[id.FingerPrint] = id
-	id.Active = true //since it's a new id being added - presume that it's active
-	connectIdentity(id)
-
-	state := rts.state
 	//if successful parse the output and add the config to the identity
-	state.Identities = append(state.Identities, &newId.Id)
+	rts.addIdentity(id, &newId.Id)
 
 	//return successful message
 	resp := dto.Response{Message: "success", Code: SUCCESS, Error: "", Payload: Clean(id)}
@@ -984,16 +1528,23 @@ func respondWithError(out *json.Encoder, msg string, code int, err error) {
 }
 
 func connectIdentity(id *Id) {
+	if rts.state.Degraded {
+		log.Warnf("not connecting identity %s[%s]. the service is running in degraded mode: %s", id.Name, id.FingerPrint, rts.state.DegradedReason)
+		startupLoad.done(id, LoadStateFailed, rts.state.DegradedReason)
+		return
+	}
 	log.Infof("connecting identity: %s[%s]", id.Name, id.FingerPrint)
 
 	if id.CId == nil || !id.CId.Loaded {
 		rts.LoadIdentity(id, DEFAULT_REFRESH_INTERVAL)
+		startupLoad.reportConnectAttempt(id)
 		rts.BroadcastEvent(dto.IdentityEvent{
 			ActionEvent: dto.IDENTITY_ADDED,
 			Id:          id.Identity,
 		})
 	} else {
 		log.Debugf("%s[%s] is already loaded", id.Name, id.FingerPrint)
+		startupLoad.done(id, LoadStateLoaded, "")
 
 		id.CId.Services.Range(func(key interface{}, value interface{}) bool {
 			id.Services = append(id.Services, nil)
@@ -1044,6 +1595,7 @@ func disconnectIdentity(id *Id) error {
 				ActionEvent: dto.IDENTITY_DISCONNECTED,
 				Id:          id.Identity,
 			})
+			runIdentityHook(id, HookPostDisconnect)
 			log.Infof("disconnecting identity complete: %s", id.Name)
 		}
 	} else {
@@ -1143,6 +1695,8 @@ func acceptServices() {
 }
 
 func handleBulkServiceChange(sc cziti.BulkServiceChange) {
+	// the rules of an identity going idle stay so its hostnames are still sent to the dns responder
+	lazyIdentities.keepIdleHostnames(sc.HostnamesToRemove)
 	if len(sc.HostnamesToRemove) > 0 {
 		log.Debug("removing rules from NRPT")
 		windns.RemoveNrptRules(sc.HostnamesToRemove)
@@ -1166,6 +1720,12 @@ func handleBulkServiceChange(sc cziti.BulkServiceChange) {
 
 	rts.BroadcastEvent(be)
 
+	if len(sc.ChangedServices) > 0 {
+		configChanges.signal(sc)
+	}
+	rts.warnServiceCidrConflicts(sc.Fingerprint, sc.ServicesToAdd)
+	loopback.servicesChanged(sc.Fingerprint, sc.ServicesToAdd, sc.ServicesToRemove, rts.state.LoopbackMappings)
+
 	id := rts.Find(sc.Fingerprint)
 	if id != nil {
 		var m = dto.IdentityEvent{
@@ -1210,9 +1770,15 @@ func secondsToReadableFmt(input int32) (result string) {
 
 func handleEvents(isInitialized chan struct{}) {
 	events.run()
-	d := 5 * time.Second
+	powerMode, _ := powerState.check()
+	d, sampleInterval := rts.metricsIntervals(powerMode)
 	every5s := time.NewTicker(d)
 	notificationFrequency = time.NewTicker(time.Duration(rts.state.NotificationFrequency) * time.Minute)
+	metricsSampling := time.NewTicker(sampleInterval)
+	powerCheck := time.NewTicker(constants.PowerStateCheckInterval * time.Second)
+	mfaReminderCheck := time.NewTicker(constants.MfaReminderCheckInterval * time.Second)
+	lazyIdleCheck := time.NewTicker(constants.LazyIdleCheckInterval * time.Second)
+	scheduleCheck := time.NewTicker(constants.ScheduleCheckInterval * time.Second)
 
 	defer log.Debugf("exiting handleEvents. loops were set for %v", d)
 	<-isInitialized
@@ -1230,6 +1796,33 @@ func handleEvents(isInitialized chan struct{}) {
 				Identities:  s.Identities,
 			})
 
+		case now := <-metricsSampling.C:
+			metricsSamples.record(now, rts.ToMetrics().Identities)
+
+		case <-powerCheck.C:
+			if mode, changed := powerState.check(); changed {
+				d, sampleInterval = rts.metricsIntervals(mode)
+				log.Infof("power mode is now %s. broadcasting metrics every %v and sampling them every %v", mode, d, sampleInterval)
+				every5s.Stop()
+				every5s = time.NewTicker(d)
+				metricsSampling.Stop()
+				metricsSampling = time.NewTicker(sampleInterval)
+			}
+
+		case now := <-mfaReminderCheck.C:
+			mfaReminders.check(now)
+
+		case now := <-lazyIdleCheck.C:
+			// every identity going idle or crossing its schedule is saved once
+			rts.BeginBatch()
+			lazyIdentities.idleCheck(now)
+			rts.EndBatch()
+
+		case now := <-scheduleCheck.C:
+			rts.BeginBatch()
+			schedules.check(now)
+			rts.EndBatch()
+
 		// notification message
 		case <-notificationFrequency.C:
 			broadcastNotification(false)
@@ -1240,7 +1833,7 @@ func handleEvents(isInitialized chan struct{}) {
 func broadcastNotification(adhoc bool) {
 	changedNotifiedStatus := false
 	cleanNotifications := make([]cziti.NotificationMessage, 0)
-	for _, id := range rts.ids {
+	for _, id := range rts.allIds() {
 
 		if id.CId == nil || !id.CId.MfaRefreshNeeded() || !id.MfaEnabled {
 			continue
@@ -1318,19 +1911,36 @@ func Clean(src *Id) dto.Identity {
 	}
 
 	log.Tracef("cleaning identity: %s: mfaNeeded: %t mfaEnabled:%t", src.Name, mfaNeeded, mfaEnabled)
-	AddMetrics(src)
+	metrics := AddMetrics(src)
+	hooks := rts.identityHooks(src.FingerPrint)
 	nid := dto.Identity{
-		Name:              src.Name,
-		FingerPrint:       src.FingerPrint,
-		Active:            src.Active,
-		Config:            idcfg.Config{},
-		ControllerVersion: src.ControllerVersion,
-		Status:            "",
-		MfaNeeded:         mfaNeeded,
-		MfaEnabled:        mfaEnabled,
-		Services:          make([]*dto.Service, 0),
-		Metrics:           src.Metrics,
-		Tags:              nil,
+		Name:                  src.Name,
+		FingerPrint:           src.FingerPrint,
+		Active:                src.Active,
+		Config:                idcfg.Config{},
+		ControllerVersion:     src.ControllerVersion,
+		Status:                "",
+		MfaNeeded:             mfaNeeded,
+		MfaEnabled:            mfaEnabled,
+		Services:              make([]*dto.Service, 0),
+		Metrics:               metrics,
+		Tags:                  nil,
+		LastError:             src.LastError,
+		ReadOnly:              src.ReadOnly,
+		LoadPriority:          src.LoadPriority,
+		ConnectTimeout:        src.ConnectTimeout,
+		ApiPageSize:           src.ApiPageSize,
+		Recovered:             src.Recovered,
+		RecoveredAt:           src.RecoveredAt,
+		PendingRemoval:        src.PendingRemoval,
+		UnresolvedName:        src.UnresolvedName,
+		Lazy:                  src.Lazy,
+		LazyHostnames:         src.LazyHostnames,
+		LazyState:             src.LazyState,
+		PostConnectCommand:    hooks.PostConnectCommand,
+		PostDisconnectCommand: hooks.PostDisconnectCommand,
+		Schedule:              src.Schedule,
+		NextTransition:        src.NextTransition,
 	}
 
 	if src.CId != nil {
@@ -1391,15 +2001,19 @@ func Clean(src *Id) dto.Identity {
 	return nid
 }
 
-func AddMetrics(id *Id) {
-	if id == nil || id.CId == nil {
-		return
+// AddMetrics reads the transfer rates of the identity and returns a copy of them, which stays consistent while the
+// rates are read again from another goroutine
+func AddMetrics(id *Id) *dto.Metrics {
+	if id == nil {
+		return nil
 	}
-	id.Metrics = &dto.Metrics{}
-	up, down, _ := id.CId.GetMetrics()
-
-	id.Metrics.Up = up
-	id.Metrics.Down = down
+	if id.CId != nil {
+		up, down, _ := id.CId.GetMetrics()
+		id.metricsLock.Lock()
+		id.Metrics = &dto.Metrics{Up: up, Down: down}
+		id.metricsLock.Unlock()
+	}
+	return id.metrics()
 }
 
 func authMfa(out *json.Encoder, fingerprint string, code string) {
@@ -1435,7 +2049,7 @@ func sendLogLevelAndNotify(enc *json.Encoder, loglevel string) {
 
 // when the identity status is updated through command line, the message is sent to UI as well
 func sendIdentityAndNotifyUI(enc *json.Encoder, fingerprint string) {
-	for _, id := range rts.ids {
+	for _, id := range rts.allIds() {
 		if id.FingerPrint == fingerprint {
 			rts.BroadcastEvent(dto.IdentityEvent{
 				ActionEvent: dto.IDENTITY_ADDED,
@@ -1466,3 +2080,109 @@ func updateNotificationFrequency(out *json.Encoder, notificationFreq int) {
 	respond(out, dto.Response{Message: "Notification frequency is set", Code: SUCCESS, Error: "", Payload: ""})
 
 }
+
+func probeService(out *json.Encoder, fingerprint string, serviceName string) {
+	reachable, latency, err := rts.ProbeService(fingerprint, serviceName)
+	probe := dto.ServiceProbe{
+		Fingerprint: fingerprint,
+		ServiceName: serviceName,
+		Reachable:   reachable,
+		LatencyMs:   latency.Milliseconds(),
+	}
+	if err != nil {
+		log.Infof("probe of service %s for identity %s failed: %v", serviceName, fingerprint, err)
+		probe.Error = err.Error()
+		respond(out, dto.Response{Message: "service probe failed", Code: ERROR, Error: err.Error(), Payload: probe})
+		return
+	}
+	respond(out, dto.Response{Message: "service probe complete", Code: SUCCESS, Error: "", Payload: probe})
+}
+
+func setLazy(out *json.Encoder, fingerprint string, lazy bool) {
+	id := rts.Find(fingerprint)
+	if id == nil {
+		respondWithError(out, fmt.Sprintf("identity with fingerprint %s not found", fingerprint), IDENTITY_NOT_FOUND, nil)
+		return
+	}
+	id.Lazy = lazy
+	if !lazy {
+		// an idle identity is connected now that it is no longer lazy
+		lazyIdentities.queried(fingerprint)
+		id.LazyState = ""
+	}
+	rts.SaveState()
+	respond(out, dto.Response{Message: "lazy loading is set", Code: SUCCESS, Error: "", Payload: fingerprint})
+}
+
+func setLoadPriority(out *json.Encoder, fingerprint string, priority int) {
+	id := rts.Find(fingerprint)
+	if id == nil {
+		respondWithError(out, fmt.Sprintf("identity with fingerprint %s not found", fingerprint), IDENTITY_NOT_FOUND, nil)
+		return
+	}
+	id.LoadPriority = priority
+	rts.SaveState()
+	respond(out, dto.Response{Message: "load priority is set", Code: SUCCESS, Error: "", Payload: priority})
+}
+
+// setIdentityApiPageSize sets the page size used the next time the identity is loaded. 0 uses the ApiPageSize of the
+// config again
+func setIdentityApiPageSize(out *json.Encoder, fingerprint string, pageSize int) {
+	id := rts.Find(fingerprint)
+	if id == nil {
+		respondWithError(out, fmt.Sprintf("identity with fingerprint %s not found", fingerprint), IDENTITY_NOT_FOUND, nil)
+		return
+	}
+	if pageSize != 0 && (pageSize < constants.MinimumApiPageSize || pageSize > constants.MaximumApiPageSize) {
+		respondWithError(out, fmt.Sprintf("the api page size must be between %d and %d", constants.MinimumApiPageSize, constants.MaximumApiPageSize), ERROR, nil)
+		return
+	}
+	id.ApiPageSize = pageSize
+	rts.SaveState()
+	respond(out, dto.Response{Message: "api page size is set. it is used the next time the identity is loaded", Code: SUCCESS, Error: "", Payload: pageSize})
+}
+
+func setConnectTimeout(out *json.Encoder, fingerprint string, seconds int) {
+	id := rts.Find(fingerprint)
+	if id == nil {
+		respondWithError(out, fmt.Sprintf("identity with fingerprint %s not found", fingerprint), IDENTITY_NOT_FOUND, nil)
+		return
+	}
+	if seconds != 0 && seconds < constants.MinimumConnectTimeout {
+		respondWithError(out, fmt.Sprintf("the connect timeout cannot be less than %d seconds", constants.MinimumConnectTimeout), ERROR, nil)
+		return
+	}
+	id.ConnectTimeout = seconds
+	rts.SaveState()
+	respond(out, dto.Response{Message: "connect timeout is set", Code: SUCCESS, Error: "", Payload: seconds})
+}
+
+// checkStrictIpv4Mask returns an error instead of letting the mask be clamped when StrictTunIpv4Mask is set. an unset
+// mask still uses the default
+func checkStrictIpv4Mask(ipv4mask int) error {
+	if !rts.state.StrictTunIpv4Mask || ipv4mask == 0 {
+		return nil
+	}
+	if ipv4mask < constants.Ipv4MaxMask || ipv4mask > constants.Ipv4MinMask {
+		return fmt.Errorf("the configured TunIpv4Mask %d is not between %d and %d. refusing to start as StrictTunIpv4Mask is set",
+			ipv4mask, constants.Ipv4MaxMask, constants.Ipv4MinMask)
+	}
+	return nil
+}
+
+// dnsListenAddresses returns the valid addresses from DnsListenAddresses the dns responder also answers on
+func dnsListenAddresses(tunIp net.IP) []net.IP {
+	addrs := make([]net.IP, 0, len(rts.state.DnsListenAddresses))
+	for _, a := range rts.state.DnsListenAddresses {
+		ip := net.ParseIP(strings.TrimSpace(a))
+		if ip == nil || ip.IsUnspecified() {
+			log.Warnf("ignoring dns listen address %s. it is not a valid ip", a)
+			continue
+		}
+		if ip.Equal(tunIp) {
+			continue
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs
+}
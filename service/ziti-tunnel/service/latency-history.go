@@ -0,0 +1,144 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"sync"
+	"time"
+)
+
+// latencyRing is a fixed size ring of the latency samples of one service of one identity
+type latencyRing struct {
+	samples []dto.LatencySample
+	next    int
+	full    bool
+}
+
+// latencyHistory keeps a latencyRing per identity and service
+type latencyHistory struct {
+	lock  sync.Mutex
+	size  int
+	rings map[string]*latencyRing
+}
+
+func newLatencyHistory(size int) *latencyHistory {
+	return &latencyHistory{
+		size:  size,
+		rings: make(map[string]*latencyRing),
+	}
+}
+
+var latencySamples = newLatencyHistory(constants.LatencyHistorySize)
+
+// the function used to measure the latency of a service, a variable so that it can be swapped out
+var measureLatency = func(fingerprint string, service string) (time.Duration, error) {
+	_, latency, err := rts.ProbeService(fingerprint, service)
+	return latency, err
+}
+
+func latencyKey(fingerprint string, service string) string {
+	return fingerprint + "/" + service
+}
+
+func (h *latencyHistory) record(fingerprint string, service string, sample dto.LatencySample) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := latencyKey(fingerprint, service)
+	ring, ok := h.rings[key]
+	if !ok {
+		ring = &latencyRing{samples: make([]dto.LatencySample, h.size)}
+		h.rings[key] = ring
+	}
+	ring.samples[ring.next] = sample
+	ring.next = (ring.next + 1) % len(ring.samples)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// snapshot returns the retained samples of the service of the identity, oldest first
+func (h *latencyHistory) snapshot(fingerprint string, service string) []dto.LatencySample {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ring, ok := h.rings[latencyKey(fingerprint, service)]
+	if !ok {
+		return make([]dto.LatencySample, 0)
+	}
+	if !ring.full {
+		return append([]dto.LatencySample(nil), ring.samples[:ring.next]...)
+	}
+	return append(append([]dto.LatencySample(nil), ring.samples[ring.next:]...), ring.samples[:ring.next]...)
+}
+
+// sampleLatencies probes every monitored service once. a failed probe is kept as a sample with its error
+func sampleLatencies(monitors []dto.LatencyMonitor, now time.Time) {
+	for _, m := range monitors {
+		latency, err := measureLatency(m.Fingerprint, m.Service)
+		sample := dto.LatencySample{Time: now, LatencyMs: latency.Milliseconds()}
+		if err != nil {
+			log.Debugf("latency sample of service %s for identity %s failed: %v", m.Service, m.Fingerprint, err)
+			sample.Error = err.Error()
+		}
+		latencySamples.record(m.Fingerprint, m.Service, sample)
+	}
+}
+
+// sampleLatencyPeriodically samples the monitored services every LatencySampleInterval seconds until the service
+// shuts down. the interval is read again after every round so a change applies without a restart
+func sampleLatencyPeriodically() {
+	for {
+		interval := rts.state.LatencySampleInterval
+		wait := time.Duration(interval) * time.Second
+		if interval < 1 {
+			wait = constants.LatencyIdleCheckInterval * time.Second
+		}
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(wait):
+		}
+		if interval > 0 {
+			sampleLatencies(rts.state.LatencyMonitors, time.Now())
+		}
+	}
+}
+
+// ServiceLatencyHistory returns the latency samples retained for the service of the identity, oldest first
+func (t *RuntimeState) ServiceLatencyHistory(fingerprint string, service string) []dto.LatencySample {
+	return latencySamples.snapshot(fingerprint, service)
+}
+
+// UpdateLatencyMonitoring sets the services sampled and the seconds between samples. an interval of 0 disables it
+func (t *RuntimeState) UpdateLatencyMonitoring(monitors []dto.LatencyMonitor, interval int) error {
+	if interval != 0 && interval < constants.MinimumLatencySampleInterval {
+		return fmt.Errorf("the latency sample interval must be 0 or at least %d seconds", constants.MinimumLatencySampleInterval)
+	}
+	for _, m := range monitors {
+		if m.Fingerprint == "" || m.Service == "" {
+			return fmt.Errorf("a monitored service needs a fingerprint and a service name")
+		}
+	}
+	log.Infof("setting latency monitoring : %d services every %d seconds", len(monitors), interval)
+	t.state.LatencyMonitors = monitors
+	t.state.LatencySampleInterval = interval
+	t.SaveState()
+	return nil
+}
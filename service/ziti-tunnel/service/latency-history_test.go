@@ -0,0 +1,109 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistory(t *testing.T) {
+	h := newLatencyHistory(3)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		h.record("fp", "svc", dto.LatencySample{Time: start.Add(time.Duration(i) * time.Second), LatencyMs: int64(i)})
+	}
+	h.record("fp", "other", dto.LatencySample{LatencyMs: 100})
+
+	got := make([]int64, 0)
+	for _, s := range h.snapshot("fp", "svc") {
+		got = append(got, s.LatencyMs)
+	}
+	if want := []int64{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot() = %v, want the last samples oldest first %v", got, want)
+	}
+	if other := h.snapshot("fp", "other"); len(other) != 1 || other[0].LatencyMs != 100 {
+		t.Errorf("snapshot() of a partly filled ring = %+v", other)
+	}
+	if none := h.snapshot("fp", "unknown"); none == nil || len(none) != 0 {
+		t.Errorf("snapshot() of a service never sampled = %#v, want an empty list", none)
+	}
+}
+
+func TestSampleLatencies(t *testing.T) {
+	savedSamples, savedMeasure := latencySamples, measureLatency
+	defer func() { latencySamples, measureLatency = savedSamples, savedMeasure }()
+	latencySamples = newLatencyHistory(10)
+	measureLatency = func(fingerprint string, service string) (time.Duration, error) {
+		if service == "down" {
+			return 0, errors.New("no terminators")
+		}
+		return 42 * time.Millisecond, nil
+	}
+
+	now := time.Now()
+	sampleLatencies([]dto.LatencyMonitor{{Fingerprint: "fp", Service: "up"}, {Fingerprint: "fp", Service: "down"}}, now)
+
+	up := latencySamples.snapshot("fp", "up")
+	if len(up) != 1 || up[0].LatencyMs != 42 || up[0].Error != "" || !up[0].Time.Equal(now) {
+		t.Errorf("samples of the reachable service = %+v", up)
+	}
+	down := latencySamples.snapshot("fp", "down")
+	if len(down) != 1 || down[0].Error != "no terminators" {
+		t.Errorf("a failed probe was not kept with its error: %+v", down)
+	}
+}
+
+func TestUpdateLatencyMonitoring(t *testing.T) {
+	useTempConfigDir(t)
+	monitors := []dto.LatencyMonitor{{Fingerprint: "fp", Service: "svc"}}
+
+	tests := []struct {
+		name     string
+		monitors []dto.LatencyMonitor
+		interval int
+		wantErr  bool
+	}{
+		{"disabled", monitors, 0, false},
+		{"minimum", monitors, 5, false},
+		{"too short", monitors, 4, true},
+		{"no service", []dto.LatencyMonitor{{Fingerprint: "fp"}}, 30, true},
+		{"no fingerprint", []dto.LatencyMonitor{{Service: "svc"}}, 30, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{LatencySampleInterval: 60}}
+			err := rt.UpdateLatencyMonitoring(tt.monitors, tt.interval)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UpdateLatencyMonitoring() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if rt.state.LatencySampleInterval != 60 || rt.state.LatencyMonitors != nil {
+					t.Errorf("a rejected update changed the state: %+v", rt.state)
+				}
+				return
+			}
+			if rt.state.LatencySampleInterval != tt.interval || !reflect.DeepEqual(rt.state.LatencyMonitors, tt.monitors) {
+				t.Errorf("the state was not updated: %d %+v", rt.state.LatencySampleInterval, rt.state.LatencyMonitors)
+			}
+		})
+	}
+}
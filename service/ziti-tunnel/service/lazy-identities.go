@@ -0,0 +1,183 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/windns"
+	"sync"
+	"time"
+)
+
+const (
+	LazyIdle   = "idle"   // not connected, its hostnames are answered by connecting it
+	LazyActive = "active" // connected, disconnected again after LazyIdleTimeout minutes without traffic
+)
+
+// lazyLoader connects lazy identities the first time one of their hostnames is queried and disconnects them when
+// they stop being used. a lazy identity which was never connected has no known hostnames and is connected at startup
+type lazyLoader struct {
+	sync.Mutex
+	lastUse       map[string]time.Time
+	idleHostnames map[string]bool
+}
+
+var lazyIdentities = &lazyLoader{
+	lastUse:       make(map[string]time.Time),
+	idleHostnames: make(map[string]bool),
+}
+
+// connectOrDefer connects the identity unless it is lazy and its hostnames are known, in which case only the
+// hostnames are registered with the dns responder
+func (l *lazyLoader) connectOrDefer(id *Id) {
+	if !id.Lazy || !id.Active || len(id.LazyHostnames) == 0 {
+		if id.Lazy {
+			l.Lock()
+			id.LazyState = LazyActive
+			l.lastUse[id.FingerPrint] = time.Now()
+			l.Unlock()
+		}
+		connectIdentity(id)
+		return
+	}
+
+	log.Infof("identity %s[%s] is lazy. it is connected the first time one of its %d hostnames is queried", id.Name, id.FingerPrint, len(id.LazyHostnames))
+	l.Lock()
+	id.LazyState = LazyIdle
+	l.Unlock()
+	startupLoad.done(id, LoadStateDeferred, "")
+	l.register()
+	windns.AddNrptRules(hostnameSet(id.LazyHostnames), rts.state.TunIpv4)
+}
+
+// register gives the dns responder the hostnames of every idle identity
+func (l *lazyLoader) register() {
+	l.Lock()
+	defer l.Unlock()
+	hostnames := make(map[string]string)
+	l.idleHostnames = make(map[string]bool)
+	for _, id := range rts.allIds() {
+		if id.LazyState != LazyIdle {
+			continue
+		}
+		for _, h := range id.LazyHostnames {
+			hostnames[h] = id.FingerPrint
+			l.idleHostnames[h] = true
+		}
+	}
+	cziti.SetLazyHostnames(hostnames, l.queried)
+}
+
+// queried connects an idle identity. called by the dns responder when one of its hostnames is queried
+func (l *lazyLoader) queried(fingerprint string) {
+	id := rts.Find(fingerprint)
+	if id == nil {
+		return
+	}
+	l.Lock()
+	if id.LazyState != LazyIdle {
+		// already being connected by an earlier query
+		l.Unlock()
+		return
+	}
+	id.LazyState = LazyActive
+	l.lastUse[fingerprint] = time.Now()
+	l.Unlock()
+
+	l.register()
+	log.Infof("first use of lazy identity %s[%s]. connecting", id.Name, id.FingerPrint)
+	connectIdentity(id)
+}
+
+// idleCheck disconnects the lazy identities which had no traffic for LazyIdleTimeout minutes
+func (l *lazyLoader) idleCheck(now time.Time) {
+	timeout := time.Duration(rts.state.LazyIdleTimeout) * time.Minute
+	for _, id := range rts.allIds() {
+		if !id.Lazy || id.LazyState != LazyActive || id.CId == nil || !id.CId.Loaded {
+			continue
+		}
+		up, down, _ := id.CId.GetMetrics()
+		l.Lock()
+		if up > 0 || down > 0 {
+			l.lastUse[id.FingerPrint] = now
+		}
+		idle := now.Sub(l.lastUse[id.FingerPrint]) >= timeout
+		l.Unlock()
+		if idle {
+			l.goIdle(id)
+		}
+	}
+}
+
+// goIdle remembers the hostnames of the identity, hands them to the dns responder and disconnects it
+func (l *lazyLoader) goIdle(id *Id) {
+	hostnames := make([]string, 0)
+	id.CId.Services.Range(func(key interface{}, value interface{}) bool {
+		if svc := value.(*cziti.ZService).Service; svc != nil {
+			for _, addr := range svc.Addresses {
+				if addr.IsHost {
+					hostnames = append(hostnames, addr.HostName)
+				}
+			}
+		}
+		return true
+	})
+	if len(hostnames) == 0 {
+		// without hostnames nothing would ever connect it again
+		log.Debugf("lazy identity %s[%s] has no hostnames. it stays connected", id.Name, id.FingerPrint)
+		return
+	}
+
+	log.Infof("lazy identity %s[%s] had no traffic for %d minutes. disconnecting", id.Name, id.FingerPrint, rts.state.LazyIdleTimeout)
+	l.Lock()
+	id.LazyHostnames = hostnames
+	id.LazyState = LazyIdle
+	l.Unlock()
+	// registered before disconnecting so the nrpt rules of the hostnames are kept
+	l.register()
+
+	if err := disconnectIdentity(id); err != nil {
+		log.Warnf("could not disconnect lazy identity %s: %v", id.FingerPrint, err)
+	}
+	id.Active = true
+	id.CId.Loaded = false
+	id.CId.Shutdown()
+	rts.idsLock.Lock()
+	id.CId = nil
+	rts.idsLock.Unlock()
+	rts.SaveState()
+}
+
+// keepIdleHostnames drops the hostnames of idle identities from the nrpt rules about to be removed
+func (l *lazyLoader) keepIdleHostnames(toRemove map[string]bool) {
+	l.Lock()
+	defer l.Unlock()
+	for h := range toRemove {
+		if l.idleHostnames[h] {
+			delete(toRemove, h)
+		}
+	}
+}
+
+func hostnameSet(hostnames []string) map[string]bool {
+	set := make(map[string]bool, len(hostnames))
+	for _, h := range hostnames {
+		set[h] = true
+	}
+	return set
+}
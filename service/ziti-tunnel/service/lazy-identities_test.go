@@ -0,0 +1,76 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+func TestLazyRegister(t *testing.T) {
+	saved := rts.ids
+	defer func() { rts.ids = saved }()
+	rts.ids = map[string]*Id{
+		"idle":   {Identity: dto.Identity{FingerPrint: "idle", Lazy: true, LazyState: LazyIdle, LazyHostnames: []string{"a.ziti", "b.ziti"}}},
+		"active": {Identity: dto.Identity{FingerPrint: "active", Lazy: true, LazyState: LazyActive, LazyHostnames: []string{"c.ziti"}}},
+		"eager":  {Identity: dto.Identity{FingerPrint: "eager", LazyHostnames: []string{"d.ziti"}}},
+	}
+	l := &lazyLoader{lastUse: make(map[string]time.Time), idleHostnames: make(map[string]bool)}
+	l.register()
+	tests := []struct {
+		hostname string
+		want     bool
+	}{
+		{"a.ziti", true},
+		{"b.ziti", true},
+		{"c.ziti", false},
+		{"d.ziti", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			if got := l.idleHostnames[tt.hostname]; got != tt.want {
+				t.Errorf("idleHostnames[%s] = %v, want %v", tt.hostname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLazyRegisterWhileChanging(t *testing.T) {
+	saved := rts.ids
+	defer func() { rts.ids = saved }()
+	rts.ids = make(map[string]*Id)
+	l := &lazyLoader{lastUse: make(map[string]time.Time), idleHostnames: make(map[string]bool)}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			fp := string(rune('a' + i%26))
+			rts.idsLock.Lock()
+			rts.ids[fp] = &Id{Identity: dto.Identity{FingerPrint: fp, Lazy: true, LazyState: LazyIdle}}
+			rts.idsLock.Unlock()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		l.register()
+	}
+	wg.Wait()
+}
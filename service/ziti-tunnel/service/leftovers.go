@@ -0,0 +1,90 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/windns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// removeLeftoversOfLastTun removes the routes and nrpt rules left behind when the service did not shut down cleanly.
+// only what belongs to the TUN recorded in the TunMarker of the saved state is removed. runs before the config is
+// loaded and the TUN is created
+func removeLeftoversOfLastTun() {
+	saved, err := stateStore.Load(false)
+	if err != nil || saved == nil || saved.TunMarker == nil {
+		log.Debug("no TUN marker saved. no leftover routes or nrpt rules to look for")
+		return
+	}
+	marker := saved.TunMarker
+	luid := winipcfg.LUID(marker.Luid)
+
+	if _, err = luid.Interface(); err == nil {
+		// the adapter and its routes are removed together by CleanUpZitiTUNAdapters
+		log.Infof("the TUN from the last run still exists. it will be removed with its routes")
+	} else {
+		removed := 0
+		for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+			rows, err := winipcfg.GetIPForwardTable2(family)
+			if err != nil {
+				log.Warnf("could not read the route table to look for leftover routes: %v", err)
+				continue
+			}
+			for i := range rows {
+				if uint64(rows[i].InterfaceLUID) != marker.Luid {
+					continue
+				}
+				dest := rows[i].DestinationPrefix.IPNet()
+				if err = rows[i].Delete(); err != nil {
+					log.Warnf("could not remove leftover route %s of the last TUN: %v", dest.String(), err)
+					continue
+				}
+				log.Infof("removed leftover route %s via %s of the last TUN", dest.String(), rows[i].NextHop.IP())
+				removed++
+			}
+		}
+		log.Infof("removed %d leftover routes of the last TUN", removed)
+	}
+
+	rules, err := windns.GetNrptRules()
+	if err != nil {
+		log.Warnf("could not look for leftover nrpt rules: %v", err)
+		return
+	}
+	if stale := staleNrptNamespaces(rules, marker.Ip); len(stale) > 0 {
+		log.Infof("removing %d leftover nrpt rules pointing at %s", len(stale), marker.Ip)
+		windns.RemoveNrptRules(stale)
+	}
+}
+
+// staleNrptNamespaces returns the namespaces of the rules which send queries to the ip of the last TUN
+func staleNrptNamespaces(rules []dto.NrptRule, tunIp string) map[string]bool {
+	stale := make(map[string]bool)
+	for _, rule := range rules {
+		for _, ns := range rule.NameServers {
+			if ns == tunIp {
+				for _, namespace := range rule.Namespace {
+					stale[namespace] = true
+				}
+			}
+		}
+	}
+	return stale
+}
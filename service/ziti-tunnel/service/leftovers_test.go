@@ -0,0 +1,64 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"testing"
+)
+
+func TestStaleNrptNamespaces(t *testing.T) {
+	rules := []dto.NrptRule{
+		{Namespace: []string{".web.ziti", ".db.ziti"}, NameServers: []string{"100.64.0.1"}},
+		{Namespace: []string{".other.ziti"}, NameServers: []string{"100.64.0.2"}},
+		{Namespace: []string{".both.ziti"}, NameServers: []string{"100.64.0.2", "100.64.0.1"}},
+	}
+	tests := []struct {
+		name  string
+		tunIp string
+		want  map[string]bool
+	}{
+		{"rules of the last TUN", "100.64.0.1", map[string]bool{".web.ziti": true, ".db.ziti": true, ".both.ziti": true}},
+		{"rules of another ip", "100.64.0.2", map[string]bool{".other.ziti": true, ".both.ziti": true}},
+		{"no rules point at the ip", "100.64.0.9", map[string]bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staleNrptNamespaces(rules, tt.tunIp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("staleNrptNamespaces() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigHashIgnoresTunMarker(t *testing.T) {
+	rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{TunIpv4: "100.64.0.1"}}
+	before, err := rt.ConfigHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.state.TunMarker = &dto.TunMarker{Luid: 42, Ip: "100.64.0.1"}
+	after, err := rt.ConfigHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Errorf("ConfigHash() changed from %s to %s when the TUN marker was recorded", before, after)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"sync"
+)
+
+// the states of an identity reported while loading the identities at startup
+const (
+	LoadStateLoading  = "loading"
+	LoadStateLoaded   = "loaded"
+	LoadStateFailed   = "failed"
+	LoadStateDeferred = "deferred" // lazy identity, connected once one of its hostnames is queried
+)
+
+// loadProgress follows the identities loaded at startup and broadcasts every change so the UI can show how far along
+// the load is. it stops reporting once every identity settled
+type loadProgress struct {
+	sync.Mutex
+	pending map[string]bool
+	total   int
+	settled int
+	loaded  int
+}
+
+var startupLoad = &loadProgress{}
+
+// begin starts following the given identities
+func (p *loadProgress) begin(ids []*Id) {
+	p.Lock()
+	defer p.Unlock()
+	p.pending = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		p.pending[id.FingerPrint] = true
+	}
+	p.total = len(ids)
+	p.settled = 0
+	p.loaded = 0
+	if p.total == 0 {
+		p.pending = nil
+	}
+}
+
+// loading reports the identity has started to load
+func (p *loadProgress) loading(id *Id) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.pending[id.FingerPrint] {
+		return
+	}
+	p.broadcast(id, LoadStateLoading, "")
+}
+
+// done reports the identity is no longer loading. only the first report of each identity counts
+func (p *loadProgress) done(id *Id, state string, reason string) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.pending[id.FingerPrint] {
+		return
+	}
+	delete(p.pending, id.FingerPrint)
+	p.settled++
+	if state == LoadStateLoaded {
+		p.loaded++
+	}
+	p.broadcast(id, state, reason)
+	if len(p.pending) == 0 {
+		log.Infof("identities loaded at startup: %d of %d", p.loaded, p.total)
+		p.pending = nil
+	}
+}
+
+func (p *loadProgress) broadcast(id *Id, state string, reason string) {
+	log.Debugf("identity %s[%s] is %s. %d of %d settled", id.Name, id.FingerPrint, state, p.settled, p.total)
+	rts.BroadcastEvent(dto.IdentityLoadProgressEvent{
+		ActionEvent: dto.IDENTITY_LOAD_PROGRESS,
+		Fingerprint: id.FingerPrint,
+		Name:        id.Name,
+		State:       state,
+		Error:       reason,
+		Settled:     p.settled,
+		Loaded:      p.loaded,
+		Total:       p.total,
+		Done:        p.settled == p.total,
+	})
+}
+
+// reportConnectAttempt reports where the attempt of connectIdentity left the identity
+func (p *loadProgress) reportConnectAttempt(id *Id) {
+	switch {
+	case id.CId == nil:
+		p.done(id, LoadStateFailed, id.LastError)
+	case id.CId.Loaded:
+		p.done(id, LoadStateLoaded, "")
+	default:
+		p.loading(id)
+	}
+}
+
+// reportStatus reports the first status of the context of the identity
+func (p *loadProgress) reportStatus(id *Id, status int) {
+	if status == 0 {
+		p.done(id, LoadStateLoaded, "")
+		return
+	}
+	reason := id.LastError
+	if _, err := id.CId.Status(); err != nil {
+		reason = err.Error()
+	}
+	p.done(id, LoadStateFailed, reason)
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"testing"
+)
+
+func TestLoadProgress(t *testing.T) {
+	saved := events.broadcast
+	defer func() { events.broadcast = saved }()
+	events.broadcast = make(chan interface{}, 20)
+
+	a := &Id{Identity: dto.Identity{FingerPrint: "a", Name: "a"}}
+	b := &Id{Identity: dto.Identity{FingerPrint: "b", Name: "b", LastError: "no controller"}}
+	c := &Id{Identity: dto.Identity{FingerPrint: "c", Name: "c"}}
+	unknown := &Id{Identity: dto.Identity{FingerPrint: "unknown"}}
+
+	p := &loadProgress{}
+	p.begin([]*Id{a, b, c})
+	p.loading(a)
+	p.done(a, LoadStateLoaded, "")
+	p.reportConnectAttempt(b)
+	p.done(b, LoadStateLoaded, "") // only the first report counts
+	p.done(unknown, LoadStateLoaded, "")
+	p.done(c, LoadStateDeferred, "")
+	p.loading(c) // nothing is reported once every identity settled
+
+	want := []dto.IdentityLoadProgressEvent{
+		{Fingerprint: "a", State: LoadStateLoading, Total: 3},
+		{Fingerprint: "a", State: LoadStateLoaded, Settled: 1, Loaded: 1, Total: 3},
+		{Fingerprint: "b", State: LoadStateFailed, Error: "no controller", Settled: 2, Loaded: 1, Total: 3},
+		{Fingerprint: "c", State: LoadStateDeferred, Settled: 3, Loaded: 1, Total: 3, Done: true},
+	}
+	close(events.broadcast)
+	i := 0
+	for e := range events.broadcast {
+		got, ok := e.(dto.IdentityLoadProgressEvent)
+		if !ok {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		if i >= len(want) {
+			t.Fatalf("unexpected event %+v", got)
+		}
+		w := want[i]
+		w.ActionEvent, w.Name = dto.IDENTITY_LOAD_PROGRESS, w.Fingerprint
+		if got != w {
+			t.Errorf("event %d = %+v, want %+v", i, got, w)
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Errorf("got %d events, want %d", i, len(want))
+	}
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// portProxy forwards connections made to a loopback port to another address, a variable so that it can be swapped out
+type portProxy interface {
+	add(listenPort int, address string, port int) error
+	remove(listenPort int) error
+}
+
+var loopbackProxy portProxy = netshPortProxy{}
+
+// the function used to check if something already listens on a loopback port
+var loopbackPortInUse = func(port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return true
+	}
+	_ = l.Close()
+	return false
+}
+
+// netshPortProxy uses the portproxy of windows. it is provided by the IP Helper service and survives restarts of the
+// tunneler, which is why the configured ports are removed again when the config is loaded
+type netshPortProxy struct{}
+
+func (netshPortProxy) add(listenPort int, address string, port int) error {
+	return netsh("add", fmt.Sprintf("listenport=%d", listenPort), "connectaddress="+address, fmt.Sprintf("connectport=%d", port))
+}
+
+func (netshPortProxy) remove(listenPort int) error {
+	return netsh("delete", fmt.Sprintf("listenport=%d", listenPort))
+}
+
+func netsh(op string, args ...string) error {
+	cmdArgs := append([]string{"interface", "portproxy", op, "v4tov4", "listenaddress=127.0.0.1"}, args...)
+	log.Tracef("running netsh %s", strings.Join(cmdArgs, " "))
+	cmd := exec.Command("netsh", cmdArgs...)
+	output := new(bytes.Buffer)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("netsh portproxy %s failed: %v %s", op, err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// loopbackIntercepts forwards the loopback ports of LoopbackMappings to the intercept of their service. loopback
+// traffic never reaches the TUN, the portproxy sends it to the intercepted address of the service which does
+type loopbackIntercepts struct {
+	sync.Mutex
+	services  map[loopbackService]*dto.Service // services of the loaded identities
+	installed map[int]string                   // loopback port -> address:port it is forwarded to
+}
+
+// loopbackService is a service of an identity. two identities may provide services with the same name
+type loopbackService struct {
+	fingerprint string
+	name        string
+}
+
+var loopback = &loopbackIntercepts{
+	services:  make(map[loopbackService]*dto.Service),
+	installed: make(map[int]string),
+}
+
+// validateLoopbackMappings checks the ports of the mappings are valid and that no port is mapped twice
+func validateLoopbackMappings(mappings []dto.LoopbackMapping) error {
+	seen := make(map[int]bool, len(mappings))
+	for _, m := range mappings {
+		if m.Port < 1 || m.Port > 65535 {
+			return fmt.Errorf("loopback port %d is not between 1 and 65535", m.Port)
+		}
+		if m.ServicePort < 0 || m.ServicePort > 65535 {
+			return fmt.Errorf("service port %d of loopback port %d is not between 1 and 65535", m.ServicePort, m.Port)
+		}
+		if strings.TrimSpace(m.Service) == "" {
+			return fmt.Errorf("loopback port %d is not mapped to a service", m.Port)
+		}
+		if seen[m.Port] {
+			return fmt.Errorf("loopback port %d is mapped more than once", m.Port)
+		}
+		seen[m.Port] = true
+	}
+	return nil
+}
+
+// loopbackTarget returns the intercepted address and port connections to the loopback port of m are forwarded to.
+// the port is the ServicePort of the mapping, or its loopback port when not set, and must be intercepted by svc
+func loopbackTarget(m dto.LoopbackMapping, svc *dto.Service) (string, int, error) {
+	port := m.ServicePort
+	if port == 0 {
+		port = m.Port
+	}
+	intercepted := len(svc.Ports) == 0
+	for _, r := range svc.Ports {
+		if port >= r.Low && port <= r.High {
+			intercepted = true
+			break
+		}
+	}
+	if !intercepted {
+		return "", 0, fmt.Errorf("port %d is not intercepted by service %s", port, svc.Name)
+	}
+	for _, a := range svc.Addresses {
+		if a.IsHost && a.HostName != "" && !strings.HasPrefix(a.HostName, "*") {
+			return a.HostName, port, nil
+		}
+		if !a.IsHost && a.IP != "" && (a.Prefix == 0 || a.Prefix == 32) {
+			return a.IP, port, nil
+		}
+	}
+	return "", 0, fmt.Errorf("service %s has no single hostname or ip intercepted", svc.Name)
+}
+
+// servicesChanged keeps track of the services available from the identity and forwards the ports mapped to them
+func (l *loopbackIntercepts) servicesChanged(fingerprint string, added []*dto.Service, removed []*dto.Service, mappings []dto.LoopbackMapping) {
+	l.Lock()
+	for _, svc := range removed {
+		if svc != nil {
+			delete(l.services, loopbackService{fingerprint: fingerprint, name: svc.Name})
+		}
+	}
+	for _, svc := range added {
+		if svc != nil {
+			l.services[loopbackService{fingerprint: fingerprint, name: svc.Name}] = svc
+		}
+	}
+	forwarding := len(l.installed) > 0
+	l.Unlock()
+	if len(mappings) > 0 || forwarding {
+		l.apply(mappings)
+	}
+}
+
+// apply forwards the loopback ports of the mappings whose service is available and stops forwarding the others. a
+// port something else already listens on is not forwarded
+func (l *loopbackIntercepts) apply(mappings []dto.LoopbackMapping) {
+	l.Lock()
+	defer l.Unlock()
+	wanted := make(map[int]string, len(mappings))
+	for _, m := range mappings {
+		svc := l.serviceOf(m)
+		if svc == nil {
+			continue
+		}
+		address, port, err := loopbackTarget(m, svc)
+		if err != nil {
+			log.Warn(recordWarning(WarningConfig, "not forwarding loopback port %d: %v", m.Port, err))
+			continue
+		}
+		wanted[m.Port] = net.JoinHostPort(address, strconv.Itoa(port))
+	}
+
+	for listenPort, target := range l.installed {
+		if wanted[listenPort] == target {
+			continue
+		}
+		if err := loopbackProxy.remove(listenPort); err != nil {
+			log.Warnf("could not stop forwarding loopback port %d: %v", listenPort, err)
+			continue
+		}
+		log.Infof("stopped forwarding loopback port %d to %s", listenPort, target)
+		delete(l.installed, listenPort)
+	}
+
+	for listenPort, target := range wanted {
+		if _, ok := l.installed[listenPort]; ok {
+			continue
+		}
+		if loopbackPortInUse(listenPort) {
+			log.Warn(recordWarning(WarningConfig, "not forwarding loopback port %d to %s. something already listens on it", listenPort, target))
+			continue
+		}
+		host, port, _ := net.SplitHostPort(target)
+		p, _ := strconv.Atoi(port)
+		if err := loopbackProxy.add(listenPort, host, p); err != nil {
+			log.Warn(recordWarning(WarningConfig, "could not forward loopback port %d to %s: %v", listenPort, target, err))
+			continue
+		}
+		log.Infof("forwarding loopback port %d to %s", listenPort, target)
+		l.installed[listenPort] = target
+	}
+}
+
+// serviceOf returns the service the mapping forwards to. without a fingerprint the service of the identity with the
+// lowest fingerprint is used so the same one is picked every time. nil when no identity provides it
+func (l *loopbackIntercepts) serviceOf(m dto.LoopbackMapping) *dto.Service {
+	if m.Fingerprint != "" {
+		return l.services[loopbackService{fingerprint: m.Fingerprint, name: m.Service}]
+	}
+	var found *dto.Service
+	first := ""
+	for key, svc := range l.services {
+		if key.name == m.Service && (found == nil || key.fingerprint < first) {
+			found = svc
+			first = key.fingerprint
+		}
+	}
+	return found
+}
+
+// forget removes the forwarding of the ports left by a previous run, before anything is forwarded by this one
+func (l *loopbackIntercepts) forget(mappings []dto.LoopbackMapping) {
+	for _, m := range mappings {
+		if err := loopbackProxy.remove(m.Port); err != nil {
+			log.Tracef("loopback port %d was not forwarded: %v", m.Port, err)
+		}
+	}
+}
+
+// removeAll stops forwarding every loopback port
+func (l *loopbackIntercepts) removeAll() {
+	l.apply(nil)
+}
+
+// UpdateLoopbackMappings replaces the loopback ports forwarded to ziti services
+func (t *RuntimeState) UpdateLoopbackMappings(mappings []dto.LoopbackMapping) error {
+	if err := validateLoopbackMappings(mappings); err != nil {
+		return err
+	}
+	log.Infof("setting %d loopback mappings", len(mappings))
+	t.state.LoopbackMappings = mappings
+	t.SaveState()
+	loopback.apply(mappings)
+	return nil
+}
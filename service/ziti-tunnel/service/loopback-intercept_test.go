@@ -0,0 +1,131 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"testing"
+)
+
+// fakePortProxy records the forwarded ports instead of calling netsh
+type fakePortProxy map[int]string
+
+func (f fakePortProxy) add(listenPort int, address string, port int) error {
+	f[listenPort] = fmt.Sprintf("%s:%d", address, port)
+	return nil
+}
+
+func (f fakePortProxy) remove(listenPort int) error {
+	delete(f, listenPort)
+	return nil
+}
+
+func loopbackTestService(name string, host string) *dto.Service {
+	return &dto.Service{Name: name, Addresses: []dto.Address{{IsHost: true, HostName: host}}}
+}
+
+func TestLoopbackServicesOfIdentities(t *testing.T) {
+	savedProxy, savedInUse := loopbackProxy, loopbackPortInUse
+	defer func() { loopbackProxy, loopbackPortInUse = savedProxy, savedInUse }()
+	loopbackPortInUse = func(int) bool { return false }
+
+	mapping := dto.LoopbackMapping{Port: 8080, Service: "web"}
+	tests := []struct {
+		name     string
+		mappings []dto.LoopbackMapping
+		removeB  bool
+		removeA  bool
+		want     map[int]string
+	}{
+		{"lowest fingerprint", []dto.LoopbackMapping{mapping}, false, false, map[int]string{8080: "a.ziti:8080"}},
+		{"identity of the mapping", []dto.LoopbackMapping{{Port: 8080, Service: "web", Fingerprint: "fpB"}}, false, false, map[int]string{8080: "b.ziti:8080"}},
+		{"other identity removes the service", []dto.LoopbackMapping{mapping}, true, false, map[int]string{8080: "a.ziti:8080"}},
+		{"falls back to the other identity", []dto.LoopbackMapping{mapping}, false, true, map[int]string{8080: "b.ziti:8080"}},
+		{"identity of the mapping removed", []dto.LoopbackMapping{{Port: 8080, Service: "web", Fingerprint: "fpB"}}, true, false, map[int]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := fakePortProxy{}
+			loopbackProxy = proxy
+			l := &loopbackIntercepts{services: make(map[loopbackService]*dto.Service), installed: make(map[int]string)}
+			a, b := loopbackTestService("web", "a.ziti"), loopbackTestService("web", "b.ziti")
+			l.servicesChanged("fpB", []*dto.Service{b}, nil, tt.mappings)
+			l.servicesChanged("fpA", []*dto.Service{a}, nil, tt.mappings)
+			if tt.removeB {
+				l.servicesChanged("fpB", nil, []*dto.Service{b}, tt.mappings)
+			}
+			if tt.removeA {
+				l.servicesChanged("fpA", nil, []*dto.Service{a}, tt.mappings)
+			}
+			if !reflect.DeepEqual(map[int]string(proxy), tt.want) {
+				t.Errorf("forwarded %v, want %v", proxy, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateLoopbackMappings(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings []dto.LoopbackMapping
+		wantErr  bool
+	}{
+		{"none", nil, false},
+		{"valid", []dto.LoopbackMapping{{Port: 80, Service: "web"}, {Port: 443, Service: "web", ServicePort: 8443}}, false},
+		{"port zero", []dto.LoopbackMapping{{Port: 0, Service: "web"}}, true},
+		{"service port too large", []dto.LoopbackMapping{{Port: 80, Service: "web", ServicePort: 70000}}, true},
+		{"no service", []dto.LoopbackMapping{{Port: 80, Service: " "}}, true},
+		{"port mapped twice", []dto.LoopbackMapping{{Port: 80, Service: "web"}, {Port: 80, Service: "db"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateLoopbackMappings(tt.mappings); (err != nil) != tt.wantErr {
+				t.Errorf("validateLoopbackMappings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoopbackTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		m        dto.LoopbackMapping
+		svc      *dto.Service
+		wantAddr string
+		wantPort int
+		wantErr  bool
+	}{
+		{"hostname", dto.LoopbackMapping{Port: 80}, loopbackTestService("web", "web.ziti"), "web.ziti", 80, false},
+		{"service port", dto.LoopbackMapping{Port: 8080, ServicePort: 80}, &dto.Service{Addresses: []dto.Address{{IP: "10.0.0.1", Prefix: 32}}, Ports: []dto.PortRange{{Low: 80, High: 80}}}, "10.0.0.1", 80, false},
+		{"port not intercepted", dto.LoopbackMapping{Port: 8080}, &dto.Service{Addresses: []dto.Address{{IP: "10.0.0.1"}}, Ports: []dto.PortRange{{Low: 80, High: 80}}}, "", 0, true},
+		{"cidr and wildcard only", dto.LoopbackMapping{Port: 80}, &dto.Service{Addresses: []dto.Address{{IP: "10.0.0.0", Prefix: 24}, {IsHost: true, HostName: "*.ziti"}}}, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, port, err := loopbackTarget(tt.m, tt.svc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loopbackTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if addr != tt.wantAddr || port != tt.wantPort {
+				t.Errorf("loopbackTarget() = %s:%d, want %s:%d", addr, port, tt.wantAddr, tt.wantPort)
+			}
+		})
+	}
+}
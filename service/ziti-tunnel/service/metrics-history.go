@@ -0,0 +1,104 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+type metricsSample struct {
+	Time        time.Time
+	Fingerprint string
+	Up          int64
+	Down        int64
+}
+
+// metricsHistory is a fixed size ring of metrics samples. once full the oldest samples are overwritten
+type metricsHistory struct {
+	lock    sync.Mutex
+	samples []metricsSample
+	next    int
+	full    bool
+}
+
+func newMetricsHistory(size int) *metricsHistory {
+	return &metricsHistory{
+		samples: make([]metricsSample, size),
+	}
+}
+
+func (h *metricsHistory) record(now time.Time, ids []*dto.Identity) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, id := range ids {
+		if id == nil || id.Metrics == nil {
+			continue
+		}
+		h.samples[h.next] = metricsSample{
+			Time:        now,
+			Fingerprint: id.FingerPrint,
+			Up:          id.Metrics.Up,
+			Down:        id.Metrics.Down,
+		}
+		h.next = (h.next + 1) % len(h.samples)
+		if h.next == 0 {
+			h.full = true
+		}
+	}
+}
+
+// snapshot returns the retained samples, oldest first
+func (h *metricsHistory) snapshot() []metricsSample {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.full {
+		return append([]metricsSample(nil), h.samples[:h.next]...)
+	}
+	return append(append([]metricsSample(nil), h.samples[h.next:]...), h.samples[:h.next]...)
+}
+
+// ExportMetricsCsv writes the retained metrics samples for the identity as csv. all identities are written when the
+// fingerprint is empty
+func (t *RuntimeState) ExportMetricsCsv(w io.Writer, fingerprint string) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"timestamp", "fingerprint", "up", "down"}); err != nil {
+		return err
+	}
+	for _, s := range metricsSamples.snapshot() {
+		if fingerprint != "" && s.Fingerprint != fingerprint {
+			continue
+		}
+		row := []string{
+			s.Time.UTC().Format(time.RFC3339),
+			s.Fingerprint,
+			strconv.FormatInt(s.Up, 10),
+			strconv.FormatInt(s.Down, 10),
+		}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bytes"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func metricsIdentity(fingerprint string, up int64, down int64) *dto.Identity {
+	return &dto.Identity{FingerPrint: fingerprint, Metrics: &dto.Metrics{Up: up, Down: down}}
+}
+
+func TestMetricsHistory(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name  string
+		size  int
+		ticks int
+		want  []int64 // the up rate of the retained samples, oldest first
+	}{
+		{"empty", 3, 0, []int64{}},
+		{"partly filled", 3, 2, []int64{0, 1}},
+		{"exactly full", 3, 3, []int64{0, 1, 2}},
+		{"wrapped", 3, 5, []int64{2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newMetricsHistory(tt.size)
+			for i := 0; i < tt.ticks; i++ {
+				h.record(start.Add(time.Duration(i)*time.Second), []*dto.Identity{metricsIdentity("fp", int64(i), 0)})
+			}
+			got := make([]int64, 0)
+			for _, s := range h.snapshot() {
+				got = append(got, s.Up)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("snapshot() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsHistorySkipsIdentitiesWithoutMetrics(t *testing.T) {
+	h := newMetricsHistory(4)
+	h.record(time.Now(), []*dto.Identity{nil, {FingerPrint: "none"}, metricsIdentity("fp", 1, 2)})
+	got := h.snapshot()
+	if len(got) != 1 || got[0].Fingerprint != "fp" {
+		t.Errorf("snapshot() = %+v, want only the sample of fp", got)
+	}
+}
+
+func TestExportMetricsCsv(t *testing.T) {
+	saved := metricsSamples
+	defer func() { metricsSamples = saved }()
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	metricsSamples = newMetricsHistory(8)
+	metricsSamples.record(start, []*dto.Identity{metricsIdentity("a", 10, 20), metricsIdentity("b", 30, 40)})
+	metricsSamples.record(start.Add(time.Minute), []*dto.Identity{metricsIdentity("a", 11, 21)})
+
+	header := "timestamp,fingerprint,up,down\n"
+	tests := []struct {
+		name        string
+		fingerprint string
+		want        string
+	}{
+		{"all identities", "", header +
+			"2026-01-02T02:04:05Z,a,10,20\n" +
+			"2026-01-02T02:04:05Z,b,30,40\n" +
+			"2026-01-02T02:05:05Z,a,11,21\n"},
+		{"one identity", "a", header +
+			"2026-01-02T02:04:05Z,a,10,20\n" +
+			"2026-01-02T02:05:05Z,a,11,21\n"},
+		{"unknown identity", "c", header},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := rts.ExportMetricsCsv(&buf, tt.fingerprint); err != nil {
+				t.Fatalf("ExportMetricsCsv() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("ExportMetricsCsv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
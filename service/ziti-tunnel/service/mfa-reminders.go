@@ -0,0 +1,74 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"time"
+)
+
+// mfaReminderSchedule broadcasts reminders for identities whose mfa is about to time out. the first reminder goes
+// out once the time remaining drops below MfaReminderLeadTime, then one every NotificationFrequency minutes until
+// the identity has been notified or the timeout is refreshed. only used from the handleEvents loop
+type mfaReminderSchedule struct {
+	lastSent map[string]time.Time
+}
+
+var mfaReminders = &mfaReminderSchedule{lastSent: make(map[string]time.Time)}
+
+func (s *mfaReminderSchedule) check(now time.Time) {
+	lead := time.Duration(rts.state.MfaReminderLeadTime) * time.Minute
+	interval := time.Duration(rts.state.NotificationFrequency) * time.Minute
+	if lead <= 0 {
+		return
+	}
+
+	for _, id := range rts.allIds() {
+		if id.CId == nil || !id.MfaEnabled || !id.CId.MfaRefreshNeeded() || id.CId.MfaMaxTimeoutRem < 0 {
+			delete(s.lastSent, id.FingerPrint)
+			continue
+		}
+		remaining := id.CId.GetRemainingTime(id.CId.MfaMaxTimeout, id.CId.MfaMaxTimeoutRem)
+		if !s.due(id.FingerPrint, id.Notified, time.Duration(remaining)*time.Second, lead, interval, now) {
+			continue
+		}
+		log.Debugf("sending mfa reminder for identity %s - %s. %d seconds remain", id.Name, id.FingerPrint, remaining)
+		rts.BroadcastEvent(dto.MfaReminderEvent{
+			ActionEvent:      dto.MFAReminderEvent,
+			Fingerprint:      id.FingerPrint,
+			RemainingSeconds: remaining,
+		})
+	}
+}
+
+// due reports if a reminder should be sent now and records it when it should
+func (s *mfaReminderSchedule) due(fingerprint string, notified bool, remaining time.Duration, lead time.Duration, interval time.Duration, now time.Time) bool {
+	if remaining > lead {
+		// not within the lead time yet, or the timeout was refreshed since the last reminder
+		delete(s.lastSent, fingerprint)
+		return false
+	}
+	if notified || remaining <= 0 {
+		return false
+	}
+	if last, ok := s.lastSent[fingerprint]; ok && now.Sub(last) < interval {
+		return false
+	}
+	s.lastSent[fingerprint] = now
+	return true
+}
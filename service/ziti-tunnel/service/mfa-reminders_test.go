@@ -0,0 +1,62 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMfaReminderDue(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	lead := 10 * time.Minute
+	interval := 5 * time.Minute
+	tests := []struct {
+		name      string
+		lastSent  *time.Time
+		notified  bool
+		remaining time.Duration
+		want      bool
+	}{
+		{"not within the lead time", nil, false, 20 * time.Minute, false},
+		{"first reminder", nil, false, 9 * time.Minute, true},
+		{"already notified", nil, true, 9 * time.Minute, false},
+		{"timed out", nil, false, 0, false},
+		{"sent within the interval", timeAt(now.Add(-2 * time.Minute)), false, 7 * time.Minute, false},
+		{"sent before the interval", timeAt(now.Add(-6 * time.Minute)), false, 3 * time.Minute, true},
+		{"refreshed since the last reminder", timeAt(now.Add(-2 * time.Minute)), false, 30 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &mfaReminderSchedule{lastSent: make(map[string]time.Time)}
+			if tt.lastSent != nil {
+				s.lastSent["fp"] = *tt.lastSent
+			}
+			if got := s.due("fp", tt.notified, tt.remaining, lead, interval, now); got != tt.want {
+				t.Errorf("due() = %v, want %v", got, tt.want)
+			}
+			if _, kept := s.lastSent["fp"]; tt.remaining > lead && kept {
+				t.Errorf("the last reminder is kept after the timeout was refreshed")
+			}
+		})
+	}
+}
+
+func timeAt(t time.Time) *time.Time {
+	return &t
+}
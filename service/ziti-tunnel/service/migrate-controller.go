@@ -0,0 +1,104 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// MigrateController points every identity whose controller host ends with oldHostSuffix at newHost, keeping the
+// scheme, port and path of the current address. each identity is backed up as .original before it is changed.
+// identities which do not match are skipped and reported as not migrated
+func (t *RuntimeState) MigrateController(oldHostSuffix string, newHost string) ([]dto.ControllerMigrationResult, error) {
+	oldHostSuffix = strings.ToLower(strings.TrimSpace(oldHostSuffix))
+	newHost = strings.TrimSpace(newHost)
+	if oldHostSuffix == "" || newHost == "" {
+		return nil, fmt.Errorf("both the old host suffix and the new host are required")
+	}
+
+	ids := t.allIds()
+	sort.Slice(ids, func(i, j int) bool { return ids[i].FingerPrint < ids[j].FingerPrint })
+
+	results := make([]dto.ControllerMigrationResult, 0, len(ids))
+	for _, id := range ids {
+		result := dto.ControllerMigrationResult{Fingerprint: id.FingerPrint}
+
+		var cfg idcfg.Config
+		if err := probeIdentityFile(id.Path(), &cfg); err != nil {
+			result.Error = fmt.Sprintf("could not read identity file: %v", err)
+			results = append(results, result)
+			continue
+		}
+		result.OldAddress = cfg.ZtAPI
+
+		newAddress, matched, err := migratedAddress(cfg.ZtAPI, oldHostSuffix, newHost)
+		if err != nil {
+			result.Error = err.Error()
+		} else if matched {
+			result.NewAddress = newAddress
+			if err = t.updateControllerAddress(id.Path(), newAddress); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Migrated = true
+				t.idsLock.Lock()
+				id.Config.ZtAPI = newAddress
+				t.idsLock.Unlock()
+			}
+		}
+		results = append(results, result)
+	}
+	log.Infof("migrated controller %s to %s for %d identities", oldHostSuffix, newHost, countMigrated(results))
+	return results, nil
+}
+
+// migratedAddress returns current with its host replaced by newHost when the host is suffix or ends with it on a
+// label boundary, so example.com matches ctrl.example.com but not badexample.com. the port of current is kept unless
+// newHost carries its own
+func migratedAddress(current string, suffix string, newHost string) (string, bool, error) {
+	u, err := url.Parse(current)
+	if err != nil {
+		return "", false, fmt.Errorf("could not parse controller address %s: %v", current, err)
+	}
+	suffix = strings.TrimPrefix(suffix, ".")
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host != suffix && !strings.HasSuffix(host, "."+suffix) {
+		return "", false, nil
+	}
+	if _, _, err := net.SplitHostPort(newHost); err == nil || u.Port() == "" {
+		u.Host = newHost
+	} else {
+		u.Host = net.JoinHostPort(newHost, u.Port())
+	}
+	return u.String(), true, nil
+}
+
+func countMigrated(results []dto.ControllerMigrationResult) int {
+	count := 0
+	for _, r := range results {
+		if r.Migrated {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMigratedAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     string
+		suffix      string
+		newHost     string
+		want        string
+		wantMatched bool
+		wantErr     bool
+	}{
+		{"subdomain", "https://ctrl.example.com:1280", "example.com", "ctrl.example.net", "https://ctrl.example.net:1280", true, false},
+		{"exact host", "https://example.com", "example.com", "example.net", "https://example.net", true, false},
+		{"leading dot", "https://ctrl.example.com", ".example.com", "example.net", "https://example.net", true, false},
+		{"case and trailing dot", "https://CTRL.Example.COM.:443/edge", "example.com", "example.net", "https://example.net:443/edge", true, false},
+		{"no label boundary", "https://badexample.com", "example.com", "example.net", "", false, false},
+		{"other domain", "https://ctrl.example.org", "example.com", "example.net", "", false, false},
+		{"new host with port", "https://ctrl.example.com:1280", "example.com", "example.net:8441", "https://example.net:8441", true, false},
+		{"unparseable address", "https://ctrl%zz", "example.com", "example.net", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, matched, err := migratedAddress(tt.current, tt.suffix, tt.newHost)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("migratedAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || matched != tt.wantMatched {
+				t.Errorf("migratedAddress() = %s, %v, want %s, %v", got, matched, tt.want, tt.wantMatched)
+			}
+		})
+	}
+}
+
+func TestMigrateController(t *testing.T) {
+	useTempConfigDir(t)
+	savedDial := dialController
+	dialController = func(ctx context.Context, target string) (net.Conn, error) {
+		return nil, errors.New("not dialing in a test")
+	}
+	defer func() { dialController = savedDial }()
+
+	addresses := map[string]string{
+		"fp1": "https://ctrl.example.com:1280",
+		"fp2": "https://example.com/edge",
+		"fp3": "https://ctrl.example.org:1280",
+	}
+	rt := &RuntimeState{state: &dto.TunnelStatus{}, ids: make(map[string]*Id)}
+	originals := make(map[string]string)
+	for fp, address := range addresses {
+		id := &Id{Identity: dto.Identity{FingerPrint: fp, Config: idcfg.Config{ZtAPI: address}}}
+		rt.ids[fp] = id
+		data, err := json.Marshal(idcfg.Config{ZtAPI: address})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(id.Path(), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		originals[fp] = string(data)
+	}
+
+	got, err := rt.MigrateController("example.com", "ctrl.example.net")
+	if err != nil {
+		t.Fatalf("MigrateController() error = %v", err)
+	}
+	want := []dto.ControllerMigrationResult{
+		{Fingerprint: "fp1", OldAddress: "https://ctrl.example.com:1280", NewAddress: "https://ctrl.example.net:1280", Migrated: true},
+		{Fingerprint: "fp2", OldAddress: "https://example.com/edge", NewAddress: "https://ctrl.example.net/edge", Migrated: true},
+		{Fingerprint: "fp3", OldAddress: "https://ctrl.example.org:1280"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("MigrateController() = %+v, want %+v", got, want)
+	}
+
+	for _, r := range want {
+		id := rt.ids[r.Fingerprint]
+		wantAddress := r.OldAddress
+		if r.Migrated {
+			wantAddress = r.NewAddress
+		}
+		var cfg idcfg.Config
+		if err := probeIdentityFile(id.Path(), &cfg); err != nil || cfg.ZtAPI != wantAddress {
+			t.Errorf("%s.json ztAPI = %s (%v), want %s", r.Fingerprint, cfg.ZtAPI, err, wantAddress)
+		}
+		if id.Config.ZtAPI != wantAddress {
+			t.Errorf("%s Config.ZtAPI = %s, want %s", r.Fingerprint, id.Config.ZtAPI, wantAddress)
+		}
+		original, err := ioutil.ReadFile(id.Path() + ".original")
+		switch {
+		case r.Migrated && (err != nil || string(original) != originals[r.Fingerprint]):
+			t.Errorf("%s.json.original = %q (%v), want %q", r.Fingerprint, original, err, originals[r.Fingerprint])
+		case !r.Migrated && err == nil:
+			t.Errorf("%s.json.original was written for an identity which was not migrated", r.Fingerprint)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"net"
+	"sort"
+)
+
+// PlanNetworkChanges returns the routes, dns servers, nrpt rules and interface metric the service applies with the
+// current config and loaded services, without changing anything. the same decisions as CreateTun are used. the nrpt
+// policy test changes the nrpt rules, so until the TUN was created the nrpt rules are assumed to be effective. the
+// route of a hostname is only listed once the tunneler assigned it an ip
+func (t *RuntimeState) PlanNetworkChanges() (dto.NetworkPlan, error) {
+	ipv4, ipv4mask := tunAddress(t.state.TunIpv4, t.state.TunIpv4Mask)
+	ip, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipv4, ipv4mask))
+	if err != nil {
+		return dto.NetworkPlan{}, fmt.Errorf("error parsing CIDR block: (%v)", err)
+	}
+
+	plan := dto.NetworkPlan{
+		TunIpv4:          ipv4,
+		TunIpv4Mask:      ipv4mask,
+		Routes:           make([]dto.PlannedRoute, 0),
+		DnsServers:       make([]string, 0),
+		DnsSearchDomains: t.state.DnsSearchDomains,
+		NrptNameServer:   ipv4,
+		WinsServers:      t.state.WinsServers,
+		DisableNetbios:   t.state.DisableNetbios,
+	}
+	if t.addsTunCidrRoute() {
+		plan.Routes = append(plan.Routes, dto.PlannedRoute{Destination: ipnet.String(), NextHop: ipnet.IP.String(), Metric: 0})
+	}
+
+	nrptEffective := true
+	if current := t.currentDnsDecision(); current != nil {
+		nrptEffective = current.NrptEffective
+		plan.NrptTested = true
+	}
+	decision := decideDns(t.state.AddDns, nrptEffective)
+	plan.DnsAction = decision.Action
+	if decision.Action == DnsActionInterface {
+		plan.DnsServers = append(plan.DnsServers, ip.String())
+	}
+	plan.InterfaceMetric = tunInterfaceMetric(t.splitTunnel(), decision.Action)
+
+	hostnames := make(map[string]bool)
+	t.idsLock.RLock()
+	for fp, id := range t.ids {
+		if id.Lazy && id.LazyState == LazyIdle {
+			for _, h := range id.LazyHostnames {
+				hostnames[h] = true
+			}
+		}
+		if id.CId == nil || !id.CId.Loaded {
+			continue
+		}
+		id.CId.Services.Range(func(key interface{}, value interface{}) bool {
+			svc := value.(*cziti.ZService).Service
+			if svc == nil {
+				return true
+			}
+			for _, addr := range svc.Addresses {
+				if addr.IsHost {
+					hostnames[addr.HostName] = true
+					// the tunneler routes the ip it assigned to the hostname, known once the service was intercepted
+					if ip := cziti.DNSMgr.Resolve(addr.HostName); ip != nil {
+						plan.Routes = append(plan.Routes, dto.PlannedRoute{Destination: (&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}).String(), NextHop: ipv4, Metric: 1, Service: svc.Name, Fingerprint: fp})
+					}
+				} else if cidr := serviceCidr(addr); cidr != nil && !t.skipsServiceCidrRoute(*cidr) {
+					plan.Routes = append(plan.Routes, dto.PlannedRoute{Destination: cidr.String(), NextHop: ipv4, Metric: 1, Service: svc.Name, Fingerprint: fp})
+				}
+			}
+			return true
+		})
+	}
+	t.idsLock.RUnlock()
+
+	plan.NrptRules = make([]string, 0, len(hostnames))
+	for h := range hostnames {
+		plan.NrptRules = append(plan.NrptRules, h)
+	}
+	sort.Strings(plan.NrptRules)
+	sort.SliceStable(plan.Routes, func(i, j int) bool {
+		if (plan.Routes[i].Service == "") != (plan.Routes[j].Service == "") {
+			return plan.Routes[i].Service == "" //the route of the TUN cidr first
+		}
+		return plan.Routes[i].Destination < plan.Routes[j].Destination
+	})
+	return plan, nil
+}
@@ -12,8 +12,9 @@ import (
 )
 
 // After System update, the identity files are not getting copied to the config path
-// So we are adding a function to scan for identities in the backtup location
-func scanForIdentitiesPostWindowsUpdate() error {
+// So we are adding a function to scan for identities in the backtup location. destination returns where a file found
+// in the backup is restored to, or "" to leave it in the backup
+func scanForIdentitiesPostWindowsUpdate(destination func(name string) string) error {
 	srcBackUpPaths := [2]string{"Windows.~BT\\Windows\\System32\\config\\systemprofile\\AppData\\Roaming\\NetFoundry",
 		"Windows.old\\Windows\\System32\\config\\systemprofile\\AppData\\Roaming\\NetFoundry"}
 	systemDrivePath := os.Getenv("SystemDrive")
@@ -27,7 +28,7 @@ func scanForIdentitiesPostWindowsUpdate() error {
 			log.Debugf("Folder %s does not exist", sourcePath)
 			continue
 		}
-		err = searchAndCopyFilesFromBackup(sourcePath)
+		err = searchAndCopyFilesFromBackup(sourcePath, destination)
 		if err != nil {
 			log.Debugf("Copy files from %s failed, %v", sourcePath, err)
 		}
@@ -35,18 +36,43 @@ func scanForIdentitiesPostWindowsUpdate() error {
 	return nil
 }
 
-func searchAndCopyFilesFromBackup(srcPath string) error {
-	err := filepath.Walk(srcPath, copyFilesFromBackUp)
+func searchAndCopyFilesFromBackup(srcPath string, destination func(name string) string) error {
+	err := filepath.Walk(srcPath, func(path string, f os.FileInfo, err error) error {
+		return copyFilesFromBackUp(path, f, err, destination)
+	})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func copyFilesFromBackUp(path string, f os.FileInfo, err error) error {
+// backupConfigDestination restores the config file to the config folder, before the config is read
+func backupConfigDestination(name string) string {
+	if !strings.Contains(name, ConfigFileName) {
+		return ""
+	}
+	return filepath.Join(config.Path(), name)
+}
+
+// backupIdentityDestination restores the identity files to the identity folder, once the folder is in use
+func backupIdentityDestination(name string) string {
+	if strings.Contains(name, ConfigFileName) {
+		return ""
+	}
+	return filepath.Join(config.IdentityPath(), name)
+}
+
+func copyFilesFromBackUp(path string, f os.FileInfo, err error, destination func(name string) string) error {
+	if err != nil {
+		log.Debugf("could not read %s from the backup: %v", path, err)
+		return nil
+	}
 	if !f.IsDir() {
+		destinationFile := destination(f.Name())
+		if destinationFile == "" {
+			return nil
+		}
 		log.Infof("Found: %s", path)
-		destinationFile := filepath.Join(config.Path(), string(os.PathSeparator), f.Name())
 		//check if the file is present in the destination folder
 		_, err := os.Stat(destinationFile)
 		if err == nil && !strings.Contains(f.Name(), ConfigFileName) {
@@ -0,0 +1,113 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupDestinations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity-folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetIdentityPath(dir)
+	defer config.SetIdentityPath("")
+
+	tests := []struct {
+		name         string
+		file         string
+		wantConfig   string
+		wantIdentity string
+	}{
+		{"config file", ConfigFileName, filepath.Join(config.Path(), ConfigFileName), ""},
+		{"config backup", ConfigFileName + ".backup", filepath.Join(config.Path(), ConfigFileName+".backup"), ""},
+		{"identity file", "fingerprint.json", "", filepath.Join(dir, "fingerprint.json")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backupConfigDestination(tt.file); got != tt.wantConfig {
+				t.Errorf("backupConfigDestination() = %s, want %s", got, tt.wantConfig)
+			}
+			if got := backupIdentityDestination(tt.file); got != tt.wantIdentity {
+				t.Errorf("backupIdentityDestination() = %s, want %s", got, tt.wantIdentity)
+			}
+		})
+	}
+}
+
+func TestSearchAndCopyFilesFromBackup(t *testing.T) {
+	backup, err := ioutil.TempDir("", "windows-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(backup)
+	dir, err := ioutil.TempDir("", "identity-folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetIdentityPath(dir)
+	defer config.SetIdentityPath("")
+
+	write := func(path string, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(backup, ConfigFileName), "backup")
+	write(filepath.Join(backup, "restored.json"), "backup")
+	write(filepath.Join(backup, "present.json"), "backup")
+	write(filepath.Join(dir, "present.json"), "current")
+
+	if err := searchAndCopyFilesFromBackup(backup, backupIdentityDestination); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		wantContent string // empty when the file must not exist
+	}{
+		{"identity restored to the identity folder", filepath.Join(dir, "restored.json"), "backup"},
+		{"restored identity removed from the backup", filepath.Join(backup, "restored.json"), ""},
+		{"present identity kept", filepath.Join(dir, "present.json"), "current"},
+		{"present identity removed from the backup", filepath.Join(backup, "present.json"), ""},
+		{"config file left in the backup", filepath.Join(backup, ConfigFileName), "backup"},
+		{"config file not restored to the identity folder", filepath.Join(dir, ConfigFileName), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(tt.path)
+			if tt.wantContent == "" {
+				if err == nil {
+					t.Errorf("%s exists", tt.path)
+				}
+				return
+			}
+			if err != nil || string(data) != tt.wantContent {
+				t.Errorf("%s contains %q (%v), want %q", tt.path, data, err, tt.wantContent)
+			}
+		})
+	}
+}
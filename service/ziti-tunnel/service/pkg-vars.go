@@ -18,12 +18,15 @@
 package service
 
 import (
+	"errors"
 	"sync"
 	"time"
 
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util/logging"
 	"golang.org/x/sys/windows/svc"
+	"golang.zx2c4.com/wireguard/tun"
 )
 
 var Version dto.ServiceVersion
@@ -44,7 +47,16 @@ var Debug bool
 var TunStarted time.Time
 var log = logging.Logger()
 
-var events = newTopic(32)
+var events = newTopic(constants.DefaultEventQueueCapacity) // resized from the config once it is loaded
+
+var metricsSamples = newMetricsHistory(constants.MetricsHistorySize)
+
+// the function used to create the TUN device, a variable so that it can be swapped out
+var createTUN = tun.CreateTUN
+
+var ErrWintunMissing = errors.New("the wintun driver is not available")
+var ErrIdentityNotFound = errors.New("identity not found")
+var ErrMfaNotEnabled = errors.New("mfa is not enabled")
 
 const (
 	API_VERSION = 1
@@ -57,6 +69,7 @@ const (
 	ERROR                  = 500
 	ERROR_DISCONNECTING_ID = 50
 	IDENTITY_NOT_FOUND     = 1000
+	FINGERPRINT_CONFLICT   = 1001
 
 	MFA_FAILED_TO_GENERATE_CODES = 200
 	MFA_FAILED_TO_RETURN_CODES   = 201
@@ -109,5 +122,14 @@ const (
 
 	STATUS_ENROLLED = "enrolled"
 
+	// how dns is provided, as decided when the TUN is created
+	DnsModeInterface           = "interface"             // dns servers applied to the TUN because AddDns is set
+	DnsModeInterfaceNrptFailed = "interface-nrpt-failed" // dns servers applied to the TUN because NRPT is not effective
+	DnsModeNrpt                = "nrpt"
+
+	// the action recorded in the dns decision
+	DnsActionInterface = "applied-interface-dns"
+	DnsActionNrpt      = "relied-on-nrpt"
+
 	ConfigFileName = "config.json"
 )
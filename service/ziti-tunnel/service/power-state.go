@@ -0,0 +1,106 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"golang.org/x/sys/windows"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// the power modes reported in the status
+const (
+	PowerModeAc      = "ac"
+	PowerModeBattery = "battery"
+)
+
+var procGetSystemPowerStatus = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetSystemPowerStatus")
+
+// systemPowerStatus mirrors SYSTEM_POWER_STATUS
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+// onBattery reports if the machine is running on battery. it is a variable so the source of the power state can be
+// replaced
+var onBattery = func() (bool, error) {
+	var status systemPowerStatus
+	r, _, err := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status)))
+	if r == 0 {
+		return false, err
+	}
+	// 0 is offline, 1 online and 255 unknown. only offline is treated as battery
+	return status.ACLineStatus == 0, nil
+}
+
+// powerWatcher keeps the last power mode seen so the metrics cadence is only changed when the mode changes
+type powerWatcher struct {
+	sync.Mutex
+	mode string
+}
+
+var powerState = &powerWatcher{mode: PowerModeAc}
+
+// check reads the power state and returns the current mode and if it changed since the last check. the mode is left
+// as it was when the power state cannot be read
+func (w *powerWatcher) check() (string, bool) {
+	battery, err := onBattery()
+	w.Lock()
+	defer w.Unlock()
+	if err != nil {
+		log.Debugf("could not read the power state, staying in %s mode: %v", w.mode, err)
+		return w.mode, false
+	}
+	mode := PowerModeAc
+	if battery {
+		mode = PowerModeBattery
+	}
+	changed := mode != w.mode
+	w.mode = mode
+	return mode, changed
+}
+
+func (w *powerWatcher) current() string {
+	w.Lock()
+	defer w.Unlock()
+	return w.mode
+}
+
+// metricsIntervals returns how often the metrics are broadcast and sampled in the given power mode. on battery neither
+// happens more often than the configured battery interval
+func (t *RuntimeState) metricsIntervals(mode string) (time.Duration, time.Duration) {
+	broadcast := constants.MetricsBroadcastInterval * time.Second
+	sample := time.Duration(t.state.MetricsSampleInterval) * time.Second
+	if mode == PowerModeBattery {
+		battery := time.Duration(t.state.BatterySampleInterval) * time.Second
+		if broadcast < battery {
+			broadcast = battery
+		}
+		if sample < battery {
+			sample = battery
+		}
+	}
+	return broadcast, sample
+}
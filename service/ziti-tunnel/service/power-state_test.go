@@ -0,0 +1,76 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"testing"
+	"time"
+)
+
+func TestPowerWatcherCheck(t *testing.T) {
+	saved := onBattery
+	defer func() { onBattery = saved }()
+
+	w := &powerWatcher{mode: PowerModeAc}
+	steps := []struct {
+		battery     bool
+		err         error
+		wantMode    string
+		wantChanged bool
+	}{
+		{false, nil, PowerModeAc, false},
+		{true, nil, PowerModeBattery, true},
+		{true, nil, PowerModeBattery, false},
+		{false, errors.New("no power status"), PowerModeBattery, false},
+		{false, nil, PowerModeAc, true},
+	}
+	for i, s := range steps {
+		onBattery = func() (bool, error) { return s.battery, s.err }
+		mode, changed := w.check()
+		if mode != s.wantMode || changed != s.wantChanged {
+			t.Errorf("step %d: check() = %s, %t, want %s, %t", i, mode, changed, s.wantMode, s.wantChanged)
+		}
+	}
+}
+
+func TestMetricsIntervals(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		sample        int
+		battery       int
+		wantBroadcast time.Duration
+		wantSample    time.Duration
+	}{
+		{"ac", PowerModeAc, 10, 30, 5 * time.Second, 10 * time.Second},
+		{"battery slows both", PowerModeBattery, 10, 30, 30 * time.Second, 30 * time.Second},
+		{"battery keeps slower samples", PowerModeBattery, 60, 30, 30 * time.Second, 60 * time.Second},
+		{"battery faster than the broadcast", PowerModeBattery, 10, 1, 5 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RuntimeState{state: &dto.TunnelStatus{MetricsSampleInterval: tt.sample, BatterySampleInterval: tt.battery}}
+			broadcast, sample := r.metricsIntervals(tt.mode)
+			if broadcast != tt.wantBroadcast || sample != tt.wantSample {
+				t.Errorf("metricsIntervals() = %v, %v, want %v, %v", broadcast, sample, tt.wantBroadcast, tt.wantSample)
+			}
+		})
+	}
+}
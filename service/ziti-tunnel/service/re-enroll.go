@@ -0,0 +1,162 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"github.com/openziti/sdk-golang/ziti/enroll"
+	"os"
+)
+
+// ReEnroll replaces the identity with the given fingerprint by one enrolled from newJwt. the name, tags and
+// per-identity settings of the old identity are carried over to the new one. the old identity is forgotten before
+// enrolling and is put back as it was if the enrollment fails
+func (t *RuntimeState) ReEnroll(fingerprint string, newJwt string) (*Id, error) {
+	old := t.Find(fingerprint)
+	if old == nil {
+		return nil, fmt.Errorf("%w: %s", ErrIdentityNotFound, fingerprint)
+	}
+	if old.ReadOnly {
+		return nil, fmt.Errorf("identity %s is read-only and cannot be re-enrolled", fingerprint)
+	}
+	preserved := old.Identity
+	oldPath := old.Path()
+
+	// moved aside rather than deleted so a failed enrollment can put it back
+	backup := oldPath + ".reenroll"
+	if err := os.Rename(oldPath, backup); err != nil {
+		return nil, fmt.Errorf("could not move the identity file %s aside: %v", oldPath, err)
+	}
+	if err := disconnectIdentity(old); err != nil {
+		log.Warnf("error when disconnecting identity %s before re-enrolling: %v", fingerprint, err)
+	}
+	t.RemoveByFingerprint(fingerprint)
+	state := t.forgetPersistedIdentity(fingerprint)
+
+	cfg, newFingerprint, err := enrollJwt(t, newJwt, preserved.Name)
+	if err == nil && t.knownFingerprint(newFingerprint) {
+		err = fmt.Errorf("an identity with fingerprint %s already exists", newFingerprint)
+	}
+	var newId *dto.Identity
+	if err == nil {
+		newId = &dto.Identity{
+			Name:           preserved.Name,
+			FingerPrint:    newFingerprint,
+			Active:         preserved.Active,
+			Config:         cfg,
+			Status:         STATUS_ENROLLED,
+			Tags:           preserved.Tags,
+			LoadPriority:   preserved.LoadPriority,
+			ConnectTimeout: preserved.ConnectTimeout,
+			ApiPageSize:    preserved.ApiPageSize,
+			Lazy:           preserved.Lazy,
+			LazyHostnames:  preserved.LazyHostnames,
+			Schedule:       preserved.Schedule,
+		}
+		err = writeIdentityFile(newId.Path(), cfg)
+	}
+	if err != nil {
+		log.Errorf("re-enrolling identity %s failed, restoring it: %v", fingerprint, err)
+		t.restoreIdentity(old, state, backup)
+		return nil, err
+	}
+
+	if err = os.Remove(backup); err != nil {
+		log.Warnf("could not remove file: %s", backup)
+	}
+	original := oldPath + ".original"
+	if _, err = os.Stat(original); err == nil {
+		if err = os.Remove(original); err != nil {
+			log.Warnf("could not remove file: %s", original)
+		}
+	}
+	log.Infof("re-enrolled identity %s as %s. identity file written to: %s", fingerprint, newFingerprint, newId.Path())
+
+	id := &Id{
+		Identity: *newId,
+	}
+	t.addIdentity(id, newId)
+	return id, nil
+}
+
+// enrollJwt enrolls the identity a jwt is for, see enrollFromJwt
+var enrollJwt = (*RuntimeState).enrollFromJwt
+
+// forgetPersistedIdentity removes the identity from the persisted state and returns what was removed
+func (t *RuntimeState) forgetPersistedIdentity(fingerprint string) *dto.Identity {
+	var removed *dto.Identity
+	kept := make([]*dto.Identity, 0, len(t.state.Identities))
+	for _, sid := range t.state.Identities {
+		if sid != nil && sid.FingerPrint == fingerprint {
+			removed = sid
+			continue
+		}
+		kept = append(kept, sid)
+	}
+	t.state.Identities = kept
+	return removed
+}
+
+// restoreIdentity puts an identity forgotten by ReEnroll back the way it was
+func (t *RuntimeState) restoreIdentity(old *Id, persisted *dto.Identity, backup string) {
+	if err := os.Rename(backup, old.Path()); err != nil {
+		log.Errorf("could not restore the identity file %s from %s: %v", old.Path(), backup, err)
+	}
+	t.idsLock.Lock()
+	t.ids[old.FingerPrint] = old
+	t.idsLock.Unlock()
+	if persisted != nil {
+		t.state.Identities = append(t.state.Identities, persisted)
+	}
+	if old.Active {
+		connectIdentity(old)
+	}
+}
+
+// enrollFromJwt enrolls a new identity using the jwt and returns its config and fingerprint. nothing is written
+func (t *RuntimeState) enrollFromJwt(jwt string, name string) (idcfg.Config, string, error) {
+	tkn, _, err := enroll.ParseToken(jwt)
+	if err != nil {
+		return idcfg.Config{}, "", fmt.Errorf("failed to parse JWT: %v", err)
+	}
+	if err = t.controllerAllowed(tkn.Issuer); err != nil {
+		return idcfg.Config{}, "", err
+	}
+
+	conf, err := enroll.Enroll(enroll.EnrollmentFlags{
+		KeyAlg: "EC",
+		Token:  tkn,
+		IDName: name,
+	})
+	if err != nil {
+		return idcfg.Config{}, "", fmt.Errorf("failed to enroll: %v", err)
+	}
+
+	sdkId, err := identity.LoadIdentity(conf.ID)
+	if err != nil {
+		return idcfg.Config{}, "", fmt.Errorf("unable to load identity which was just created. this is abnormal: %v", err)
+	}
+	fingerprint, err := fingerprintOf(sdkId)
+	if err != nil {
+		return idcfg.Config{}, "", err
+	}
+	return *conf, fingerprint, nil
+}
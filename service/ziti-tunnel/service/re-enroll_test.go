@@ -0,0 +1,116 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReEnroll(t *testing.T) {
+	tests := []struct {
+		name    string
+		enroll  func(t *RuntimeState, jwt string, name string) (idcfg.Config, string, error)
+		wantErr bool
+	}{
+		{"enrolled", func(*RuntimeState, string, string) (idcfg.Config, string, error) {
+			return idcfg.Config{ZtAPI: "https://ctrl:1280"}, "newfp", nil
+		}, false},
+		{"enrollment failed", func(*RuntimeState, string, string) (idcfg.Config, string, error) {
+			return idcfg.Config{}, "", errors.New("the jwt has expired")
+		}, true},
+		{"new fingerprint already known", func(*RuntimeState, string, string) (idcfg.Config, string, error) {
+			return idcfg.Config{ZtAPI: "https://ctrl:1280"}, "otherfp", nil
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempConfigDir(t)
+			saved := enrollJwt
+			defer func() { enrollJwt = saved }()
+			enrollJwt = tt.enroll
+
+			persisted := &dto.Identity{FingerPrint: "oldfp", Name: "local name", Tags: []string{"site-a"}, LoadPriority: 3}
+			old := &Id{Identity: *persisted}
+			other := &dto.Identity{FingerPrint: "otherfp", Name: "other"}
+			rt := &RuntimeState{
+				ids:   map[string]*Id{"oldfp": old, "otherfp": {Identity: *other}},
+				state: &dto.TunnelStatus{Identities: []*dto.Identity{persisted, other}},
+			}
+			content := []byte(`{"ztAPI":"https://old:1280"}`)
+			if err := ioutil.WriteFile(old.Path(), content, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := rt.ReEnroll("oldfp", "jwt")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReEnroll() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if _, err := os.Stat(old.Path() + ".reenroll"); !os.IsNotExist(err) {
+				t.Errorf("the moved aside identity file is left behind: %v", err)
+			}
+
+			if tt.wantErr {
+				if data, err := ioutil.ReadFile(old.Path()); err != nil || string(data) != string(content) {
+					t.Errorf("the identity file was not moved back: %q %v", data, err)
+				}
+				if rt.Find("oldfp") != old {
+					t.Error("the identity was not put back")
+				}
+				restored := findPersisted(rt, "oldfp")
+				if restored == nil || restored.Name != "local name" || !reflect.DeepEqual(restored.Tags, []string{"site-a"}) {
+					t.Errorf("the persisted identity was not restored with its name and tags: %+v", restored)
+				}
+				return
+			}
+
+			if id == nil || id.FingerPrint != "newfp" || rt.Find("newfp") != id {
+				t.Fatalf("ReEnroll() = %+v, want the new identity added", id)
+			}
+			if id.Name != "local name" || !reflect.DeepEqual(id.Tags, []string{"site-a"}) || id.LoadPriority != 3 {
+				t.Errorf("the new identity %+v did not keep the name, tags and settings", id.Identity)
+			}
+			if rt.Find("oldfp") != nil || findPersisted(rt, "oldfp") != nil {
+				t.Error("the old identity is still known")
+			}
+			if findPersisted(rt, "newfp") == nil {
+				t.Error("the new identity was not persisted")
+			}
+			if _, err := os.Stat(old.Path()); !os.IsNotExist(err) {
+				t.Errorf("the old identity file is left behind: %v", err)
+			}
+			if _, err := os.Stat(id.Path()); err != nil {
+				t.Errorf("the new identity file was not written: %v", err)
+			}
+		})
+	}
+}
+
+func findPersisted(t *RuntimeState, fingerprint string) *dto.Identity {
+	for _, sid := range t.state.Identities {
+		if sid != nil && sid.FingerPrint == fingerprint {
+			return sid
+		}
+	}
+	return nil
+}
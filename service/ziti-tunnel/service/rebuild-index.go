@@ -0,0 +1,91 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"os"
+)
+
+// RebuildIdentityIndex rebuilds the map of identities from the identities in the config, for when the map no longer
+// matches it. identities which are loaded are kept as they are, the others are loaded again from their files the
+// same way they are when the service starts. identities in the map but not in the config are disconnected and
+// dropped, identities in the config whose file is gone are left out
+func (t *RuntimeState) RebuildIdentityIndex() dto.IdentityIndexRebuild {
+	result := dto.IdentityIndexRebuild{
+		Kept:     make([]string, 0),
+		Reloaded: make([]string, 0),
+		Missing:  make([]string, 0),
+		Dropped:  make([]string, 0),
+	}
+
+	t.idsLock.Lock()
+	previous := t.ids
+	rebuilt := make(map[string]*Id, len(t.state.Identities))
+	toLoad := make([]*Id, 0)
+	for _, sid := range t.state.Identities {
+		if sid == nil || sid.FingerPrint == "" {
+			continue
+		}
+		if _, dup := rebuilt[sid.FingerPrint]; dup {
+			continue
+		}
+		if existing, found := previous[sid.FingerPrint]; found && existing.CId != nil && existing.CId.Loaded {
+			rebuilt[sid.FingerPrint] = existing
+			result.Kept = append(result.Kept, sid.FingerPrint)
+			continue
+		}
+		if _, err := os.Stat(sid.Path()); err != nil {
+			log.Warnf("identity %s[%s] is not added back to the index. its file %s cannot be read: %v", sid.Name, sid.FingerPrint, sid.Path(), err)
+			result.Missing = append(result.Missing, sid.FingerPrint)
+			continue
+		}
+		id := &Id{Identity: *sid}
+		rebuilt[sid.FingerPrint] = id
+		toLoad = append(toLoad, id)
+		result.Reloaded = append(result.Reloaded, sid.FingerPrint)
+	}
+	stale := make([]*Id, 0)
+	for fp, id := range previous {
+		if rebuilt[fp] != id {
+			stale = append(stale, id)
+			if _, found := rebuilt[fp]; !found {
+				result.Dropped = append(result.Dropped, fp)
+			}
+		}
+	}
+	t.ids = rebuilt
+	t.idsLock.Unlock()
+
+	// outside of the lock, disconnecting and loading identities call back into the runtime state
+	for _, id := range stale {
+		if id.CId != nil && id.CId.Loaded {
+			if err := disconnectIdentity(id); err != nil {
+				log.Warnf("could not disconnect identity %s[%s] removed from the index: %v", id.Name, id.FingerPrint, err)
+			}
+		}
+	}
+	sortInLoadOrder(toLoad)
+	for _, id := range toLoad {
+		lazyIdentities.connectOrDefer(id)
+	}
+
+	log.Infof("identity index rebuilt. kept: %d reloaded: %d missing: %d dropped: %d",
+		len(result.Kept), len(result.Reloaded), len(result.Missing), len(result.Dropped))
+	return result
+}
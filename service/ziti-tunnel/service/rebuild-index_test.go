@@ -0,0 +1,74 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRebuildIdentityIndex(t *testing.T) {
+	dir := useTempConfigDir(t)
+	savedIds, savedState, savedBroadcast, savedLoad := rts.ids, rts.state, events.broadcast, loadZiti
+	defer func() {
+		rts.ids, rts.state, events.broadcast, loadZiti = savedIds, savedState, savedBroadcast, savedLoad
+	}()
+	events.broadcast = make(chan interface{}, 10)
+	loadZiti = func(zid *cziti.ZIdentity, cfg string, refreshInterval int, apiPageSize int) {
+		zid.StatusChanges(0)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "reloaded.json"), []byte(`{"ztAPI":"https://ctrl:1280"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := &Id{Identity: dto.Identity{FingerPrint: "kept", Name: "kept"}, CId: &cziti.ZIdentity{Loaded: true}}
+	rts.ids = map[string]*Id{
+		"kept":    kept,
+		"dropped": {Identity: dto.Identity{FingerPrint: "dropped", Name: "dropped"}},
+	}
+	rts.state = &dto.TunnelStatus{Identities: []*dto.Identity{
+		{FingerPrint: "kept", Name: "kept"},
+		{FingerPrint: "reloaded", Name: "reloaded", Active: true},
+		{FingerPrint: "missing", Name: "missing"},
+		{FingerPrint: "reloaded", Name: "duplicate"},
+	}}
+
+	got := rts.RebuildIdentityIndex()
+	want := dto.IdentityIndexRebuild{
+		Kept:     []string{"kept"},
+		Reloaded: []string{"reloaded"},
+		Missing:  []string{"missing"},
+		Dropped:  []string{"dropped"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RebuildIdentityIndex() = %+v, want %+v", got, want)
+	}
+	if rts.Find("kept") != kept {
+		t.Error("the loaded identity was replaced")
+	}
+	if id := rts.Find("reloaded"); id == nil || id.CId == nil || !id.CId.Loaded {
+		t.Error("the identity in the config was not loaded again")
+	}
+	if rts.Find("missing") != nil || rts.Find("dropped") != nil {
+		t.Errorf("the index holds identities which are not in the config or have no file: %v", rts.ids)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// reconnectStagger spreads the reconnects of the identities whose load was abandoned over ReconnectWindow seconds.
+// when the network comes back every identity times out at about the same time, reconnecting them all at once
+// loads the controller and the cpu. the identities of a batch reconnect in load order, each in its own slot of the
+// window delayed by up to ReconnectJitterMs within the slot
+type reconnectStagger struct {
+	sync.Mutex
+	pending []*Id
+	timer   *time.Timer
+}
+
+var reconnects = &reconnectStagger{}
+
+// the function used for the jitter of a reconnect, a variable so that it can be swapped out
+var reconnectJitter = rand.Int63n
+
+// schedule reconnects the identity with the next batch, ConnectRetryDelay seconds after the first of the batch
+func (s *reconnectStagger) schedule(id *Id) {
+	s.Lock()
+	defer s.Unlock()
+	for _, p := range s.pending {
+		if p == id {
+			return
+		}
+	}
+	s.pending = append(s.pending, id)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(constants.ConnectRetryDelay*time.Second, s.release)
+	}
+}
+
+func (s *reconnectStagger) release() {
+	s.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.timer = nil
+	s.Unlock()
+
+	sortInLoadOrder(batch)
+	window, jitter := rts.reconnectWindow()
+	delays := staggerDelays(len(batch), window, jitter)
+	if len(batch) > 1 {
+		log.Infof("reconnecting %d identities over %v", len(batch), window)
+	}
+	for i, id := range batch {
+		id := id
+		time.AfterFunc(delays[i], func() {
+			if rts.Find(id.FingerPrint) != id || !id.Active || rts.cId(id) != nil {
+				return
+			}
+			log.Infof("loading identity %s[%s] again after its connect timeout", id.Name, id.FingerPrint)
+			connectIdentity(id)
+		})
+	}
+}
+
+// staggerDelays returns the delay of each of n reconnects. every reconnect has its own slot of the window and the
+// jitter never moves it out of its slot, so the order of the reconnects is kept
+func staggerDelays(n int, window time.Duration, jitter time.Duration) []time.Duration {
+	delays := make([]time.Duration, n)
+	if n == 0 || window <= 0 {
+		return delays
+	}
+	slot := window / time.Duration(n)
+	if jitter > slot {
+		jitter = slot
+	}
+	for i := range delays {
+		delays[i] = time.Duration(i) * slot
+		if jitter > 0 {
+			delays[i] += time.Duration(reconnectJitter(int64(jitter)))
+		}
+	}
+	return delays
+}
+
+// reconnectWindow returns the window the reconnects are spread over and their jitter. a negative ReconnectWindow
+// reconnects every identity at once, a negative ReconnectJitterMs disables the jitter
+func (t *RuntimeState) reconnectWindow() (time.Duration, time.Duration) {
+	window := time.Duration(t.state.ReconnectWindow) * time.Second
+	if t.state.ReconnectWindow == 0 {
+		window = constants.DefaultReconnectWindow * time.Second
+	}
+	jitter := time.Duration(t.state.ReconnectJitterMs) * time.Millisecond
+	if t.state.ReconnectJitterMs == 0 {
+		jitter = constants.DefaultReconnectJitterMs * time.Millisecond
+	}
+	return window, jitter
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStaggerDelays(t *testing.T) {
+	saved := reconnectJitter
+	defer func() { reconnectJitter = saved }()
+	// the largest jitter possible, so that it is seen if the jitter leaves the slot
+	reconnectJitter = func(n int64) int64 { return n - 1 }
+
+	tests := []struct {
+		name   string
+		n      int
+		window time.Duration
+		jitter time.Duration
+		want   []time.Duration
+	}{
+		{"none", 0, time.Minute, 0, []time.Duration{}},
+		{"no window", 3, 0, time.Second, []time.Duration{0, 0, 0}},
+		{"one slot each", 4, 4 * time.Second, 0, []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}},
+		{"jitter within the slot", 2, 10 * time.Second, time.Second, []time.Duration{time.Second - 1, 6*time.Second - 1}},
+		{"jitter clamped to the slot", 2, 2 * time.Second, 5 * time.Second, []time.Duration{time.Second - 1, 2*time.Second - 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staggerDelays(tt.n, tt.window, tt.jitter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("staggerDelays() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
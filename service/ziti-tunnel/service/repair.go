@@ -0,0 +1,194 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+	"strings"
+)
+
+const (
+	RepairConfigFolder  = "ConfigFolder"
+	RepairIdentityFiles = "IdentityFiles"
+	RepairTunAdapter    = "TunAdapter"
+
+	secureFolderSddl = "D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)"
+	secureFileSddl   = "D:P" + System + BuiltinAdmins
+)
+
+// sids which must never be granted access to the config folder or the identity files
+var insecureSddlTrustees = []string{";;;WD)", ";;;BU)", ";;;AU)", ";;;IU)"}
+
+// aclLayer reads and replaces the security info of files and folders, a variable so that it can be swapped out
+type aclLayer interface {
+	secured(path string) (bool, error)
+	apply(path string, sddl string) error
+}
+
+var acls aclLayer = windowsAcls{}
+
+type windowsAcls struct{}
+
+func (windowsAcls) secured(path string) (bool, error) {
+	return isSecured(path)
+}
+
+func (windowsAcls) apply(path string, sddl string) error {
+	return applySddl(path, sddl)
+}
+
+// VerifyAndRepair checks the ownership and permissions of the config folder and the identity files as well as the
+// presence of the TUN adapter. anything that can be safely repaired is repaired. the named steps in skip are not run
+func (t *RuntimeState) VerifyAndRepair(skip map[string]bool) []dto.RepairResult {
+	results := make([]dto.RepairResult, 0)
+	if skip[RepairConfigFolder] {
+		log.Infof("verify and repair: skipping %s", RepairConfigFolder)
+	} else {
+		results = append(results, verifyAndRepairAcl(RepairConfigFolder, config.Path(), secureFolderSddl))
+	}
+
+	if skip[RepairIdentityFiles] {
+		log.Infof("verify and repair: skipping %s", RepairIdentityFiles)
+	} else {
+		for _, f := range t.identityFiles() {
+			results = append(results, verifyAndRepairAcl(RepairIdentityFiles, f, secureFileSddl))
+		}
+	}
+
+	if skip[RepairTunAdapter] {
+		log.Infof("verify and repair: skipping %s", RepairTunAdapter)
+	} else {
+		results = append(results, t.verifyTunAdapter())
+	}
+	return results
+}
+
+func (t *RuntimeState) identityFiles() []string {
+	t.idsLock.RLock()
+	defer t.idsLock.RUnlock()
+	files := make([]string, 0, len(t.ids))
+	for _, id := range t.ids {
+		files = append(files, id.Path())
+	}
+	return files
+}
+
+func verifyAndRepairAcl(step string, path string, sddl string) dto.RepairResult {
+	result := dto.RepairResult{Step: step, Target: path}
+	secure, err := acls.secured(path)
+	if err != nil {
+		log.Warnf("verify and repair: could not read the security info of %s: %v", path, err)
+		result.Error = err.Error()
+		return result
+	}
+	if secure {
+		log.Debugf("verify and repair: %s is secured", path)
+		result.Ok = true
+		return result
+	}
+
+	log.Infof("verify and repair: %s has unexpected ownership or permissions. repairing", path)
+	if err = acls.apply(path, sddl); err != nil {
+		log.Errorf("verify and repair: could not repair the permissions of %s: %v", path, err)
+		result.Error = err.Error()
+		return result
+	}
+	log.Infof("verify and repair: repaired the permissions of %s", path)
+	result.Ok = true
+	result.Repaired = true
+	return result
+}
+
+// isSecured reports if the path is owned by SYSTEM or the administrators and does not grant access to everyone/users
+func isSecured(path string) (bool, error) {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return false, err
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return false, err
+	}
+	if !owner.IsWellKnown(windows.WinLocalSystemSid) && !owner.IsWellKnown(windows.WinBuiltinAdministratorsSid) {
+		log.Debugf("%s is owned by unexpected sid: %s", path, owner.String())
+		return false, nil
+	}
+	return !grantsInsecureTrustee(path, sd), nil
+}
+
+// grantsInsecureTrustee reports if the security descriptor grants access to everyone/users
+func grantsInsecureTrustee(path string, sd *windows.SECURITY_DESCRIPTOR) bool {
+	dacl, _, err := sd.DACL()
+	if err != nil || dacl == nil {
+		//a missing dacl grants everyone access
+		return true
+	}
+	sddl := sd.String()
+	for _, trustee := range insecureSddlTrustees {
+		if strings.Contains(sddl, trustee) {
+			log.Debugf("%s grants access to an unexpected trustee: %s", path, sddl)
+			return true
+		}
+	}
+	return false
+}
+
+func applySddl(path string, sddl string) error {
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	system, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return err
+	}
+	info := windows.SECURITY_INFORMATION(windows.OWNER_SECURITY_INFORMATION | windows.DACL_SECURITY_INFORMATION | windows.PROTECTED_DACL_SECURITY_INFORMATION)
+	return windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, info, system, nil, dacl, nil)
+}
+
+// the adapter cannot be safely recreated while the service is running, it is only reported
+func (t *RuntimeState) verifyTunAdapter() dto.RepairResult {
+	result := dto.RepairResult{Step: RepairTunAdapter, Target: TunName}
+	if t.state.Degraded {
+		result.Error = fmt.Sprintf("the service is running in degraded mode: %s", t.state.DegradedReason)
+		return result
+	}
+	adapter, err := tun.WintunPool.OpenAdapter(TunName)
+	if err != nil {
+		log.Warnf("verify and repair: the TUN adapter %s was not found in pool %s: %v", TunName, tun.WintunPool, err)
+		result.Error = fmt.Sprintf("the TUN adapter %s is missing or not owned by this service. restart the service to recreate it", TunName)
+		return result
+	}
+	if t.tun != nil {
+		native := (*t.tun).(*tun.NativeTun)
+		if native.LUID() != adapter.LUID() {
+			result.Error = fmt.Sprintf("the TUN adapter %s is not the adapter in use. restart the service to recreate it", TunName)
+			return result
+		}
+	}
+	result.Ok = true
+	return result
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"testing"
+)
+
+// fakeAcls reports the paths in insecure as not secured and records the paths the sddl is applied to
+type fakeAcls struct {
+	insecure map[string]bool
+	readErr  error
+	applyErr error
+	applied  map[string]string
+}
+
+func (f *fakeAcls) secured(path string) (bool, error) {
+	if f.readErr != nil {
+		return false, f.readErr
+	}
+	return !f.insecure[path], nil
+}
+
+func (f *fakeAcls) apply(path string, sddl string) error {
+	if f.applyErr != nil {
+		return f.applyErr
+	}
+	f.applied[path] = sddl
+	return nil
+}
+
+func useFakeAcls(t *testing.T, fake *fakeAcls) {
+	saved := acls
+	acls = fake
+	t.Cleanup(func() { acls = saved })
+}
+
+func TestVerifyAndRepairAcl(t *testing.T) {
+	const path = `C:\ziti\id.json`
+	tests := []struct {
+		name        string
+		acls        fakeAcls
+		want        dto.RepairResult
+		wantApplied map[string]string
+	}{
+		{"secured", fakeAcls{}, dto.RepairResult{Step: "step", Target: path, Ok: true}, map[string]string{}},
+		{"repaired", fakeAcls{insecure: map[string]bool{path: true}},
+			dto.RepairResult{Step: "step", Target: path, Ok: true, Repaired: true}, map[string]string{path: "sddl"}},
+		{"unreadable", fakeAcls{readErr: errors.New("access denied")},
+			dto.RepairResult{Step: "step", Target: path, Error: "access denied"}, map[string]string{}},
+		{"repair fails", fakeAcls{insecure: map[string]bool{path: true}, applyErr: errors.New("not the owner")},
+			dto.RepairResult{Step: "step", Target: path, Error: "not the owner"}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := tt.acls
+			fake.applied = make(map[string]string)
+			useFakeAcls(t, &fake)
+
+			if got := verifyAndRepairAcl("step", path, "sddl"); got != tt.want {
+				t.Errorf("verifyAndRepairAcl() = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(fake.applied, tt.wantApplied) {
+				t.Errorf("applied = %v, want %v", fake.applied, tt.wantApplied)
+			}
+		})
+	}
+}
+
+func TestVerifyAndRepairSkip(t *testing.T) {
+	useTempConfigDir(t)
+	id := &Id{Identity: dto.Identity{Name: "id", FingerPrint: "fp"}}
+	folder, file := config.Path(), id.Path()
+
+	tests := []struct {
+		name        string
+		skip        map[string]bool
+		want        []dto.RepairResult
+		wantApplied map[string]string
+	}{
+		{"all acl steps", map[string]bool{RepairTunAdapter: true},
+			[]dto.RepairResult{
+				{Step: RepairConfigFolder, Target: folder, Ok: true, Repaired: true},
+				{Step: RepairIdentityFiles, Target: file, Ok: true, Repaired: true},
+			},
+			map[string]string{folder: secureFolderSddl, file: secureFileSddl}},
+		{"config folder skipped", map[string]bool{RepairTunAdapter: true, RepairConfigFolder: true},
+			[]dto.RepairResult{{Step: RepairIdentityFiles, Target: file, Ok: true, Repaired: true}},
+			map[string]string{file: secureFileSddl}},
+		{"everything skipped", map[string]bool{RepairTunAdapter: true, RepairConfigFolder: true, RepairIdentityFiles: true},
+			[]dto.RepairResult{}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeAcls{insecure: map[string]bool{folder: true, file: true}, applied: make(map[string]string)}
+			useFakeAcls(t, fake)
+			r := &RuntimeState{ids: map[string]*Id{"fp": id}}
+
+			if got := r.VerifyAndRepair(tt.skip); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("VerifyAndRepair() = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(fake.applied, tt.wantApplied) {
+				t.Errorf("applied = %v, want %v", fake.applied, tt.wantApplied)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var (
+	procGetProcessHandleCount   = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetProcessHandleCount")
+	procK32GetProcessMemoryInfo = windows.NewLazySystemDLL("kernel32.dll").NewProc("K32GetProcessMemoryInfo")
+)
+
+// processMemoryCounters mirrors PROCESS_MEMORY_COUNTERS
+type processMemoryCounters struct {
+	Cb                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+// processCounters returns the working set and the open handles of the service process. it is a variable so the
+// source of the counters can be replaced
+var processCounters = func() (uint64, uint32, error) {
+	process := windows.CurrentProcess()
+	var handles uint32
+	if r, _, err := procGetProcessHandleCount.Call(uintptr(process), uintptr(unsafe.Pointer(&handles))); r == 0 {
+		return 0, 0, err
+	}
+	counters := processMemoryCounters{}
+	counters.Cb = uint32(unsafe.Sizeof(counters))
+	if r, _, err := procK32GetProcessMemoryInfo.Call(uintptr(process), uintptr(unsafe.Pointer(&counters)), uintptr(counters.Cb)); r == 0 {
+		return 0, handles, err
+	}
+	return uint64(counters.WorkingSetSize), handles, nil
+}
+
+// resourceSampler keeps the last sample so that asking for the stats often costs nothing. reading the memory stats
+// of the go runtime stops the world, so it is read at most every ResourceStatsMinInterval seconds
+type resourceSampler struct {
+	sync.Mutex
+	last dto.ResourceStats
+}
+
+var resources = &resourceSampler{}
+
+// ResourceStats returns the memory, goroutines and open handles of the service process and the throughput of the
+// TUN summed over the identities
+func (t *RuntimeState) ResourceStats() dto.ResourceStats {
+	resources.Lock()
+	defer resources.Unlock()
+	now := time.Now()
+	if !resources.last.Time.IsZero() && now.Sub(resources.last.Time) < constants.ResourceStatsMinInterval*time.Second {
+		return resources.last
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := dto.ResourceStats{
+		Time:       now,
+		HeapBytes:  mem.HeapAlloc,
+		SysBytes:   mem.Sys,
+		Goroutines: runtime.NumGoroutine(),
+	}
+	workingSet, handles, err := processCounters()
+	if err != nil {
+		log.Debugf("could not read the process counters: %v", err)
+	}
+	stats.WorkingSetBytes = workingSet
+	stats.Handles = handles
+
+	t.idsLock.RLock()
+	for _, id := range t.ids {
+		if up, down, ok := id.CId.GetMetrics(); ok {
+			stats.TunUpRate += up
+			stats.TunDownRate += down
+		}
+	}
+	t.idsLock.RUnlock()
+	resources.last = stats
+	return stats
+}
+
+// writeResourceStats writes the resource stats into the logs folder so they are part of the logs collected for
+// support
+func (t *RuntimeState) writeResourceStats() {
+	data, err := json.MarshalIndent(t.ResourceStats(), "", "  ")
+	if err != nil {
+		log.Warnf("could not encode the resource stats: %v", err)
+		return
+	}
+	path := filepath.Join(config.LogsPath(), constants.ResourceStatsFile)
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		log.Warnf("could not write the resource stats to %s: %v", path, err)
+	}
+}
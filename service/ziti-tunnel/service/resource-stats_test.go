@@ -0,0 +1,63 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"testing"
+	"time"
+)
+
+func TestResourceStats(t *testing.T) {
+	savedResources, savedCounters := resources, processCounters
+	defer func() { resources, processCounters = savedResources, savedCounters }()
+	resources = &resourceSampler{}
+	reads := 0
+	processCounters = func() (uint64, uint32, error) {
+		reads++
+		return 4096, 42, nil
+	}
+	rt := &RuntimeState{ids: map[string]*Id{"fp": {Identity: dto.Identity{FingerPrint: "fp"}}}}
+
+	first := rt.ResourceStats()
+	if first.WorkingSetBytes != 4096 || first.Handles != 42 {
+		t.Errorf("ResourceStats() = %+v, want the counters of the process", first)
+	}
+	if first.Goroutines < 1 || first.HeapBytes == 0 || first.SysBytes == 0 || first.Time.IsZero() {
+		t.Errorf("ResourceStats() = %+v, want the stats of the go runtime", first)
+	}
+	if first.TunUpRate != 0 || first.TunDownRate != 0 {
+		t.Errorf("an identity which never loaded added to the throughput: %+v", first)
+	}
+
+	if again := rt.ResourceStats(); again != first || reads != 1 {
+		t.Errorf("a second call within %d seconds sampled again: %d reads", constants.ResourceStatsMinInterval, reads)
+	}
+
+	// an old sample is replaced, a failure to read the process counters leaves them at zero
+	resources.last.Time = time.Now().Add(-constants.ResourceStatsMinInterval * time.Second)
+	processCounters = func() (uint64, uint32, error) {
+		reads++
+		return 0, 0, errors.New("access denied")
+	}
+	if later := rt.ResourceStats(); reads != 2 || later.WorkingSetBytes != 0 || later.Handles != 0 {
+		t.Errorf("ResourceStats() = %+v after %d reads, want a new sample without the process counters", later, reads)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	KeyRotationStarted = "started"
+	KeyRotationRotated = "rotated"
+	KeyRotationFailed  = "failed"
+)
+
+// RotateKey replaces the key and certificate of the identity with the given fingerprint. a new key is generated, its
+// csr is signed by the controller through the certificate authenticator of the identity and the identity is reloaded
+// with the new certificate, which also gives it a new fingerprint. the old identity file is kept next to the new one.
+// nothing changes locally nor on the controller if any step before the controller accepts the new certificate fails
+func (t *RuntimeState) RotateKey(fingerprint string) (*Id, error) {
+	old := t.Find(fingerprint)
+	if old == nil {
+		return nil, fmt.Errorf("%w: %s", ErrIdentityNotFound, fingerprint)
+	}
+	if old.ReadOnly {
+		return nil, fmt.Errorf("identity %s is read-only and its key cannot be rotated", fingerprint)
+	}
+	t.broadcastKeyRotation(fingerprint, "", KeyRotationStarted, "")
+
+	id, err := t.rotateKey(old)
+	if err != nil {
+		log.Errorf("rotating the key of identity %s failed: %v", fingerprint, err)
+		old.LastError = fmt.Sprintf("key rotation failed: %v", err)
+		t.broadcastKeyRotation(fingerprint, "", KeyRotationFailed, err.Error())
+		return nil, err
+	}
+	t.broadcastKeyRotation(fingerprint, id.FingerPrint, KeyRotationRotated, "")
+	return id, nil
+}
+
+func (t *RuntimeState) broadcastKeyRotation(fingerprint string, newFingerprint string, state string, reason string) {
+	t.BroadcastEvent(dto.KeyRotationEvent{
+		ActionEvent:    dto.IDENTITY_KEY_ROTATION,
+		Fingerprint:    fingerprint,
+		NewFingerprint: newFingerprint,
+		State:          state,
+		Error:          reason,
+	})
+}
+
+func (t *RuntimeState) rotateKey(old *Id) (*Id, error) {
+	oldPath := old.Path()
+	cfg := idcfg.Config{}
+	if err := probeIdentityFile(oldPath, &cfg); err != nil {
+		return nil, fmt.Errorf("could not read identity file %s: %v", oldPath, err)
+	}
+	if !strings.HasPrefix(cfg.ID.Key, "pem:") || !strings.HasPrefix(cfg.ID.Cert, "pem:") {
+		return nil, fmt.Errorf("only identities with the key and certificate inside the identity file can be rotated")
+	}
+	if err := t.controllerAllowed(cfg.ZtAPI); err != nil {
+		return nil, err
+	}
+	sdkId, err := identity.LoadIdentity(cfg.ID)
+	if err != nil {
+		return nil, fmt.Errorf("the certificate or key of the identity cannot be used: %v", err)
+	}
+
+	client := controllerClient(sdkId)
+	defer client.CloseIdleConnections()
+	api := strings.TrimRight(cfg.ZtAPI, "/")
+
+	var session struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	if err = controllerCall(client, http.MethodPost, api+"/authenticate?method=cert", nil, nil, &session); err != nil {
+		return nil, fmt.Errorf("the controller did not authenticate the identity: %v", err)
+	}
+	headers := http.Header{"zt-session": []string{session.Data.Token}}
+	defer func() {
+		if err := controllerCall(client, http.MethodDelete, api+"/current-api-session", headers, nil, nil); err != nil {
+			log.Warnf("could not remove the api session used to rotate the key of %s: %v", old.FingerPrint, err)
+		}
+	}()
+
+	authenticator, err := certAuthenticator(client, api, headers, old.FingerPrint)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate a new key: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: sdkId.Cert().Leaf.Subject}, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the certificate request: %v", err)
+	}
+	extendReq := map[string]string{
+		"clientCertCsr": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	}
+	var extended struct {
+		Data struct {
+			ClientCert string `json:"clientCert"`
+			CA         string `json:"ca"`
+		} `json:"data"`
+	}
+	extendUrl := api + "/current-identity/authenticators/" + authenticator + "/extend"
+	if err = controllerCall(client, http.MethodPost, extendUrl, headers, extendReq, &extended); err != nil {
+		return nil, fmt.Errorf("the controller did not sign the new certificate, it may not support extending certificates: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode the new key: %v", err)
+	}
+	newCfg := cfg
+	newCfg.ID.Key = "pem:" + string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	newCfg.ID.Cert = "pem:" + extended.Data.ClientCert
+	if extended.Data.CA != "" {
+		newCfg.ID.CA = "pem:" + extended.Data.CA
+	}
+	newSdkId, err := identity.LoadIdentity(newCfg.ID)
+	if err != nil {
+		return nil, fmt.Errorf("the certificate returned by the controller cannot be used: %v", err)
+	}
+	newFingerprint, err := fingerprintOf(newSdkId)
+	if err != nil {
+		return nil, fmt.Errorf("the certificate returned by the controller cannot be used: %v", err)
+	}
+	if t.knownFingerprint(newFingerprint) {
+		return nil, fmt.Errorf("an identity with fingerprint %s already exists", newFingerprint)
+	}
+
+	newId := old.Identity
+	newId.FingerPrint = newFingerprint
+	newId.Config = newCfg
+	newId.Status = STATUS_ENROLLED
+	newId.LastError = ""
+	newId.Services = nil
+	newId.Metrics = nil
+	newPath := newId.Path()
+	if err = writeIdentityFile(newPath, newCfg); err != nil {
+		return nil, err
+	}
+
+	// until the new certificate is verified the controller keeps accepting the old one, past this point there is no
+	// going back to the old identity
+	verifyReq := map[string]string{"clientCert": extended.Data.ClientCert}
+	if err = controllerCall(client, http.MethodPost, extendUrl+"-verify", headers, verifyReq, nil); err != nil {
+		if rmErr := os.Remove(newPath); rmErr != nil {
+			log.Warnf("could not remove file: %s", newPath)
+		}
+		return nil, fmt.Errorf("the controller did not accept the new certificate: %v", err)
+	}
+
+	if err = disconnectIdentity(old); err != nil {
+		log.Warnf("error when disconnecting identity %s after rotating its key: %v", old.FingerPrint, err)
+	}
+	t.RemoveByFingerprint(old.FingerPrint)
+	t.forgetPersistedIdentity(old.FingerPrint)
+	backup := oldPath + ".rotated"
+	if err = os.Rename(oldPath, backup); err != nil {
+		log.Warnf("could not keep the old identity file %s as %s: %v", oldPath, backup, err)
+	}
+	log.Infof("rotated the key of identity %s, it is now %s. identity file written to: %s", old.FingerPrint, newFingerprint, newPath)
+
+	id := &Id{
+		Identity: newId,
+	}
+	t.addIdentity(id, &newId)
+	return id, nil
+}
+
+// certAuthenticator returns the id of the certificate authenticator of the current identity, the one matching the
+// fingerprint when the identity has more than one
+func certAuthenticator(client *http.Client, api string, headers http.Header, fingerprint string) (string, error) {
+	var authenticators struct {
+		Data []struct {
+			Id          string `json:"id"`
+			Method      string `json:"method"`
+			Fingerprint string `json:"certFingerprint"`
+		} `json:"data"`
+	}
+	if err := controllerCall(client, http.MethodGet, api+"/current-identity/authenticators", headers, nil, &authenticators); err != nil {
+		return "", fmt.Errorf("could not list the authenticators of the identity: %v", err)
+	}
+	found := ""
+	count := 0
+	for _, a := range authenticators.Data {
+		if a.Method != "cert" {
+			continue
+		}
+		if strings.EqualFold(a.Fingerprint, fingerprint) {
+			return a.Id, nil
+		}
+		found = a.Id
+		count++
+	}
+	if count != 1 {
+		return "", fmt.Errorf("found %d certificate authenticators for the identity, expected one", count)
+	}
+	return found, nil
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeCertController signs the csr sent to extend the certificate authenticator of an identity. extendStatus and
+// verifyStatus are answered to the extend and extend-verify calls
+type fakeCertController struct {
+	t            *testing.T
+	fingerprint  string
+	extendStatus int
+	verifyStatus int
+	caKey        *ecdsa.PrivateKey
+	ca           *x509.Certificate
+	caPem        []byte
+	verified     bool
+}
+
+func newFakeCertController(t *testing.T, fingerprint string, extendStatus int, verifyStatus int) *fakeCertController {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "controller ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeCertController{t: t, fingerprint: fingerprint, extendStatus: extendStatus, verifyStatus: verifyStatus,
+		caKey: caKey, ca: ca, caPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *fakeCertController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/authenticate":
+		_, _ = w.Write([]byte(`{"data":{"token":"session"}}`))
+	case "/current-api-session":
+	case "/current-identity/authenticators":
+		_, _ = w.Write([]byte(`{"data":[{"id":"updb","method":"updb"},{"id":"cert1","method":"cert","certFingerprint":"` + c.fingerprint + `"}]}`))
+	case "/current-identity/authenticators/cert1/extend":
+		if c.extendStatus != http.StatusOK {
+			w.WriteHeader(c.extendStatus)
+			return
+		}
+		var req struct {
+			ClientCertCsr string `json:"clientCertCsr"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		block, _ := pem.Decode([]byte(req.ClientCertCsr))
+		if block == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil || csr.CheckSignature() != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, c.ca, csr.PublicKey, c.caKey)
+		if err != nil {
+			c.t.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{
+			"clientCert": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			"ca":         string(c.caPem),
+		}})
+	case "/current-identity/authenticators/cert1/extend-verify":
+		w.WriteHeader(c.verifyStatus)
+		c.verified = c.verifyStatus == http.StatusOK
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		extendStatus int
+		verifyStatus int
+		wantErr      bool
+	}{
+		{"rotated", http.StatusOK, http.StatusOK, false},
+		{"csr rejected", http.StatusBadRequest, http.StatusOK, true},
+		{"new certificate not verified", http.StatusOK, http.StatusConflict, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useTempConfigDir(t)
+			savedClient, savedBroadcast := controllerClient, events.broadcast
+			defer func() { controllerClient, events.broadcast = savedClient, savedBroadcast }()
+			events.broadcast = make(chan interface{}, 10)
+
+			key, cert, fingerprint := testIdentityPem(t)
+			controller := newFakeCertController(t, fingerprint, tt.extendStatus, tt.verifyStatus)
+			srv := httptest.NewServer(controller)
+			defer srv.Close()
+			controllerClient = func(identity.Identity) *http.Client { return srv.Client() }
+
+			persisted := &dto.Identity{FingerPrint: fingerprint, Name: "rotated identity", Tags: []string{"site-a"}}
+			old := &Id{Identity: *persisted}
+			rt := &RuntimeState{
+				ids:   map[string]*Id{fingerprint: old},
+				state: &dto.TunnelStatus{Identities: []*dto.Identity{persisted}},
+			}
+			content, err := json.Marshal(idcfg.Config{ZtAPI: srv.URL, ID: identity.IdentityConfig{Key: key, Cert: cert}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(old.Path(), content, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := rt.RotateKey(fingerprint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RotateKey() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				if data, err := ioutil.ReadFile(old.Path()); err != nil || string(data) != string(content) {
+					t.Errorf("the identity file was changed: %v", err)
+				}
+				files, _ := ioutil.ReadDir(dir)
+				if len(files) != 1 {
+					t.Errorf("the failed rotation left files behind: %d files", len(files))
+				}
+				if rt.Find(fingerprint) != old || findPersisted(rt, fingerprint) != persisted || len(rt.state.Identities) != 1 {
+					t.Error("the identity was not left as it was")
+				}
+				if old.LastError == "" {
+					t.Error("the failure was not recorded on the identity")
+				}
+				return
+			}
+
+			if !controller.verified {
+				t.Error("the new certificate was not verified with the controller")
+			}
+			if id == nil || id.FingerPrint == fingerprint || rt.Find(id.FingerPrint) != id {
+				t.Fatalf("RotateKey() = %+v, want the identity under a new fingerprint", id)
+			}
+			if id.Name != "rotated identity" || len(id.Tags) != 1 || id.Tags[0] != "site-a" {
+				t.Errorf("the identity %+v did not keep its name and tags", id.Identity)
+			}
+			if rt.Find(fingerprint) != nil || findPersisted(rt, fingerprint) != nil || findPersisted(rt, id.FingerPrint) == nil {
+				t.Error("the old identity is still known or the new one was not persisted")
+			}
+			if _, err = os.Stat(old.Path() + ".rotated"); err != nil {
+				t.Errorf("the old identity file was not kept: %v", err)
+			}
+			rotated := idcfg.Config{}
+			if err = probeIdentityFile(id.Path(), &rotated); err != nil {
+				t.Fatal(err)
+			}
+			if rotated.ID.Key == key || rotated.ID.Cert == cert || rotated.ID.CA != "pem:"+string(controller.caPem) {
+				t.Error("the new identity file does not hold the new key, certificate and ca")
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+)
+
+// RouteDiff compares the routes of the TUN against the expected routes, for example the routes of a machine which
+// is known to work. routes are matched on destination and next hop, an empty expected next hop matches any
+func (t *RuntimeState) RouteDiff(expected []dto.RouteInfo) (*dto.RouteDiff, error) {
+	if t.tun == nil {
+		return nil, fmt.Errorf("the TUN is not running")
+	}
+	luid := winipcfg.LUID((*t.tun).(*tun.NativeTun).LUID())
+	actual, err := tunRoutes(luid)
+	if err != nil {
+		return nil, err
+	}
+	return diffRoutes(expected, actual)
+}
+
+// tunRoutes reads the ipv4 and ipv6 routes of the interface
+func tunRoutes(luid winipcfg.LUID) ([]dto.RouteInfo, error) {
+	routes := make([]dto.RouteInfo, 0)
+	for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+		rows, err := winipcfg.GetIPForwardTable2(family)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the route table: %v", err)
+		}
+		for i := range rows {
+			if rows[i].InterfaceLUID != luid {
+				continue
+			}
+			dest := rows[i].DestinationPrefix.IPNet()
+			routes = append(routes, dto.RouteInfo{
+				Destination: dest.String(),
+				NextHop:     rows[i].NextHop.IP().String(),
+				Metric:      rows[i].Metric,
+			})
+		}
+	}
+	return routes, nil
+}
+
+func diffRoutes(expected []dto.RouteInfo, actual []dto.RouteInfo) (*dto.RouteDiff, error) {
+	diff := &dto.RouteDiff{
+		Missing:          make([]dto.RouteInfo, 0),
+		Extra:            make([]dto.RouteInfo, 0),
+		MetricMismatches: make([]dto.RouteMetricMismatch, 0),
+	}
+
+	unmatched := make([]*dto.RouteInfo, 0, len(actual))
+	for i := range actual {
+		unmatched = append(unmatched, &actual[i])
+	}
+
+	for _, want := range expected {
+		dest, hop, err := normalizeRoute(want)
+		if err != nil {
+			return nil, err
+		}
+		found := -1
+		for i, have := range unmatched {
+			if have == nil {
+				continue
+			}
+			haveDest, haveHop, err := normalizeRoute(*have)
+			if err != nil {
+				continue
+			}
+			if dest == haveDest && (hop == "" || hop == haveHop) {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			diff.Missing = append(diff.Missing, want)
+			continue
+		}
+		have := unmatched[found]
+		unmatched[found] = nil
+		if have.Metric != want.Metric {
+			diff.MetricMismatches = append(diff.MetricMismatches, dto.RouteMetricMismatch{
+				Destination:    have.Destination,
+				NextHop:        have.NextHop,
+				ExpectedMetric: want.Metric,
+				ActualMetric:   have.Metric,
+			})
+		}
+	}
+
+	for _, have := range unmatched {
+		if have != nil {
+			diff.Extra = append(diff.Extra, *have)
+		}
+	}
+	return diff, nil
+}
+
+// normalizeRoute returns the destination and next hop in the form they are read from the route table so that
+// 100.64.0.0/10 and 100.64.0.1/10 or ::0 and :: compare as equal
+func normalizeRoute(r dto.RouteInfo) (string, string, error) {
+	_, dest, err := net.ParseCIDR(r.Destination)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid route destination %s: %v", r.Destination, err)
+	}
+	hop := ""
+	if r.NextHop != "" {
+		ip := net.ParseIP(r.NextHop)
+		if ip == nil {
+			return "", "", fmt.Errorf("invalid route next hop %s", r.NextHop)
+		}
+		hop = ip.String()
+	}
+	return dest.String(), hop, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"testing"
+)
+
+func TestDiffRoutes(t *testing.T) {
+	actual := []dto.RouteInfo{
+		{Destination: "100.64.0.0/10", NextHop: "100.64.0.1", Metric: 255},
+		{Destination: "10.0.0.0/24", NextHop: "100.64.0.1", Metric: 255},
+		{Destination: "::/0", NextHop: "::", Metric: 0},
+	}
+	tests := []struct {
+		name     string
+		expected []dto.RouteInfo
+		want     dto.RouteDiff
+		wantErr  bool
+	}{
+		{"identical", actual, dto.RouteDiff{Missing: []dto.RouteInfo{}, Extra: []dto.RouteInfo{}, MetricMismatches: []dto.RouteMetricMismatch{}}, false},
+		{"normalized and any next hop", []dto.RouteInfo{
+			{Destination: "100.64.0.1/10", Metric: 255},
+			{Destination: "10.0.0.0/24", NextHop: "100.64.0.1", Metric: 255},
+			{Destination: "::0/0", NextHop: "::0", Metric: 0},
+		}, dto.RouteDiff{Missing: []dto.RouteInfo{}, Extra: []dto.RouteInfo{}, MetricMismatches: []dto.RouteMetricMismatch{}}, false},
+		{"missing, extra and metric", []dto.RouteInfo{
+			{Destination: "100.64.0.0/10", NextHop: "100.64.0.1", Metric: 5},
+			{Destination: "192.168.1.0/24", NextHop: "100.64.0.1", Metric: 255},
+		}, dto.RouteDiff{
+			Missing: []dto.RouteInfo{{Destination: "192.168.1.0/24", NextHop: "100.64.0.1", Metric: 255}},
+			Extra:   []dto.RouteInfo{actual[1], actual[2]},
+			MetricMismatches: []dto.RouteMetricMismatch{
+				{Destination: "100.64.0.0/10", NextHop: "100.64.0.1", ExpectedMetric: 5, ActualMetric: 255},
+			},
+		}, false},
+		{"other next hop", []dto.RouteInfo{{Destination: "10.0.0.0/24", NextHop: "10.0.0.1", Metric: 255}}, dto.RouteDiff{
+			Missing:          []dto.RouteInfo{{Destination: "10.0.0.0/24", NextHop: "10.0.0.1", Metric: 255}},
+			Extra:            actual,
+			MetricMismatches: []dto.RouteMetricMismatch{},
+		}, false},
+		{"invalid destination", []dto.RouteInfo{{Destination: "10.0.0.0"}}, dto.RouteDiff{}, true},
+		{"invalid next hop", []dto.RouteInfo{{Destination: "10.0.0.0/24", NextHop: "gateway"}}, dto.RouteDiff{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := diffRoutes(tt.expected, actual)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("diffRoutes() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("diffRoutes() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+	"time"
+)
+
+// routeTable is the part of winipcfg.LUID needed to delete a route and check it is gone
+type routeTable interface {
+	DeleteRoute(destination net.IPNet, nextHop net.IP) error
+	Route(destination net.IPNet, nextHop net.IP) (*winipcfg.MibIPforwardRow2, error)
+}
+
+// deleteRouteVerified deletes the route and reads it back afterwards. some versions of windows report the delete as
+// successful while the route stays, so the delete is repeated until the route is gone or the attempts run out. the
+// route is only gone when the lookup says it was not found, any other lookup error is returned
+func deleteRouteVerified(routes routeTable, destination net.IPNet, nextHop net.IP) error {
+	var err error
+	for attempt := 1; attempt <= constants.RouteDeleteAttempts; attempt++ {
+		err = routes.DeleteRoute(destination, nextHop)
+		existing, lookupErr := routes.Route(destination, nextHop)
+		if errors.Is(lookupErr, windows.ERROR_NOT_FOUND) || (lookupErr == nil && existing == nil) {
+			if attempt > 1 {
+				log.Infof("route %s via %s was removed after %d attempts", destination.String(), nextHop.String(), attempt)
+			}
+			return nil
+		}
+		if lookupErr != nil {
+			return fmt.Errorf("could not check route %s via %s was removed: %v", destination.String(), nextHop.String(), lookupErr)
+		}
+		log.Warnf("route %s via %s is still present after deleting it. attempt %d of %d: %v", destination.String(), nextHop.String(),
+			attempt, constants.RouteDeleteAttempts, err)
+		if attempt < constants.RouteDeleteAttempts {
+			time.Sleep(time.Duration(attempt*constants.RouteDeleteBackoffMs) * time.Millisecond)
+		}
+	}
+	return fmt.Errorf("route %s via %s could not be removed after %d attempts: %v", destination.String(), nextHop.String(),
+		constants.RouteDeleteAttempts, err)
+}
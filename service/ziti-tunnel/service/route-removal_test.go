@@ -0,0 +1,76 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+	"testing"
+)
+
+// fakeRouteTable keeps the route until it was deleted deletesNeeded times. lookupErr is returned by every lookup
+type fakeRouteTable struct {
+	deletesNeeded int
+	deletes       int
+	lookupErr     error
+}
+
+func (f *fakeRouteTable) DeleteRoute(destination net.IPNet, nextHop net.IP) error {
+	f.deletes++
+	return nil
+}
+
+func (f *fakeRouteTable) Route(destination net.IPNet, nextHop net.IP) (*winipcfg.MibIPforwardRow2, error) {
+	if f.lookupErr != nil {
+		return nil, f.lookupErr
+	}
+	if f.deletes >= f.deletesNeeded {
+		return nil, windows.ERROR_NOT_FOUND
+	}
+	return &winipcfg.MibIPforwardRow2{}, nil
+}
+
+func TestDeleteRouteVerified(t *testing.T) {
+	_, destination, _ := net.ParseCIDR("100.64.0.0/10")
+	nextHop := net.ParseIP("100.64.0.1")
+	tests := []struct {
+		name        string
+		table       *fakeRouteTable
+		wantErr     bool
+		wantDeletes int
+	}{
+		{"removed at once", &fakeRouteTable{deletesNeeded: 1}, false, 1},
+		{"removed on a retry", &fakeRouteTable{deletesNeeded: 2}, false, 2},
+		{"never removed", &fakeRouteTable{deletesNeeded: constants.RouteDeleteAttempts + 1}, true, constants.RouteDeleteAttempts},
+		{"lookup fails", &fakeRouteTable{deletesNeeded: 1, lookupErr: errors.New("access denied")}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := deleteRouteVerified(tt.table, *destination, nextHop)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deleteRouteVerified() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.table.deletes != tt.wantDeletes {
+				t.Errorf("deleted %d times, want %d", tt.table.deletes, tt.wantDeletes)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/wintun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+const (
+	selfTestTunName   = TunName + "-selftest"
+	selfTestCidr      = "100.127.255.253/30"
+	selfTestRouteCidr = "100.127.255.248/30"
+)
+
+// selfTestLayer is what the self test checks the machine with, a variable so that it can be swapped out
+type selfTestLayer interface {
+	instanceRunning() bool
+	ipv6Disabled() bool
+	wintunVersion() (uint32, error)
+	createTun(name string) (selfTestTun, error)
+}
+
+// selfTestTun is the TUN created by the self test
+type selfTestTun interface {
+	setAddress(address net.IPNet) error
+	addRoute(route net.IPNet, nextHop net.IP) error
+	deleteRoute(route net.IPNet, nextHop net.IP) error
+	setDns(server net.IP) error
+	flushDns() error
+	close() error
+}
+
+var selfTests selfTestLayer = windowsSelfTest{}
+
+type windowsSelfTest struct{}
+
+func (windowsSelfTest) instanceRunning() bool {
+	timeout := 1 * time.Second
+	conn, err := winio.DialPipe(IpcPipeName(), &timeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func (windowsSelfTest) ipv6Disabled() bool {
+	return iPv6Disabled()
+}
+
+func (windowsSelfTest) wintunVersion() (uint32, error) {
+	return wintun.RunningVersion()
+}
+
+func (windowsSelfTest) createTun(name string) (selfTestTun, error) {
+	device, err := createTUN(name, 64*1024-1)
+	if err != nil {
+		return nil, err
+	}
+	return &windowsSelfTestTun{device: device, luid: winipcfg.LUID(device.(*tun.NativeTun).LUID())}, nil
+}
+
+type windowsSelfTestTun struct {
+	device tun.Device
+	luid   winipcfg.LUID
+}
+
+func (w *windowsSelfTestTun) setAddress(address net.IPNet) error {
+	return w.luid.SetIPAddresses([]net.IPNet{address})
+}
+
+func (w *windowsSelfTestTun) addRoute(route net.IPNet, nextHop net.IP) error {
+	return w.luid.AddRoute(route, nextHop, 0)
+}
+
+func (w *windowsSelfTestTun) deleteRoute(route net.IPNet, nextHop net.IP) error {
+	return w.luid.DeleteRoute(route, nextHop)
+}
+
+func (w *windowsSelfTestTun) setDns(server net.IP) error {
+	return w.luid.SetDNS(winipcfg.AddressFamily(windows.AF_INET), []net.IP{server}, nil)
+}
+
+func (w *windowsSelfTestTun) flushDns() error {
+	return w.luid.FlushDNS(winipcfg.AddressFamily(windows.AF_INET))
+}
+
+func (w *windowsSelfTestTun) close() error {
+	return w.device.Close()
+}
+
+// SelfTest verifies this machine is able to run the tunneler: the wintun driver loads, a TUN can be created,
+// addressed and routed and dns can be configured on it. the persisted config is never read nor written and
+// everything created is removed before returning. refuses to run while another instance is running
+func SelfTest() (results []dto.SelfTestResult, passed bool) {
+	results = make([]dto.SelfTestResult, 0)
+	passed = true
+	report := func(check string, err error, detail string) bool {
+		r := dto.SelfTestResult{Check: check, Passed: err == nil, Detail: detail}
+		if err != nil {
+			r.Detail = err.Error()
+			passed = false
+		}
+		results = append(results, r)
+		return err == nil
+	}
+
+	if selfTests.instanceRunning() {
+		report("instance", fmt.Errorf("the tunneler is already running. stop it before running the self test"), "")
+		return results, passed
+	}
+	report("instance", nil, "no running instance detected")
+
+	v6 := selfTests.ipv6Disabled()
+	report("ipv6", nil, fmt.Sprintf("ipv6 disabled: %t", v6))
+
+	if v, err := selfTests.wintunVersion(); err == nil {
+		report("wintun", nil, fmt.Sprintf("wintun driver version %d.%d is loaded", (v>>16)&0xffff, v&0xffff))
+	} else {
+		report("wintun", nil, "the wintun driver is not loaded yet. it is loaded when the TUN is created")
+	}
+
+	device, err := selfTests.createTun(selfTestTunName)
+	if !report("create tun", err, selfTestTunName) {
+		return results, passed
+	}
+	defer func() {
+		err := device.close()
+		report("remove tun", err, selfTestTunName)
+	}()
+
+	ip, ipnet, _ := net.ParseCIDR(selfTestCidr)
+	err = device.setAddress(net.IPNet{IP: ip, Mask: ipnet.Mask})
+	if !report("set address", err, selfTestCidr) {
+		return results, passed
+	}
+
+	_, route, _ := net.ParseCIDR(selfTestRouteCidr)
+	err = device.addRoute(*route, ip)
+	if report("add route", err, selfTestRouteCidr) {
+		err = device.deleteRoute(*route, ip)
+		report("remove route", err, selfTestRouteCidr)
+	}
+
+	err = device.setDns(ip)
+	if report("set dns", err, ip.String()) {
+		err = device.flushDns()
+		report("remove dns", err, ip.String())
+	}
+	return results, passed
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeSelfTest fails the operations named in errs and records the operations run on the TUN
+type fakeSelfTest struct {
+	running bool
+	errs    map[string]error
+	ops     []string
+}
+
+func (f *fakeSelfTest) instanceRunning() bool { return f.running }
+func (f *fakeSelfTest) ipv6Disabled() bool    { return false }
+
+func (f *fakeSelfTest) wintunVersion() (uint32, error) {
+	return 0x00090002, f.errs["version"]
+}
+
+func (f *fakeSelfTest) createTun(name string) (selfTestTun, error) {
+	if err := f.errs["create"]; err != nil {
+		return nil, err
+	}
+	f.ops = append(f.ops, "create "+name)
+	return &fakeSelfTestTun{f}, nil
+}
+
+type fakeSelfTestTun struct {
+	f *fakeSelfTest
+}
+
+func (t *fakeSelfTestTun) run(op string) error {
+	if err := t.f.errs[op]; err != nil {
+		return err
+	}
+	t.f.ops = append(t.f.ops, op)
+	return nil
+}
+
+func (t *fakeSelfTestTun) setAddress(net.IPNet) error          { return t.run("address") }
+func (t *fakeSelfTestTun) addRoute(net.IPNet, net.IP) error    { return t.run("add route") }
+func (t *fakeSelfTestTun) deleteRoute(net.IPNet, net.IP) error { return t.run("delete route") }
+func (t *fakeSelfTestTun) setDns(net.IP) error                 { return t.run("dns") }
+func (t *fakeSelfTestTun) flushDns() error                     { return t.run("flush dns") }
+func (t *fakeSelfTestTun) close() error                        { return t.run("close") }
+
+func TestSelfTest(t *testing.T) {
+	failure := errors.New("failure")
+	create := "create " + selfTestTunName
+	tests := []struct {
+		name       string
+		running    bool
+		errs       map[string]error
+		wantPassed bool
+		wantFailed []string // the checks that failed
+		wantChecks []string
+		wantOps    []string
+	}{
+		{name: "all pass", wantPassed: true,
+			wantChecks: []string{"instance", "ipv6", "wintun", "create tun", "set address", "add route", "remove route", "set dns", "remove dns", "remove tun"},
+			wantOps:    []string{create, "address", "add route", "delete route", "dns", "flush dns", "close"}},
+		{name: "already running", running: true,
+			wantFailed: []string{"instance"}, wantChecks: []string{"instance"}},
+		{name: "wintun not loaded yet", errs: map[string]error{"version": failure}, wantPassed: true,
+			wantChecks: []string{"instance", "ipv6", "wintun", "create tun", "set address", "add route", "remove route", "set dns", "remove dns", "remove tun"},
+			wantOps:    []string{create, "address", "add route", "delete route", "dns", "flush dns", "close"}},
+		{name: "tun not created", errs: map[string]error{"create": failure},
+			wantFailed: []string{"create tun"}, wantChecks: []string{"instance", "ipv6", "wintun", "create tun"}},
+		{name: "address fails", errs: map[string]error{"address": failure},
+			wantFailed: []string{"set address"},
+			wantChecks: []string{"instance", "ipv6", "wintun", "create tun", "set address", "remove tun"},
+			wantOps:    []string{create, "close"}},
+		{name: "route fails", errs: map[string]error{"add route": failure},
+			wantFailed: []string{"add route"},
+			wantChecks: []string{"instance", "ipv6", "wintun", "create tun", "set address", "add route", "set dns", "remove dns", "remove tun"},
+			wantOps:    []string{create, "address", "dns", "flush dns", "close"}},
+		{name: "dns fails", errs: map[string]error{"dns": failure},
+			wantFailed: []string{"set dns"},
+			wantChecks: []string{"instance", "ipv6", "wintun", "create tun", "set address", "add route", "remove route", "set dns", "remove tun"},
+			wantOps:    []string{create, "address", "add route", "delete route", "close"}},
+		{name: "tun not removed", errs: map[string]error{"close": failure},
+			wantFailed: []string{"remove tun"},
+			wantChecks: []string{"instance", "ipv6", "wintun", "create tun", "set address", "add route", "remove route", "set dns", "remove dns", "remove tun"},
+			wantOps:    []string{create, "address", "add route", "delete route", "dns", "flush dns"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeSelfTest{running: tt.running, errs: tt.errs}
+			saved := selfTests
+			selfTests = fake
+			defer func() { selfTests = saved }()
+
+			results, passed := SelfTest()
+			if passed != tt.wantPassed {
+				t.Errorf("SelfTest() passed = %t, want %t", passed, tt.wantPassed)
+			}
+			checks, failed := make([]string, 0), make([]string, 0)
+			for _, r := range results {
+				checks = append(checks, r.Check)
+				if !r.Passed {
+					failed = append(failed, r.Check)
+				}
+			}
+			if tt.wantFailed == nil {
+				tt.wantFailed = []string{}
+			}
+			if !reflect.DeepEqual(checks, tt.wantChecks) {
+				t.Errorf("checks = %v, want %v", checks, tt.wantChecks)
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("failed checks = %v, want %v", failed, tt.wantFailed)
+			}
+			if !reflect.DeepEqual(fake.ops, tt.wantOps) {
+				t.Errorf("tun operations = %v, want %v", fake.ops, tt.wantOps)
+			}
+		})
+	}
+}
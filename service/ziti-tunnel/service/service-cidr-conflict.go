@@ -0,0 +1,140 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"net"
+	"sort"
+)
+
+const (
+	ServiceCidrRouteAdd  = "add"  // add the route of a service cidr which contains the TUN address. the default
+	ServiceCidrRouteSkip = "skip" // leave out the route of a service cidr which contains the TUN address
+)
+
+// serviceCidr returns the cidr intercepted at addr, a single ip being a /32 or a /128. a single ip has no prefix, the
+// same as a /0, which is told apart by its unspecified address. nil is returned for hostnames
+func serviceCidr(addr dto.Address) *net.IPNet {
+	if addr.IsHost {
+		return nil
+	}
+	ip := net.ParseIP(addr.IP)
+	if ip == nil {
+		return nil
+	}
+	bits := net.IPv6len * 8
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, net.IPv4len*8
+	}
+	prefix := addr.Prefix
+	if prefix == 0 && !ip.IsUnspecified() {
+		prefix = bits
+	}
+	if prefix < 0 || prefix > bits {
+		return nil
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// serviceCidrConflicts returns the cidrs intercepted by the services which contain ip
+func serviceCidrConflicts(fingerprint string, services []*dto.Service, ip net.IP) []dto.TunCidrConflict {
+	conflicts := make([]dto.TunCidrConflict, 0)
+	for _, svc := range services {
+		if svc == nil {
+			continue
+		}
+		for _, addr := range svc.Addresses {
+			if cidr := serviceCidr(addr); cidr != nil && cidr.Contains(ip) {
+				conflicts = append(conflicts, dto.TunCidrConflict{Fingerprint: fingerprint, Service: svc.Name, Cidr: cidr.String()})
+			}
+		}
+	}
+	return conflicts
+}
+
+// ServiceCidrConflicts lists the services of the loaded identities which intercept a cidr containing the TUN address.
+// the route of such a cidr competes with the TUN address itself
+func (t *RuntimeState) ServiceCidrConflicts() []dto.TunCidrConflict {
+	conflicts := make([]dto.TunCidrConflict, 0)
+	ip := net.ParseIP(t.state.TunIpv4)
+	if ip == nil {
+		return conflicts
+	}
+	t.idsLock.RLock()
+	for fp, id := range t.ids {
+		if id.CId == nil || !id.CId.Loaded {
+			continue
+		}
+		services := make([]*dto.Service, 0)
+		id.CId.Services.Range(func(key interface{}, value interface{}) bool {
+			services = append(services, value.(*cziti.ZService).Service)
+			return true
+		})
+		conflicts = append(conflicts, serviceCidrConflicts(fp, services, ip)...)
+	}
+	t.idsLock.RUnlock()
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Fingerprint != conflicts[j].Fingerprint {
+			return conflicts[i].Fingerprint < conflicts[j].Fingerprint
+		}
+		return conflicts[i].Service < conflicts[j].Service
+	})
+	return conflicts
+}
+
+// warnServiceCidrConflicts warns about the services just added which intercept a cidr containing the TUN address
+func (t *RuntimeState) warnServiceCidrConflicts(fingerprint string, added []*dto.Service) {
+	ip := net.ParseIP(t.state.TunIpv4)
+	if ip == nil {
+		return
+	}
+	for _, c := range serviceCidrConflicts(fingerprint, added, ip) {
+		log.Error(recordWarning(WarningTun, "service %s of identity %s intercepts %s which contains the TUN address %s. routing to the TUN may be ambiguous",
+			c.Service, c.Fingerprint, c.Cidr, ip))
+	}
+}
+
+// skipServiceCidrRoute reports if the route to destination is left out because it contains the TUN address and
+// ServiceCidrRoute is skip
+func (t *RuntimeState) skipServiceCidrRoute(destination net.IPNet) bool {
+	if !t.skipsServiceCidrRoute(destination) {
+		return false
+	}
+	log.Warn(recordWarning(WarningTun, "not adding the route for %s, it contains the TUN address %s. ServiceCidrRoute is %s",
+		destination.String(), t.state.TunIpv4, ServiceCidrRouteSkip))
+	return true
+}
+
+// skipsServiceCidrRoute reports if the route to destination is left out, without warning about it
+func (t *RuntimeState) skipsServiceCidrRoute(destination net.IPNet) bool {
+	ip := net.ParseIP(t.state.TunIpv4)
+	if ip == nil || !destination.Contains(ip) {
+		return false
+	}
+	switch t.state.ServiceCidrRoute {
+	case ServiceCidrRouteSkip:
+		return true
+	case "", ServiceCidrRouteAdd:
+	default:
+		log.Warnf("unknown ServiceCidrRoute %s, the route for %s is added", t.state.ServiceCidrRoute, destination.String())
+	}
+	return false
+}
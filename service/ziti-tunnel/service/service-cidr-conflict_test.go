@@ -0,0 +1,93 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestServiceCidr(t *testing.T) {
+	tests := []struct {
+		name string
+		addr dto.Address
+		want string // empty when no cidr is intercepted
+	}{
+		{"hostname", dto.Address{IsHost: true, HostName: "web.ziti"}, ""},
+		{"single ipv4", dto.Address{IP: "10.1.2.3"}, "10.1.2.3/32"},
+		{"ipv4 cidr", dto.Address{IP: "10.1.2.3", Prefix: 16}, "10.1.0.0/16"},
+		{"ipv4 /32", dto.Address{IP: "10.1.2.3", Prefix: 32}, "10.1.2.3/32"},
+		{"ipv4 /0", dto.Address{IP: "0.0.0.0", Prefix: 0}, "0.0.0.0/0"},
+		{"single ipv6", dto.Address{IP: "fd00::1"}, "fd00::1/128"},
+		{"ipv6 cidr", dto.Address{IP: "fd00::1", Prefix: 64}, "fd00::/64"},
+		{"ipv6 /0", dto.Address{IP: "::", Prefix: 0}, "::/0"},
+		{"ipv4 prefix too long", dto.Address{IP: "10.1.2.3", Prefix: 33}, ""},
+		{"ipv6 prefix too long", dto.Address{IP: "fd00::1", Prefix: 129}, ""},
+		{"not an ip", dto.Address{IP: "web.ziti"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if cidr := serviceCidr(tt.addr); cidr != nil {
+				got = cidr.String()
+			}
+			if got != tt.want {
+				t.Errorf("serviceCidr() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceCidrConflicts(t *testing.T) {
+	services := []*dto.Service{
+		nil,
+		{Name: "wide", Addresses: []dto.Address{{IP: "100.64.0.0", Prefix: 10}}},
+		{Name: "everything", Addresses: []dto.Address{{IP: "0.0.0.0"}}},
+		{Name: "other", Addresses: []dto.Address{{IP: "10.0.0.0", Prefix: 8}, {IsHost: true, HostName: "100.64.0.1"}}},
+		{Name: "tun address", Addresses: []dto.Address{{IP: "100.64.0.1"}}},
+		{Name: "neighbour", Addresses: []dto.Address{{IP: "100.64.0.2"}}},
+		{Name: "ipv6 everything", Addresses: []dto.Address{{IP: "::"}}},
+	}
+	tests := []struct {
+		name string
+		ip   string
+		want []dto.TunCidrConflict
+	}{
+		{"tun address", "100.64.0.1", []dto.TunCidrConflict{
+			{Fingerprint: "fp", Service: "wide", Cidr: "100.64.0.0/10"},
+			{Fingerprint: "fp", Service: "everything", Cidr: "0.0.0.0/0"},
+			{Fingerprint: "fp", Service: "tun address", Cidr: "100.64.0.1/32"},
+		}},
+		{"outside every cidr but the /0", "192.168.1.1", []dto.TunCidrConflict{
+			{Fingerprint: "fp", Service: "everything", Cidr: "0.0.0.0/0"},
+		}},
+		{"ipv6", "fd00::1", []dto.TunCidrConflict{
+			{Fingerprint: "fp", Service: "ipv6 everything", Cidr: "::/0"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := serviceCidrConflicts("fp", services, net.ParseIP(tt.ip))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("serviceCidrConflicts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -31,9 +31,9 @@ type zitiService struct{}
 
 func (m *zitiService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
 	changes <- svc.Status{State: svc.StartPending}
-	err := config.EnsureConfigFolder()
+	err := EnsureConfigDir()
 	if err != nil {
-		log.Panic("config folder not found and was not created by process!")
+		log.Panicf("config folder not found and was not created by process! %v", err)
 	}
 	err = config.EnsureLogsFolder()
 	if err != nil {
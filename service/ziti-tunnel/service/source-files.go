@@ -0,0 +1,90 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// privilegedOwners are the sids of the accounts whose files the service does not read for an ipc caller, unless they
+// are in the import folder: local system, administrators, local service, network service and trusted installer
+var privilegedOwners = []string{
+	"S-1-5-18",
+	"S-1-5-32-544",
+	"S-1-5-19",
+	"S-1-5-20",
+	"S-1-5-80-956008885-3418522649-1831038044-1853292631-2271478464",
+}
+
+// fileOwner returns the sid of the owner of the file. it is a variable so the acl check can be replaced
+var fileOwner = func(path string) (string, error) {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION)
+	if err != nil {
+		return "", err
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return "", err
+	}
+	if owner == nil {
+		return "", fmt.Errorf("the file has no owner")
+	}
+	return owner.String(), nil
+}
+
+// sourceFileAllowed returns an error unless the service may read the file named by an ipc caller. the service runs
+// as local system, so only regular files in the import folder or owned by an unprivileged user are read
+func (t *RuntimeState) sourceFileAllowed(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%s is not an absolute path", path)
+	}
+	clean := filepath.Clean(path)
+	info, err := os.Lstat(clean)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if dir := strings.TrimSpace(t.state.ImportDir); dir != "" && withinFolder(dir, clean) {
+		return nil
+	}
+	owner, err := fileOwner(clean)
+	if err != nil {
+		return fmt.Errorf("the owner of %s could not be verified: %v", path, err)
+	}
+	for _, sid := range privilegedOwners {
+		if strings.EqualFold(owner, sid) {
+			return fmt.Errorf("%s is owned by a privileged account. move it to a folder of the user or to the import folder", path)
+		}
+	}
+	return nil
+}
+
+// withinFolder reports if path is inside folder. windows paths are not case sensitive
+func withinFolder(folder string, path string) bool {
+	rel, err := filepath.Rel(strings.ToLower(filepath.Clean(folder)), strings.ToLower(path))
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
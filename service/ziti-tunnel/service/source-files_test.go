@@ -0,0 +1,119 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceFileAllowed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	importDir := filepath.Join(dir, "Import")
+	if err = os.Mkdir(importDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(path string) string {
+		if err := ioutil.WriteFile(path, []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	userFile := write(filepath.Join(dir, "user.json"))
+	systemFile := write(filepath.Join(dir, "system.json"))
+	imported := write(filepath.Join(importDir, "system.json"))
+
+	saved := fileOwner
+	defer func() { fileOwner = saved }()
+	fileOwner = func(path string) (string, error) {
+		switch path {
+		case userFile:
+			return "S-1-5-21-1-2-3-1001", nil
+		case systemFile, imported:
+			return "S-1-5-18", nil
+		}
+		return "", errors.New("access denied")
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		importDir string
+		wantErr   bool
+	}{
+		{"owned by a user", userFile, "", false},
+		{"owned by local system", systemFile, "", true},
+		{"in the import folder", imported, importDir, false},
+		{"in the import folder with another case", imported, filepath.Join(dir, "import"), false},
+		{"outside the import folder", systemFile, importDir, true},
+		{"relative", "user.json", "", true},
+		{"missing", filepath.Join(dir, "missing.json"), "", true},
+		{"folder", importDir, "", true},
+		{"owner cannot be read", write(filepath.Join(dir, "unknown.json")), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RuntimeState{state: &dto.TunnelStatus{ImportDir: tt.importDir}}
+			if err := r.sourceFileAllowed(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("sourceFileAllowed() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type certIdentity struct {
+	identity.Identity
+	cert *tls.Certificate
+}
+
+func (c certIdentity) Cert() *tls.Certificate { return c.cert }
+
+func TestFingerprintOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		cert    *tls.Certificate
+		want    string
+		wantErr bool
+	}{
+		{"no certificate", nil, "", true},
+		{"no leaf", &tls.Certificate{}, "", true},
+		{"leaf", &tls.Certificate{Leaf: &x509.Certificate{Raw: []byte("abc")}}, "a9993e364706816aba3e25717850c26c9cd0d89d", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fingerprintOf(certIdentity{cert: tt.cert})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fingerprintOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("fingerprintOf() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// StateStore persists the state of the tunnel. the config file is used unless another store is set with
+// SetStateStore before the service starts
+type StateStore interface {
+	// Load returns the saved state, or the backup of it. a store which has never been saved returns an empty state
+	Load(backup bool) (*dto.TunnelStatus, error)
+	Save(status dto.TunnelStatus) error
+	// Backup copies the saved state to the backup and returns where the backup is
+	Backup() (string, error)
+	// Repair is called once the state was loaded. when neither the state nor the backup could be read they are set
+	// aside, otherwise a backup which cannot be read is made again from the state
+	Repair(unreadable bool)
+	// Prune removes the backups older than retentionDays and returns what was removed
+	Prune(retentionDays int, now time.Time) ([]string, error)
+	// Export writes the saved state to w
+	Export(w io.Writer) error
+}
+
+var stateStore StateStore = &fileStateStore{}
+
+func SetStateStore(store StateStore) {
+	stateStore = store
+}
+
+// fileStateStore keeps the state in config.File() and the backup in config.BackupFile()
+type fileStateStore struct {
+}
+
+func (f *fileStateStore) Load(backup bool) (*dto.TunnelStatus, error) {
+	if backup {
+		return readConfig(config.BackupFile())
+	}
+	return readConfig(config.File())
+}
+
+func (f *fileStateStore) Save(status dto.TunnelStatus) error {
+	// overwrite file if it exists
+	if err := EnsureConfigDir(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(config.File()); err == nil {
+		log.Debugf("backing up config")
+		var backup string
+		err = retryConfigWrite("back up the config file", func() error {
+			var backupErr error
+			backup, backupErr = f.Backup()
+			return backupErr
+		})
+		if err != nil {
+			log.Warnf("could not backup config file! %v", err)
+		} else {
+			log.Debugf("config file backed up to: %s", backup)
+		}
+	}
+
+	// written next to the config file and renamed over it so the config file is never left half written
+	tmp := config.File() + ".tmp"
+	cfg, err := openConfigForWrite(tmp)
+	if err != nil {
+		return err
+	}
+	defer cfg.Close()
+
+	w := bufio.NewWriter(cfg)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(status); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		_ = cfg.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("could not write the config file: %v", err)
+	}
+
+	if err = cfg.Close(); err != nil {
+		return fmt.Errorf("could not close the config file: %v", err)
+	}
+	if err = retryConfigWrite("replace the config file", func() error { return renameConfigFile(tmp, config.File()) }); err != nil {
+		return err
+	}
+
+	if status.BackupRetentionDays > 0 {
+		if _, err = f.Prune(status.BackupRetentionDays, time.Now()); err != nil {
+			log.Warnf("could not prune the config backups: %v", err)
+		}
+	}
+	return nil
+}
+
+// the functions used to open and replace the config file, variables so that they can be swapped out
+var openConfigFile = os.OpenFile
+var renameConfigFile = os.Rename
+
+// openConfigForWrite opens the config file for writing, retrying while it is locked
+func openConfigForWrite(path string) (*os.File, error) {
+	var cfg *os.File
+	err := retryConfigWrite("open the config file "+path, func() error {
+		var openErr error
+		cfg, openErr = openConfigFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		return openErr
+	})
+	return cfg, err
+}
+
+// retryConfigWrite runs op until it succeeds or the attempts run out, with a short backoff. antivirus and backup
+// software lock the config files for a moment when they scan or copy them
+func retryConfigWrite(what string, op func() error) error {
+	var err error
+	for attempt := 1; attempt <= constants.ConfigSaveAttempts; attempt++ {
+		if err = op(); err == nil {
+			return nil
+		}
+		log.Warnf("attempt %d of %d to %s failed: %v", attempt, constants.ConfigSaveAttempts, what, err)
+		if attempt < constants.ConfigSaveAttempts {
+			time.Sleep(time.Duration(attempt*constants.ConfigSaveBackoffMs) * time.Millisecond)
+		}
+	}
+	return fmt.Errorf("could not %s after %d attempts: %v", what, constants.ConfigSaveAttempts, err)
+}
+
+// Prune removes the files set aside by the service once they are older than retentionDays: the copies of the
+// config and of its backup moved aside as corrupt, and the identity files moved aside when they were forgotten or
+// split. the backup is rewritten by every save and the newest copy of the config which can still be read is kept
+// whatever its age. the .original identity files are not pruned, they are removed with their identity
+func (f *fileStateStore) Prune(retentionDays int, now time.Time) ([]string, error) {
+	configCopies, err := globAll(config.BackupFile()+"*", config.File()+".corrupt.*")
+	if err != nil {
+		return nil, err
+	}
+	setAside, err := globAll(filepath.Join(config.IdentityPath(), "*.json.forgotten"), filepath.Join(config.IdentityPath(), "*.json.split"))
+	if err != nil {
+		return nil, err
+	}
+	return pruneOldFiles(configCopies, setAside, retentionDays, now), nil
+}
+
+func globAll(patterns ...string) ([]string, error) {
+	files := make([]string, 0)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// pruneOldFiles removes the files older than retentionDays, keeping the newest of configCopies which can be read
+func pruneOldFiles(configCopies []string, setAside []string, retentionDays int, now time.Time) []string {
+	type candidate struct {
+		path    string
+		modTime time.Time
+	}
+	stat := func(files []string) []candidate {
+		candidates := make([]candidate, 0, len(files))
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			candidates = append(candidates, candidate{path: file, modTime: info.ModTime()})
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].modTime.After(candidates[j].modTime)
+		})
+		return candidates
+	}
+	copies := stat(configCopies)
+
+	keep := ""
+	for _, c := range copies {
+		if _, err := readConfig(c.path); err == nil {
+			keep = c.path
+			break
+		}
+	}
+
+	cutoff := now.Add(-time.Duration(retentionDays) * 24 * time.Hour)
+	removed := make([]string, 0)
+	for _, c := range append(copies, stat(setAside)...) {
+		if c.path == keep || !c.modTime.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(c.path); err != nil {
+			log.Warnf("could not remove old backup %s: %v", c.path, err)
+			continue
+		}
+		log.Infof("removed backup %s older than %d days", c.path, retentionDays)
+		removed = append(removed, c.path)
+	}
+	return removed
+}
+
+func (f *fileStateStore) Backup() (string, error) {
+	original, err := os.Open(config.File())
+	if err != nil {
+		return "", err
+	}
+	defer original.Close()
+	backup := config.BackupFile()
+	new, err := os.Create(backup)
+	if err != nil {
+		return "", err
+	}
+	defer new.Close()
+
+	_, err = io.Copy(new, original)
+	if err != nil {
+		return "", err
+	}
+	return backup, err
+}
+
+// Repair moves the config file and the backup aside when neither could be read, so they are kept for a look and
+// the next save starts over
+func (f *fileStateStore) Repair(unreadable bool) {
+	if unreadable {
+		moveCorruptFileAside(config.File())
+		moveCorruptFileAside(config.BackupFile())
+		return
+	}
+	f.repairBackup()
+}
+
+// Export copies the config file to w
+func (f *fileStateStore) Export(w io.Writer) error {
+	cfg, err := os.Open(config.File())
+	if err != nil {
+		return err
+	}
+	defer cfg.Close()
+	_, err = io.Copy(w, cfg)
+	return err
+}
+
+// repairBackup regenerates the backup from the config file when the backup does not decode. only called once the
+// config file itself was read successfully, otherwise a corrupt config would replace a good backup
+func (f *fileStateStore) repairBackup() {
+	backup := config.BackupFile()
+	if _, err := os.Stat(config.File()); err != nil {
+		return
+	}
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		return
+	}
+	_, err := readConfig(backup)
+	if err == nil {
+		return
+	}
+	log.Warn(recordWarning(WarningConfig, "the config backup %s is not valid, regenerating it from the config file. %v", backup, err))
+	moveCorruptFileAside(backup)
+	if _, err = f.Backup(); err != nil {
+		log.Errorf("could not regenerate the config backup %s: %v", backup, err)
+		return
+	}
+	log.Infof("config backup %s regenerated from the config file", backup)
+}
+
+var utf8Bom = []byte{0xEF, 0xBB, 0xBF}
+
+// decodeJsonFile decodes the json file into v, skipping the utf-8 byte order mark some editors write. trailing
+// whitespace is ignored, anything else after the json value is an error
+func decodeJsonFile(r io.Reader, v interface{}) error {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(len(utf8Bom)); err == nil && bytes.Equal(b, utf8Bom) {
+		_, _ = br.Discard(len(utf8Bom))
+	}
+	dec := json.NewDecoder(br)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after the json value at offset %d", dec.InputOffset())
+	}
+	return nil
+}
+
+func readConfig(filename string) (*dto.TunnelStatus, error) {
+	log.Debugf("reading config file located at: %s", filename)
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		log.Infof("the config file does not exist. this is normal if this is a new install or if the config file was removed manually")
+		return &dto.TunnelStatus{}, nil
+	}
+
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("the config file at contains no bytes and is considered invalid: %s", filename)
+	}
+
+	if maxSize := config.MaxConfigSize(); info.Size() > maxSize {
+		return nil, fmt.Errorf("the config file at %s is %d bytes which is larger than the maximum permitted: %d. set %s to override", filename, info.Size(), maxSize, config.MaxConfigSizeEnv)
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error opening config file: %v", err)
+	}
+	defer file.Close()
+
+	status := &dto.TunnelStatus{}
+	if err = decodeJsonFile(file, status); err != nil {
+		return nil, fmt.Errorf("unexpected error reading config file: %v", err)
+	}
+	return status, nil
+}
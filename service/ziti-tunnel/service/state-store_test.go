@@ -0,0 +1,419 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryStateStore keeps the saved state in memory
+type memoryStateStore struct {
+	saved *dto.TunnelStatus
+	saves int
+}
+
+func (m *memoryStateStore) Load(bool) (*dto.TunnelStatus, error) {
+	if m.saved == nil {
+		return &dto.TunnelStatus{}, nil
+	}
+	return m.saved, nil
+}
+
+func (m *memoryStateStore) Save(status dto.TunnelStatus) error {
+	m.saved = &status
+	m.saves++
+	return nil
+}
+
+func (m *memoryStateStore) Backup() (string, error) {
+	return "memory", nil
+}
+
+func (m *memoryStateStore) Repair(bool) {
+}
+
+func (m *memoryStateStore) Prune(int, time.Time) ([]string, error) {
+	return nil, nil
+}
+
+func (m *memoryStateStore) Export(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m.saved)
+}
+
+// useTempConfigDir points the config folder at a new folder for the test, returning the folder
+func useTempConfigDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "config-folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{"APPDATA", "XDG_CONFIG_HOME"} {
+		saved, found := os.LookupEnv(env)
+		_ = os.Setenv(env, dir)
+		env := env
+		t.Cleanup(func() {
+			if found {
+				_ = os.Setenv(env, saved)
+			} else {
+				_ = os.Unsetenv(env)
+			}
+		})
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	if err = os.MkdirAll(config.Path(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return config.Path()
+}
+
+func TestReadConfigMaxSize(t *testing.T) {
+	small := `{"TunIpv4":"100.64.0.1"}`
+	big := `{"TunIpv4":"100.64.0.1","Identities":[]` + strings.Repeat(" ", 64) + `}`
+	tests := []struct {
+		name     string
+		limit    string
+		content  string
+		wantIpv4 string
+		wantErr  string
+	}{
+		{"under the limit", "64", small, "100.64.0.1", ""},
+		{"over the limit", "64", big, "", "larger than the maximum permitted: 64"},
+		{"limit raised", "4096", big, "100.64.0.1", ""},
+		{"invalid limit uses the default", "many", big, "100.64.0.1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useTempConfigDir(t)
+			saved, found := os.LookupEnv(config.MaxConfigSizeEnv)
+			_ = os.Setenv(config.MaxConfigSizeEnv, tt.limit)
+			defer func() {
+				if found {
+					_ = os.Setenv(config.MaxConfigSizeEnv, saved)
+				} else {
+					_ = os.Unsetenv(config.MaxConfigSizeEnv)
+				}
+			}()
+			path := filepath.Join(dir, "config.json")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			status, err := readConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readConfig() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readConfig() error = %v", err)
+			}
+			if status.TunIpv4 != tt.wantIpv4 {
+				t.Errorf("readConfig() TunIpv4 = %q, want %q", status.TunIpv4, tt.wantIpv4)
+			}
+		})
+	}
+}
+
+func TestLoadFallsBackToTheBackupOfAnOversizedConfig(t *testing.T) {
+	useTempConfigDir(t)
+	_ = os.Setenv(config.MaxConfigSizeEnv, "64")
+	defer func() { _ = os.Unsetenv(config.MaxConfigSizeEnv) }()
+	if err := ioutil.WriteFile(config.File(), []byte(`{"TunIpv4":"100.64.0.1"`+strings.Repeat(" ", 64)+`}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config.BackupFile(), []byte(`{"TunIpv4":"100.64.0.2"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &fileStateStore{}
+	if _, err := store.Load(false); err == nil {
+		t.Fatal("Load() of the oversized config succeeded")
+	}
+	status, err := store.Load(true)
+	if err != nil {
+		t.Fatalf("Load() of the backup error = %v", err)
+	}
+	if status.TunIpv4 != "100.64.0.2" {
+		t.Errorf("Load() of the backup TunIpv4 = %q, want 100.64.0.2", status.TunIpv4)
+	}
+}
+
+func TestRepairBackup(t *testing.T) {
+	const good = `{"TunIpv4":"100.64.0.1"}`
+	tests := []struct {
+		name        string
+		config      string // not written when empty
+		backup      string // not written when empty
+		wantBackup  string // empty when the backup should not exist
+		wantCorrupt bool
+	}{
+		{"corrupt backup", good, `{"TunIpv4":`, good, true},
+		{"valid backup", good, `{"TunIpv4":"100.64.0.2"}`, `{"TunIpv4":"100.64.0.2"}`, false},
+		{"no backup", good, "", "", false},
+		{"no config", "", `{"TunIpv4":`, `{"TunIpv4":`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useTempConfigDir(t)
+			saved := warnings
+			defer func() { warnings = saved }()
+			warnings = &warningCollector{max: 10}
+			if tt.config != "" {
+				if err := ioutil.WriteFile(config.File(), []byte(tt.config), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.backup != "" {
+				if err := ioutil.WriteFile(config.BackupFile(), []byte(tt.backup), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			(&fileStateStore{}).repairBackup()
+
+			content, err := ioutil.ReadFile(config.BackupFile())
+			if tt.wantBackup == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("a backup was created: %s", content)
+				}
+			} else if string(content) != tt.wantBackup {
+				t.Errorf("backup = %s, want %s", content, tt.wantBackup)
+			}
+			corrupt, _ := filepath.Glob(filepath.Join(dir, "*.corrupt.*"))
+			if (len(corrupt) == 1) != tt.wantCorrupt {
+				t.Errorf("corrupt files moved aside = %v, want one %t", corrupt, tt.wantCorrupt)
+			}
+			if recorded := len(warnings.warnings); (recorded == 1) != tt.wantCorrupt {
+				t.Errorf("%d warnings recorded, want a warning %t", recorded, tt.wantCorrupt)
+			}
+		})
+	}
+}
+
+func TestRetryConfigWrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		wantErr   bool
+		wantCalls int
+	}{
+		{"first attempt", 0, false, 1},
+		{"locked for a moment", 2, false, 3},
+		{"locked for good", constants.ConfigSaveAttempts, true, constants.ConfigSaveAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryConfigWrite("write the test file", func() error {
+				calls++
+				if calls <= tt.failures {
+					return errors.New("the file is in use by another process")
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("retryConfigWrite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("op ran %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestOpenConfigForWrite(t *testing.T) {
+	original := openConfigFile
+	defer func() { openConfigFile = original }()
+	dir, err := ioutil.TempDir("", "config-write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	locked := 1
+	openConfigFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		if locked > 0 {
+			locked--
+			return nil, errors.New("the file is in use by another process")
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+	cfg, err := openConfigForWrite(filepath.Join(dir, "config.json.tmp"))
+	if err != nil {
+		t.Fatalf("openConfigForWrite() error = %v", err)
+	}
+	_ = cfg.Close()
+}
+
+// useMemoryStateStore swaps the saved state and the store for the test, returning the store
+func useMemoryStateStore(t *testing.T) *memoryStateStore {
+	savedStore, savedState := stateStore, rts.state
+	t.Cleanup(func() { stateStore, rts.state = savedStore, savedState })
+	m := &memoryStateStore{}
+	stateStore = m
+	rts.state = &dto.TunnelStatus{}
+	return m
+}
+
+func TestPruneOldFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune-backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	write := func(name string, content string, age time.Duration) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	day := 24 * time.Hour
+	backup := write("config.json.backup", "{}", 40*day)
+	oldCorrupt := write("config.json.corrupt.1", "{", 40*day)
+	newCorrupt := write("config.json.corrupt.2", "{", day)
+	forgotten := write("id.json.forgotten", "{}", 40*day)
+	split := write("combined.json.split", "[]", day)
+
+	removed := pruneOldFiles([]string{backup, oldCorrupt, newCorrupt}, []string{forgotten, split}, 30, now)
+	tests := []struct {
+		name     string
+		file     string
+		wantGone bool
+	}{
+		{"newest valid backup whatever its age", backup, false},
+		{"old corrupt copy", oldCorrupt, true},
+		{"recent corrupt copy", newCorrupt, false},
+		{"old forgotten identity", forgotten, true},
+		{"recent split file", split, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := os.Stat(tt.file)
+			if gone := os.IsNotExist(err); gone != tt.wantGone {
+				t.Errorf("%s removed = %v, want %v", tt.file, gone, tt.wantGone)
+			}
+		})
+	}
+	if len(removed) != 2 {
+		t.Errorf("pruneOldFiles() removed %v, want 2 files", removed)
+	}
+}
+
+func TestExportState(t *testing.T) {
+	store := useMemoryStateStore(t)
+	store.saved = &dto.TunnelStatus{TunIpv4: "100.64.0.1"}
+	dir, err := ioutil.TempDir("", "export-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "config.json")
+	if err = exportState(target); err != nil {
+		t.Fatalf("exportState() error = %v", err)
+	}
+	exported, err := readConfig(target)
+	if err != nil {
+		t.Fatalf("the exported config cannot be read: %v", err)
+	}
+	if exported.TunIpv4 != "100.64.0.1" {
+		t.Errorf("exported TunIpv4 %s, want the saved state", exported.TunIpv4)
+	}
+}
+
+func TestDecodeJsonFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantErr  bool
+		wantIpv4 string
+	}{
+		{"json", `{"TunIpv4":"100.64.0.1"}`, false, "100.64.0.1"},
+		{"byte order mark", "\xEF\xBB\xBF" + `{"TunIpv4":"100.64.0.1"}`, false, "100.64.0.1"},
+		{"trailing whitespace", "{\"TunIpv4\":\"100.64.0.1\"}\r\n\t ", false, "100.64.0.1"},
+		{"trailing garbage", `{"TunIpv4":"100.64.0.1"}x`, true, ""},
+		{"second value", `{"TunIpv4":"100.64.0.1"}{}`, true, ""},
+		{"malformed", `{"TunIpv4":`, true, ""},
+		{"empty", "", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &dto.TunnelStatus{}
+			err := decodeJsonFile(strings.NewReader(tt.data), status)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeJsonFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && status.TunIpv4 != tt.wantIpv4 {
+				t.Errorf("TunIpv4 = %s, want %s", status.TunIpv4, tt.wantIpv4)
+			}
+		})
+	}
+}
+
+func TestStripByteOrderMark(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		wantStripped bool
+		want         string
+	}{
+		{"byte order mark", "\xEF\xBB\xBF{}", true, "{}"},
+		{"none", "{}", false, "{}"},
+		{"empty", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "strip-bom")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "id.json")
+			if err := ioutil.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			stripped, err := stripByteOrderMark(path)
+			if err != nil {
+				t.Fatalf("stripByteOrderMark() error = %v", err)
+			}
+			got, _ := ioutil.ReadFile(path)
+			if stripped != tt.wantStripped || string(got) != tt.want {
+				t.Errorf("got %t and %q, want %t and %q", stripped, got, tt.wantStripped, tt.want)
+			}
+			if files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*")); len(files) != 1 {
+				t.Errorf("files left behind: %v", files)
+			}
+		})
+	}
+}
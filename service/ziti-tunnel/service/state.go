@@ -18,7 +18,8 @@
 package service
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,8 +28,10 @@ import (
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util/logging"
 	"github.com/openziti/foundation/identity/identity"
 	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"golang.zx2c4.com/wireguard/tun"
@@ -39,8 +42,12 @@ import (
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -50,66 +57,192 @@ type RuntimeState struct {
 	tun       *tun.Device
 	tunName   string
 	ids       map[string]*Id
+	idsLock   sync.RWMutex
 	tun_state atomic.Value
+
+	dnsLock     sync.Mutex
+	dnsDecision *dto.DnsDecision // made when the TUN is created, never written to the config file. guarded by dnsLock
+
+	routesLock sync.Mutex
+	routes     map[string]tunRoute // added by the tunneler, added again when the TUN is recreated
+
+	batchLock  sync.Mutex
+	batchDepth int
+	batchDirty bool
+
+	configured  *dto.TunnelStatus // the config as read when the service started, before defaults and limits
+	adjustments []dto.ConfigAdjustment
+	policy      *dto.ConfigPolicy      // read from config.PolicyFile, nil when there is none
+	enforced    []dto.ConfigAdjustment // the adjustments made by the policy, never written to the config file
+
+	identityDirErr error // set when the identity folder is refused, no identity is loaded while it is set
 }
 
 func (t *RuntimeState) RemoveByFingerprint(fingerprint string) {
+	t.idsLock.Lock()
+	defer t.idsLock.Unlock()
 	delete(t.ids, fingerprint)
 }
 
-func (t *RuntimeState) Find(fingerprint string) *Id {
-	return t.ids[fingerprint]
+// connectNewIdentity connects the identities added with addIdentity, replaced in tests
+var connectNewIdentity = connectIdentity
+
+// addIdentity makes a newly written identity known: it is added to the identities in use and persisted as persisted,
+// connected when it is active and the state is saved
+func (t *RuntimeState) addIdentity(id *Id, persisted *dto.Identity) {
+	t.idsLock.Lock()
+	t.ids[id.FingerPrint] = id
+	t.idsLock.Unlock()
+	t.state.Identities = append(t.state.Identities, persisted)
+	if id.Active {
+		connectNewIdentity(id)
+	}
+	t.SaveState()
 }
 
-func (t *RuntimeState) SaveState() {
-	// overwrite file if it exists
-	_ = os.MkdirAll(config.Path(), 0644)
+// cId returns the context of the identity. read under idsLock because a load which did not connect in time is
+// abandoned from a timer while the uv loop reports on it
+func (t *RuntimeState) cId(id *Id) *cziti.ZIdentity {
+	t.idsLock.RLock()
+	defer t.idsLock.RUnlock()
+	return id.CId
+}
 
-	log.Debugf("backing up config")
-	backup, err := backupConfig()
-	if err != nil {
-		log.Warnf("could not backup config file! %v", err)
-	} else {
-		log.Debugf("config file backed up to: %s", backup)
+// replaceCId sets the context of the identity to zid when it is still old, reporting if it was replaced
+func (t *RuntimeState) replaceCId(id *Id, old *cziti.ZIdentity, zid *cziti.ZIdentity) bool {
+	t.idsLock.Lock()
+	defer t.idsLock.Unlock()
+	if id.CId != old {
+		return false
 	}
+	id.CId = zid
+	return true
+}
 
-	cfg, err := os.OpenFile(config.File(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	defer cfg.Close()
-	if err != nil {
-		log.Panicf("An unexpected and unrecoverable error has occurred while %s: %v", "opening the config file", err)
+// allIds returns the identities, copied under the lock so the caller can range over them while identities are added
+// or removed
+func (t *RuntimeState) allIds() []*Id {
+	t.idsLock.RLock()
+	defer t.idsLock.RUnlock()
+	ids := make([]*Id, 0, len(t.ids))
+	for _, id := range t.ids {
+		ids = append(ids, id)
 	}
+	return ids
+}
 
-	w := bufio.NewWriter(bufio.NewWriter(cfg))
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "  ")
-	_ = enc.Encode(t.ToStatus(false))
-	_ = w.Flush()
+// idsInLoadOrder returns the identities sorted by LoadPriority, highest first, then by name
+func (t *RuntimeState) idsInLoadOrder() []*Id {
+	t.idsLock.RLock()
+	ordered := make([]*Id, 0, len(t.ids))
+	for _, id := range t.ids {
+		ordered = append(ordered, id)
+	}
+	t.idsLock.RUnlock()
+	sortInLoadOrder(ordered)
+	return ordered
+}
 
-	err = cfg.Close()
-	if err != nil {
-		log.Panicf("An unexpected and unrecoverable error has occurred while %s: %v", "closing the config file", err)
+func sortInLoadOrder(ids []*Id) {
+	sort.SliceStable(ids, func(i, j int) bool {
+		if ids[i].LoadPriority != ids[j].LoadPriority {
+			return ids[i].LoadPriority > ids[j].LoadPriority
+		}
+		return ids[i].Name < ids[j].Name
+	})
+}
+
+func (t *RuntimeState) Find(fingerprint string) *Id {
+	t.idsLock.RLock()
+	defer t.idsLock.RUnlock()
+	return t.ids[fingerprint]
+}
+
+// SaveState writes the state to the state store. a failed save is recorded as a warning and returned, the state in
+// memory is kept and written again by the next save
+func (t *RuntimeState) SaveState() error {
+	t.batchLock.Lock()
+	if t.batchDepth > 0 {
+		t.batchDirty = true
+		t.batchLock.Unlock()
+		log.Trace("state save deferred until the batch ends")
+		return nil
+	}
+	t.batchLock.Unlock()
+
+	status := t.ToStatus(false)
+	t.withoutPolicy(&status)
+	if err := stateStore.Save(status); err != nil {
+		log.Error(recordWarning(WarningConfig, "the state could not be saved: %v", err))
+		return err
 	}
 	log.Debug("state saved")
+	return nil
 }
 
-func backupConfig() (string, error) {
-	original, err := os.Open(config.File())
-	if err != nil {
-		return "", err
+// BeginBatch defers every SaveState until the matching EndBatch so a bulk change writes the config file once.
+// batches nest, the state is saved when the outermost batch ends. defer EndBatch right after BeginBatch so the state
+// is still saved if the bulk change panics
+func (t *RuntimeState) BeginBatch() {
+	t.batchLock.Lock()
+	defer t.batchLock.Unlock()
+	t.batchDepth++
+}
+
+// EndBatch ends a batch started with BeginBatch, saving the state if it changed during the outermost batch
+func (t *RuntimeState) EndBatch() {
+	t.batchLock.Lock()
+	if t.batchDepth == 0 {
+		t.batchLock.Unlock()
+		log.Warn("EndBatch called without a matching BeginBatch")
+		return
 	}
-	defer original.Close()
-	backup := config.File() + ".backup"
-	new, err := os.Create(backup)
-	if err != nil {
-		return "", err
+	t.batchDepth--
+	save := t.batchDepth == 0 && t.batchDirty
+	if t.batchDepth == 0 {
+		t.batchDirty = false
+	}
+	t.batchLock.Unlock()
+
+	if save {
+		t.SaveState()
 	}
-	defer new.Close()
+}
+
+// PruneBackups removes the files set aside by the service which are older than BackupRetentionDays and returns the
+// files removed. the newest copy of the config which can still be read is never removed
+func (t *RuntimeState) PruneBackups() ([]string, error) {
+	return stateStore.Prune(t.state.BackupRetentionDays, time.Now())
+}
 
-	_, err = io.Copy(new, original)
+// VerifyBackupIntegrity saves the state, forces a backup and confirms both decode to the same status. it refuses to
+// run during a batch, which would defer the save and compare a config that is about to change
+func (t *RuntimeState) VerifyBackupIntegrity() error {
+	t.batchLock.Lock()
+	open := t.batchDepth > 0
+	t.batchLock.Unlock()
+	if open {
+		return fmt.Errorf("a batch of changes is open, the config is only saved once it ends")
+	}
+	if err := t.SaveState(); err != nil {
+		return fmt.Errorf("could not save the config: %v", err)
+	}
+	if _, err := stateStore.Backup(); err != nil {
+		return fmt.Errorf("could not backup config file: %v", err)
+	}
+	current, err := stateStore.Load(false)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("could not decode the config: %v", err)
+	}
+	backup, err := stateStore.Load(true)
+	if err != nil {
+		return fmt.Errorf("could not decode the backup config: %v", err)
+	}
+	if !reflect.DeepEqual(current, backup) {
+		return fmt.Errorf("the backup config does not match the config")
 	}
-	return backup, err
+	log.Debug("config file and backup verified")
+	return nil
 }
 
 func (t *RuntimeState) ToStatus(onlyInitialized bool) dto.TunnelStatus {
@@ -128,14 +261,60 @@ func (t *RuntimeState) ToStatus(onlyInitialized bool) dto.TunnelStatus {
 		ServiceVersion:        Version,
 		TunIpv4:               t.state.TunIpv4,
 		TunIpv4Mask:           t.state.TunIpv4Mask,
+		StrictTunIpv4Mask:     t.state.StrictTunIpv4Mask,
+		TunIpConflict:         t.state.TunIpConflict,
+		TunAutoRecover:        t.state.TunAutoRecover,
+		TunCidrRoute:          t.state.TunCidrRoute,
+		ServiceCidrRoute:      t.state.ServiceCidrRoute,
+		ExistingTunPolicy:     t.state.ExistingTunPolicy,
+		SplitTunnel:           t.state.SplitTunnel,
+		VerifyRouteRemoval:    t.state.VerifyRouteRemoval,
+		OrphanGraceDays:       t.state.OrphanGraceDays,
+		AutoForgetOrphans:     t.state.AutoForgetOrphans,
+		AutoRecoverOrphans:    t.state.AutoRecoverOrphans,
 		AddDns:                t.state.AddDns,
 		NotificationFrequency: t.state.NotificationFrequency,
 		ApiPageSize:           t.state.ApiPageSize,
+		ImportDir:             t.state.ImportDir,
+		IdentityDir:           t.state.IdentityDir,
+		StrictIdentityDir:     t.state.StrictIdentityDir,
+		DnsTtlSeconds:         t.state.DnsTtlSeconds,
+		DnsQueryLogging:       t.state.DnsQueryLogging,
+		DnsRateLimit:          t.state.DnsRateLimit,
+		DnsRateLimitBurst:     t.state.DnsRateLimitBurst,
+		DnsFailureMode:        t.state.DnsFailureMode,
+		MetricsSampleInterval: t.state.MetricsSampleInterval,
+		BatterySampleInterval: t.state.BatterySampleInterval,
+		LatencySampleInterval: t.state.LatencySampleInterval,
+		ReconnectWindow:       t.state.ReconnectWindow,
+		ReconnectJitterMs:     t.state.ReconnectJitterMs,
+		ControllerDialTimeout: t.state.ControllerDialTimeout,
+		BackupRetentionDays:   t.state.BackupRetentionDays,
+		LogMaxSizeMb:          t.state.LogMaxSizeMb,
+		LogMaxFiles:           t.state.LogMaxFiles,
+		MaxIdentities:         t.state.MaxIdentities,
+		AllowedControllers:    t.state.AllowedControllers,
+		InterceptedDnsTypes:   t.state.InterceptedDnsTypes,
+		Syslog:                t.state.Syslog,
+		LogDestination:        t.state.LogDestination,
+		StaticHostOverrides:   t.state.StaticHostOverrides,
+		LatencyMonitors:       t.state.LatencyMonitors,
+		LoopbackMappings:      t.state.LoopbackMappings,
+		DnsSearchDomains:      t.state.DnsSearchDomains,
+		DnsListenAddresses:    t.state.DnsListenAddresses,
+		WinsServers:           t.state.WinsServers,
+		DisableNetbios:        t.state.DisableNetbios,
+		EventQueueCapacity:    t.state.EventQueueCapacity,
+		MfaReminderLeadTime:   t.state.MfaReminderLeadTime,
+		LazyIdleTimeout:       t.state.LazyIdleTimeout,
+		TunMarker:             t.state.TunMarker,
+		Degraded:              t.state.Degraded,
+		DegradedReason:        t.state.DegradedReason,
 	}
 
 	i := 0
-	for _, id := range t.ids {
-		if onlyInitialized {
+	for _, id := range t.allIds() {
+		if onlyInitialized && !t.state.Degraded {
 			if id.CId != nil && id.CId.Loaded {
 				cid := Clean(id)
 				clean.Identities = append(clean.Identities, &cid)
@@ -147,21 +326,33 @@ func (t *RuntimeState) ToStatus(onlyInitialized bool) dto.TunnelStatus {
 		i++
 	}
 
+	if onlyInitialized {
+		// runtime only, never written to the config file
+		stats := t.DnsResponderStats()
+		clean.DnsResponderStats = &stats
+		clean.EventQueueLen = len(events.broadcast)
+		clean.EventQueueCap = cap(events.broadcast)
+		clean.DnsDecision = t.currentDnsDecision()
+		clean.PowerMode = powerState.current()
+		clean.TunInterface = t.TunInterface()
+		clean.ServiceCidrConflicts = t.ServiceCidrConflicts()
+	}
 	return clean
 }
 
 func (t *RuntimeState) ToMetrics() dto.TunnelStatus {
+	t.idsLock.RLock()
+	defer t.idsLock.RUnlock()
 	clean := dto.TunnelStatus{
 		Identities: make([]*dto.Identity, len(t.ids)),
 	}
 
 	i := 0
 	for _, id := range t.ids {
-		AddMetrics(id)
 		clean.Identities[i] = &dto.Identity{
 			Name:               id.Name,
 			FingerPrint:        id.FingerPrint,
-			Metrics:            id.Metrics,
+			Metrics:            AddMetrics(id),
 			Active:             id.Active,
 			MfaEnabled:         id.MfaEnabled,
 			MfaNeeded:          id.MfaNeeded,
@@ -177,9 +368,24 @@ func (t *RuntimeState) ToMetrics() dto.TunnelStatus {
 	return clean
 }
 
+// isWintunMissing reports if the TUN device could not be created because the wintun driver/dll is not available
+func isWintunMissing(err error) bool {
+	if errors.Is(err, windows.ERROR_MOD_NOT_FOUND) || errors.Is(err, windows.ERROR_PROC_NOT_FOUND) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Error loading wintun DLL") || strings.Contains(msg, "Unable to load library")
+}
+
 func (t *RuntimeState) CreateTun(ipv4 string, ipv4mask int, applyDns bool) (net.IP, *tun.Device, error) {
 	log.Infof("creating TUN device: %s", TunName)
-	tunDevice, err := tun.CreateTUN(TunName, 64*1024-1)
+	var tunDevice tun.Device
+	var err error
+	if guid := t.prepareTun(TunName); guid != nil {
+		tunDevice, err = createTUNWithGUID(TunName, guid, 64*1024-1)
+	} else {
+		tunDevice, err = createTUN(TunName, 64*1024-1)
+	}
 	if err == nil {
 		t.tun = &tunDevice
 		tunName, err2 := tunDevice.Name()
@@ -187,6 +393,9 @@ func (t *RuntimeState) CreateTun(ipv4 string, ipv4mask int, applyDns bool) (net.
 			t.tunName = tunName
 		}
 	} else {
+		if isWintunMissing(err) {
+			return nil, nil, fmt.Errorf("%w: (%v)", ErrWintunMissing, err)
+		}
 		return nil, nil, fmt.Errorf("error creating TUN device: (%v)", err)
 	}
 
@@ -199,21 +408,22 @@ func (t *RuntimeState) CreateTun(ipv4 string, ipv4mask int, applyDns bool) (net.
 	nativeTunDevice := tunDevice.(*tun.NativeTun)
 	luid := winipcfg.LUID(nativeTunDevice.LUID())
 
-	if strings.TrimSpace(ipv4) == "" {
-		log.Infof("ip not provided using default: %v", ipv4)
-		ipv4 = constants.Ipv4ip
-		rts.UpdateIpv4(ipv4)
-	}
-	if ipv4mask < constants.Ipv4MaxMask {
-		log.Warnf("provided mask is too large: %d using default: %d", ipv4mask, constants.Ipv4DefaultMask)
-		ipv4mask = constants.Ipv4DefaultMask
-		rts.UpdateIpv4Mask(ipv4mask)
-	}
+	ipv4, ipv4mask = t.clampTunAddress(ipv4, ipv4mask)
 	ip, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipv4, ipv4mask))
 	if err != nil {
 		return nil, nil, fmt.Errorf("error parsing CIDR block: (%v)", err)
 	}
 
+	resolved, err := t.resolveTunIpConflict(luid, ip, ipnet)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !resolved.Equal(ip) {
+		ip = resolved
+		ipv4 = ip.String()
+		rts.UpdateIpv4(ipv4)
+	}
+
 	log.Infof("setting TUN interface address to [%s]", ip)
 	err = luid.SetIPAddresses([]net.IPNet{{IP: ip, Mask: ipnet.Mask}})
 	if err != nil {
@@ -227,132 +437,629 @@ func (t *RuntimeState) CreateTun(ipv4 string, ipv4mask int, applyDns bool) (net.
 	}
 	log.Infof("TUN dns servers set to: %s", dns)
 
-	log.Infof("setting routes for cidr: %s. Next Hop: %s", ipnet.String(), ipnet.IP.String())
-	err = luid.SetRoutes([]*winipcfg.RouteData{{Destination: *ipnet, NextHop: ipnet.IP, Metric: 0}})
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to SetRoutes: (%v)", err)
+	if err = t.setTunCidrRoute(luid, ipnet); err != nil {
+		return nil, nil, err
 	}
 	log.Info("routing applied")
+	t.state.TunMarker = &dto.TunMarker{Luid: uint64(luid), Ip: ipv4}
 
 	zitiPoliciesEffective := windns.IsNrptPoliciesEffective(ipv4)
-	interfaceMetric := 255
+	decision := decideDns(applyDns, zitiPoliciesEffective)
 	if applyDns || !zitiPoliciesEffective {
 		if applyDns {
 			log.Infof("DNS is applied to the TUN interface, because apply Dns flag in the config file is %t ", applyDns)
 		}
 		if !applyDns && !zitiPoliciesEffective {
-			log.Infof("DNS is applied to the TUN interface, because Ziti policies test result in this client is %t", zitiPoliciesEffective)
+			log.Info(recordWarning(WarningDns, "DNS is applied to the TUN interface, because Ziti policies test result in this client is %t", zitiPoliciesEffective))
 		}
 		//for windows 10+, could 'domains' be able to replace NRPT? dunno - didn't test it
-		luid.SetDNS(windows.AF_INET, []net.IP{ip}, nil)
-		interfaceMetric = 5
+		luid.SetDNS(windows.AF_INET, []net.IP{ip}, t.state.DnsSearchDomains)
+	} else if len(t.state.DnsSearchDomains) > 0 {
+		if err = applyDnsSearchDomains(luid, t.state.DnsSearchDomains); err != nil {
+			log.Warn(recordWarning(WarningDns, "could not apply the dns search domains %v: %v", t.state.DnsSearchDomains, err))
+		}
 	}
-	cziti.SetInterfaceMetric(TunName, interfaceMetric)
-	log.Debugf("Interface Metric of %s is set to %d", TunName, interfaceMetric)
-
+	if len(t.state.WinsServers) > 0 || t.state.DisableNetbios {
+		if err = applyWins(luid, t.state.WinsServers, t.state.DisableNetbios); err != nil {
+			log.Warn(recordWarning(WarningDns, "could not apply the wins servers %v: %v", t.state.WinsServers, err))
+		}
+	}
+	decision.InterfaceMetric = tunInterfaceMetric(t.splitTunnel(), decision.Action)
+	t.dnsLock.Lock()
+	t.dnsDecision = decision
+	t.dnsLock.Unlock()
+	cziti.SetInterfaceMetric(TunName, decision.InterfaceMetric)
+	log.Debugf("Interface Metric of %s is set to %d", TunName, decision.InterfaceMetric)
+
+	tunInterfaceDetails.invalidate()
 	return ip, t.tun, nil
 }
 
+// tunAddress returns the address and mask the TUN is given, the defaults replace a missing ip or a mask which is
+// too large
+func tunAddress(ipv4 string, ipv4mask int) (string, int) {
+	if strings.TrimSpace(ipv4) == "" {
+		ipv4 = constants.Ipv4ip
+	}
+	if ipv4mask < constants.Ipv4MaxMask {
+		ipv4mask = constants.Ipv4DefaultMask
+	}
+	return ipv4, ipv4mask
+}
+
+// clampTunAddress is where the address of the TUN is corrected before it is used. the ip or mask replaced by
+// tunAddress is saved and a clamped mask is recorded as a warning
+func (t *RuntimeState) clampTunAddress(ipv4 string, ipv4mask int) (string, int) {
+	clampedIpv4, clampedMask := tunAddress(ipv4, ipv4mask)
+	if clampedIpv4 != ipv4 {
+		log.Infof("ip not provided using default: %v", clampedIpv4)
+		t.UpdateIpv4(clampedIpv4)
+	}
+	if clampedMask != ipv4mask {
+		log.Warn(recordWarning(WarningTun, "provided mask is too large: %d using default: %d", ipv4mask, clampedMask))
+		t.UpdateIpv4Mask(clampedMask)
+	}
+	return clampedIpv4, clampedMask
+}
+
+// tunInterfaceMetric chooses the interface metric of the TUN:
+//
+//	dns action             split tunnel  metric
+//	applied-interface-dns  either        TunMetricPreferred, windows must prefer the dns server of the TUN
+//	relied-on-nrpt         true          TunMetricSplit, the nrpt rules send the ziti names to the TUN, nothing else
+//	relied-on-nrpt         false         TunMetricPreferred
+func tunInterfaceMetric(splitTunnel bool, dnsAction string) int {
+	if dnsAction == DnsActionNrpt && splitTunnel {
+		return constants.TunMetricSplit
+	}
+	return constants.TunMetricPreferred
+}
+
+func (t *RuntimeState) splitTunnel() bool {
+	return t.state.SplitTunnel == nil || *t.state.SplitTunnel
+}
+
+// UpdateSplitTunnel sets SplitTunnel and applies the resulting interface metric to the TUN when it is up
+func (t *RuntimeState) UpdateSplitTunnel(enabled bool) int {
+	log.Infof("setting split tunnel : %t", enabled)
+	t.state.SplitTunnel = &enabled
+	metric := 0
+	t.dnsLock.Lock()
+	tunUp := t.dnsDecision != nil
+	if tunUp {
+		metric = tunInterfaceMetric(enabled, t.dnsDecision.Action)
+		t.dnsDecision.InterfaceMetric = metric
+	}
+	t.dnsLock.Unlock()
+	if tunUp {
+		cziti.SetInterfaceMetric(TunName, metric)
+		log.Infof("Interface Metric of %s is set to %d", TunName, metric)
+	}
+	t.SaveState()
+	return metric
+}
+
+// currentDnsDecision returns a copy of the dns decision made when the TUN was created, nil before that
+func (t *RuntimeState) currentDnsDecision() *dto.DnsDecision {
+	t.dnsLock.Lock()
+	defer t.dnsLock.Unlock()
+	if t.dnsDecision == nil {
+		return nil
+	}
+	d := *t.dnsDecision
+	return &d
+}
+
+// dnsMode describes how dns is provided with the decision. empty until the TUN was created
+func dnsMode(d *dto.DnsDecision) string {
+	switch {
+	case d == nil:
+		return ""
+	case d.Action == DnsActionNrpt:
+		return DnsModeNrpt
+	case d.ApplyDns:
+		return DnsModeInterface
+	default:
+		return DnsModeInterfaceNrptFailed
+	}
+}
+
+// decideDns records the inputs of the decision to apply dns to the TUN interface or to rely on the nrpt rules
+func decideDns(applyDns bool, nrptEffective bool) *dto.DnsDecision {
+	d := &dto.DnsDecision{ApplyDns: applyDns, NrptEffective: nrptEffective, Action: DnsActionNrpt}
+	if applyDns || !nrptEffective {
+		d.Action = DnsActionInterface
+	}
+	return d
+}
+
+// tunDnsServers returns the dns servers set on the TUN interface, replaced in tests
+var tunDnsServers = func(device tun.Device) ([]net.IP, error) {
+	nativeTunDevice := device.(*tun.NativeTun)
+	return winipcfg.LUID(nativeTunDevice.LUID()).DNS()
+}
+
+// nrptRules returns the nrpt rules added by the tunneler, replaced in tests
+var nrptRules = windns.GetNrptRules
+
+// CurrentDnsConfig returns the dns servers set on the TUN, the nrpt rules added by the tunneler and how dns was
+// decided to be provided when the TUN was created
+func (t *RuntimeState) CurrentDnsConfig() (*dto.DnsConfig, error) {
+	if t.tun == nil {
+		return nil, fmt.Errorf("the TUN is not up")
+	}
+	servers, err := tunDnsServers(*t.tun)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch DNS address: (%v)", err)
+	}
+	rules, err := nrptRules()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &dto.DnsConfig{
+		DnsMode:   dnsMode(t.currentDnsDecision()),
+		Servers:   make([]string, len(servers)),
+		NrptRules: rules,
+	}
+	for i, s := range servers {
+		cfg.Servers[i] = s.String()
+	}
+	return cfg, nil
+}
+
+// loadZiti hands the identity file to the ziti sdk, replaced in tests
+var loadZiti = cziti.LoadZiti
+
 func (t *RuntimeState) LoadIdentity(id *Id, refreshInterval int) {
 	if id.CId != nil && id.CId.Loaded {
 		log.Warnf("id %s[%s] already connected", id.Name, id.FingerPrint)
 		return
 	}
 
-	_, err := os.Stat(id.Path())
+	if t.identityDirErr != nil {
+		log.Errorf("refusing to load identity %s[%s]: %v", id.Name, id.FingerPrint, t.identityDirErr)
+		id.LastError = t.identityDirErr.Error()
+		return
+	}
+
+	info, err := os.Stat(id.Path())
 	if err != nil {
 		if os.IsNotExist(err) {
 			//file does not exist. TODO remove this from the list
 		} else {
-			log.Warnf("refusing to load identity with fingerprint %s:%s due to error %v", id.Name, id.FingerPrint, err)
+			log.Warn(recordWarning(WarningIdentity, "refusing to load identity with fingerprint %s:%s due to error %v", id.Name, id.FingerPrint, err))
 		}
 		return
 	}
+	readOnly := isReadOnly(info)
+	if readOnly && !id.ReadOnly {
+		log.Infof("identity file %s is read-only. the identity will be loaded but the file will never be modified", id.Path())
+	}
+	id.ReadOnly = readOnly
+	if !readOnly {
+		// the sdk reads the file itself and does not expect a byte order mark
+		if stripped, err := stripByteOrderMark(id.Path()); err != nil {
+			log.Warnf("could not remove the byte order mark from identity file %s: %v", id.Path(), err)
+		} else if stripped {
+			log.Infof("removed the byte order mark from identity file %s", id.Path())
+			if info, err = os.Stat(id.Path()); err != nil {
+				log.Warn(recordWarning(WarningIdentity, "refusing to load identity with fingerprint %s:%s due to error %v", id.Name, id.FingerPrint, err))
+				return
+			}
+		}
+	}
+
+	if existing := t.Find(id.FingerPrint); existing != nil && existing != id && existing.CId != nil && existing.CId.Loaded {
+		t.rejectFingerprintConflict(id)
+		return
+	}
 
 	log.Infof("loading identity %s[%s]", id.Name, id.FingerPrint)
 
+	var zid *cziti.ZIdentity
 	sc := func(status int) {
+		if !connectWatch.connected(zid) || t.cId(id) != zid {
+			// the load took too long and was abandoned
+			return
+		}
+		startupLoad.reportStatus(id, status)
 		log.Tracef("identity status change! %d", status)
 		id.ControllerVersion = id.CId.Version
 		id.CId.Fingerprint = id.FingerPrint
 		id.CId.Loaded = true
 		id.Config.ZtAPI = id.CId.Controller()
 
-		// hack for now - if the identity name is '<unknown>' don't set it... :(
-		if id.CId.Name == "<unknown>" || id.CId.Name == "" {
-			log.Debugf("name is set to '%s' which probably indicates the controller is down or the identity is not authorized - not changing the name. Continuing to use: %s", id.CId.Name, id.Name)
-		} else if id.Name != id.CId.Name {
-			log.Debugf("name changed from %s to %s", id.Name, id.CId.Name)
-			id.Name = id.CId.Name
+		if id.applyControllerName(id.CId.Name) {
 			rts.SaveState()
 		}
 		log.Infof("successfully loaded %s@%s", id.CId.Name, id.CId.Controller())
 
 		id.Config.ID = identity.IdentityConfig{} //after successfully loading the identity clear the id info
 
-		_, found := t.ids[id.FingerPrint]
+		t.idsLock.Lock()
+		existing, found := t.ids[id.FingerPrint]
 		if !found {
 			t.ids[id.FingerPrint] = id //add this identity to the list of known ids
 		}
+		t.idsLock.Unlock()
+		if found && existing != id {
+			//a different identity already owns this fingerprint, never overwrite it
+			t.rejectFingerprintConflict(id)
+			id.CId.Loaded = false
+			id.CId.Shutdown()
+			return
+		}
 		id.MfaEnabled = id.CId.MfaEnabled
 		id.MfaNeeded = id.CId.MfaNeeded
+		if id.Recovered {
+			log.Infof("recovered identity %s loaded successfully and is no longer considered orphaned", id.FingerPrint)
+			id.Recovered = false
+			id.PendingRemoval = false
+			rts.SaveState()
+		}
 
 		rts.BroadcastEvent(dto.IdentityEvent{
 			ActionEvent: dto.IDENTITY_ADDED,
 			Id:          id.Identity,
 		})
 		log.Infof("connecting identity completed: %s[%s] %t/%t", id.Name, id.FingerPrint, id.MfaEnabled, id.MfaNeeded)
+		runIdentityHook(id, HookPostConnect)
 	}
 
-	id.CId = cziti.NewZid(sc)
-	id.CId.Active = id.Active
-	log.Debugf("Default API PAGE SIZE set to: %d", rts.state.ApiPageSize)
-	cziti.LoadZiti(id.CId, id.Path(), refreshInterval, rts.state.ApiPageSize)
+	cfg := idcfg.Config{}
+	if err = probeIdentityFile(id.Path(), &cfg); err != nil {
+		log.Warn(recordWarning(WarningIdentity, "could not read the controller address of identity %s[%s]: %v", id.Name, id.FingerPrint, err))
+	}
+	if err = t.controllerAllowed(cfg.ZtAPI); err != nil {
+		log.Error(recordWarning(WarningIdentity, "refusing to load identity %s[%s]: %v", id.Name, id.FingerPrint, err))
+		id.LastError = err.Error()
+		return
+	}
+
+	// the file is read again by the sdk. make sure it was not replaced or still being written since it was checked
+	if err = verifyUnchanged(id.Path(), info); err != nil {
+		log.Error(recordWarning(WarningIdentity, "refusing to load identity %s[%s]: %v", id.Name, id.FingerPrint, err))
+		id.LastError = err.Error()
+		return
+	}
+
+	zid = cziti.NewZid(sc)
+	zid.Active = id.Active
+	t.idsLock.Lock()
+	id.CId = zid
+	t.idsLock.Unlock()
+	pageSize := t.apiPageSize(id)
+	log.Debugf("API PAGE SIZE of %s[%s] set to: %d", id.Name, id.FingerPrint, pageSize)
+	connectWatch.start(id, zid)
+	loadZiti(zid, id.Path(), refreshInterval, pageSize)
+}
+
+// applyControllerName uses the name the controller returned for the identity and reports if the name changed. the
+// name is '<unknown>' or empty when the controller is down or the identity is not authorized, the name in use is then
+// kept and UnresolvedName is set until a real name arrives
+func (id *Id) applyControllerName(name string) bool {
+	id.UnresolvedName = name == "<unknown>" || name == ""
+	if id.UnresolvedName {
+		log.Debugf("name is set to '%s' which probably indicates the controller is down or the identity is not authorized - not changing the name. Continuing to use: %s", name, id.Name)
+		return false
+	}
+	if id.Name == name {
+		return false
+	}
+	if id.ReadOnly {
+		log.Debugf("name changed from %s to %s but the identity is read-only - not changing the name", id.Name, name)
+		return false
+	}
+	log.Debugf("name changed from %s to %s", id.Name, name)
+	id.Name = name
+	return true
+}
+
+// apiPageSize returns the ApiPageSize of the identity when it is set and valid, the ApiPageSize of the config otherwise
+func (t *RuntimeState) apiPageSize(id *Id) int {
+	if id.ApiPageSize == 0 {
+		return t.state.ApiPageSize
+	}
+	if id.ApiPageSize < constants.MinimumApiPageSize || id.ApiPageSize > constants.MaximumApiPageSize {
+		log.Warn(recordWarning(WarningIdentity, "api page size %d of identity %s[%s] is not between %d and %d. using the default: %d",
+			id.ApiPageSize, id.Name, id.FingerPrint, constants.MinimumApiPageSize, constants.MaximumApiPageSize, t.state.ApiPageSize))
+		return t.state.ApiPageSize
+	}
+	return id.ApiPageSize
+}
+
+func (t *RuntimeState) rejectFingerprintConflict(id *Id) {
+	id.LastError = fmt.Sprintf("another identity is already loaded with fingerprint %s", id.FingerPrint)
+	log.Error(recordWarning(WarningIdentity, "refusing to load identity %s: %s", id.Name, id.LastError))
+	rts.BroadcastEvent(dto.IdentityEvent{
+		ActionEvent: dto.IDENTITY_CONFLICT,
+		Id:          id.Identity,
+	})
+}
+
+// verifyUnchanged returns an error if the size or modification time of the file differ from those in info
+func verifyUnchanged(path string, info os.FileInfo) error {
+	now, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("identity file %s could not be checked before loading: %v", path, err)
+	}
+	if now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()) {
+		return fmt.Errorf("identity file %s was modified while it was being loaded", path)
+	}
+	return nil
 }
 
 func (t *RuntimeState) LoadConfig() {
-	scanForIdentitiesPostWindowsUpdate()
-	err := readConfig(t, config.File())
+	if err := EnsureConfigDir(); err != nil {
+		log.Errorf("the config folder is not usable, the config cannot be read or saved: %v", err)
+	}
+	scanForIdentitiesPostWindowsUpdate(backupConfigDestination)
+	state, err := stateStore.Load(false)
 	if err != nil {
-		err = readConfig(t, config.BackupFile())
+		log.Warn(recordWarning(WarningConfig, "could not read config file, trying the backup. %v", err))
+		state, err = stateStore.Load(true)
 		if err != nil {
-			//this means BOTH files are unusable. that's really bad... :( delete both files and then panic...
-			os.Remove(config.File())
-			os.Remove(config.BackupFile())
-			log.Panicf("config file is not valid nor is backup file! both files have been deleted.")
+			//this means BOTH files are unusable. that's really bad... :(
+			if config.StrictConfigRecovery() {
+				log.Panicf("config file is not valid nor is backup file! %s is set, refusing to start. %v", config.StrictConfigRecoveryEnv, err)
+			}
+			log.Errorf("config file is not valid nor is backup file! starting with an empty configuration. %v", err)
+			stateStore.Repair(true)
+			state = &dto.TunnelStatus{}
 		}
+	} else {
+		stateStore.Repair(false)
+	}
+	t.state = state
+	configured := *state
+	configured.Identities = nil
+
+	t.policy, err = readConfigPolicy(config.PolicyFile())
+	if err != nil {
+		log.Errorf("the policy file cannot be read and is not applied: %v", err)
+	} else if t.policy != nil {
+		log.Infof("applying the policy from %s", config.PolicyFile())
 	}
+	t.enforced = applyConfigPolicy(t.policy, t.state)
+	afterPolicy := *t.state
 
-	//find/fix orphaned identities
-	t.scanForOrphanedIdentities(config.Path())
+	t.useIdentityDir()
+	if t.identityDirErr == nil {
+		scanForIdentitiesPostWindowsUpdate(backupIdentityDestination)
+
+		//pick up any identities staged for import
+		t.importIdentities(t.state.ImportDir)
+
+		//find/fix orphaned identities
+		t.scanForOrphanedIdentities(config.IdentityPath())
+		t.flagStaleOrphans(time.Now())
+	}
 
 	//any specific code needed when starting the process. some values need to be cleared
 	TunStarted = time.Now() //reset the time on startup
+	t.state.Degraded = false
+	t.state.DegradedReason = ""
 
-	if t.state.TunIpv4Mask > constants.Ipv4MinMask {
-		log.Warnf("provided mask: [%d] is smaller than the minimum permitted: [%d] and will be changed", rts.state.TunIpv4Mask, constants.Ipv4MinMask)
+	if t.state.TunIpv4Mask > constants.Ipv4MinMask && !t.state.StrictTunIpv4Mask {
+		log.Warn(recordWarning(WarningConfig, "provided mask: [%d] is smaller than the minimum permitted: [%d] and will be changed", rts.state.TunIpv4Mask, constants.Ipv4MinMask))
 		rts.UpdateIpv4Mask(constants.Ipv4MinMask)
 	}
 
 	if t.state.NotificationFrequency < constants.MinimumFrequency {
 		rts.UpdateNotificationFrequency(constants.MinimumFrequency)
 	}
+
+	if t.state.DnsTtlSeconds == 0 {
+		t.state.DnsTtlSeconds = constants.DefaultDnsTtl
+	}
+	t.state.DnsTtlSeconds = clampDnsTtl(t.state.DnsTtlSeconds)
+	cziti.SetDnsTtl(t.state.DnsTtlSeconds)
+	cziti.SetDnsQueryLogging(t.state.DnsQueryLogging)
+	cziti.SetDnsOwnerLookup(t.dnsOwners)
+	if t.state.DnsRateLimit < 0 {
+		t.state.DnsRateLimit = 0
+	}
+	cziti.SetDnsRateLimit(t.state.DnsRateLimit, t.state.DnsRateLimitBurst)
+	if err := validTunCidrRoute(t.state.TunCidrRoute); err != nil {
+		log.Warn(recordWarning(WarningConfig, "%v. the route for the TUN cidr is added", err))
+		t.state.TunCidrRoute = ""
+	}
+
+	if err := validTunIpConflict(t.state.TunIpConflict); err != nil {
+		log.Warn(recordWarning(WarningConfig, "%v. the TUN address is kept when another adapter has it", err))
+		t.state.TunIpConflict = ""
+	}
+
+	if t.state.ControllerDialTimeout == 0 {
+		t.state.ControllerDialTimeout = constants.DefaultControllerDialTimeout
+	}
+	t.state.ControllerDialTimeout = clampControllerDialTimeout(t.state.ControllerDialTimeout)
+
+	if len(t.state.InterceptedDnsTypes) == 0 {
+		t.state.InterceptedDnsTypes = []string{"A", "AAAA"}
+	}
+	if err := cziti.SetInterceptedDnsTypes(t.state.InterceptedDnsTypes); err != nil {
+		log.Warn(recordWarning(WarningConfig, "invalid intercepted dns types %v, intercepting A and AAAA: %v", t.state.InterceptedDnsTypes, err))
+		t.state.InterceptedDnsTypes = []string{"A", "AAAA"}
+		_ = cziti.SetInterceptedDnsTypes(t.state.InterceptedDnsTypes)
+	}
+	if err := cziti.SetDnsFailureMode(t.dnsFailureMode()); err != nil {
+		log.Warn(recordWarning(WarningConfig, "invalid dns failure mode, using the default instead: %v", err))
+		t.state.DnsFailureMode = ""
+		_ = cziti.SetDnsFailureMode(t.dnsFailureMode())
+	}
+
+	if err := cziti.SetStaticHostOverrides(t.state.StaticHostOverrides); err != nil {
+		log.Warn(recordWarning(WarningConfig, "ignoring the static host overrides: %v", err))
+		t.state.StaticHostOverrides = nil
+	}
+
+	if err := validateLoopbackMappings(t.state.LoopbackMappings); err != nil {
+		log.Warn(recordWarning(WarningConfig, "ignoring the loopback mappings: %v", err))
+		t.state.LoopbackMappings = nil
+	}
+	loopback.forget(t.state.LoopbackMappings)
+
+	if _, err := normalizeWinsServers(t.state.WinsServers); err != nil {
+		log.Warn(recordWarning(WarningConfig, "ignoring the wins servers: %v", err))
+		t.state.WinsServers = nil
+	}
+
+	if t.state.EventQueueCapacity == 0 {
+		t.state.EventQueueCapacity = constants.DefaultEventQueueCapacity
+	} else if t.state.EventQueueCapacity < constants.MinimumEventQueueCapacity || t.state.EventQueueCapacity > constants.MaximumEventQueueCapacity {
+		log.Warn(recordWarning(WarningConfig, "event queue capacity %d is not between %d and %d, using the default: %d", t.state.EventQueueCapacity,
+			constants.MinimumEventQueueCapacity, constants.MaximumEventQueueCapacity, constants.DefaultEventQueueCapacity))
+		t.state.EventQueueCapacity = constants.DefaultEventQueueCapacity
+	}
+
+	if t.state.LatencySampleInterval < 0 {
+		t.state.LatencySampleInterval = 0
+	} else if t.state.LatencySampleInterval > 0 && t.state.LatencySampleInterval < constants.MinimumLatencySampleInterval {
+		log.Warn(recordWarning(WarningConfig, "latency sample interval %d is smaller than the minimum permitted: [%d] and will be changed",
+			t.state.LatencySampleInterval, constants.MinimumLatencySampleInterval))
+		t.state.LatencySampleInterval = constants.MinimumLatencySampleInterval
+	}
+
+	if t.state.ReconnectWindow > constants.MaximumReconnectWindow {
+		log.Warn(recordWarning(WarningConfig, "reconnect window %d is larger than the maximum permitted: [%d] and will be changed",
+			t.state.ReconnectWindow, constants.MaximumReconnectWindow))
+		t.state.ReconnectWindow = constants.MaximumReconnectWindow
+	}
+
+	if t.state.BackupRetentionDays < 1 {
+		t.state.BackupRetentionDays = constants.DefaultBackupRetentionDays
+	}
+
+	if t.state.LazyIdleTimeout < 1 {
+		t.state.LazyIdleTimeout = constants.DefaultLazyIdleTimeout
+	}
+
+	if t.state.MfaReminderLeadTime < 0 {
+		t.state.MfaReminderLeadTime = 0
+	}
+
+	if t.state.MetricsSampleInterval < constants.MinimumMetricsSampleInterval {
+		t.state.MetricsSampleInterval = constants.DefaultMetricsSampleInterval
+	}
+	if t.state.BatterySampleInterval < 1 {
+		t.state.BatterySampleInterval = constants.DefaultBatterySampleInterval
+	}
+
+	t.configured = &configured
+	t.adjustments = append(append([]dto.ConfigAdjustment{}, t.enforced...), configAdjustments(&afterPolicy, t.state)...)
+	for _, a := range t.adjustments {
+		log.Infof("config value %s is %v instead of the configured %v: %s", a.Field, a.Effective, a.Configured, a.Reason)
+	}
+}
+
+func clampDnsTtl(ttl int) int {
+	if ttl < constants.MinimumDnsTtl {
+		log.Warn(recordWarning(WarningConfig, "dns ttl %d is smaller than the minimum permitted: [%d] and will be changed", ttl, constants.MinimumDnsTtl))
+		return constants.MinimumDnsTtl
+	}
+	if ttl > constants.MaximumDnsTtl {
+		log.Warn(recordWarning(WarningConfig, "dns ttl %d is larger than the maximum permitted: [%d] and will be changed", ttl, constants.MaximumDnsTtl))
+		return constants.MaximumDnsTtl
+	}
+	return ttl
+}
+
+func clampControllerDialTimeout(timeout int) int {
+	if timeout < constants.MinimumControllerDialTimeout {
+		log.Warn(recordWarning(WarningConfig, "controller dial timeout %d is smaller than the minimum permitted: [%d] and will be changed", timeout, constants.MinimumControllerDialTimeout))
+		return constants.MinimumControllerDialTimeout
+	}
+	if timeout > constants.MaximumControllerDialTimeout {
+		log.Warn(recordWarning(WarningConfig, "controller dial timeout %d is larger than the maximum permitted: [%d] and will be changed", timeout, constants.MaximumControllerDialTimeout))
+		return constants.MaximumControllerDialTimeout
+	}
+	return timeout
+}
+
+// renames an unreadable config file out of the way instead of deleting it so that it can still be inspected or
+// recovered by hand. identities are recovered from their own files by scanForOrphanedIdentities
+func moveCorruptFileAside(filename string) {
+	if _, err := os.Stat(filename); err != nil {
+		return
+	}
+	corrupt := fmt.Sprintf("%s.corrupt.%s", filename, time.Now().Format("20060102150405"))
+	if err := os.Rename(filename, corrupt); err != nil {
+		log.Warnf("could not move corrupt file %s aside: %v", filename, err)
+	} else {
+		log.Warnf("corrupt file %s moved to: %s", filename, corrupt)
+	}
 }
 
+// orphan is an identity file found by findOrphanedIdentities
+type orphan struct {
+	fingerprint string
+	path        string
+	cfg         idcfg.Config
+}
+
+// scanForOrphanedIdentities adds the orphaned identity files back to the config unless AutoRecoverOrphans is false,
+// in which case they are only logged and listed by OrphanCandidates. the identities of combined identity files are
+// split out first and added as new identities
 func (t *RuntimeState) scanForOrphanedIdentities(folder string) {
+	split := splitCombinedIdentities(folder, t.identityLimitReachedWith)
 	files, err := ioutil.ReadDir(folder)
 	if err != nil {
 		log.Panic(err)
 	}
+	autoRecover := t.state.AutoRecoverOrphans == nil || *t.state.AutoRecoverOrphans
+	for _, o := range t.findOrphanedIdentities(folder, files) {
+		if split[o.fingerprint] {
+			log.Infof("adding identity %s split from a combined identity file to the configuration", o.fingerprint)
+			t.state.Identities = append(t.state.Identities, &dto.Identity{
+				Name:        o.fingerprint,
+				FingerPrint: o.fingerprint,
+				Active:      true,
+				Config:      o.cfg,
+				Status:      STATUS_ENROLLED,
+			})
+			t.SaveState()
+			continue
+		}
+		if !autoRecover {
+			log.Infof("found orphaned identity %s. not adding it back to the configuration, AutoRecoverOrphans is false", o.fingerprint)
+			continue
+		}
+		log.Infof("found orphaned identity %s. Adding back to the configuration", o.fingerprint)
+		newId := dto.Identity{
+			Name:        "recovered identity",
+			FingerPrint: o.fingerprint,
+			Active:      false,
+			Config:      o.cfg,
+			Recovered:   true,
+			RecoveredAt: time.Now(),
+		}
+
+		t.state.Identities = append(t.state.Identities, &newId)
+		t.SaveState()
+	}
+}
+
+// OrphanCandidates lists the identity files of the identity folder which no identity of the config refers to
+func (t *RuntimeState) OrphanCandidates() ([]dto.OrphanCandidate, error) {
+	folder := config.IdentityPath()
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the identity folder %s: %v", folder, err)
+	}
+	candidates := make([]dto.OrphanCandidate, 0)
+	for _, o := range t.findOrphanedIdentities(folder, files) {
+		candidates = append(candidates, dto.OrphanCandidate{Fingerprint: o.fingerprint, Path: o.path, Controller: o.cfg.ZtAPI})
+	}
+	return candidates, nil
+}
+
+func (t *RuntimeState) findOrphanedIdentities(folder string, files []os.FileInfo) []orphan {
+	orphans := make([]orphan, 0)
 	for _, f := range files {
 		if strings.HasSuffix(f.Name(), "json") {
-			cfg := idcfg.Config{}
-			err = probeIdentityFile(path.Join(folder, f.Name()), &cfg)
-			if err != nil {
-				log.Tracef("file is not deserializable as a config file. probably config.json etc.%s", f.Name())
-				continue
-			}
-			if strings.TrimSpace(cfg.ID.Key) != "" {
+			cfg, ok := identityFileOf(path.Join(folder, f.Name()))
+			if ok {
 				log.Debugf("Config file appears to be valid for network: %s", cfg.ZtAPI)
 				fingerprint := strings.Split(f.Name(), ".")[0]
 				var found *dto.Identity
@@ -363,15 +1070,7 @@ func (t *RuntimeState) scanForOrphanedIdentities(folder string) {
 					}
 				}
 				if found == nil {
-					log.Infof("found orphaned identity %s. Adding back to the configuration", fingerprint)
-					newId := dto.Identity{
-						Name:        "recovered identity",
-						FingerPrint: fingerprint,
-						Active:      false,
-						Config:      cfg,
-					}
-
-					t.state.Identities = append(t.state.Identities, &newId)
+					orphans = append(orphans, orphan{fingerprint: fingerprint, path: path.Join(folder, f.Name()), cfg: cfg})
 				} else {
 					log.Debugf("identity with fingerprint is known: %s", fingerprint)
 				}
@@ -380,49 +1079,97 @@ func (t *RuntimeState) scanForOrphanedIdentities(folder string) {
 			}
 		}
 	}
+	return orphans
 }
 
-func probeIdentityFile(path string, cfg *idcfg.Config) error {
-	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
-	if err != nil {
-		log.Errorf("unexpected error opening config file: %v", err)
+// flagStaleOrphans flags the recovered identities which have never loaded within the grace period for removal, and
+// forgets them when AutoForgetOrphans is set. identities which were enrolled or have loaded are never flagged
+func (t *RuntimeState) flagStaleOrphans(now time.Time) {
+	graceDays := t.state.OrphanGraceDays
+	if graceDays < 1 {
+		graceDays = constants.DefaultOrphanGraceDays
 	}
+	grace := time.Duration(graceDays) * 24 * time.Hour
 
-	r := bufio.NewReader(file)
-	dec := json.NewDecoder(r)
-	err = dec.Decode(&cfg)
-	defer file.Close()
-	return err
+	kept := make([]*dto.Identity, 0, len(t.state.Identities))
+	for _, sid := range t.state.Identities {
+		if sid == nil || !sid.Recovered {
+			kept = append(kept, sid)
+			continue
+		}
+		if sid.RecoveredAt.IsZero() {
+			sid.RecoveredAt = now
+		}
+		if now.Sub(sid.RecoveredAt) < grace {
+			kept = append(kept, sid)
+			continue
+		}
+		if !t.state.AutoForgetOrphans {
+			if !sid.PendingRemoval {
+				log.Warnf("recovered identity %s has not loaded since %v and is flagged for removal", sid.FingerPrint, sid.RecoveredAt)
+			}
+			sid.PendingRemoval = true
+			kept = append(kept, sid)
+			continue
+		}
+		// moved aside rather than deleted so the next scan does not recover it again
+		forgotten := sid.Path() + ".forgotten"
+		if err := os.Rename(sid.Path(), forgotten); err != nil && !os.IsNotExist(err) {
+			log.Errorf("could not forget recovered identity %s: %v", sid.FingerPrint, err)
+			sid.PendingRemoval = true
+			kept = append(kept, sid)
+			continue
+		}
+		log.Infof("forgot recovered identity %s which has not loaded since %v. the file was moved to %s", sid.FingerPrint, sid.RecoveredAt, forgotten)
+	}
+	if len(kept) != len(t.state.Identities) {
+		t.state.Identities = kept
+		t.SaveState()
+	}
 }
 
-func readConfig(t *RuntimeState, filename string) error {
-	log.Infof("reading config file located at: %s", filename)
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		log.Infof("the config file does not exist. this is normal if this is a new install or if the config file was removed manually")
-		rts.state = &dto.TunnelStatus{}
-		return nil
+// fingerprintOf returns the fingerprint of the identity, the sha1 of its certificate
+func fingerprintOf(id identity.Identity) (string, error) {
+	cert := id.Cert()
+	if cert == nil || cert.Leaf == nil {
+		return "", errors.New("the identity has no certificate")
 	}
+	return fmt.Sprintf("%x", sha1.Sum(cert.Leaf.Raw)), nil
+}
 
-	if info.Size() == 0 {
-		return fmt.Errorf("the config file at contains no bytes and is considered invalid: %s", filename)
+// identityFileOf decodes the file at path and reports whether it is an identity file, a config file with a key. other
+// json files such as config.json are not
+func identityFileOf(path string) (idcfg.Config, bool) {
+	cfg := idcfg.Config{}
+	if err := probeIdentityFile(path, &cfg); err != nil {
+		log.Tracef("file is not deserializable as a config file. probably config.json etc.%s", path)
+		return cfg, false
 	}
+	return cfg, strings.TrimSpace(cfg.ID.Key) != ""
+}
 
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0644)
+func probeIdentityFile(path string, cfg *idcfg.Config) error {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("unexpected error opening config file: %v", err)
+		log.Errorf("unexpected error opening config file: %v", err)
 	}
 
-	r := bufio.NewReader(file)
-	dec := json.NewDecoder(r)
-
-	err = dec.Decode(&t.state)
+	err = decodeJsonFile(file, &cfg)
 	defer file.Close()
+	return err
+}
 
-	if err != nil {
-		return fmt.Errorf("unexpected error reading config file: %v", err)
+// stripByteOrderMark rewrites the file without the utf-8 byte order mark it starts with, if it does
+func stripByteOrderMark(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.HasPrefix(data, utf8Bom) {
+		return false, err
 	}
-	return nil
+	err = replaceIdentityFile(path, func(w io.Writer) error {
+		_, err := w.Write(data[len(utf8Bom):])
+		return err
+	})
+	return err == nil, err
 }
 
 func (t *RuntimeState) UpdateIpv4Mask(ipv4mask int) {
@@ -471,7 +1218,7 @@ func UpdateRuntimeStateIpv4(ip string, ipv4Mask int, addDns string, apiPageSize
 func iPv6Disabled() bool {
 	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters`, registry.QUERY_VALUE)
 	if err != nil {
-		log.Warnf("could not read registry to detect IPv6 - assuming IPv6 enabled. If IPv6 is not enabled the service may fail to start")
+		log.Warn(recordWarning(WarningTun, "could not read registry to detect IPv6 - assuming IPv6 enabled. If IPv6 is not enabled the service may fail to start"))
 		return false
 	}
 	defer k.Close()
@@ -486,20 +1233,35 @@ func iPv6Disabled() bool {
 	if actual == 255 {
 		return true
 	} else {
-		log.Infof("IPv6 has DisabledComponents set to %d. If the service fails to start please report this message", val)
+		log.Info(recordWarning(WarningTun, "IPv6 has DisabledComponents set to %d. If the service fails to start please report this message", val))
 		return false
 	}
 }
 
 func (t *RuntimeState) AddRoute(destination net.IPNet, nextHop net.IP, metric uint32) error {
+	if t.skipServiceCidrRoute(destination) {
+		return nil
+	}
 	nativeTunDevice := (*t.tun).(*tun.NativeTun)
 	luid := winipcfg.LUID(nativeTunDevice.LUID())
-	return luid.AddRoute(destination, nextHop, metric)
+	if err := luid.AddRoute(destination, nextHop, metric); err != nil {
+		return err
+	}
+	t.recordRoute(destination, nextHop, metric)
+	return nil
 }
 
+// RemoveRoute deletes a route the tunneler no longer needs. the routes went with the TUN when it is already closed
 func (t *RuntimeState) RemoveRoute(destination net.IPNet, nextHop net.IP) error {
+	t.forgetRoute(destination, nextHop)
+	if t.tun == nil {
+		return nil
+	}
 	nativeTunDevice := (*t.tun).(*tun.NativeTun)
 	luid := winipcfg.LUID(nativeTunDevice.LUID())
+	if t.state.VerifyRouteRemoval {
+		return deleteRouteVerified(luid, destination, nextHop)
+	}
 	return luid.DeleteRoute(destination, nextHop)
 }
 
@@ -524,24 +1286,32 @@ func (t *RuntimeState) Close() {
 	} else {
 		log.Warn("unexpected situation. the TUN was null? ")
 	}
+	loopback.removeAll()
 	t.RemoveZitiTun()
 }
 
 func (t *RuntimeState) RemoveZitiTun() {
-	log.Infof("Removing existing interface: %s", TunName)
-	wt, err := tun.WintunPool.OpenAdapter(TunName)
+	removeTunAdapter(TunName)
+}
+
+func removeTunAdapter(name string) {
+	log.Infof("Removing existing interface: %s", name)
+	wt, err := tun.WintunPool.OpenAdapter(name)
 	if err == nil {
 		// If so, we delete it, in case it has weird residual configuration.
-		_, err = wt.Delete(true)
+		err = retryAdapterDeletion(name, func() error {
+			_, err := wt.Delete(true)
+			return err
+		})
 		if err != nil {
 			log.Errorf("Error deleting already existing interface: %v", err)
 		} else {
-			log.Infof("Removed wintun tun: %s", TunName)
+			log.Infof("Removed wintun tun: %s", name)
 		}
 	} else {
-		log.Tracef("INTERFACE %s was nil? must have been removed already. %v", TunName, err)
+		log.Tracef("INTERFACE %s was nil? must have been removed already. %v", name, err)
 	}
-	log.Infof("Successfully removed interface: %s", TunName)
+	log.Infof("Successfully removed interface: %s", name)
 }
 
 func (t *RuntimeState) InterceptDNS() {
@@ -579,64 +1349,77 @@ func (t *RuntimeState) UpdateMfa(fingerprint string, mfaEnabled bool, mfaNeeded
 }
 
 func (t *RuntimeState) UpdateControllerAddress(configFile string, newAddress string) {
+	_ = t.updateControllerAddress(configFile, newAddress)
+}
+
+// updateControllerAddress backs up the identity file as .original and changes the controller address in it, logging
+// and returning why when the address is not changed. an address which is already set is not an error
+func (t *RuntimeState) updateControllerAddress(configFile string, newAddress string) error {
 	log.Debugf("request to update config file %s with new address: %s", configFile, newAddress)
 
+	if info, err := os.Stat(configFile); err == nil && isReadOnly(info) {
+		log.Warnf("not updating config for identity file %s with new address %s. the file is read-only", configFile, newAddress)
+		return fmt.Errorf("identity file %s is read-only", configFile)
+	}
+
 	f, fe := ioutil.ReadFile(configFile)
 	if fe != nil {
 		log.Warnf("Could not read identity file: %s", configFile)
-		return
+		return fe
 	}
 	c := idcfg.Config{}
 	err := json.Unmarshal(f, &c)
 	if err != nil {
 		log.Warnf("Could not unmarshal config file for identity file: %s to newAddress: %s", configFile, newAddress)
-		return
+		return err
 	}
 
 	if strings.Compare(c.ZtAPI, newAddress) == 0 {
 		log.Debugf("not updating config for identity file %s. address already set to: %s", newAddress)
-		return
+		return nil
+	}
+
+	if err = t.controllerAllowed(newAddress); err != nil {
+		log.Errorf("not updating config for identity file %s: %v", configFile, err)
+		if id := t.findByPath(configFile); id != nil {
+			id.LastError = err.Error()
+		}
+		return err
 	}
 
 	err = saveOriginalIdentity(configFile)
 	if err != nil {
 		log.Warnf("unexpected error when saving original identity. cannot change controller address. %v", err)
-		return
+		return err
 	}
 
-	newConfigFileName := configFile + ".address.update"
-	defer func() {
-		log.Debugf("removing original file after update: %s", newConfigFileName)
-		os.Remove(newConfigFileName)
-	}()
-	log.Debugf("renaming identity file %s as: %s", configFile, newConfigFileName)
-	_ = os.Rename(configFile, newConfigFileName)
-
 	var newAddy string
 	if strings.HasPrefix(newAddress, "https://") {
 		newAddy = newAddress
 	} else {
 		newAddy = "https://" + newAddress
 	}
+	// the controller may only be down for now, the address is still updated. the check only warns so it does not
+	// hold up the caller, which can be the uv loop or an ipc client
+	go func() {
+		if err := checkControllerReachable(newAddy); err != nil {
+			log.Warnf("the new controller address %s for identity file %s is not reachable: %v", newAddy, configFile, err)
+		}
+	}()
+
 	log.Infof("updating identity file %s with new address. changing from %s to %s", configFile, c.ZtAPI, newAddy)
 	c.ZtAPI = newAddy
 
-	idFile, err := os.OpenFile(configFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	defer idFile.Close()
-	if err != nil {
+	// the new content is swapped over the identity file in a single rename so the file always exists
+	if err = writeIdentityFile(configFile, c); err != nil {
 		log.Warnf("An unexpected error has occurred while trying to update identity file %s with newAddress %s. %v", configFile, newAddress, err)
-		return
+		return err
 	}
+	return nil
+}
 
-	w := bufio.NewWriter(bufio.NewWriter(idFile))
-	enc := json.NewEncoder(w)
-	_ = enc.Encode(c)
-	_ = w.Flush()
-
-	err = idFile.Close()
-	if err != nil {
-		log.Warnf("An unexpected error has occurred while closing the identity file %s with newAddress %s. %v", configFile, newAddress, err)
-	}
+func isReadOnly(info os.FileInfo) bool {
+	return info.Mode().Perm()&0200 == 0
 }
 
 // if a change address header is ever processed - archive the original identity used. it will never be overwritten once created
@@ -656,22 +1439,330 @@ func saveOriginalIdentity(configFile string) error {
 		return nil
 	}
 
-	log.Debugf("renaming original identity file from %s to %s", configFile, originalFileName)
-	return os.Rename(configFile, originalFileName)
+	log.Debugf("copying original identity file from %s to %s", configFile, originalFileName)
+	_, err = copy(configFile, originalFileName)
+	return err
 }
 
+// SetNotified marks the identity as notified or not. the flag is changed under the lock NotifiedFingerprints and
+// ResetAllNotified read and write it with
 func (t *RuntimeState) SetNotified(fingerprint string, notified bool) {
+	t.idsLock.Lock()
+	defer t.idsLock.Unlock()
+	if id := t.ids[fingerprint]; id != nil {
+		id.Notified = notified
+	}
+}
+
+// MfaSatisfied reports if the mfa of the identity is currently satisfied and how long until it must be renewed. a
+// satisfied identity whose services have no mfa timeout never needs renewing and returns 0
+func (t *RuntimeState) MfaSatisfied(fingerprint string) (bool, time.Duration, error) {
 	id := t.Find(fingerprint)
+	if id == nil {
+		return false, 0, fmt.Errorf("%w: %s", ErrIdentityNotFound, fingerprint)
+	}
+	if id.CId == nil || !id.CId.MfaEnabled {
+		return false, 0, fmt.Errorf("%w for identity %s", ErrMfaNotEnabled, fingerprint)
+	}
+	if id.CId.MfaNeeded {
+		return false, 0, nil
+	}
+	if id.CId.MfaMaxTimeoutRem < 0 {
+		return true, 0, nil
+	}
+	remaining := id.CId.GetRemainingTime(id.CId.MfaMaxTimeout, id.CId.MfaMaxTimeoutRem)
+	if remaining <= 0 {
+		return false, 0, nil
+	}
+	return true, time.Duration(remaining) * time.Second, nil
+}
 
-	if id != nil {
-		id.Notified = notified
+// NextMfaDeadline returns the identity with mfa enabled whose mfa must be renewed soonest and how long until then. an
+// identity which needs the mfa now comes first. identities whose services have no mfa timeout are never returned
+func (t *RuntimeState) NextMfaDeadline() dto.MfaDeadline {
+	t.idsLock.RLock()
+	defer t.idsLock.RUnlock()
+	next := dto.MfaDeadline{}
+	for _, id := range t.ids {
+		if id.CId == nil || !id.CId.MfaEnabled {
+			continue
+		}
+		var remaining int64
+		if !id.CId.MfaNeeded {
+			if id.CId.MfaMaxTimeoutRem < 0 {
+				continue
+			}
+			remaining = int64(id.CId.GetRemainingTime(id.CId.MfaMaxTimeout, id.CId.MfaMaxTimeoutRem))
+		}
+		if next.Fingerprint == "" || remaining < next.RemainingSeconds ||
+			(remaining == next.RemainingSeconds && id.FingerPrint < next.Fingerprint) {
+			next = dto.MfaDeadline{Fingerprint: id.FingerPrint, Name: id.Name, RemainingSeconds: remaining}
+		}
 	}
+	return next
+}
+
+// dialProbe dials a service through the ziti context of an identity, replaced in tests
+var dialProbe = cziti.ProbeService
+
+// ProbeService dials the service through the identity's ziti context to verify it is reachable
+func (t *RuntimeState) ProbeService(fingerprint string, serviceName string) (bool, time.Duration, error) {
+	id := t.Find(fingerprint)
+	if id == nil {
+		return false, 0, fmt.Errorf("identity with fingerprint %s not found", fingerprint)
+	}
+	if id.CId == nil || !id.CId.Loaded {
+		return false, 0, fmt.Errorf("identity %s is not loaded", fingerprint)
+	}
+	latency, err := dialProbe(id.CId, serviceName, constants.ServiceProbeTimeout*time.Second)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, latency, nil
+}
+
+// ListInterceptions returns what the identity intercepts per service, sorted by service name
+func (t *RuntimeState) ListInterceptions(fingerprint string) ([]dto.Interception, error) {
+	id := t.Find(fingerprint)
+	if id == nil {
+		return nil, fmt.Errorf("identity with fingerprint %s not found", fingerprint)
+	}
+	if id.CId == nil || !id.CId.Loaded {
+		return nil, fmt.Errorf("identity %s is not loaded", fingerprint)
+	}
+
+	interceptions := make([]dto.Interception, 0)
+	id.CId.Services.Range(func(key interface{}, value interface{}) bool {
+		svc := value.(*cziti.ZService).Service
+		if svc == nil {
+			return true
+		}
+		i := dto.Interception{
+			ServiceName: svc.Name,
+			Hostnames:   make([]string, 0),
+			Domains:     make([]string, 0),
+			Cidrs:       make([]string, 0),
+			Protocols:   svc.Protocols,
+			Ports:       svc.Ports,
+		}
+		for _, addr := range svc.Addresses {
+			if !addr.IsHost && addr.Prefix == 0 {
+				i.Cidrs = append(i.Cidrs, addr.IP) //a single ip
+			} else if !addr.IsHost {
+				i.Cidrs = append(i.Cidrs, fmt.Sprintf("%s/%d", addr.IP, addr.Prefix))
+			} else if strings.HasPrefix(addr.HostName, "*.") {
+				i.Domains = append(i.Domains, addr.HostName)
+			} else {
+				i.Hostnames = append(i.Hostnames, addr.HostName)
+			}
+		}
+		sort.Strings(i.Hostnames)
+		sort.Strings(i.Domains)
+		sort.Strings(i.Cidrs)
+		interceptions = append(interceptions, i)
+		return true
+	})
+	sort.SliceStable(interceptions, func(i, j int) bool {
+		return interceptions[i].ServiceName < interceptions[j].ServiceName
+	})
+	return interceptions, nil
+}
+
+// ResetAllNotified clears the notified flag of every identity. used at the start of a new notification cycle
+func (t *RuntimeState) ResetAllNotified() {
+	t.idsLock.Lock()
+	defer t.idsLock.Unlock()
+	for _, id := range t.ids {
+		id.Notified = false
+	}
+}
+
+// NotifiedFingerprints returns the fingerprints of the identities currently marked as notified
+func (t *RuntimeState) NotifiedFingerprints() []string {
+	t.idsLock.RLock()
+	defer t.idsLock.RUnlock()
+	fingerprints := make([]string, 0)
+	for fingerprint, id := range t.ids {
+		if id.Notified {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	return fingerprints
+}
+
+func (t *RuntimeState) UpdateDnsTtl(ttl int) int {
+	ttl = clampDnsTtl(ttl)
+	log.Infof("setting dns ttl : %d", ttl)
+	t.state.DnsTtlSeconds = ttl
+	cziti.SetDnsTtl(ttl)
+	t.SaveState()
+	return ttl
+}
+
+// UpdateDnsQueryLogging turns the logging of every query seen by the dns responder on or off
+func (t *RuntimeState) UpdateDnsQueryLogging(enabled bool) {
+	log.Infof("setting dns query logging : %t", enabled)
+	t.state.DnsQueryLogging = enabled
+	cziti.SetDnsQueryLogging(enabled)
+	t.SaveState()
+}
+
+// dnsFailureMode is the dns failure mode in use. the default is only decided here and never saved: without a
+// DnsFailureMode the record types left out of configured InterceptedDnsTypes are forwarded upstream, while with the
+// default types they are answered without records as they were before the types could be configured
+func (t *RuntimeState) dnsFailureMode() string {
+	if t.state.DnsFailureMode != "" {
+		return t.state.DnsFailureMode
+	}
+	if defaultDnsTypes(t.state.InterceptedDnsTypes) {
+		return cziti.DnsFailureEmpty
+	}
+	return cziti.DnsFailureForward
+}
+
+// defaultDnsTypes reports if exactly A and AAAA are intercepted, the types intercepted when none are configured
+func defaultDnsTypes(types []string) bool {
+	found := make(map[string]bool)
+	for _, t := range types {
+		found[strings.ToUpper(strings.TrimSpace(t))] = true
+	}
+	return len(found) == 2 && found["A"] && found["AAAA"]
+}
+
+// UpdateDnsFailureMode sets how queries for intercepted hostnames which are not answered are handled
+func (t *RuntimeState) UpdateDnsFailureMode(mode string) error {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if err := cziti.SetDnsFailureMode(mode); err != nil {
+		return err
+	}
+	log.Infof("setting dns failure mode : %s", mode)
+	t.state.DnsFailureMode = mode
+	t.SaveState()
+	return nil
+}
+
+// UpdateVerifyRouteRemoval turns the check that a removed route is really gone on or off
+func (t *RuntimeState) UpdateVerifyRouteRemoval(enabled bool) {
+	log.Infof("setting verify route removal : %t", enabled)
+	t.state.VerifyRouteRemoval = enabled
+	t.SaveState()
+}
+
+// UpdateTunAutoRecover turns the automatic recreation of the TUN when writes to it keep failing on or off
+func (t *RuntimeState) UpdateTunAutoRecover(enabled bool) {
+	log.Infof("setting tun auto recover : %t", enabled)
+	t.state.TunAutoRecover = enabled
+	t.SaveState()
+}
+
+// UpdateDnsRateLimit limits the queries per second each source can send to the dns responder, 0 disables the limit
+func (t *RuntimeState) UpdateDnsRateLimit(perSecond int, burst int) error {
+	if perSecond < 0 || burst < 0 {
+		return fmt.Errorf("the dns rate limit and burst cannot be negative")
+	}
+	log.Infof("setting dns rate limit : %d per second, burst %d", perSecond, burst)
+	t.state.DnsRateLimit = perSecond
+	t.state.DnsRateLimitBurst = burst
+	cziti.SetDnsRateLimit(perSecond, burst)
+	t.SaveState()
+	return nil
+}
+
+// UpdateControllerDialTimeout sets the seconds to wait when dialing a controller
+func (t *RuntimeState) UpdateControllerDialTimeout(timeout int) int {
+	timeout = clampControllerDialTimeout(timeout)
+	log.Infof("setting controller dial timeout : %d", timeout)
+	t.state.ControllerDialTimeout = timeout
+	t.SaveState()
+	return timeout
+}
+
+// RecentLogs returns up to n of the most recent log records at minLevel or more severe, newest first. every level
+// is returned when minLevel is empty
+func (t *RuntimeState) RecentLogs(n int, minLevel string) []logging.LogRecord {
+	level := logrus.TraceLevel
+	if strings.TrimSpace(minLevel) != "" {
+		level, _ = logging.ParseLevel(minLevel)
+	}
+	return logging.RecentLogs(n, level)
+}
+
+// UpdateLogDestination moves the log file while the service runs. the current file is kept when the new one cannot be
+// written to. the log file has to stay within the logs folder, the service writes and deletes the rotated files as
+// SYSTEM so any other location would let a user overwrite or remove files they cannot change themselves
+func (t *RuntimeState) UpdateLogDestination(d dto.LogDestination) error {
+	path, err := logDestinationPath(config.LogsPath(), d.Path)
+	if err != nil {
+		return err
+	}
+	if err = logging.SetLogDestination(path, d.RotationHours, d.RotationCount); err != nil {
+		return err
+	}
+	d.Path = path
+	t.state.LogDestination = &d
+	t.SaveState()
+	return nil
+}
+
+// logDestinationPath returns the absolute path of the log file, a relative path is within the logs folder. a path
+// outside of the logs folder is refused
+func logDestinationPath(logsFolder string, path string) (string, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return "", fmt.Errorf("no log file given")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(logsFolder, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(filepath.Clean(logsFolder), path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("the log file %s is not within the logs folder %s", path, logsFolder)
+	}
+	return path, nil
+}
+
+// UpdateLogRotation rotates the log file once it grows past maxSizeMb, keeping maxFiles files
+func (t *RuntimeState) UpdateLogRotation(maxSizeMb int, maxFiles int) error {
+	if err := logging.SetLogRotationSize(maxSizeMb, maxFiles); err != nil {
+		return err
+	}
+	log.Infof("setting log rotation : %d MB keeping %d files", maxSizeMb, maxFiles)
+	t.state.LogMaxSizeMb = maxSizeMb
+	t.state.LogMaxFiles = maxFiles
+	t.SaveState()
+	return nil
+}
+
+// UpdateStaticHostOverrides replaces the hostnames answered with a fixed ip by the dns responder
+func (t *RuntimeState) UpdateStaticHostOverrides(overrides map[string]string) error {
+	if err := cziti.SetStaticHostOverrides(overrides); err != nil {
+		return err
+	}
+	log.Infof("setting %d static host overrides", len(overrides))
+	t.state.StaticHostOverrides = overrides
+	t.SaveState()
+	return nil
+}
+
+// DnsResponderStats returns the count, average and p99 latency of the queries answered by the ziti dns responder
+func (t *RuntimeState) DnsResponderStats() dto.DnsResponderStats {
+	return cziti.DnsResponderStats()
+}
+
+func (t *RuntimeState) ResetDnsResponderStats() {
+	log.Info("resetting the dns responder stats")
+	cziti.ResetDnsResponderStats()
 }
 
 func (t *RuntimeState) UpdateNotificationFrequency(notificationFreq int) error {
 
 	log.Infof("setting notification frequency : %d", notificationFreq)
 
+	if t.policy != nil && t.policy.NotificationFrequency != nil {
+		return fmt.Errorf("the notification frequency is set by the policy to %d minutes and cannot be changed", *t.policy.NotificationFrequency)
+	}
+
 	if notificationFreq < constants.MinimumFrequency || notificationFreq > constants.MaximumFrequency {
 		return errors.New(fmt.Sprintf("Notification frequency should be between %d and %d minutes", constants.MinimumFrequency, constants.MaximumFrequency))
 	}
@@ -683,18 +1774,70 @@ func (t *RuntimeState) UpdateNotificationFrequency(notificationFreq int) error {
 	return nil
 }
 
+// matchesZitiTunAdapter is the predicate that decides which adapters the cleanup removes
+func matchesZitiTunAdapter(name func() (string, error), tunName string) (string, bool) {
+	interfaceName, err := name()
+	if err != nil {
+		log.Warnf("Could not determine interface name, not removing: %v", err)
+		return "", false
+	}
+	return interfaceName, strings.HasPrefix(interfaceName, tunName)
+}
+
+// removeMatchingAdapters calls matches with the name of each adapter of the wintun pool, removing the adapters it
+// matches. replaced in tests
+var removeMatchingAdapters = func(matches func(name func() (string, error)) bool) []error {
+	_, errs := tun.WintunPool.DeleteMatchingAdapters(func(adapter *wintun.Adapter) bool {
+		return matches(adapter.Name)
+	}, false)
+	return errs
+}
+
 func CleanUpZitiTUNAdapters(tunName string) {
 	log.Info("Invoking ZitiTun adapter cleanup script")
-	tun.WintunPool.DeleteMatchingAdapters(func(wintun *wintun.Adapter) bool {
-		interfaceName, err := wintun.Name()
-		if err != nil {
-			log.Warnf("Could not determine interface name, not removing: %v", err)
-			return false
+	err := retryAdapterDeletion(tunName+"*", func() error {
+		errs := removeMatchingAdapters(func(name func() (string, error)) bool {
+			interfaceName, matches := matchesZitiTunAdapter(name, tunName)
+			if matches {
+				log.Infof("Removing old Wintun interface with name : %s", interfaceName)
+			}
+			return matches
+		})
+		if len(errs) > 0 {
+			return fmt.Errorf("%v", errs)
 		}
-		if strings.HasPrefix(interfaceName, tunName) {
-			log.Infof("Removing old Wintun interface with name : %s", interfaceName)
-			return true
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Error removing old Wintun interfaces: %v", err)
+	}
+}
+
+// retryAdapterDeletion retries the deletion with a short backoff. deleting an adapter fails transiently when the
+// device is still referenced
+func retryAdapterDeletion(name string, del func() error) error {
+	var err error
+	for attempt := 1; attempt <= constants.AdapterDeleteAttempts; attempt++ {
+		if err = del(); err == nil {
+			return nil
 		}
-		return false
-	}, false)
+		log.Warnf("attempt %d of %d to delete adapter %s failed: %v", attempt, constants.AdapterDeleteAttempts, name, err)
+		if attempt < constants.AdapterDeleteAttempts {
+			time.Sleep(time.Duration(attempt*constants.AdapterDeleteBackoffMs) * time.Millisecond)
+		}
+	}
+	return fmt.Errorf("could not delete adapter %s after %d attempts: %v", name, constants.AdapterDeleteAttempts, err)
+}
+
+// CleanUpZitiTUNAdaptersDryRun returns the names of the adapters CleanUpZitiTUNAdapters would remove without
+// removing anything
+func CleanUpZitiTUNAdaptersDryRun(tunName string) []string {
+	names := make([]string, 0)
+	removeMatchingAdapters(func(name func() (string, error)) bool {
+		if interfaceName, matches := matchesZitiTunAdapter(name, tunName); matches {
+			names = append(names, interfaceName)
+		}
+		return false //never delete during a dry run
+	})
+	return names
 }
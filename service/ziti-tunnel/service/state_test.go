@@ -0,0 +1,1475 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogDestinationPath(t *testing.T) {
+	logs := filepath.Join(string(filepath.Separator)+"ziti", "logs", "service")
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"file name", "tunnel.log", filepath.Join(logs, "tunnel.log"), false},
+		{"sub folder", filepath.Join("archive", "tunnel.log"), filepath.Join(logs, "archive", "tunnel.log"), false},
+		{"absolute within", filepath.Join(logs, "tunnel.log"), filepath.Join(logs, "tunnel.log"), false},
+		{"empty", "  ", "", true},
+		{"the folder itself", logs, "", true},
+		{"escapes with dots", filepath.Join("..", "..", "config.json"), "", true},
+		{"absolute outside", filepath.Join(string(filepath.Separator)+"windows", "system32", "drivers", "etc", "hosts"), "", true},
+		{"sibling with the same prefix", logs + "-other" + string(filepath.Separator) + "tunnel.log", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := logDestinationPath(logs, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("logDestinationPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("logDestinationPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoveCorruptFileAside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corrupt-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(file, []byte(`{"TunIpv4":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	moveCorruptFileAside(file)
+	moveCorruptFileAside(filepath.Join(dir, "missing.json"))
+
+	if _, err = os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("%s was not moved aside: %v", file, err)
+	}
+	corrupt, err := filepath.Glob(filepath.Join(dir, "*.corrupt.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 1 {
+		t.Fatalf("found %v set aside, want only the copy of config.json", corrupt)
+	}
+	if data, err := ioutil.ReadFile(corrupt[0]); err != nil || string(data) != `{"TunIpv4":` {
+		t.Errorf("%s contains %q (%v), want the corrupt config", corrupt[0], data, err)
+	}
+}
+
+func TestLoadConfigWithCorruptFiles(t *testing.T) {
+	dir := useTempConfigDir(t)
+	// keep the test away from the policy, Windows update backups and strict recovery of this machine
+	for env, value := range map[string]string{"ProgramData": "", "SystemDrive": "", config.StrictConfigRecoveryEnv: ""} {
+		saved, found := os.LookupEnv(env)
+		_ = os.Setenv(env, value)
+		env := env
+		t.Cleanup(func() {
+			if found {
+				_ = os.Setenv(env, saved)
+			} else {
+				_ = os.Unsetenv(env)
+			}
+		})
+	}
+	savedStore, savedWarnings := stateStore, warnings
+	savedState, savedPolicy, savedConfigured, savedAdjustments := rts.state, rts.policy, rts.configured, rts.adjustments
+	defer func() {
+		stateStore, warnings = savedStore, savedWarnings
+		rts.state, rts.policy, rts.configured, rts.adjustments = savedState, savedPolicy, savedConfigured, savedAdjustments
+	}()
+	stateStore = &fileStateStore{}
+	warnings = &warningCollector{max: 10}
+
+	corruptConfig, corruptBackup := `{"TunIpv4":`, `{"Identities":[`
+	if err := ioutil.WriteFile(config.File(), []byte(corruptConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config.BackupFile(), []byte(corruptBackup), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := writeTestIdentity(t, filepath.Join(dir, "identity.json"))
+	if err := os.Rename(filepath.Join(dir, "identity.json"), filepath.Join(dir, fingerprint+".json")); err != nil {
+		t.Fatal(err)
+	}
+
+	rts.LoadConfig()
+
+	suffix := regexp.MustCompile(`\.corrupt\.\d{14}$`)
+	for file, content := range map[string]string{config.File(): corruptConfig, config.BackupFile(): corruptBackup} {
+		kept, err := filepath.Glob(file + ".corrupt.*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kept) != 1 || !suffix.MatchString(kept[0]) {
+			t.Errorf("%v kept for %s, want one copy with a timestamp suffix", kept, file)
+			continue
+		}
+		if data, err := ioutil.ReadFile(kept[0]); err != nil || string(data) != content {
+			t.Errorf("%s contains %q (%v), want %q", kept[0], data, err, content)
+		}
+	}
+	if len(rts.state.Identities) != 1 || rts.state.Identities[0].FingerPrint != fingerprint || !rts.state.Identities[0].Recovered {
+		t.Errorf("identities %+v, want %s recovered", rts.state.Identities, fingerprint)
+	}
+	saved, err := readConfig(config.File())
+	if err != nil {
+		t.Fatalf("the config saved after the recovery does not decode: %v", err)
+	}
+	if len(saved.Identities) != 1 || saved.Identities[0].FingerPrint != fingerprint {
+		t.Errorf("saved identities %+v, want %s", saved.Identities, fingerprint)
+	}
+}
+
+func TestProbeService(t *testing.T) {
+	savedDial := dialProbe
+	defer func() { dialProbe = savedDial }()
+	dialProbe = func(zid *cziti.ZIdentity, serviceName string, timeout time.Duration) (time.Duration, error) {
+		switch serviceName {
+		case "reachable":
+			return 20 * time.Millisecond, nil
+		case "unreachable":
+			return 0, errors.New("connection refused")
+		}
+		return 0, fmt.Errorf("service %s was not found", serviceName)
+	}
+	rt := &RuntimeState{ids: map[string]*Id{
+		"loaded":   {Identity: dto.Identity{FingerPrint: "loaded"}, CId: &cziti.ZIdentity{Loaded: true}},
+		"unloaded": {Identity: dto.Identity{FingerPrint: "unloaded"}, CId: &cziti.ZIdentity{}},
+	}}
+
+	tests := []struct {
+		name          string
+		fingerprint   string
+		service       string
+		wantReachable bool
+		wantLatency   time.Duration
+		wantErr       bool
+	}{
+		{"reachable", "loaded", "reachable", true, 20 * time.Millisecond, false},
+		{"unreachable", "loaded", "unreachable", false, 0, true},
+		{"unknown service", "loaded", "missing", false, 0, true},
+		{"identity not loaded", "unloaded", "reachable", false, 0, true},
+		{"unknown identity", "missing", "reachable", false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reachable, latency, err := rt.ProbeService(tt.fingerprint, tt.service)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProbeService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if reachable != tt.wantReachable || latency != tt.wantLatency {
+				t.Errorf("ProbeService() = %t, %v, want %t, %v", reachable, latency, tt.wantReachable, tt.wantLatency)
+			}
+		})
+	}
+}
+
+// noTunAdapters has no TUN adapter left behind by a previous run
+type noTunAdapters struct{}
+
+func (noTunAdapters) find(string) (windows.GUID, bool) { return windows.GUID{}, false }
+func (noTunAdapters) remove(string)                    {}
+
+func TestCreateTunWintunMissing(t *testing.T) {
+	savedCreate, savedAdapters := createTUN, tunAdapters
+	defer func() { createTUN, tunAdapters = savedCreate, savedAdapters }()
+	tunAdapters = noTunAdapters{}
+
+	tests := []struct {
+		name        string
+		err         error
+		wantMissing bool
+	}{
+		{"dll not found", fmt.Errorf("loading wintun: %w", windows.ERROR_MOD_NOT_FOUND), true},
+		{"procedure not found", windows.ERROR_PROC_NOT_FOUND, true},
+		{"dll could not be loaded", errors.New("Error loading wintun DLL: Unable to load library"), true},
+		{"other error", errors.New("access is denied"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			createTUN = func(string, int) (tun.Device, error) { return nil, tt.err }
+			rt := &RuntimeState{state: &dto.TunnelStatus{}}
+			_, dev, err := rt.CreateTun("100.64.0.1", 10, false)
+			if err == nil || dev != nil {
+				t.Fatalf("CreateTun() = %v, %v, want an error", dev, err)
+			}
+			if errors.Is(err, ErrWintunMissing) != tt.wantMissing {
+				t.Errorf("CreateTun() error = %v, want the wintun driver missing %t", err, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestEnterDegradedMode(t *testing.T) {
+	savedIds, savedState, savedBroadcast := rts.ids, rts.state, events.broadcast
+	defer func() { rts.ids, rts.state, events.broadcast = savedIds, savedState, savedBroadcast }()
+	rts.ids = make(map[string]*Id)
+	events.broadcast = make(chan interface{}, 1)
+	rts.state = &dto.TunnelStatus{Active: true, Identities: []*dto.Identity{{FingerPrint: "fp", Name: "identity"}}}
+
+	enterDegradedMode(fmt.Errorf("%w: (not found)", ErrWintunMissing))
+
+	if rts.state.Active || !rts.state.Degraded || rts.state.DegradedReason == "" {
+		t.Errorf("active %t degraded %t reason %q, want degraded with a reason", rts.state.Active, rts.state.Degraded, rts.state.DegradedReason)
+	}
+	if rts.Find("fp") == nil {
+		t.Error("the identities are not listed in degraded mode")
+	}
+	select {
+	case e := <-events.broadcast:
+		if d, ok := e.(dto.TunnelDegradedEvent); !ok || d.Action != dto.DRIVER_MISSING_ACTION || d.Reason != rts.state.DegradedReason {
+			t.Errorf("broadcast %+v, want the driver missing event", e)
+		}
+	default:
+		t.Error("the driver missing event was not broadcast")
+	}
+}
+
+func TestLoadIdentityFingerprintConflict(t *testing.T) {
+	dir := useTempConfigDir(t)
+	savedBroadcast := events.broadcast
+	defer func() { events.broadcast = savedBroadcast }()
+	events.broadcast = make(chan interface{}, 1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "fp.json"), []byte(`{"ztAPI":"https://ctrl:1280"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Id{Identity: dto.Identity{FingerPrint: "fp", Name: "first"}, CId: &cziti.ZIdentity{Loaded: true}}
+	rt := &RuntimeState{ids: map[string]*Id{"fp": loaded}, state: &dto.TunnelStatus{}}
+	second := &Id{Identity: dto.Identity{FingerPrint: "fp", Name: "second"}}
+
+	rt.LoadIdentity(second, DEFAULT_REFRESH_INTERVAL)
+
+	if rt.Find("fp") != loaded {
+		t.Error("the loaded identity was replaced")
+	}
+	if second.CId != nil || second.LastError == "" {
+		t.Errorf("second identity loading %t with error %q, want it refused", second.CId != nil, second.LastError)
+	}
+	select {
+	case e := <-events.broadcast:
+		if ie, ok := e.(dto.IdentityEvent); !ok || ie.ActionEvent != dto.IDENTITY_CONFLICT || ie.Id.Name != "second" {
+			t.Errorf("broadcast %+v, want the conflict of the second identity", e)
+		}
+	default:
+		t.Error("the conflict was not broadcast")
+	}
+}
+
+func TestLoadReadOnlyIdentity(t *testing.T) {
+	content := []byte(`{"ztAPI":"https://ctrl:1280"}`)
+	tests := []struct {
+		name      string
+		perm      os.FileMode
+		wantName  string
+		wantSaved bool
+	}{
+		{"read-only", 0400, "file name", false},
+		{"writable", 0600, "controller name", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useTempConfigDir(t)
+			savedIds, savedState, savedBroadcast, savedLoad := rts.ids, rts.state, events.broadcast, loadZiti
+			defer func() {
+				rts.ids, rts.state, events.broadcast, loadZiti = savedIds, savedState, savedBroadcast, savedLoad
+			}()
+			rts.ids = map[string]*Id{}
+			rts.state = &dto.TunnelStatus{}
+			events.broadcast = make(chan interface{}, 1)
+			path := filepath.Join(dir, "fp.json")
+			if err := ioutil.WriteFile(path, content, tt.perm); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = os.Chmod(path, 0600) })
+
+			// the sdk is not loaded, the identity reports as connected right away
+			loadZiti = func(zid *cziti.ZIdentity, cfg string, refreshInterval int, apiPageSize int) {
+				zid.Name = "controller name"
+				zid.StatusChanges(0)
+			}
+			id := &Id{Identity: dto.Identity{FingerPrint: "fp", Name: "file name"}}
+			rts.LoadIdentity(id, DEFAULT_REFRESH_INTERVAL)
+
+			if id.CId == nil || !id.CId.Loaded || rts.Find("fp") != id {
+				t.Fatalf("the identity was not loaded: %q", id.LastError)
+			}
+			if id.ReadOnly != (tt.perm == 0400) {
+				t.Errorf("ReadOnly = %t, want %t", id.ReadOnly, tt.perm == 0400)
+			}
+			if id.Name != tt.wantName {
+				t.Errorf("Name = %s, want %s", id.Name, tt.wantName)
+			}
+			if _, err := os.Stat(config.File()); (err == nil) != tt.wantSaved {
+				t.Errorf("the state was saved %t, want %t", err == nil, tt.wantSaved)
+			}
+			if data, err := ioutil.ReadFile(path); err != nil || string(data) != string(content) {
+				t.Errorf("identity file contains %q (%v), want %q", data, err, content)
+			}
+		})
+	}
+}
+
+func TestClampDnsTtl(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  int
+		want int
+	}{
+		{"in range", 300, 300},
+		{"minimum", constants.MinimumDnsTtl, constants.MinimumDnsTtl},
+		{"maximum", constants.MaximumDnsTtl, constants.MaximumDnsTtl},
+		{"negative", -5, constants.MinimumDnsTtl},
+		{"too large", constants.MaximumDnsTtl + 1, constants.MaximumDnsTtl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clampDnsTtl(tt.ttl); got != tt.want {
+				t.Errorf("clampDnsTtl(%d) = %d, want %d", tt.ttl, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeTunAdapters is a pool of adapters, an empty name is an adapter whose name cannot be read. the first failures
+// removals fail without removing anything
+type fakeTunAdapters struct {
+	names    []string
+	removed  []string
+	failures int
+	attempts int
+}
+
+func (f *fakeTunAdapters) removeMatching(matches func(name func() (string, error)) bool) []error {
+	f.attempts++
+	if f.attempts <= f.failures {
+		return []error{errors.New("the device is still referenced")}
+	}
+	for _, n := range f.names {
+		n := n
+		name := func() (string, error) {
+			if n == "" {
+				return "", errors.New("the adapter has no name")
+			}
+			return n, nil
+		}
+		if matches(name) {
+			f.removed = append(f.removed, n)
+		}
+	}
+	return nil
+}
+
+func TestCleanUpZitiTUNAdaptersDryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		adapters []string
+		want     []string
+	}{
+		{"no adapters", nil, []string{}},
+		{"only ziti adapters", []string{"ZitiTUN", "ZitiTUN 2"}, []string{"ZitiTUN", "ZitiTUN 2"}},
+		{"other adapters are kept", []string{"Ethernet", "ZitiTUN", "Wi-Fi", "OtherZitiTUN", "zititun"}, []string{"ZitiTUN"}},
+		{"unreadable names are kept", []string{"", "ZitiTUN-selftest"}, []string{"ZitiTUN-selftest"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := removeMatchingAdapters
+			defer func() { removeMatchingAdapters = saved }()
+			pool := &fakeTunAdapters{names: tt.adapters}
+			removeMatchingAdapters = pool.removeMatching
+
+			got := CleanUpZitiTUNAdaptersDryRun(TunName)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CleanUpZitiTUNAdaptersDryRun() = %v, want %v", got, tt.want)
+			}
+			if len(pool.removed) != 0 {
+				t.Fatalf("the dry run removed %v", pool.removed)
+			}
+
+			CleanUpZitiTUNAdapters(TunName)
+			if removed := append([]string{}, pool.removed...); !reflect.DeepEqual(removed, got) {
+				t.Errorf("CleanUpZitiTUNAdapters() removed %v, the dry run listed %v", removed, got)
+			}
+		})
+	}
+}
+
+func TestIdsInLoadOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []dto.Identity
+		want string
+	}{
+		{"no identities", nil, ""},
+		{"default priority by name", []dto.Identity{{Name: "c"}, {Name: "a"}, {Name: "b"}}, "a,b,c"},
+		{"highest priority first", []dto.Identity{{Name: "a"}, {Name: "b", LoadPriority: 10}, {Name: "c", LoadPriority: 5}}, "b,c,a"},
+		{"same priority by name", []dto.Identity{{Name: "z", LoadPriority: 1}, {Name: "y", LoadPriority: 1}, {Name: "x"}}, "y,z,x"},
+		{"negative priority last", []dto.Identity{{Name: "a", LoadPriority: -1}, {Name: "b"}}, "b,a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &RuntimeState{ids: make(map[string]*Id)}
+			for i, id := range tt.ids {
+				id.FingerPrint = fmt.Sprintf("fp-%d", i)
+				rt.ids[id.FingerPrint] = &Id{Identity: id}
+			}
+			var got []string
+			for _, id := range rt.idsInLoadOrder() {
+				got = append(got, id.Name)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("idsInLoadOrder() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAdapterDeletion(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"removed at once", 0, 1, false},
+		{"fails twice then succeeds", 2, 3, false},
+		{"always fails", constants.AdapterDeleteAttempts, constants.AdapterDeleteAttempts, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := retryAdapterDeletion(TunName, func() error {
+				attempts++
+				if attempts <= tt.failures {
+					return errors.New("the device is still referenced")
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("retryAdapterDeletion() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("deletion attempted %d times, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestCleanUpZitiTUNAdaptersRetries(t *testing.T) {
+	saved := removeMatchingAdapters
+	defer func() { removeMatchingAdapters = saved }()
+	pool := &fakeTunAdapters{names: []string{"Ethernet", TunName}, failures: 2}
+	removeMatchingAdapters = pool.removeMatching
+
+	CleanUpZitiTUNAdapters(TunName)
+	if pool.attempts != 3 {
+		t.Errorf("removal attempted %d times, want 3", pool.attempts)
+	}
+	if strings.Join(pool.removed, ",") != TunName {
+		t.Errorf("removed %v, want %s", pool.removed, TunName)
+	}
+}
+
+func TestCheckStrictIpv4Mask(t *testing.T) {
+	tests := []struct {
+		name    string
+		strict  bool
+		mask    int
+		wantErr bool
+	}{
+		{"lenient too large", false, 8, false},
+		{"lenient too small", false, 24, false},
+		{"strict unset", true, 0, false},
+		{"strict largest", true, constants.Ipv4MaxMask, false},
+		{"strict smallest", true, constants.Ipv4MinMask, false},
+		{"strict too large", true, constants.Ipv4MaxMask - 1, true},
+		{"strict too small", true, constants.Ipv4MinMask + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := rts.state
+			defer func() { rts.state = saved }()
+			rts.state = &dto.TunnelStatus{StrictTunIpv4Mask: tt.strict}
+			if err := checkStrictIpv4Mask(tt.mask); (err != nil) != tt.wantErr {
+				t.Errorf("checkStrictIpv4Mask(%d) error = %v, wantErr %t", tt.mask, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFlagStaleOrphans(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	grace := constants.DefaultOrphanGraceDays * 24 * time.Hour
+	tests := []struct {
+		name        string
+		id          dto.Identity
+		autoForget  bool
+		wantKept    bool
+		wantPending bool
+		wantMoved   bool
+	}{
+		{"enrolled identity", dto.Identity{FingerPrint: "fp", RecoveredAt: now.Add(-2 * grace)}, false, true, false, false},
+		{"within the grace period", dto.Identity{FingerPrint: "fp", Recovered: true, RecoveredAt: now.Add(-grace / 2)}, false, true, false, false},
+		{"first seen without a time", dto.Identity{FingerPrint: "fp", Recovered: true}, false, true, false, false},
+		{"stale is flagged", dto.Identity{FingerPrint: "fp", Recovered: true, RecoveredAt: now.Add(-grace)}, false, true, true, false},
+		{"stale is forgotten", dto.Identity{FingerPrint: "fp", Recovered: true, RecoveredAt: now.Add(-grace)}, true, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempConfigDir(t)
+			id := tt.id
+			if err := ioutil.WriteFile(id.Path(), []byte(`{"ztAPI":"https://ctrl:1280"}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+			rt := &RuntimeState{state: &dto.TunnelStatus{Identities: []*dto.Identity{&id}, AutoForgetOrphans: tt.autoForget}}
+
+			rt.flagStaleOrphans(now)
+
+			if kept := len(rt.state.Identities) == 1; kept != tt.wantKept {
+				t.Fatalf("identity kept %t, want %t", kept, tt.wantKept)
+			}
+			if id.PendingRemoval != tt.wantPending {
+				t.Errorf("PendingRemoval = %t, want %t", id.PendingRemoval, tt.wantPending)
+			}
+			if id.Recovered && id.RecoveredAt.IsZero() {
+				t.Error("RecoveredAt was not set")
+			}
+			if _, err := os.Stat(id.Path() + ".forgotten"); (err == nil) != tt.wantMoved {
+				t.Errorf("identity file moved aside %t, want %t", err == nil, tt.wantMoved)
+			}
+		})
+	}
+}
+
+func TestUpdateControllerAddressSwapsTheFile(t *testing.T) {
+	const original = `{"ztAPI":"https://ctrl.example.com:1280"}`
+	tests := []struct {
+		name       string
+		newAddress string
+		wantZtAPI  string
+		wantFiles  []string
+	}{
+		{"new address", "moved.example.com:1280", "https://moved.example.com:1280", []string{"fp.json", "fp.json.original"}},
+		{"same address", "https://ctrl.example.com:1280", "https://ctrl.example.com:1280", []string{"fp.json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "controller-address")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "fp.json")
+			if err = ioutil.WriteFile(path, []byte(original), 0600); err != nil {
+				t.Fatal(err)
+			}
+			savedDial := dialController
+			dialController = func(ctx context.Context, target string) (net.Conn, error) {
+				return nil, errors.New("not dialing in a test")
+			}
+			defer func() { dialController = savedDial }()
+			rt := &RuntimeState{state: &dto.TunnelStatus{}, ids: make(map[string]*Id)}
+
+			rt.UpdateControllerAddress(path, tt.newAddress)
+
+			var got idcfg.Config
+			data, err := ioutil.ReadFile(path)
+			if err == nil {
+				err = json.Unmarshal(data, &got)
+			}
+			if err != nil || got.ZtAPI != tt.wantZtAPI {
+				t.Errorf("ZtAPI = %s (%v), want %s", got.ZtAPI, err, tt.wantZtAPI)
+			}
+			// the temporary file is renamed over the identity file, nothing else is left behind
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0, len(files))
+			for _, f := range files {
+				names = append(names, f.Name())
+			}
+			if !reflect.DeepEqual(names, tt.wantFiles) {
+				t.Errorf("files = %v, want %v", names, tt.wantFiles)
+			}
+			if data, err = ioutil.ReadFile(path + ".original"); err == nil && string(data) != original {
+				t.Errorf("original identity = %s, want %s", data, original)
+			}
+		})
+	}
+}
+
+func TestReplaceIdentityFileInterrupted(t *testing.T) {
+	const original = `{"ztAPI":"https://ctrl.example.com:1280"}`
+	dir, err := ioutil.TempDir("", "controller-address")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fp.json")
+	if err = ioutil.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = replaceIdentityFile(path, func(w io.Writer) error {
+		if _, err := w.Write([]byte(`{"ztAPI":"https://moved`)); err != nil {
+			return err
+		}
+		return errors.New("interrupted")
+	})
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Fatalf("replaceIdentityFile() error = %v, want the write error", err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != original {
+		t.Errorf("fp.json = %s (%v), want %s", data, err, original)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		names := make([]string, 0, len(files))
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("files = %v, want only fp.json", names)
+	}
+}
+
+// backupStateStore keeps the state and its backup in memory, corrupt changes the backup as it is made
+type backupStateStore struct {
+	memoryStateStore
+	backup    *dto.TunnelStatus
+	saveErr   error
+	backupErr error
+	corrupt   func(status *dto.TunnelStatus)
+}
+
+func (b *backupStateStore) Save(status dto.TunnelStatus) error {
+	if b.saveErr != nil {
+		return b.saveErr
+	}
+	return b.memoryStateStore.Save(status)
+}
+
+func (b *backupStateStore) Backup() (string, error) {
+	if b.backupErr != nil {
+		return "", b.backupErr
+	}
+	backup := *b.saved
+	if b.corrupt != nil {
+		b.corrupt(&backup)
+	}
+	b.backup = &backup
+	return "memory backup", nil
+}
+
+func (b *backupStateStore) Load(backup bool) (*dto.TunnelStatus, error) {
+	if backup {
+		if b.backup == nil {
+			return nil, errors.New("no backup")
+		}
+		return b.backup, nil
+	}
+	return b.memoryStateStore.Load(false)
+}
+
+func TestVerifyBackupIntegrity(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   *backupStateStore
+		wantErr string
+	}{
+		{"backup matches", &backupStateStore{}, ""},
+		{"corrupt backup", &backupStateStore{corrupt: func(s *dto.TunnelStatus) { s.TunIpv4 = "100.64.0.9" }}, "does not match"},
+		{"log level lost from the backup", &backupStateStore{corrupt: func(s *dto.TunnelStatus) { s.LogLevel = "" }}, "does not match"},
+		{"backup fails", &backupStateStore{backupErr: errors.New("disk full")}, "could not backup config file: disk full"},
+		{"save fails", &backupStateStore{saveErr: errors.New("the file is in use")}, "could not save the config: the file is in use"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved, savedWarnings := stateStore, warnings
+			defer func() { stateStore, warnings = saved, savedWarnings }()
+			stateStore = tt.store
+			warnings = &warningCollector{max: 10}
+			rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{TunIpv4: "100.64.0.1", LogLevel: "debug"}}
+
+			err := rt.VerifyBackupIntegrity()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("VerifyBackupIntegrity() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyBackupIntegrity() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyBackupIntegrityDuringBatch(t *testing.T) {
+	saved := stateStore
+	defer func() { stateStore = saved }()
+	store := &backupStateStore{}
+	stateStore = store
+	rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{TunIpv4: "100.64.0.1"}}
+
+	rt.BeginBatch()
+	err := rt.VerifyBackupIntegrity()
+	rt.EndBatch()
+	if err == nil || !strings.Contains(err.Error(), "batch") {
+		t.Errorf("VerifyBackupIntegrity() during a batch error = %v, want a batch error", err)
+	}
+	if store.backup != nil {
+		t.Error("VerifyBackupIntegrity() during a batch took a backup")
+	}
+	if err := rt.VerifyBackupIntegrity(); err != nil {
+		t.Errorf("VerifyBackupIntegrity() after the batch error = %v", err)
+	}
+}
+
+func TestDnsFailureModeDefault(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		types []string
+		want  string
+	}{
+		{"default types", "", []string{"A", "AAAA"}, cziti.DnsFailureEmpty},
+		{"default types in any order and case", "", []string{"aaaa", " a "}, cziti.DnsFailureEmpty},
+		{"only A", "", []string{"A"}, cziti.DnsFailureForward},
+		{"more than the default", "", []string{"A", "AAAA", "TXT"}, cziti.DnsFailureForward},
+		{"a configured mode wins", cziti.DnsFailureNxdomain, []string{"A"}, cziti.DnsFailureNxdomain},
+		{"a configured mode wins over the default types", cziti.DnsFailureForward, []string{"A", "AAAA"}, cziti.DnsFailureForward},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &RuntimeState{state: &dto.TunnelStatus{DnsFailureMode: tt.mode, InterceptedDnsTypes: tt.types}}
+			if got := rt.dnsFailureMode(); got != tt.want {
+				t.Errorf("dnsFailureMode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDnsListenAddresses(t *testing.T) {
+	tunIp := net.ParseIP("100.64.0.1")
+	tests := []struct {
+		name      string
+		addresses []string
+		want      string
+	}{
+		{"none", nil, ""},
+		{"loopback", []string{"127.0.0.53"}, "127.0.0.53"},
+		{"ipv6 and spaces", []string{" 127.0.0.53 ", "::1"}, "127.0.0.53,::1"},
+		{"the TUN ip is not repeated", []string{"100.64.0.1", "127.0.0.53"}, "127.0.0.53"},
+		{"invalid ips are ignored", []string{"localhost", "0.0.0.0", "::", "127.0.0.53"}, "127.0.0.53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := rts.state
+			defer func() { rts.state = saved }()
+			rts.state = &dto.TunnelStatus{DnsListenAddresses: tt.addresses}
+			var got []string
+			for _, ip := range dnsListenAddresses(tunIp) {
+				got = append(got, ip.String())
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("dnsListenAddresses() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyUnchanged(t *testing.T) {
+	content := []byte(`{"ztAPI":"https://ctrl:1280"}`)
+	tests := []struct {
+		name    string
+		change  func(path string) error
+		wantErr bool
+	}{
+		{"unchanged", func(string) error { return nil }, false},
+		{"rewritten with the same content", func(path string) error {
+			if err := ioutil.WriteFile(path, content, 0600); err != nil {
+				return err
+			}
+			later := time.Now().Add(time.Minute)
+			return os.Chtimes(path, later, later)
+		}, true},
+		{"size changed", func(path string) error { return ioutil.WriteFile(path, append(content, ' '), 0600) }, true},
+		{"removed", os.Remove, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "identity-unchanged")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "fp.json")
+			if err = ioutil.WriteFile(path, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = tt.change(path); err != nil {
+				t.Fatal(err)
+			}
+			if err = verifyUnchanged(path, info); (err != nil) != tt.wantErr {
+				t.Errorf("verifyUnchanged() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecideDns(t *testing.T) {
+	tests := []struct {
+		applyDns      bool
+		nrptEffective bool
+		want          string
+	}{
+		{false, true, DnsActionNrpt},
+		{false, false, DnsActionInterface},
+		{true, true, DnsActionInterface},
+		{true, false, DnsActionInterface},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("applyDns=%t nrpt=%t", tt.applyDns, tt.nrptEffective), func(t *testing.T) {
+			got := decideDns(tt.applyDns, tt.nrptEffective)
+			if got.Action != tt.want {
+				t.Errorf("Action = %s, want %s", got.Action, tt.want)
+			}
+			if got.ApplyDns != tt.applyDns || got.NrptEffective != tt.nrptEffective {
+				t.Errorf("decideDns() = %+v, want the inputs recorded", got)
+			}
+		})
+	}
+}
+
+func TestCurrentDnsDecision(t *testing.T) {
+	r := &RuntimeState{}
+	if got := r.currentDnsDecision(); got != nil {
+		t.Fatalf("currentDnsDecision() = %+v before the TUN was created, want nil", got)
+	}
+	r.dnsDecision = decideDns(false, true)
+	got := r.currentDnsDecision()
+	got.InterfaceMetric = 1
+	if r.dnsDecision.InterfaceMetric == 1 {
+		t.Error("currentDnsDecision() returned the decision itself instead of a copy")
+	}
+	if got.Action != DnsActionNrpt {
+		t.Errorf("Action = %s, want %s", got.Action, DnsActionNrpt)
+	}
+}
+
+func TestToMetricsConcurrent(t *testing.T) {
+	id := &Id{Identity: dto.Identity{FingerPrint: "fp", Metrics: &dto.Metrics{Up: 1, Down: 1}}}
+	r := &RuntimeState{ids: map[string]*Id{"fp": id}}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := int64(2); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			id.metricsLock.Lock()
+			id.Metrics = &dto.Metrics{Up: i, Down: i}
+			id.metricsLock.Unlock()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		m := r.ToMetrics().Identities[0].Metrics
+		if m == nil {
+			t.Fatal("ToMetrics() returned no metrics")
+		}
+		if m.Up != m.Down {
+			t.Fatalf("ToMetrics() returned up %d and down %d from different reads", m.Up, m.Down)
+		}
+		id.metricsLock.Lock()
+		same := m == id.Metrics
+		id.metricsLock.Unlock()
+		if same {
+			t.Fatal("ToMetrics() returned the metrics of the identity instead of a copy")
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestNextMfaDeadline(t *testing.T) {
+	now := time.Now()
+	mfa := func(needed bool, timeout int32, remaining int32) *cziti.ZIdentity {
+		return &cziti.ZIdentity{MfaEnabled: true, MfaNeeded: needed, MfaMaxTimeout: timeout, MfaMaxTimeoutRem: remaining, MfaLastUpdatedTime: now}
+	}
+	ids := map[string]*Id{
+		"no-mfa":     {Identity: dto.Identity{FingerPrint: "no-mfa"}, CId: &cziti.ZIdentity{}},
+		"not-loaded": {Identity: dto.Identity{FingerPrint: "not-loaded"}},
+		"later":      {Identity: dto.Identity{FingerPrint: "later", Name: "later"}, CId: mfa(false, 600, 600)},
+		"sooner":     {Identity: dto.Identity{FingerPrint: "sooner", Name: "sooner"}, CId: mfa(false, 300, 300)},
+		"no-timeout": {Identity: dto.Identity{FingerPrint: "no-timeout"}, CId: mfa(false, -1, -1)},
+	}
+	r := &RuntimeState{ids: ids}
+
+	got := r.NextMfaDeadline()
+	if got.Fingerprint != "sooner" || got.RemainingSeconds < 299 || got.RemainingSeconds > 300 {
+		t.Errorf("NextMfaDeadline() = %+v, want sooner with about 300 seconds", got)
+	}
+
+	ids["needed"] = &Id{Identity: dto.Identity{FingerPrint: "needed", Name: "needed"}, CId: mfa(true, 600, 600)}
+	if got = r.NextMfaDeadline(); got.Fingerprint != "needed" || got.RemainingSeconds != 0 {
+		t.Errorf("NextMfaDeadline() = %+v, want the identity which needs the mfa now", got)
+	}
+
+	r.ids = map[string]*Id{"no-mfa": ids["no-mfa"]}
+	if got = r.NextMfaDeadline(); got != (dto.MfaDeadline{}) {
+		t.Errorf("NextMfaDeadline() = %+v, want no deadline", got)
+	}
+}
+
+func TestTunInterfaceMetric(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name        string
+		splitTunnel *bool
+		action      string
+		want        int
+	}{
+		{"interface dns, split by default", nil, DnsActionInterface, constants.TunMetricPreferred},
+		{"interface dns, not split", &disabled, DnsActionInterface, constants.TunMetricPreferred},
+		{"nrpt, split by default", nil, DnsActionNrpt, constants.TunMetricSplit},
+		{"nrpt, split", &enabled, DnsActionNrpt, constants.TunMetricSplit},
+		{"nrpt, not split", &disabled, DnsActionNrpt, constants.TunMetricPreferred},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RuntimeState{state: &dto.TunnelStatus{SplitTunnel: tt.splitTunnel}}
+			if got := tunInterfaceMetric(r.splitTunnel(), tt.action); got != tt.want {
+				t.Errorf("tunInterfaceMetric() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApiPageSize(t *testing.T) {
+	r := &RuntimeState{state: &dto.TunnelStatus{ApiPageSize: 25}}
+	tests := []struct {
+		name     string
+		pageSize int
+		want     int
+	}{
+		{"not set", 0, 25},
+		{"set", constants.MinimumApiPageSize, constants.MinimumApiPageSize},
+		{"too small", constants.MinimumApiPageSize - 1, 25},
+		{"too large", constants.MaximumApiPageSize + 1, 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := &Id{Identity: dto.Identity{FingerPrint: "fp", ApiPageSize: tt.pageSize}}
+			if got := r.apiPageSize(id); got != tt.want {
+				t.Errorf("apiPageSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanForOrphanedIdentities(t *testing.T) {
+	dir := useTempConfigDir(t)
+	known := writeTestIdentity(t, filepath.Join(dir, "known.json"))
+	if err := os.Rename(filepath.Join(dir, "known.json"), filepath.Join(dir, known+".json")); err != nil {
+		t.Fatal(err)
+	}
+	orphaned := writeTestIdentity(t, filepath.Join(dir, "orphaned.json"))
+	if err := os.Rename(filepath.Join(dir, "orphaned.json"), filepath.Join(dir, orphaned+".json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.json"), []byte(`{"note":"not an identity"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	off, on := false, true
+
+	tests := []struct {
+		name        string
+		autoRecover *bool
+		wantAdded   bool
+	}{
+		{"not set", nil, true},
+		{"recover", &on, true},
+		{"only list", &off, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &RuntimeState{state: &dto.TunnelStatus{
+				AutoRecoverOrphans: tt.autoRecover,
+				Identities:         []*dto.Identity{{FingerPrint: known, Name: "known"}},
+			}}
+
+			candidates, err := rt.OrphanCandidates()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(candidates) != 1 || candidates[0].Fingerprint != orphaned || candidates[0].Controller != "https://ctrl:1280" {
+				t.Fatalf("OrphanCandidates() = %+v, want only %s", candidates, orphaned)
+			}
+			if filepath.Clean(candidates[0].Path) != filepath.Join(dir, orphaned+".json") {
+				t.Errorf("Path = %s, want %s", candidates[0].Path, filepath.Join(dir, orphaned+".json"))
+			}
+
+			rt.scanForOrphanedIdentities(dir)
+			added := len(rt.state.Identities) == 2 && rt.state.Identities[1].FingerPrint == orphaned && rt.state.Identities[1].Recovered
+			if added != tt.wantAdded {
+				t.Errorf("orphan added back = %t, want %t: %+v", added, tt.wantAdded, rt.state.Identities)
+			}
+			if !tt.wantAdded && len(rt.state.Identities) != 1 {
+				t.Errorf("the config changed: %+v", rt.state.Identities)
+			}
+		})
+	}
+}
+
+func TestNotifiedFlags(t *testing.T) {
+	rt := &RuntimeState{ids: map[string]*Id{
+		"a": {Identity: dto.Identity{FingerPrint: "a"}},
+		"b": {Identity: dto.Identity{FingerPrint: "b"}},
+		"c": {Identity: dto.Identity{FingerPrint: "c"}},
+	}}
+	tests := []struct {
+		name   string
+		change func()
+		want   string
+	}{
+		{"none notified", func() {}, ""},
+		{"set two", func() { rt.SetNotified("a", true); rt.SetNotified("c", true) }, "a,c"},
+		{"unknown fingerprint", func() { rt.SetNotified("missing", true) }, "a,c"},
+		{"clear one", func() { rt.SetNotified("a", false) }, "c"},
+		{"reset all", func() { rt.SetNotified("b", true); rt.ResetAllNotified() }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+			got := rt.NotifiedFingerprints()
+			sort.Strings(got)
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("NotifiedFingerprints() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// run with -race, the identities are ranged over while they are added and removed
+func TestAllIdsWhileChanging(t *testing.T) {
+	rt := &RuntimeState{ids: make(map[string]*Id)}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			fp := fmt.Sprintf("fp-%d", i%10)
+			rt.idsLock.Lock()
+			rt.ids[fp] = &Id{Identity: dto.Identity{FingerPrint: fp}}
+			rt.idsLock.Unlock()
+			rt.RemoveByFingerprint(fp)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			for _, id := range rt.allIds() {
+				_ = id.FingerPrint
+			}
+			_ = rt.NotifiedFingerprints()
+		}
+	}()
+	wg.Wait()
+}
+
+func TestBatchSavesOnce(t *testing.T) {
+	tests := []struct {
+		name      string
+		mutations int
+		nested    bool
+		wantSaves int
+	}{
+		{"no change", 0, false, 0},
+		{"50 mutations", 50, false, 1},
+		{"nested batches", 50, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useMemoryStateStore(t)
+			rts.BeginBatch()
+			if tt.nested {
+				rts.BeginBatch()
+			}
+			for i := 0; i < tt.mutations; i++ {
+				rts.state.DnsTtlSeconds = i
+				_ = rts.SaveState()
+			}
+			if tt.nested {
+				rts.EndBatch()
+				if store.saves != 0 {
+					t.Errorf("the inner batch saved the state")
+				}
+			}
+			rts.EndBatch()
+			if store.saves != tt.wantSaves {
+				t.Errorf("saved %d times, want %d", store.saves, tt.wantSaves)
+			}
+		})
+	}
+}
+
+func TestBatchSavesAfterPanic(t *testing.T) {
+	store := useMemoryStateStore(t)
+	func() {
+		defer func() { _ = recover() }()
+		rts.BeginBatch()
+		defer rts.EndBatch()
+		_ = rts.SaveState()
+		panic("bulk change failed")
+	}()
+	if store.saves != 1 {
+		t.Errorf("saved %d times after the panic, want 1", store.saves)
+	}
+}
+
+func TestForgetStaleOrphansSavesOnce(t *testing.T) {
+	store := useMemoryStateStore(t)
+	now := time.Now()
+	rts.state.AutoForgetOrphans = true
+	rts.state.OrphanGraceDays = 1
+	stale := now.Add(-48 * time.Hour)
+	rts.state.Identities = []*dto.Identity{
+		{FingerPrint: "kept"},
+		{FingerPrint: "stale1", Recovered: true, RecoveredAt: stale},
+		{FingerPrint: "stale2", Recovered: true, RecoveredAt: stale},
+		{FingerPrint: "recent", Recovered: true, RecoveredAt: now},
+	}
+	rts.BeginBatch()
+	rts.flagStaleOrphans(now)
+	rts.EndBatch()
+	if store.saves != 1 {
+		t.Errorf("saved %d times, want 1", store.saves)
+	}
+	var kept []string
+	for _, sid := range rts.state.Identities {
+		kept = append(kept, sid.FingerPrint)
+	}
+	if strings.Join(kept, ",") != "kept,recent" {
+		t.Errorf("kept %v, want kept and recent", kept)
+	}
+}
+
+func TestApplyControllerName(t *testing.T) {
+	id := &Id{Identity: dto.Identity{Name: "fingerprint"}}
+	tests := []struct {
+		name           string
+		controllerName string
+		readOnly       bool
+		wantChanged    bool
+		wantName       string
+		wantUnresolved bool
+	}{
+		{"controller down", "<unknown>", false, false, "fingerprint", true},
+		{"real name arrives", "laptop", false, true, "laptop", false},
+		{"same name", "laptop", false, false, "laptop", false},
+		{"no name", "", false, false, "laptop", true},
+		{"renamed on a read-only identity", "desktop", true, false, "laptop", false},
+		{"renamed", "desktop", false, true, "desktop", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id.ReadOnly = tt.readOnly
+			if changed := id.applyControllerName(tt.controllerName); changed != tt.wantChanged {
+				t.Errorf("applyControllerName() = %v, want %v", changed, tt.wantChanged)
+			}
+			if id.Name != tt.wantName || id.UnresolvedName != tt.wantUnresolved {
+				t.Errorf("name %s unresolved %v, want %s unresolved %v", id.Name, id.UnresolvedName, tt.wantName, tt.wantUnresolved)
+			}
+		})
+	}
+}
+
+func TestDnsMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		decision *dto.DnsDecision
+		want     string
+	}{
+		{"no TUN yet", nil, ""},
+		{"nrpt", decideDns(false, true), DnsModeNrpt},
+		{"add dns", decideDns(true, true), DnsModeInterface},
+		{"add dns and nrpt failed", decideDns(true, false), DnsModeInterface},
+		{"nrpt failed", decideDns(false, false), DnsModeInterfaceNrptFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dnsMode(tt.decision); got != tt.want {
+				t.Errorf("dnsMode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCurrentDnsConfig(t *testing.T) {
+	savedServers, savedRules := tunDnsServers, nrptRules
+	defer func() { tunDnsServers, nrptRules = savedServers, savedRules }()
+
+	tunDns := []net.IP{net.ParseIP("100.64.0.2")}
+	rules := []dto.NrptRule{{Namespace: []string{".ziti"}, NameServers: []string{"100.64.0.2"}}}
+	tests := []struct {
+		name       string
+		decision   *dto.DnsDecision
+		servers    []net.IP
+		rules      []dto.NrptRule
+		wantMode   string
+		wantServer []string
+	}{
+		{"interface dns", decideDns(false, false), tunDns, nil, DnsModeInterfaceNrptFailed, []string{"100.64.0.2"}},
+		{"nrpt", decideDns(false, true), nil, rules, DnsModeNrpt, []string{}},
+		{"interface dns and nrpt", decideDns(true, true), tunDns, rules, DnsModeInterface, []string{"100.64.0.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunDnsServers = func(tun.Device) ([]net.IP, error) { return tt.servers, nil }
+			nrptRules = func() ([]dto.NrptRule, error) { return tt.rules, nil }
+			var device tun.Device
+			r := &RuntimeState{tun: &device, dnsDecision: tt.decision}
+
+			got, err := r.CurrentDnsConfig()
+			if err != nil {
+				t.Fatalf("CurrentDnsConfig() error = %v", err)
+			}
+			if got.DnsMode != tt.wantMode {
+				t.Errorf("DnsMode = %s, want %s", got.DnsMode, tt.wantMode)
+			}
+			if !reflect.DeepEqual(got.Servers, tt.wantServer) {
+				t.Errorf("Servers = %v, want %v", got.Servers, tt.wantServer)
+			}
+			if !reflect.DeepEqual(got.NrptRules, tt.rules) {
+				t.Errorf("NrptRules = %v, want %v", got.NrptRules, tt.rules)
+			}
+		})
+	}
+
+	t.Run("TUN down", func(t *testing.T) {
+		if _, err := (&RuntimeState{}).CurrentDnsConfig(); err == nil {
+			t.Error("CurrentDnsConfig() succeeded without a TUN")
+		}
+	})
+	t.Run("nrpt rules fail", func(t *testing.T) {
+		tunDnsServers = func(tun.Device) ([]net.IP, error) { return tunDns, nil }
+		nrptRules = func() ([]dto.NrptRule, error) { return nil, errors.New("powershell failed") }
+		var device tun.Device
+		r := &RuntimeState{tun: &device, dnsDecision: decideDns(false, true)}
+		if _, err := r.CurrentDnsConfig(); err == nil {
+			t.Error("CurrentDnsConfig() succeeded while the nrpt rules could not be listed")
+		}
+	})
+}
+
+func TestAddIdentity(t *testing.T) {
+	savedConnect := connectNewIdentity
+	defer func() { connectNewIdentity = savedConnect }()
+
+	tests := []struct {
+		name          string
+		active        bool
+		wantConnected bool
+	}{
+		{"active", true, true},
+		{"inactive", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useMemoryStateStore(t)
+			var connected []string
+			connectNewIdentity = func(id *Id) { connected = append(connected, id.FingerPrint) }
+			rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{}}
+			persisted := &dto.Identity{FingerPrint: "fp", Active: tt.active}
+			id := &Id{Identity: *persisted}
+
+			rt.addIdentity(id, persisted)
+			if rt.Find("fp") != id {
+				t.Error("the identity is not in use")
+			}
+			if len(rt.state.Identities) != 1 || rt.state.Identities[0] != persisted {
+				t.Errorf("persisted %v, want the added identity", rt.state.Identities)
+			}
+			if (len(connected) == 1) != tt.wantConnected {
+				t.Errorf("connected %v, want connected %t", connected, tt.wantConnected)
+			}
+			if store.saves != 1 {
+				t.Errorf("saved %d times, want 1", store.saves)
+			}
+		})
+	}
+}
+
+func TestListInterceptions(t *testing.T) {
+	loaded := &cziti.ZIdentity{Loaded: true}
+	loaded.Services.Store("web-id", &cziti.ZService{Service: &dto.Service{
+		Name:      "web",
+		Protocols: []string{"tcp"},
+		Ports:     []dto.PortRange{{Low: 443, High: 443}},
+		Addresses: []dto.Address{
+			{IsHost: true, HostName: "web.ziti"},
+			{IsHost: true, HostName: "*.web.ziti"},
+			{IsHost: true, HostName: "api.ziti"},
+			{IP: "10.0.0.5"},
+			{IP: "192.168.0.0", Prefix: 16},
+			{IP: "10.1.0.0", Prefix: 24},
+		},
+	}})
+	loaded.Services.Store("db-id", &cziti.ZService{Service: &dto.Service{
+		Name:      "db",
+		Protocols: []string{"tcp", "udp"},
+		Addresses: []dto.Address{{IsHost: true, HostName: "db.ziti"}},
+	}})
+	loaded.Services.Store("pending-id", &cziti.ZService{})
+	r := &RuntimeState{ids: map[string]*Id{
+		"loaded":     {Identity: dto.Identity{FingerPrint: "loaded"}, CId: loaded},
+		"unloaded":   {Identity: dto.Identity{FingerPrint: "unloaded"}, CId: &cziti.ZIdentity{}},
+		"no-context": {Identity: dto.Identity{FingerPrint: "no-context"}},
+	}}
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		wantErr     string
+	}{
+		{"not found", "missing", "not found"},
+		{"not loaded", "unloaded", "not loaded"},
+		{"no context", "no-context", "not loaded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.ListInterceptions(tt.fingerprint)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || got != nil {
+				t.Errorf("ListInterceptions() = %v, %v, want an error containing %q", got, err, tt.wantErr)
+			}
+		})
+	}
+
+	want := []dto.Interception{
+		{
+			ServiceName: "db",
+			Hostnames:   []string{"db.ziti"},
+			Domains:     []string{},
+			Cidrs:       []string{},
+			Protocols:   []string{"tcp", "udp"},
+		},
+		{
+			ServiceName: "web",
+			Hostnames:   []string{"api.ziti", "web.ziti"},
+			Domains:     []string{"*.web.ziti"},
+			Cidrs:       []string{"10.0.0.5", "10.1.0.0/24", "192.168.0.0/16"},
+			Protocols:   []string{"tcp"},
+			Ports:       []dto.PortRange{{Low: 443, High: 443}},
+		},
+	}
+	// the services are kept in a map, listing them again must give the same order
+	for i := 0; i < 5; i++ {
+		got, err := r.ListInterceptions("loaded")
+		if err != nil {
+			t.Fatalf("ListInterceptions() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("ListInterceptions() = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestMfaSatisfied(t *testing.T) {
+	now := time.Now()
+	mfa := func(needed bool, timeout int32, remaining int32, updated time.Time) *cziti.ZIdentity {
+		return &cziti.ZIdentity{MfaEnabled: true, MfaNeeded: needed, MfaMaxTimeout: timeout, MfaMaxTimeoutRem: remaining, MfaLastUpdatedTime: updated}
+	}
+	r := &RuntimeState{ids: map[string]*Id{
+		"not-enabled": {Identity: dto.Identity{FingerPrint: "not-enabled"}, CId: &cziti.ZIdentity{Loaded: true}},
+		"no-context":  {Identity: dto.Identity{FingerPrint: "no-context"}},
+		"needed":      {Identity: dto.Identity{FingerPrint: "needed"}, CId: mfa(true, 600, 600, now)},
+		"satisfied":   {Identity: dto.Identity{FingerPrint: "satisfied"}, CId: mfa(false, 600, 600, now)},
+		"no-timeout":  {Identity: dto.Identity{FingerPrint: "no-timeout"}, CId: mfa(false, -1, -1, now)},
+		"timed-out":   {Identity: dto.Identity{FingerPrint: "timed-out"}, CId: mfa(false, 600, 600, now.Add(-700*time.Second))},
+	}}
+	tests := []struct {
+		fingerprint   string
+		wantErr       error
+		wantSatisfied bool
+		wantRenewMin  time.Duration
+		wantRenewMax  time.Duration
+	}{
+		{"missing", ErrIdentityNotFound, false, 0, 0},
+		{"not-enabled", ErrMfaNotEnabled, false, 0, 0},
+		{"no-context", ErrMfaNotEnabled, false, 0, 0},
+		{"needed", nil, false, 0, 0},
+		{"satisfied", nil, true, 599 * time.Second, 600 * time.Second},
+		{"no-timeout", nil, true, 0, 0},
+		{"timed-out", nil, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fingerprint, func(t *testing.T) {
+			satisfied, renewIn, err := r.MfaSatisfied(tt.fingerprint)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("MfaSatisfied() error = %v, want %v", err, tt.wantErr)
+			}
+			if satisfied != tt.wantSatisfied || renewIn < tt.wantRenewMin || renewIn > tt.wantRenewMax {
+				t.Errorf("MfaSatisfied() = %t, %v, want %t renewing in %v to %v", satisfied, renewIn, tt.wantSatisfied, tt.wantRenewMin, tt.wantRenewMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TestEnrollment authenticates the identity in the file with its controller without loading it. the api session is
+// deleted afterwards and neither the identities nor the tunnel are touched. the file must be owned by a user or be in
+// the import folder, see sourceFileAllowed
+func (t *RuntimeState) TestEnrollment(path string) dto.EnrollmentTest {
+	result := dto.EnrollmentTest{Path: path}
+	if err := testEnrollment(t, path, &result); err != nil {
+		log.Infof("enrollment test of %s failed: %v", path, err)
+		result.Error = err.Error()
+	} else {
+		log.Infof("enrollment test of %s succeeded. %s authenticated with %s (%s)", path, result.Name, result.Controller, result.ControllerVersion)
+		result.Success = true
+	}
+	return result
+}
+
+func testEnrollment(t *RuntimeState, path string, result *dto.EnrollmentTest) error {
+	if err := t.sourceFileAllowed(path); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("could not read identity file %s: %v", path, err)
+	}
+	cfg := idcfg.Config{}
+	if err := probeIdentityFile(path, &cfg); err != nil {
+		return fmt.Errorf("%s is not an identity file: %v", path, err)
+	}
+	result.Controller = cfg.ZtAPI
+	if err := t.controllerAllowed(cfg.ZtAPI); err != nil {
+		return err
+	}
+	sdkId, err := identity.LoadIdentity(cfg.ID)
+	if err != nil {
+		return fmt.Errorf("the certificate or key of the identity cannot be used: %v", err)
+	}
+
+	client := controllerClient(sdkId)
+	defer client.CloseIdleConnections()
+	api := strings.TrimRight(cfg.ZtAPI, "/")
+
+	var version struct {
+		Data struct {
+			Version string `json:"version"`
+		} `json:"data"`
+	}
+	if err = controllerCall(client, http.MethodGet, api+"/version", nil, nil, &version); err != nil {
+		return fmt.Errorf("could not reach the controller: %v", err)
+	}
+	result.ControllerVersion = version.Data.Version
+
+	var session struct {
+		Data struct {
+			Token    string `json:"token"`
+			Identity struct {
+				Name string `json:"name"`
+			} `json:"identity"`
+		} `json:"data"`
+	}
+	if err = controllerCall(client, http.MethodPost, api+"/authenticate?method=cert", nil, nil, &session); err != nil {
+		return fmt.Errorf("the controller did not authenticate the identity: %v", err)
+	}
+	result.Name = session.Data.Identity.Name
+
+	headers := http.Header{"zt-session": []string{session.Data.Token}}
+	if err = controllerCall(client, http.MethodDelete, api+"/current-api-session", headers, nil, nil); err != nil {
+		log.Warnf("could not remove the api session of the enrollment test of %s: %v", path, err)
+	}
+	return nil
+}
+
+// controllerClient returns a client which authenticates with the certificate of the identity and dials the controller
+// the same way identities are loaded
+var controllerClient = func(sdkId identity.Identity) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig: sdkId.ClientTLSConfig(),
+		DialContext:     controllerDialer().DialContext,
+	}
+	return &http.Client{Timeout: controllerDialTimeout(), Transport: transport}
+}
+
+// controllerCall sends a request to the edge api of a controller and decodes the json response into out when it is set.
+// in is sent as the json body of a POST, an empty object is sent when it is nil
+func controllerCall(client *http.Client, method string, url string, headers http.Header, in interface{}, out interface{}) error {
+	var body io.Reader
+	if method == http.MethodPost {
+		if in == nil {
+			body = bytes.NewBufferString("{}")
+		} else {
+			data, err := json.Marshal(in)
+			if err != nil {
+				return err
+			}
+			body = bytes.NewBuffer(data)
+		}
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s", method, req.URL.Path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
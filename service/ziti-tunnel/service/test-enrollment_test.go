@@ -0,0 +1,109 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/foundation/identity/identity"
+	idcfg "github.com/openziti/sdk-golang/ziti/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeController answers the edge api calls of the enrollment test, authenticate answers with authStatus
+func fakeController(t *testing.T, authStatus int) (*httptest.Server, *[]string) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/version":
+			_, _ = w.Write([]byte(`{"data":{"version":"v0.19.0"}}`))
+		case "/authenticate":
+			w.WriteHeader(authStatus)
+			_, _ = w.Write([]byte(`{"data":{"token":"session","identity":{"name":"controller name"}}}`))
+		case "/current-api-session":
+			if r.Header.Get("zt-session") != "session" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestTestEnrollment(t *testing.T) {
+	tests := []struct {
+		name        string
+		authStatus  int
+		allowed     []string
+		wantSuccess bool
+		wantCalls   int
+	}{
+		{"authenticated", http.StatusOK, nil, true, 3},
+		{"rejected", http.StatusUnauthorized, nil, false, 2},
+		{"controller not allowed", http.StatusOK, []string{"ctrl.example.com"}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, calls := fakeController(t, tt.authStatus)
+			saved := controllerClient
+			defer func() { controllerClient = saved }()
+			controllerClient = func(identity.Identity) *http.Client { return srv.Client() }
+
+			dir, err := ioutil.TempDir("", "test-enrollment")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			key, cert, _ := testIdentityPem(t)
+			data, err := json.Marshal(idcfg.Config{ZtAPI: srv.URL, ID: identity.IdentityConfig{Key: key, Cert: cert}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "id.json")
+			if err = ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{AllowedControllers: tt.allowed}}
+			got := rt.TestEnrollment(path)
+			if got.Success != tt.wantSuccess || (got.Error == "") != tt.wantSuccess {
+				t.Fatalf("TestEnrollment() = %+v, want success %t", got, tt.wantSuccess)
+			}
+			if got.Controller != srv.URL {
+				t.Errorf("Controller = %s, want %s", got.Controller, srv.URL)
+			}
+			if tt.wantSuccess && (got.Name != "controller name" || got.ControllerVersion != "v0.19.0") {
+				t.Errorf("TestEnrollment() = %+v, want the name and version from the controller", got)
+			}
+			if len(*calls) != tt.wantCalls {
+				t.Errorf("the controller got %v, want %d calls", *calls, tt.wantCalls)
+			}
+			if len(rt.ids) != 0 {
+				t.Errorf("the enrollment test loaded identities: %v", rt.ids)
+			}
+		})
+	}
+}
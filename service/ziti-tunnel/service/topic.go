@@ -17,26 +17,131 @@
 
 package service
 
+import (
+	"reflect"
+	"sync"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
 type topic struct {
 	broadcast chan interface{}
+	lock      sync.RWMutex // guards channels and filters
 	channels  map[string]chan interface{}
+	filters   map[string]dto.EventFilter // for the subscribers which only want some of the events
 	done      chan bool
 }
 
+// subscriber is a registered channel with its filter, as seen by run when an event is delivered
+type subscriber struct {
+	id       string
+	c        chan interface{}
+	filter   dto.EventFilter
+	filtered bool
+}
+
 func newTopic(cap int16) topic {
 	return topic{
 		broadcast: make(chan interface{}, cap),
 		channels:  make(map[string]chan interface{}, cap),
+		filters:   make(map[string]dto.EventFilter),
 		done:      make(chan bool, cap),
 	}
 }
 
+// resize replaces the broadcast channel with one of the given capacity. any queued events are kept. must be called
+// before run
+func (t *topic) resize(capacity int) {
+	if capacity == cap(t.broadcast) {
+		return
+	}
+	resized := make(chan interface{}, capacity)
+	for len(t.broadcast) > 0 && len(resized) < capacity {
+		resized <- <-t.broadcast
+	}
+	t.broadcast = resized
+}
+
 func (t *topic) register(id string, c chan interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	t.channels[id] = c
 }
 
 func (t *topic) unregister(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	delete(t.channels, id)
+	delete(t.filters, id)
+}
+
+// filter restricts the events delivered to the subscriber with the given id. an empty filter delivers everything.
+// the filter of a subscriber which is no longer registered is dropped
+func (t *topic) filter(id string, f dto.EventFilter) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, registered := t.channels[id]; !registered || (len(f.Fingerprints) == 0 && len(f.Ops) == 0) {
+		delete(t.filters, id)
+		return
+	}
+	t.filters[id] = f
+}
+
+// subscribers returns the registered channels with their filters so an event can be delivered without the lock
+func (t *topic) subscribers() []subscriber {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	subs := make([]subscriber, 0, len(t.channels))
+	for id, c := range t.channels {
+		f, filtered := t.filters[id]
+		subs = append(subs, subscriber{id: id, c: c, filter: f, filtered: filtered})
+	}
+	return subs
+}
+
+func (s subscriber) wants(msg interface{}) bool {
+	return !s.filtered || matchesFilter(s.filter, msg)
+}
+
+// matchesFilter returns true when the event is for one of the fingerprints and is one of the ops of the filter. events
+// which are not for a specific identity never match a fingerprint filter
+func matchesFilter(f dto.EventFilter, msg interface{}) bool {
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	if len(f.Ops) > 0 && !contains(f.Ops, stringField(v, "Op")) {
+		return false
+	}
+	if len(f.Fingerprints) > 0 {
+		fp := stringField(v, "Fingerprint")
+		if fp == "" {
+			if id := reflect.Indirect(v.FieldByName("Id")); id.Kind() == reflect.Struct {
+				fp = stringField(id, "FingerPrint")
+			}
+		}
+		if fp == "" || !contains(f.Fingerprints, fp) {
+			return false
+		}
+	}
+	return true
+}
+
+func stringField(v reflect.Value, name string) string {
+	f := v.FieldByName(name)
+	if f.IsValid() && f.Kind() == reflect.String {
+		return f.String()
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 func (t *topic) shutdown() {
@@ -48,11 +153,14 @@ func (t *topic) run() {
 		for {
 			select {
 			case msg := <-t.broadcast:
-				for id, c := range t.channels {
-					if len(c) == cap(c) {
-						log.Warnf("channel with id [%s] is about to block!", id)
+				for _, s := range t.subscribers() {
+					if !s.wants(msg) {
+						continue
+					}
+					if len(s.c) == cap(s.c) {
+						log.Warnf("channel with id [%s] is about to block!", s.id)
 					}
-					c <- msg
+					s.c <- msg
 				}
 				break
 			case <-t.done:
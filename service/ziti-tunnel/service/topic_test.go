@@ -0,0 +1,147 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	Op          string
+	Fingerprint string
+}
+
+func TestTopicFilter(t *testing.T) {
+	onlyAdded := dto.EventFilter{Ops: []string{"added"}}
+	tests := []struct {
+		name         string
+		register     bool
+		unregister   bool
+		filter       dto.EventFilter
+		wantFiltered bool
+	}{
+		{"registered", true, false, onlyAdded, true},
+		{"empty filter", true, false, dto.EventFilter{}, false},
+		{"never registered", false, false, onlyAdded, false},
+		{"unregistered before the filter arrived", true, true, onlyAdded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := newTopic(1)
+			if tt.register {
+				topic.register("a", make(chan interface{}, 1))
+			}
+			if tt.unregister {
+				topic.unregister("a")
+			}
+			topic.filter("a", tt.filter)
+			if _, filtered := topic.filters["a"]; filtered != tt.wantFiltered {
+				t.Errorf("filter stored = %t, want %t", filtered, tt.wantFiltered)
+			}
+		})
+	}
+}
+
+func TestTopicDeliversFilteredEvents(t *testing.T) {
+	topic := newTopic(4)
+	all := make(chan interface{}, 4)
+	added := make(chan interface{}, 4)
+	topic.register("all", all)
+	topic.register("added", added)
+	topic.filter("added", dto.EventFilter{Ops: []string{"added"}})
+	topic.run()
+	defer topic.shutdown()
+
+	topic.broadcast <- testEvent{Op: "removed"}
+	topic.broadcast <- testEvent{Op: "added"}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+			t.Fatalf("event %d was not delivered to the subscriber without a filter", i)
+		}
+	}
+	select {
+	case msg := <-added:
+		if msg.(testEvent).Op != "added" {
+			t.Errorf("got %v, want the added event", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the added event was not delivered to the filtered subscriber")
+	}
+	if len(added) != 0 {
+		t.Errorf("the filtered subscriber got %d more events", len(added))
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		f    dto.EventFilter
+		msg  interface{}
+		want bool
+	}{
+		{"op", dto.EventFilter{Ops: []string{"added"}}, testEvent{Op: "added"}, true},
+		{"other op", dto.EventFilter{Ops: []string{"added"}}, testEvent{Op: "removed"}, false},
+		{"fingerprint", dto.EventFilter{Fingerprints: []string{"fp"}}, &testEvent{Fingerprint: "fp"}, true},
+		{"identity fingerprint", dto.EventFilter{Fingerprints: []string{"fp"}}, dto.IdentityEvent{Id: dto.Identity{FingerPrint: "fp"}}, true},
+		{"no fingerprint", dto.EventFilter{Fingerprints: []string{"fp"}}, testEvent{Op: "added"}, false},
+		{"not a struct", dto.EventFilter{Ops: []string{"added"}}, "added", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesFilter(tt.f, tt.msg); got != tt.want {
+				t.Errorf("matchesFilter() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicResize(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		queued   int
+		resize   int
+		wantLen  int
+	}{
+		{"same capacity", 4, 2, 4, 2},
+		{"larger keeps every event", 4, 3, 8, 3},
+		{"smaller keeps what fits", 8, 6, 4, 4},
+		{"empty", 4, 0, 16, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := newTopic(int16(tt.capacity))
+			for i := 0; i < tt.queued; i++ {
+				topic.broadcast <- i
+			}
+			topic.resize(tt.resize)
+			if cap(topic.broadcast) != tt.resize || len(topic.broadcast) != tt.wantLen {
+				t.Fatalf("resized to %d/%d, want %d/%d", len(topic.broadcast), cap(topic.broadcast), tt.wantLen, tt.resize)
+			}
+			for i := 0; i < tt.wantLen; i++ {
+				if got := <-topic.broadcast; got != i {
+					t.Errorf("event %d = %v, want the events kept in order", i, got)
+				}
+			}
+		})
+	}
+}
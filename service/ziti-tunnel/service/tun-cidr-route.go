@@ -0,0 +1,71 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+)
+
+const (
+	TunCidrRouteAdd  = "add"  // add the route for the TUN cidr. the default
+	TunCidrRouteSkip = "skip" // leave the route for the TUN cidr to windows
+)
+
+// validTunCidrRoute returns an error when mode is not one of the TunCidrRoute values. empty is add
+func validTunCidrRoute(mode string) error {
+	switch mode {
+	case "", TunCidrRouteAdd, TunCidrRouteSkip:
+		return nil
+	}
+	return fmt.Errorf("unknown TunCidrRoute %s, it must be %s or %s", mode, TunCidrRouteAdd, TunCidrRouteSkip)
+}
+
+// addsTunCidrRoute reports if the route of the TUN cidr is added with the TunCidrRoute of the config. LoadConfig
+// has already replaced an unknown value with the default
+func (t *RuntimeState) addsTunCidrRoute() bool {
+	return t.state.TunCidrRoute != TunCidrRouteSkip
+}
+
+// setTunCidrRoute routes the TUN cidr to the TUN, using the network address as the next hop. nothing is added when
+// TunCidrRoute is skip or when the same route already exists
+func (t *RuntimeState) setTunCidrRoute(luid winipcfg.LUID, ipnet *net.IPNet) error {
+	if !t.addsTunCidrRoute() {
+		log.Infof("not setting routes for cidr: %s. TunCidrRoute is %s", ipnet.String(), TunCidrRouteSkip)
+		return nil
+	}
+
+	if existing, err := luid.Route(*ipnet, ipnet.IP); err == nil && existing != nil {
+		log.Infof("a route for cidr: %s. Next Hop: %s already exists. not adding it again", ipnet.String(), ipnet.IP.String())
+		return nil
+	}
+
+	log.Infof("setting routes for cidr: %s. Next Hop: %s", ipnet.String(), ipnet.IP.String())
+	err := luid.SetRoutes([]*winipcfg.RouteData{{Destination: *ipnet, NextHop: ipnet.IP, Metric: 0}})
+	if errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS) {
+		log.Infof("windows added the route for cidr: %s while it was being set. using the existing route", ipnet.String())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to SetRoutes: (%v)", err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"testing"
+)
+
+func TestTunCidrRoute(t *testing.T) {
+	tests := []struct {
+		mode    string
+		wantErr bool
+		adds    bool
+	}{
+		{"", false, true},
+		{TunCidrRouteAdd, false, true},
+		{TunCidrRouteSkip, false, false},
+		{"never", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			if err := validTunCidrRoute(tt.mode); (err != nil) != tt.wantErr {
+				t.Fatalf("validTunCidrRoute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			r := &RuntimeState{state: &dto.TunnelStatus{TunCidrRoute: tt.mode}}
+			if got := r.addsTunCidrRoute(); got != tt.adds {
+				t.Errorf("addsTunCidrRoute() = %t, want %t", got, tt.adds)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+	"sync"
+	"time"
+)
+
+// tunInterfaceSource reads the live state of an interface. liveInterface reads it from windows
+type tunInterfaceSource interface {
+	Interface() (*winipcfg.MibIfRow2, error)
+	Addresses() ([]net.IPNet, error)
+}
+
+type liveInterface struct {
+	winipcfg.LUID
+}
+
+// Addresses returns the unicast addresses assigned to the interface
+func (l liveInterface) Addresses() ([]net.IPNet, error) {
+	rows, err := winipcfg.GetUnicastIPAddressTable(windows.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]net.IPNet, 0)
+	for i := range rows {
+		if rows[i].InterfaceLUID != l.LUID {
+			continue
+		}
+		ip := rows[i].Address.IP()
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		addresses = append(addresses, net.IPNet{IP: ip, Mask: net.CIDRMask(int(rows[i].OnLinkPrefixLength), bits)})
+	}
+	return addresses, nil
+}
+
+// tunInterfaceCache keeps the live state of the TUN for TunInterfaceCacheTtl seconds, every status would otherwise
+// list the addresses of every adapter. it is invalidated when the TUN is created and when an interface changes
+type tunInterfaceCache struct {
+	sync.Mutex
+	details *dto.TunInterface
+	read    time.Time
+}
+
+var tunInterfaceDetails = &tunInterfaceCache{}
+
+func (c *tunInterfaceCache) get(now time.Time, read func() *dto.TunInterface) *dto.TunInterface {
+	c.Lock()
+	defer c.Unlock()
+	if c.details == nil || now.Sub(c.read) >= constants.TunInterfaceCacheTtl*time.Second || now.Before(c.read) {
+		c.details = read()
+		c.read = now
+	}
+	return c.details
+}
+
+func (c *tunInterfaceCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.details = nil
+}
+
+// TunInterface reports the live state of the TUN. nil is returned while there is no TUN
+func (t *RuntimeState) TunInterface() *dto.TunInterface {
+	if t.tun == nil {
+		return nil
+	}
+	native, ok := (*t.tun).(*tun.NativeTun)
+	if !ok {
+		return nil
+	}
+	return tunInterfaceDetails.get(time.Now(), func() *dto.TunInterface {
+		return readTunInterface(liveInterface{winipcfg.LUID(native.LUID())})
+	})
+}
+
+// readTunInterface maps what the source reports onto a dto.TunInterface. anything which cannot be read is reported
+// in Error instead of failing the whole status
+func readTunInterface(source tunInterfaceSource) *dto.TunInterface {
+	details := &dto.TunInterface{}
+	row, err := source.Interface()
+	if err != nil {
+		details.Error = fmt.Sprintf("could not read the interface: %v", err)
+		return details
+	}
+	details.Luid = uint64(row.InterfaceLUID)
+	details.Index = row.InterfaceIndex
+	details.Alias = row.Alias()
+	details.Mtu = row.MTU
+	details.OperStatus = operStatusName(row.OperStatus)
+
+	addresses, err := source.Addresses()
+	if err != nil {
+		details.Error = fmt.Sprintf("could not read the addresses of the interface: %v", err)
+		return details
+	}
+	for _, a := range addresses {
+		details.Addresses = append(details.Addresses, a.String())
+	}
+	return details
+}
+
+func operStatusName(status winipcfg.IfOperStatus) string {
+	switch status {
+	case winipcfg.IfOperStatusUp:
+		return "up"
+	case winipcfg.IfOperStatusDown:
+		return "down"
+	case winipcfg.IfOperStatusTesting:
+		return "testing"
+	case winipcfg.IfOperStatusDormant:
+		return "dormant"
+	case winipcfg.IfOperStatusNotPresent:
+		return "not present"
+	case winipcfg.IfOperStatusLowerLayerDown:
+		return "lower layer down"
+	default:
+		return "unknown"
+	}
+}
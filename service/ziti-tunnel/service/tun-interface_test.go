@@ -0,0 +1,96 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTunInterfaceCache(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name       string
+		invalidate bool
+		after      time.Duration
+		wantReads  int
+	}{
+		{"cached", false, time.Second, 1},
+		{"expired", false, 10 * time.Second, 2},
+		{"clock went back", false, -time.Second, 2},
+		{"invalidated", true, time.Second, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &tunInterfaceCache{}
+			reads := 0
+			read := func() *dto.TunInterface {
+				reads++
+				return &dto.TunInterface{Mtu: uint32(reads)}
+			}
+			c.get(start, read)
+			if tt.invalidate {
+				c.invalidate()
+			}
+			got := c.get(start.Add(tt.after), read)
+			if reads != tt.wantReads || got.Mtu != uint32(tt.wantReads) {
+				t.Errorf("got %d reads and mtu %d, want %d", reads, got.Mtu, tt.wantReads)
+			}
+		})
+	}
+}
+
+type fakeTunInterface struct {
+	row          *winipcfg.MibIfRow2
+	rowErr       error
+	addresses    []net.IPNet
+	addressesErr error
+}
+
+func (f fakeTunInterface) Interface() (*winipcfg.MibIfRow2, error) { return f.row, f.rowErr }
+func (f fakeTunInterface) Addresses() ([]net.IPNet, error)         { return f.addresses, f.addressesErr }
+
+func TestReadTunInterface(t *testing.T) {
+	row := &winipcfg.MibIfRow2{InterfaceLUID: 7, InterfaceIndex: 3, MTU: 1400, OperStatus: winipcfg.IfOperStatusUp}
+	_, tunNet, _ := net.ParseCIDR("100.64.0.1/10")
+	tunNet.IP = net.ParseIP("100.64.0.1").To4()
+	tests := []struct {
+		name   string
+		source fakeTunInterface
+		want   *dto.TunInterface
+	}{
+		{"interface fails", fakeTunInterface{rowErr: errors.New("gone")},
+			&dto.TunInterface{Error: "could not read the interface: gone"}},
+		{"addresses fail", fakeTunInterface{row: row, addressesErr: errors.New("busy")},
+			&dto.TunInterface{Luid: 7, Index: 3, Mtu: 1400, OperStatus: "up", Error: "could not read the addresses of the interface: busy"}},
+		{"read", fakeTunInterface{row: row, addresses: []net.IPNet{*tunNet}},
+			&dto.TunInterface{Luid: 7, Index: 3, Mtu: 1400, OperStatus: "up", Addresses: []string{"100.64.0.1/10"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readTunInterface(tt.source); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
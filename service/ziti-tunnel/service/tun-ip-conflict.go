@@ -0,0 +1,126 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+	"strings"
+)
+
+const (
+	TunIpConflictKeep = "keep" // use the address anyway and only warn. the default
+	TunIpConflictFail = "fail" // refuse to create the TUN
+	TunIpConflictNext = "next" // use the next free address in the TUN subnet
+)
+
+// validTunIpConflict returns an error when mode is not one of the TunIpConflict values. empty is keep
+func validTunIpConflict(mode string) error {
+	switch mode {
+	case "", TunIpConflictKeep, TunIpConflictFail, TunIpConflictNext:
+		return nil
+	}
+	return fmt.Errorf("unknown TunIpConflict %s, it must be %s, %s or %s", mode, TunIpConflictKeep, TunIpConflictFail, TunIpConflictNext)
+}
+
+// resolveTunIpConflict checks the addresses of every other adapter against the TUN address. an adapter with the same
+// address is resolved according to TunIpConflict, an adapter with an overlapping subnet is only logged. returns the
+// address the TUN should use
+func (t *RuntimeState) resolveTunIpConflict(tunLuid winipcfg.LUID, ip net.IP, ipnet *net.IPNet) (net.IP, error) {
+	rows, err := winipcfg.GetUnicastIPAddressTable(windows.AF_INET)
+	if err != nil {
+		log.Warnf("could not list the adapter addresses to check for a TUN address conflict: %v", err)
+		return ip, nil
+	}
+	used := make(map[string]bool)
+	duplicate := false
+	for i := range rows {
+		row := &rows[i]
+		if row.InterfaceLUID == tunLuid {
+			continue
+		}
+		addr := row.Address.IP()
+		if addr == nil {
+			continue
+		}
+		used[addr.String()] = true
+		other := net.IPNet{IP: addr.Mask(net.CIDRMask(int(row.OnLinkPrefixLength), 32)), Mask: net.CIDRMask(int(row.OnLinkPrefixLength), 32)}
+		if addr.Equal(ip) {
+			log.Warnf("the TUN address %s is already assigned to the adapter with index %d", ip, row.InterfaceIndex)
+			duplicate = true
+		} else if ipnet.Contains(addr) || other.Contains(ip) {
+			log.Warnf("the TUN subnet %s overlaps %s assigned to the adapter with index %d. routing may not work as expected", ipnet, other.String(), row.InterfaceIndex)
+		}
+	}
+	if !duplicate {
+		return ip, nil
+	}
+
+	switch t.state.TunIpConflict {
+	case TunIpConflictFail:
+		return nil, fmt.Errorf("the TUN address %s is already assigned to another adapter. set TunIpConflict to %s to use the next free address", ip, TunIpConflictNext)
+	case TunIpConflictNext:
+	default:
+		log.Warn(recordWarning(WarningTun, "the TUN address %s is already assigned to another adapter and is used anyway. set TunIpConflict to %s to use the next free address",
+			ip, TunIpConflictNext))
+		return ip, nil
+	}
+	next := nextFreeIp(ip, ipnet, used)
+	if next == nil {
+		return nil, fmt.Errorf("the TUN address %s is already assigned to another adapter and there is no free address in %s", ip, ipnet)
+	}
+	log.Infof("the TUN address %s is already assigned to another adapter. using %s instead", ip, next)
+	return next, nil
+}
+
+// UpdateTunIpConflict sets what is done when the TUN address is assigned to another adapter. applied the next time
+// the TUN is created
+func (t *RuntimeState) UpdateTunIpConflict(mode string) error {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if err := validTunIpConflict(mode); err != nil {
+		return err
+	}
+	log.Infof("setting tun ip conflict : %s", mode)
+	t.state.TunIpConflict = mode
+	t.SaveState()
+	return nil
+}
+
+// nextFreeIp returns the first address after ip, wrapping around, in ipnet which is not used. network and broadcast
+// addresses are never returned
+func nextFreeIp(ip net.IP, ipnet *net.IPNet, used map[string]bool) net.IP {
+	ones, bits := ipnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	network := binary.BigEndian.Uint32(ipnet.IP.To4())
+	start := binary.BigEndian.Uint32(ip.To4()) - network
+	for i := uint32(1); i < size; i++ {
+		offset := (start + i) % size
+		if offset == 0 || offset == size-1 {
+			continue
+		}
+		candidate := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(candidate, network+offset)
+		if !used[candidate.String()] {
+			return candidate
+		}
+	}
+	return nil
+}
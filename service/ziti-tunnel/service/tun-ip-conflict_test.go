@@ -0,0 +1,74 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUpdateTunIpConflict(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"keep", TunIpConflictKeep, false},
+		{" Next ", TunIpConflictNext, false},
+		{"fail", TunIpConflictFail, false},
+		{"skip", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			useMemoryStateStore(t)
+			err := rts.UpdateTunIpConflict(tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UpdateTunIpConflict() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if rts.state.TunIpConflict != tt.want {
+				t.Errorf("TunIpConflict = %s, want %s", rts.state.TunIpConflict, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextFreeIp(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("100.64.0.0/30")
+	tests := []struct {
+		name string
+		ip   string
+		used []string
+		want string
+	}{
+		{"next address", "100.64.0.1", nil, "100.64.0.2"},
+		{"wraps around past the broadcast address", "100.64.0.2", nil, "100.64.0.1"},
+		{"all used", "100.64.0.1", []string{"100.64.0.2", "100.64.0.1"}, "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := map[string]bool{tt.ip: true}
+			for _, u := range tt.used {
+				used[u] = true
+			}
+			if got := nextFreeIp(net.ParseIP(tt.ip), ipnet, used); got.String() != tt.want {
+				t.Errorf("nextFreeIp() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+)
+
+// tunRoute is a route the tunneler added to the TUN, kept so it can be added again to a recreated TUN
+type tunRoute struct {
+	destination net.IPNet
+	nextHop     net.IP
+	metric      uint32
+}
+
+func routeKey(destination net.IPNet, nextHop net.IP) string {
+	return destination.String() + " via " + nextHop.String()
+}
+
+func (t *RuntimeState) recordRoute(destination net.IPNet, nextHop net.IP, metric uint32) {
+	t.routesLock.Lock()
+	defer t.routesLock.Unlock()
+	if t.routes == nil {
+		t.routes = make(map[string]tunRoute)
+	}
+	t.routes[routeKey(destination, nextHop)] = tunRoute{destination: destination, nextHop: nextHop, metric: metric}
+}
+
+// hasRoute reports if the route was added to the TUN and not removed since
+func (t *RuntimeState) hasRoute(destination net.IPNet, nextHop net.IP) bool {
+	t.routesLock.Lock()
+	defer t.routesLock.Unlock()
+	_, found := t.routes[routeKey(destination, nextHop)]
+	return found
+}
+
+func (t *RuntimeState) forgetRoute(destination net.IPNet, nextHop net.IP) {
+	t.routesLock.Lock()
+	defer t.routesLock.Unlock()
+	delete(t.routes, routeKey(destination, nextHop))
+}
+
+// tunWriteFailing is called when writes to the TUN keep failing. the TUN is recreated when TunAutoRecover is set
+func (t *RuntimeState) tunWriteFailing(failures int, err error) {
+	reason := fmt.Sprintf("%d writes to the TUN failed within %d seconds: %v", failures, constants.TunWriteFailureWindow, err)
+	log.Errorf("the TUN is not working: %s", reason)
+	t.BroadcastEvent(dto.TunnelDegradedEvent{
+		ActionEvent: dto.TUN_WRITE_FAILING,
+		Reason:      reason,
+	})
+	if !t.state.TunAutoRecover {
+		log.Warn("automatic recovery of the TUN is off. restart the service to recreate the TUN")
+		return
+	}
+	if err := t.RecreateTun(); err != nil {
+		log.Errorf("could not recreate the TUN: %v", err)
+	}
+}
+
+// RecreateTun closes the TUN and creates it again with the same address, dns and routes, without reloading the
+// identities. packets sent while it is recreated are lost
+func (t *RuntimeState) RecreateTun() error {
+	log.Warnf("recreating TUN device: %s", TunName)
+	return cziti.ReplaceTunDevice(func(old tun.Device) (tun.Device, error) {
+		if err := old.Close(); err != nil {
+			log.Warnf("could not close the TUN before recreating it: %v", err)
+		}
+		_, dev, err := t.CreateTun(t.state.TunIpv4, t.state.TunIpv4Mask, t.state.AddDns)
+		if err != nil {
+			return nil, err
+		}
+		t.restoreRoutes()
+		return *dev, nil
+	})
+}
+
+func (t *RuntimeState) restoreRoutes() {
+	luid := winipcfg.LUID((*t.tun).(*tun.NativeTun).LUID())
+	t.routesLock.Lock()
+	defer t.routesLock.Unlock()
+	for _, r := range t.routes {
+		if err := luid.AddRoute(r.destination, r.nextHop, r.metric); err != nil {
+			log.Warnf("could not add route %s back to the recreated TUN: %v", routeKey(r.destination, r.nextHop), err)
+		}
+	}
+	log.Infof("added %d routes back to the recreated TUN", len(t.routes))
+}
@@ -3,11 +3,25 @@ package service
 import (
 	"github.com/openziti/desktop-edge-win/service/cziti"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"sync"
 )
 
 type Id struct {
 	dto.Identity
 	CId *cziti.ZIdentity
+
+	metricsLock sync.Mutex // guards Metrics, it is replaced each time the metrics are read
+}
+
+// metrics returns a copy of the last metrics read, nil if they were never read
+func (id *Id) metrics() *dto.Metrics {
+	id.metricsLock.Lock()
+	defer id.metricsLock.Unlock()
+	if id.Metrics == nil {
+		return nil
+	}
+	m := *id.Metrics
+	return &m
 }
 
 type WindowsEvents struct {
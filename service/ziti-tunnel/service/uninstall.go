@@ -0,0 +1,132 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/windns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// PrepareUninstall removes everything the tunnel has applied to the machine so an uninstaller can remove the service
+// cleanly: routes, nrpt rules, the interface dns and the TUN itself. identities are never removed. when export is set
+// the config and the identity files are first copied to config.UninstallExportPath, which only SYSTEM and the
+// administrators can read. safe to call when the TUN is already down
+func (t *RuntimeState) PrepareUninstall(export bool) []dto.CleanupResult {
+	results := make([]dto.CleanupResult, 0)
+	if export {
+		exportDir := config.UninstallExportPath()
+		results = append(results, cleanupResult("ExportConfig", exportDir, t.exportConfig(exportDir)))
+	}
+
+	if t.tun != nil {
+		log.Info("prepare uninstall: removing the routes from the TUN")
+		results = append(results, cleanupResult("RemoveRoutes", TunName, flushTunRoutes(*t.tun)))
+
+		log.Info("prepare uninstall: releasing the interface dns")
+		results = append(results, cleanupResult("ReleaseDns", TunName, releaseTunDns(*t.tun)))
+	} else {
+		log.Info("prepare uninstall: the TUN is already down. no routes or interface dns to remove")
+	}
+
+	log.Info("prepare uninstall: removing the nrpt rules")
+	results = append(results, cleanupResult("RemoveNrptRules", "", removeNrptRules()))
+	results = append(results, cleanupResult("RemoveAdapterProfiles", "", removeAdapterProfiles()))
+
+	closeTun(t)
+	var err error
+	if remaining := removeZitiTunAdapters(TunName); len(remaining) > 0 {
+		err = fmt.Errorf("adapters still present: %v", remaining)
+	}
+	results = append(results, cleanupResult("RemoveTun", TunName, err))
+	return results
+}
+
+// the steps of PrepareUninstall which change the machine, replaced in tests
+var (
+	flushTunRoutes = func(device tun.Device) error {
+		luid := winipcfg.LUID(device.(*tun.NativeTun).LUID())
+		if err := luid.FlushRoutes(windows.AF_INET); err != nil {
+			return err
+		}
+		return luid.FlushRoutes(windows.AF_INET6)
+	}
+	releaseTunDns = func(device tun.Device) error {
+		return winipcfg.LUID(device.(*tun.NativeTun).LUID()).FlushDNS(windows.AF_INET)
+	}
+	removeNrptRules       = windns.RemoveAllNrptRules
+	removeAdapterProfiles = windns.CleanUpNetworkAdapterProfile
+	closeTun              = func(t *RuntimeState) { t.Close() }
+	// removeZitiTunAdapters returns the adapters still present after the cleanup
+	removeZitiTunAdapters = func(tunName string) []string {
+		CleanUpZitiTUNAdapters(tunName)
+		return CleanUpZitiTUNAdaptersDryRun(tunName)
+	}
+)
+
+func cleanupResult(step string, target string, err error) dto.CleanupResult {
+	result := dto.CleanupResult{Step: step, Target: target, Ok: err == nil}
+	if err != nil {
+		log.Warnf("prepare uninstall: %s failed: %v", step, err)
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (t *RuntimeState) exportConfig(exportDir string) error {
+	if err := os.MkdirAll(exportDir, 0700); err != nil {
+		return err
+	}
+	if err := applySddl(exportDir, secureFolderSddl); err != nil {
+		return fmt.Errorf("could not secure the export folder %s: %v", exportDir, err)
+	}
+	if err := exportState(filepath.Join(exportDir, filepath.Base(config.File()))); err != nil {
+		return err
+	}
+	files := t.identityFiles()
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(filepath.Join(exportDir, filepath.Base(f)), b, 0600); err != nil {
+			return err
+		}
+	}
+	log.Infof("prepare uninstall: exported the config and %d identity files to %s", len(files), exportDir)
+	return nil
+}
+
+func exportState(target string) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = stateStore.Export(f); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("could not export the config: %v", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"golang.zx2c4.com/wireguard/tun"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCleanupResult(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want dto.CleanupResult
+	}{
+		{"step succeeded", nil, dto.CleanupResult{Step: "RemoveTun", Target: TunName, Ok: true}},
+		{"step failed", errors.New("adapters still present"), dto.CleanupResult{Step: "RemoveTun", Target: TunName, Error: "adapters still present"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanupResult("RemoveTun", TunName, tt.err); got != tt.want {
+				t.Errorf("cleanupResult() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		idFiles   []string
+		wantErr   bool
+		wantFiles []string
+	}{
+		{"config only", nil, false, []string{"config.json"}},
+		{"config and identities", []string{"fp1", "fp2"}, false, []string{"config.json", "fp1.json", "fp2.json"}},
+		{"identity file missing", []string{"missing"}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempConfigDir(t)
+			if err := ioutil.WriteFile(config.File(), []byte(`{"TunIpv4":"100.64.0.1"}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+			rt := &RuntimeState{ids: make(map[string]*Id)}
+			for _, fp := range tt.idFiles {
+				id := &Id{Identity: dto.Identity{FingerPrint: fp}}
+				rt.ids[fp] = id
+				if fp != "missing" {
+					if err := ioutil.WriteFile(id.Path(), []byte(`{"ztAPI":"https://ctrl:1280"}`), 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			exportDir := filepath.Join(config.Path(), "export")
+
+			err := rt.exportConfig(exportDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("exportConfig() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			for _, f := range tt.wantFiles {
+				exported, err := ioutil.ReadFile(filepath.Join(exportDir, f))
+				if err != nil {
+					t.Errorf("%s was not exported: %v", f, err)
+					continue
+				}
+				original, _ := ioutil.ReadFile(filepath.Join(config.Path(), f))
+				if string(exported) != string(original) {
+					t.Errorf("exported %s = %q, want %q", f, exported, original)
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareUninstall(t *testing.T) {
+	savedFlush, savedRelease, savedNrpt, savedProfiles, savedClose, savedAdapters :=
+		flushTunRoutes, releaseTunDns, removeNrptRules, removeAdapterProfiles, closeTun, removeZitiTunAdapters
+	defer func() {
+		flushTunRoutes, releaseTunDns, removeNrptRules, removeAdapterProfiles, closeTun, removeZitiTunAdapters =
+			savedFlush, savedRelease, savedNrpt, savedProfiles, savedClose, savedAdapters
+	}()
+
+	tests := []struct {
+		name      string
+		tunUp     bool
+		nrptErr   error
+		wantCalls []string
+		want      []dto.CleanupResult
+	}{
+		{
+			name:      "TUN up",
+			tunUp:     true,
+			wantCalls: []string{"flushRoutes", "releaseDns", "removeNrptRules", "removeAdapterProfiles", "closeTun", "removeAdapters"},
+			want: []dto.CleanupResult{
+				{Step: "RemoveRoutes", Target: TunName, Ok: true},
+				{Step: "ReleaseDns", Target: TunName, Ok: true},
+				{Step: "RemoveNrptRules", Ok: true},
+				{Step: "RemoveAdapterProfiles", Ok: true},
+				{Step: "RemoveTun", Target: TunName, Ok: true},
+			},
+		},
+		{
+			name:      "TUN already down",
+			wantCalls: []string{"removeNrptRules", "removeAdapterProfiles", "closeTun", "removeAdapters"},
+			want: []dto.CleanupResult{
+				{Step: "RemoveNrptRules", Ok: true},
+				{Step: "RemoveAdapterProfiles", Ok: true},
+				{Step: "RemoveTun", Target: TunName, Ok: true},
+			},
+		},
+		{
+			name:      "nrpt rules not removed",
+			nrptErr:   errors.New("powershell failed"),
+			wantCalls: []string{"removeNrptRules", "removeAdapterProfiles", "closeTun", "removeAdapters"},
+			want: []dto.CleanupResult{
+				{Step: "RemoveNrptRules", Error: "powershell failed"},
+				{Step: "RemoveAdapterProfiles", Ok: true},
+				{Step: "RemoveTun", Target: TunName, Ok: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			flushTunRoutes = func(tun.Device) error { calls = append(calls, "flushRoutes"); return nil }
+			releaseTunDns = func(tun.Device) error { calls = append(calls, "releaseDns"); return nil }
+			removeNrptRules = func() error { calls = append(calls, "removeNrptRules"); return tt.nrptErr }
+			removeAdapterProfiles = func() error { calls = append(calls, "removeAdapterProfiles"); return nil }
+			closeTun = func(*RuntimeState) { calls = append(calls, "closeTun") }
+			removeZitiTunAdapters = func(string) []string { calls = append(calls, "removeAdapters"); return nil }
+
+			rt := &RuntimeState{}
+			if tt.tunUp {
+				var device tun.Device
+				rt.tun = &device
+			}
+			got := rt.PrepareUninstall(false)
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PrepareUninstall() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("adapters still present", func(t *testing.T) {
+		removeNrptRules = func() error { return nil }
+		removeAdapterProfiles = func() error { return nil }
+		closeTun = func(*RuntimeState) {}
+		removeZitiTunAdapters = func(string) []string { return []string{TunName} }
+
+		got := (&RuntimeState{}).PrepareUninstall(false)
+		last := got[len(got)-1]
+		if last.Step != "RemoveTun" || last.Ok || last.Error == "" {
+			t.Errorf("RemoveTun result = %+v, want a failure", last)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"sync"
+	"time"
+)
+
+const (
+	WarningConfig   = "config"
+	WarningTun      = "tun"
+	WarningDns      = "dns"
+	WarningIdentity = "identity"
+)
+
+// warningCollector keeps the last warnings so they can be shown without reading the logs
+type warningCollector struct {
+	lock     sync.Mutex
+	warnings []dto.Warning
+	max      int
+}
+
+var warnings = &warningCollector{max: constants.MaxWarnings}
+
+// recordWarning keeps the warning and returns its message so it can be logged where it happened:
+//
+//	log.Warn(recordWarning(WarningConfig, "mask %d was changed", mask))
+func recordWarning(category string, format string, args ...interface{}) string {
+	msg := fmt.Sprintf(format, args...)
+	warnings.add(category, msg, time.Now())
+	return msg
+}
+
+func (c *warningCollector) add(category string, msg string, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.warnings) >= c.max {
+		c.warnings = append(c.warnings[:0], c.warnings[len(c.warnings)-c.max+1:]...)
+	}
+	c.warnings = append(c.warnings, dto.Warning{Category: category, Message: msg, Time: now})
+}
+
+// Warnings returns the warnings recorded since the last ClearWarnings, oldest first
+func (t *RuntimeState) Warnings() []dto.Warning {
+	warnings.lock.Lock()
+	defer warnings.lock.Unlock()
+	return append([]dto.Warning{}, warnings.warnings...)
+}
+
+// ClearWarnings forgets the recorded warnings and returns how many there were
+func (t *RuntimeState) ClearWarnings() int {
+	warnings.lock.Lock()
+	defer warnings.lock.Unlock()
+	n := len(warnings.warnings)
+	warnings.warnings = nil
+	return n
+}
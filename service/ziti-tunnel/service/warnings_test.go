@@ -0,0 +1,86 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+)
+
+func TestWarningCollectorBounded(t *testing.T) {
+	c := &warningCollector{max: 3}
+	now := time.Now()
+	for _, msg := range []string{"a", "b", "c", "d", "e"} {
+		c.add(WarningConfig, msg, now)
+	}
+	var got []string
+	for _, w := range c.warnings {
+		got = append(got, w.Message)
+	}
+	if strings.Join(got, ",") != "c,d,e" {
+		t.Errorf("kept warnings %v, want the last 3", got)
+	}
+}
+
+func TestClampedMaskWarning(t *testing.T) {
+	store := useMemoryStateStore(t)
+	rts.ClearWarnings()
+	defer rts.ClearWarnings()
+
+	tests := []struct {
+		name         string
+		ipv4         string
+		mask         int
+		wantIpv4     string
+		wantMask     int
+		wantWarnings int
+	}{
+		{"valid", "100.64.0.1", 16, "100.64.0.1", 16, 0},
+		{"default ip", "", 16, constants.Ipv4ip, 16, 0},
+		{"mask too large", "100.64.0.1", 8, "100.64.0.1", constants.Ipv4DefaultMask, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rts.ClearWarnings()
+			rts.state.TunIpv4, rts.state.TunIpv4Mask = tt.ipv4, tt.mask
+			ipv4, mask := rts.clampTunAddress(tt.ipv4, tt.mask)
+			if ipv4 != tt.wantIpv4 || mask != tt.wantMask {
+				t.Errorf("clampTunAddress() = %s/%d, want %s/%d", ipv4, mask, tt.wantIpv4, tt.wantMask)
+			}
+			if rts.state.TunIpv4 != tt.wantIpv4 || rts.state.TunIpv4Mask != tt.wantMask {
+				t.Errorf("the state has %s/%d, want %s/%d", rts.state.TunIpv4, rts.state.TunIpv4Mask, tt.wantIpv4, tt.wantMask)
+			}
+			warned := rts.Warnings()
+			if len(warned) != tt.wantWarnings {
+				t.Fatalf("recorded %d warnings, want %d", len(warned), tt.wantWarnings)
+			}
+			if tt.wantWarnings > 0 && warned[0].Category != WarningTun {
+				t.Errorf("the warning has category %s, want %s", warned[0].Category, WarningTun)
+			}
+			if n := rts.ClearWarnings(); n != tt.wantWarnings || len(rts.Warnings()) != 0 {
+				t.Errorf("ClearWarnings() = %d, the warnings were not cleared", n)
+			}
+		})
+	}
+	if store.saves == 0 {
+		t.Errorf("the clamped address was not saved")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"net"
+	"strings"
+)
+
+const netbtInterfacesKey = `SYSTEM\CurrentControlSet\Services\NetBT\Parameters\Interfaces\Tcpip_`
+
+// the NetbiosOptions of an interface
+const (
+	netbiosDefault  = 0 // from dhcp
+	netbiosDisabled = 2
+)
+
+// netbtLayer sets the wins servers and netbios of an interface, an interface so that it can be swapped out
+type netbtLayer interface {
+	apply(guid *windows.GUID, servers []string, disableNetbios bool) error
+}
+
+// netbtRegistry keeps the netbios settings of the interfaces in the registry where NetBT reads them
+type netbtRegistry struct{}
+
+var netbt netbtLayer = netbtRegistry{}
+
+func (netbtRegistry) apply(guid *windows.GUID, servers []string, disableNetbios bool) error {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, netbtInterfacesKey+guid.String(), registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("could not open the netbios settings of the interface: %v", err)
+	}
+	defer k.Close()
+	if len(servers) > 0 {
+		err = k.SetStringsValue("NameServerList", servers)
+	} else if err = k.DeleteValue("NameServerList"); err == registry.ErrNotExist {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not set the wins servers of the interface: %v", err)
+	}
+	options := uint32(netbiosDefault)
+	if disableNetbios {
+		options = netbiosDisabled
+	}
+	if err = k.SetDWordValue("NetbiosOptions", options); err != nil {
+		return fmt.Errorf("could not set the netbios option of the interface: %v", err)
+	}
+	return nil
+}
+
+// applyWins sets the wins servers of the TUN interface and disables netbios on it when disableNetbios is set
+func applyWins(luid winipcfg.LUID, servers []string, disableNetbios bool) error {
+	guid, err := luid.GUID()
+	if err != nil {
+		return err
+	}
+	return netbt.apply(guid, servers, disableNetbios)
+}
+
+// normalizeWinsServers validates and dedupes the wins servers, which must be ipv4 addresses of a host
+func normalizeWinsServers(servers []string) ([]string, error) {
+	seen := make(map[string]bool)
+	cleaned := make([]string, 0, len(servers))
+	for _, s := range servers {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+			return nil, fmt.Errorf("invalid wins server: %s", s)
+		}
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			cleaned = append(cleaned, ip.String())
+		}
+	}
+	return cleaned, nil
+}
+
+// SetWins validates the wins servers, applies them and the netbios option to the TUN interface and saves them so
+// they are applied again when the TUN is created
+func (t *RuntimeState) SetWins(servers []string, disableNetbios bool) ([]string, error) {
+	cleaned, err := normalizeWinsServers(servers)
+	if err != nil {
+		return nil, err
+	}
+	if t.tun != nil {
+		nativeTunDevice := (*t.tun).(*tun.NativeTun)
+		if err = applyWins(winipcfg.LUID(nativeTunDevice.LUID()), cleaned, disableNetbios); err != nil {
+			return nil, fmt.Errorf("could not set the wins servers on the TUN: %v", err)
+		}
+	}
+	log.Infof("setting wins servers: %v, netbios disabled: %t", cleaned, disableNetbios)
+	t.state.WinsServers = cleaned
+	t.state.DisableNetbios = disableNetbios
+	t.SaveState()
+	return cleaned, nil
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeWinsServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []string
+		want    []string
+		wantErr bool
+	}{
+		{"none", nil, []string{}, false},
+		{"trimmed and deduped", []string{" 10.0.0.1", "10.0.0.2", "", "10.0.0.1 "}, []string{"10.0.0.1", "10.0.0.2"}, false},
+		{"not an address", []string{"wins.example"}, nil, true},
+		{"ipv6", []string{"fd00::1"}, nil, true},
+		{"loopback", []string{"127.0.0.1"}, nil, true},
+		{"unspecified", []string{"0.0.0.0"}, nil, true},
+		{"multicast", []string{"224.0.0.1"}, nil, true},
+		{"broadcast", []string{"255.255.255.255"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeWinsServers(tt.servers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeWinsServers(%v) error = %v, wantErr %t", tt.servers, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeWinsServers(%v) = %v, want %v", tt.servers, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetWinsWithoutTun(t *testing.T) {
+	useTempConfigDir(t)
+	rt := &RuntimeState{ids: make(map[string]*Id), state: &dto.TunnelStatus{WinsServers: []string{"10.0.0.9"}}}
+
+	if _, err := rt.SetWins([]string{"not an address"}, true); err == nil {
+		t.Error("SetWins() accepted an invalid wins server")
+	}
+	if !reflect.DeepEqual(rt.state.WinsServers, []string{"10.0.0.9"}) || rt.state.DisableNetbios {
+		t.Errorf("an invalid wins server changed the state to %v, netbios disabled %t", rt.state.WinsServers, rt.state.DisableNetbios)
+	}
+
+	// the servers are saved to be applied when the TUN is created
+	got, err := rt.SetWins([]string{"10.0.0.1", "10.0.0.1"}, true)
+	if err != nil {
+		t.Fatalf("SetWins() error = %v", err)
+	}
+	if want := []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) || !reflect.DeepEqual(rt.state.WinsServers, want) {
+		t.Errorf("SetWins() = %v with the state at %v, want %v", got, rt.state.WinsServers, want)
+	}
+	if !rt.state.DisableNetbios {
+		t.Error("DisableNetbios was not saved")
+	}
+}
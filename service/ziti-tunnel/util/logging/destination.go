@@ -0,0 +1,171 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logging
+
+import (
+	"fmt"
+	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRotationHours = 24
+	defaultRotationCount = 7
+)
+
+// swappableSink is the log file writer shared by both loggers. the writer is only replaced while holding the lock
+// so a record is either written to the old file or to the new one
+type swappableSink struct {
+	mu   sync.Mutex
+	w    io.Writer
+	path string
+
+	rotationHours int
+	rotationCount int
+	maxSizeMb     int // 0 rotates on time only
+}
+
+var fileSink swappableSink
+
+func (s *swappableSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return len(p), nil
+	}
+	return s.w.Write(p)
+}
+
+// newRotateLogs rotates the log file every rotationHours and, when maxSizeMb is set, as soon as it grows past
+// maxSizeMb. a file rotated on size continues as .1, .2, etc. only the newest rotationCount files are kept
+func newRotateLogs(path string, rotationHours int, rotationCount int, maxSizeMb int) (*rotatelogs.RotateLogs, error) {
+	options := []rotatelogs.Option{
+		rotatelogs.WithRotationTime(time.Duration(rotationHours) * time.Hour),
+		rotatelogs.WithRotationCount(uint(rotationCount)),
+		rotatelogs.WithLinkName(path),
+	}
+	if maxSizeMb > 0 {
+		options = append(options, rotatelogs.WithRotationSize(int64(maxSizeMb)*1024*1024))
+	}
+	return rotatelogs.New(path+".%Y%m%d%H%M.log", options...)
+}
+
+// LogFilePath returns the file the logs are currently written to
+func LogFilePath() string {
+	fileSink.mu.Lock()
+	defer fileSink.mu.Unlock()
+	return fileSink.path
+}
+
+// SetLogDestination moves the log file to path while the service runs. the folder is created and checked to be
+// writable before anything changes, the old file is closed once the new one is in place. zero rotation values use
+// the defaults of a new rotation every 24 hours keeping 7 files
+func SetLogDestination(path string, rotationHours int, rotationCount int) error {
+	if path == "" {
+		return fmt.Errorf("no log file given")
+	}
+	if rotationHours == 0 {
+		rotationHours = defaultRotationHours
+	}
+	if rotationCount == 0 {
+		rotationCount = defaultRotationCount
+	}
+	if rotationHours < 1 || rotationCount < 1 {
+		return fmt.Errorf("invalid log rotation: every %d hours keeping %d files", rotationHours, rotationCount)
+	}
+	if err := checkWritable(filepath.Dir(path)); err != nil {
+		return err
+	}
+	fileSink.mu.Lock()
+	maxSizeMb := fileSink.maxSizeMb
+	fileSink.mu.Unlock()
+
+	oldPath, err := openLogFile(path, rotationHours, rotationCount, maxSizeMb)
+	if err != nil {
+		return err
+	}
+	noFilenamelogger.Infof("log file moved from %s to %s. rotating every %d hours keeping %d files", oldPath, path, rotationHours, rotationCount)
+	return nil
+}
+
+// SetLogRotationSize rotates the current log file once it grows past maxSizeMb and keeps maxFiles files. a zero
+// maxSizeMb only rotates on time, a zero maxFiles keeps the current number of files
+func SetLogRotationSize(maxSizeMb int, maxFiles int) error {
+	if maxSizeMb < 0 || maxFiles < 0 {
+		return fmt.Errorf("invalid log rotation: %d MB keeping %d files", maxSizeMb, maxFiles)
+	}
+	fileSink.mu.Lock()
+	path := fileSink.path
+	rotationHours := fileSink.rotationHours
+	rotationCount := fileSink.rotationCount
+	fileSink.mu.Unlock()
+	if path == "" {
+		return fmt.Errorf("the logger is not initialized")
+	}
+	if maxFiles > 0 {
+		rotationCount = maxFiles
+	}
+
+	if _, err := openLogFile(path, rotationHours, rotationCount, maxSizeMb); err != nil {
+		return err
+	}
+	noFilenamelogger.Infof("log file %s rotates every %d hours or after %d MB keeping %d files", path, rotationHours, maxSizeMb, rotationCount)
+	return nil
+}
+
+// openLogFile replaces the log file writer and closes the old one. returns the path of the old log file
+func openLogFile(path string, rotationHours int, rotationCount int, maxSizeMb int) (string, error) {
+	rl, err := newRotateLogs(path, rotationHours, rotationCount, maxSizeMb)
+	if err != nil {
+		return "", fmt.Errorf("could not open log file %s: %v", path, err)
+	}
+
+	fileSink.mu.Lock()
+	old := fileSink.w
+	oldPath := fileSink.path
+	fileSink.w = rl
+	fileSink.path = path
+	fileSink.rotationHours = rotationHours
+	fileSink.rotationCount = rotationCount
+	fileSink.maxSizeMb = maxSizeMb
+	fileSink.mu.Unlock()
+
+	if c, ok := old.(io.Closer); ok {
+		_ = c.Close()
+	}
+	return oldPath, nil
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("could not create log folder %s: %v", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, ".write-check-")
+	if err != nil {
+		return fmt.Errorf("log folder %s is not writable: %v", dir, err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	_ = os.Remove(name)
+	return nil
+}
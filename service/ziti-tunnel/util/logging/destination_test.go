@@ -0,0 +1,107 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logging
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTempLogFile points the log file at a new folder for the test and puts the old sink back afterwards
+func useTempLogFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "log-folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileSink.mu.Lock()
+	w, path, hours, count, size := fileSink.w, fileSink.path, fileSink.rotationHours, fileSink.rotationCount, fileSink.maxSizeMb
+	fileSink.mu.Unlock()
+	t.Cleanup(func() {
+		fileSink.mu.Lock()
+		current := fileSink.w
+		fileSink.w, fileSink.path, fileSink.rotationHours, fileSink.rotationCount, fileSink.maxSizeMb = w, path, hours, count, size
+		fileSink.mu.Unlock()
+		if c, ok := current.(io.Closer); ok && current != w {
+			_ = c.Close()
+		}
+		_ = os.RemoveAll(dir)
+	})
+	return filepath.Join(dir, "ziti-tunneler.log")
+}
+
+func TestSetLogRotationSize(t *testing.T) {
+	path := useTempLogFile(t)
+	fileSink.mu.Lock()
+	fileSink.path = ""
+	fileSink.mu.Unlock()
+	if err := SetLogRotationSize(10, 3); err == nil {
+		t.Error("SetLogRotationSize() accepted a logger which is not initialized")
+	}
+
+	if err := SetLogDestination(path, 12, 5); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		maxSizeMb int
+		maxFiles  int
+		wantErr   bool
+		wantSize  int
+		wantCount int
+	}{
+		{"size and files", 10, 3, false, 10, 3},
+		{"files kept when not set", 20, 0, false, 20, 3},
+		{"time only", 0, 0, false, 0, 3},
+		{"negative size", -1, 3, true, 0, 3},
+		{"negative files", 10, -1, true, 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := SetLogRotationSize(tt.maxSizeMb, tt.maxFiles)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetLogRotationSize(%d, %d) error = %v, wantErr %t", tt.maxSizeMb, tt.maxFiles, err, tt.wantErr)
+			}
+			fileSink.mu.Lock()
+			defer fileSink.mu.Unlock()
+			if fileSink.maxSizeMb != tt.wantSize || fileSink.rotationCount != tt.wantCount {
+				t.Errorf("rotation = %d MB keeping %d files, want %d MB keeping %d files",
+					fileSink.maxSizeMb, fileSink.rotationCount, tt.wantSize, tt.wantCount)
+			}
+			if fileSink.path != path || fileSink.rotationHours != 12 {
+				t.Errorf("the log file changed to %s rotating every %d hours", fileSink.path, fileSink.rotationHours)
+			}
+		})
+	}
+
+	// a later move of the log file keeps the size rotation
+	if err := SetLogRotationSize(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(filepath.Dir(path), "moved.log")
+	if err := SetLogDestination(moved, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	fileSink.mu.Lock()
+	defer fileSink.mu.Unlock()
+	if fileSink.path != moved || fileSink.maxSizeMb != 5 {
+		t.Errorf("after the move the log file is %s rotating after %d MB, want %s after 5 MB", fileSink.path, fileSink.maxSizeMb, moved)
+	}
+}
@@ -19,7 +19,6 @@ package logging
 
 import (
 	"fmt"
-	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
 	"github.com/mgutz/ansi"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/windows/svc/debug"
@@ -81,12 +80,15 @@ func initLogger(logger *logrus.Logger, level logrus.Level) {
 
 	logger.SetReportCaller(true)
 
-	rl, _ := rotatelogs.New(config.LogFile()+".%Y%m%d%H%M.log",
-		rotatelogs.WithRotationTime(24*time.Hour),
-		rotatelogs.WithRotationCount(7),
-		rotatelogs.WithLinkName(config.LogFile()))
+	if fileSink.w == nil {
+		rl, _ := newRotateLogs(config.LogFile(), defaultRotationHours, defaultRotationCount, 0)
+		fileSink.w = rl
+		fileSink.path = config.LogFile()
+		fileSink.rotationHours = defaultRotationHours
+		fileSink.rotationCount = defaultRotationCount
+	}
 
-	multiWriter := io.MultiWriter(rl, os.Stdout)
+	multiWriter := io.MultiWriter(&fileSink, os.Stdout)
 
 	logger.SetOutput(multiWriter)
 	if !loggerInitialized {
@@ -0,0 +1,86 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logging
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the number of log records kept in memory
+const recentLogSize = 1000
+
+// LogRecord is a log record kept in memory for the UI
+type LogRecord struct {
+	Time    time.Time
+	Level   string
+	Message string
+}
+
+// recentLogHook keeps the last recentLogSize records logged in a ring. the hook sees the same records which are
+// written to the log file
+type recentLogHook struct {
+	mu      sync.Mutex
+	records [recentLogSize]LogRecord
+	levels  [recentLogSize]logrus.Level
+	next    int
+	full    bool
+}
+
+var recentLogs = &recentLogHook{}
+
+func init() {
+	withFilenameLogger.AddHook(recentLogs)
+	noFilenamelogger.AddHook(recentLogs)
+}
+
+func (h *recentLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *recentLogHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records[h.next] = LogRecord{Time: entry.Time.UTC(), Level: entry.Level.String(), Message: entry.Message}
+	h.levels[h.next] = entry.Level
+	h.next = (h.next + 1) % recentLogSize
+	if h.next == 0 {
+		h.full = true
+	}
+	return nil
+}
+
+// RecentLogs returns up to n of the most recent log records at minLevel or more severe, newest first
+func RecentLogs(n int, minLevel logrus.Level) []LogRecord {
+	recentLogs.mu.Lock()
+	defer recentLogs.mu.Unlock()
+	count := recentLogs.next
+	if recentLogs.full {
+		count = recentLogSize
+	}
+	result := make([]LogRecord, 0)
+	for i := 1; i <= count && len(result) < n; i++ {
+		idx := (recentLogs.next - i + recentLogSize) % recentLogSize
+		if recentLogs.levels[idx] <= minLevel {
+			result = append(result, recentLogs.records[idx])
+		}
+	}
+	return result
+}
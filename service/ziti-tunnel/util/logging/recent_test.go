@@ -0,0 +1,76 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logging
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+func TestRecentLogs(t *testing.T) {
+	saved := recentLogs
+	defer func() { recentLogs = saved }()
+	recentLogs = &recentLogHook{}
+
+	fire := func(level logrus.Level, msg string) {
+		if err := recentLogs.Fire(&logrus.Entry{Time: time.Now(), Level: level, Message: msg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fire(logrus.InfoLevel, "info")
+	fire(logrus.DebugLevel, "debug")
+	fire(logrus.WarnLevel, "warn")
+
+	messages := func(records []LogRecord) string {
+		m := make([]string, 0, len(records))
+		for _, r := range records {
+			m = append(m, r.Message)
+		}
+		return fmt.Sprint(m)
+	}
+	tests := []struct {
+		n        int
+		minLevel logrus.Level
+		want     string
+	}{
+		{10, logrus.TraceLevel, "[warn debug info]"},
+		{2, logrus.TraceLevel, "[warn debug]"},
+		{10, logrus.InfoLevel, "[warn info]"},
+		{10, logrus.ErrorLevel, "[]"},
+		{0, logrus.TraceLevel, "[]"},
+	}
+	for _, tt := range tests {
+		if got := messages(RecentLogs(tt.n, tt.minLevel)); got != tt.want {
+			t.Errorf("RecentLogs(%d, %s) = %s, want %s", tt.n, tt.minLevel, got, tt.want)
+		}
+	}
+
+	// the ring keeps the newest records once it is full
+	for i := 0; i < recentLogSize+5; i++ {
+		fire(logrus.InfoLevel, fmt.Sprint(i))
+	}
+	all := RecentLogs(2*recentLogSize, logrus.TraceLevel)
+	if len(all) != recentLogSize {
+		t.Fatalf("RecentLogs() returned %d records, want %d", len(all), recentLogSize)
+	}
+	if all[0].Message != fmt.Sprint(recentLogSize+4) || all[recentLogSize-1].Message != "5" {
+		t.Errorf("RecentLogs() returned %s to %s, want the newest %d records", all[0].Message, all[recentLogSize-1].Message, recentLogSize)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logging
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	syslogQueueSize  = 1024
+	syslogAppName    = "ziti-tunnel"
+	syslogMaxBackoff = time.Minute
+)
+
+// syslogHook forwards log records to a syslog collector formatted per RFC 5424. records are queued and written by a
+// separate goroutine so logging never blocks. records are dropped while the queue is full
+type syslogHook struct {
+	network  string
+	address  string
+	facility int
+	hostname string
+	queue    chan []byte
+}
+
+var activeSyslog *syslogHook
+
+var syslogDial = net.DialTimeout
+
+// EnableSyslog starts forwarding log records to the syslog collector at address using the network udp or tcp
+func EnableSyslog(network string, address string, facility int) error {
+	network = strings.ToLower(strings.TrimSpace(network))
+	if network == "" {
+		network = "udp"
+	}
+	if network != "udp" && network != "tcp" {
+		return fmt.Errorf("unsupported syslog protocol: %s", network)
+	}
+	if facility < 0 || facility > 23 {
+		return fmt.Errorf("invalid syslog facility: %d", facility)
+	}
+	if activeSyslog != nil {
+		return fmt.Errorf("syslog forwarding is already enabled to %s", activeSyslog.address)
+	}
+	hostname, _ := os.Hostname()
+	h := &syslogHook{
+		network:  network,
+		address:  address,
+		facility: facility,
+		hostname: hostname,
+		queue:    make(chan []byte, syslogQueueSize),
+	}
+	go h.run()
+	withFilenameLogger.AddHook(h)
+	noFilenamelogger.AddHook(h)
+	activeSyslog = h
+	return nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	select {
+	case h.queue <- h.format(entry):
+	default:
+		//never block the logger
+	}
+	return nil
+}
+
+func (h *syslogHook) format(entry *logrus.Entry) []byte {
+	pri := h.facility*8 + severity(entry.Level)
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, entry.Time.UTC().Format(time.RFC3339Nano), nilValue(h.hostname),
+		syslogAppName, os.Getpid(), strings.TrimSpace(entry.Message))
+	if h.network == "tcp" {
+		//octet counting framing, RFC 6587
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	return []byte(msg)
+}
+
+func (h *syslogHook) run() {
+	backoff := time.Second
+	var pending []byte
+	for {
+		conn, err := syslogDial(h.network, h.address, 5*time.Second)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not connect to syslog collector %s: %v. retrying in %v\n", h.address, err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > syslogMaxBackoff {
+				backoff = syslogMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		pending = h.send(conn, pending)
+		_ = conn.Close()
+	}
+}
+
+// send writes pending followed by the queued records to conn until a write fails. the record that could not be written
+// is returned so it is retried once reconnected
+func (h *syslogHook) send(conn net.Conn, pending []byte) []byte {
+	for {
+		if pending == nil {
+			pending = <-h.queue
+		}
+		if _, err := conn.Write(pending); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write to syslog collector %s: %v. reconnecting\n", h.address, err)
+			return pending
+		}
+		pending = nil
+	}
+}
+
+func severity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0 //emergency
+	case logrus.FatalLevel:
+		return 2 //critical
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7 //debug
+	}
+}
+
+func nilValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
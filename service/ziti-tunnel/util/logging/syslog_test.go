@@ -0,0 +1,144 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakeSyslogConn records the written records and fails every write once failAfter records were written
+type fakeSyslogConn struct {
+	net.Conn
+	failAfter int
+	written   []string
+	writes    chan string
+}
+
+func (c *fakeSyslogConn) Write(b []byte) (int, error) {
+	if len(c.written) >= c.failAfter {
+		return 0, errors.New("connection reset")
+	}
+	c.written = append(c.written, string(b))
+	if c.writes != nil {
+		c.writes <- string(b)
+	}
+	return len(b), nil
+}
+
+func (c *fakeSyslogConn) Close() error {
+	return nil
+}
+
+func TestSyslogSend(t *testing.T) {
+	tests := []struct {
+		name        string
+		pending     string
+		queued      []string
+		failAfter   int
+		wantWritten []string
+		wantPending string
+	}{
+		{"first write fails", "", []string{"a", "b"}, 0, nil, "a"},
+		{"write fails after one record", "", []string{"a", "b"}, 1, []string{"a"}, "b"},
+		{"pending written first", "p", []string{"a"}, 1, []string{"p"}, "a"},
+		{"pending kept when write fails", "p", []string{"a"}, 0, nil, "p"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &syslogHook{queue: make(chan []byte, syslogQueueSize)}
+			for _, q := range tt.queued {
+				h.queue <- []byte(q)
+			}
+			var pending []byte
+			if tt.pending != "" {
+				pending = []byte(tt.pending)
+			}
+			conn := &fakeSyslogConn{failAfter: tt.failAfter}
+			got := h.send(conn, pending)
+			if string(got) != tt.wantPending {
+				t.Errorf("send() = %q, want %q", got, tt.wantPending)
+			}
+			if !reflect.DeepEqual(conn.written, tt.wantWritten) {
+				t.Errorf("written %v, want %v", conn.written, tt.wantWritten)
+			}
+		})
+	}
+}
+
+func TestSyslogRetriesAfterReconnect(t *testing.T) {
+	saved := syslogDial
+	defer func() { syslogDial = saved }()
+
+	writes := make(chan string, 2)
+	conns := []*fakeSyslogConn{{failAfter: 0}, {failAfter: 2, writes: writes}}
+	syslogDial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if len(conns) == 0 {
+			select {} //the test is done, never reconnect
+		}
+		c := conns[0]
+		conns = conns[1:]
+		return c, nil
+	}
+	h := &syslogHook{queue: make(chan []byte, syslogQueueSize)}
+	h.queue <- []byte("a")
+	h.queue <- []byte("b")
+	go h.run()
+
+	for _, want := range []string{"a", "b"} {
+		select {
+		case got := <-writes:
+			if got != want {
+				t.Errorf("written %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not written after reconnecting", want)
+		}
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	entry := &logrus.Entry{Level: logrus.WarnLevel, Message: "hello\n", Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	udp := fmt.Sprintf("<12>1 2020-01-02T03:04:05Z host ziti-tunnel %d - - hello", os.Getpid())
+	tests := []struct {
+		name     string
+		network  string
+		hostname string
+		want     string
+	}{
+		{"udp", "udp", "host", udp},
+		{"no hostname", "udp", "", strings.Replace(udp, " host ", " - ", 1)},
+		{"tcp octet counting", "tcp", "host", fmt.Sprintf("%d %s", len(udp), udp)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &syslogHook{network: tt.network, hostname: tt.hostname, facility: 1}
+			if got := string(h.format(entry)); got != tt.want {
+				t.Errorf("format() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}